@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"expvar"
+	h "gokv/helper"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// Header carrying the ID of a request, taken from the client if it sent a valid one
+const requestIDHeader = "X-Request-ID"
+
+// Longest request ID accepted from a client
+const maxRequestIDLength = 64
+
+// Panics recovered while serving a request
+var panics = expvar.NewInt("panics")
+
+// Context key of the ID of a request
+type requestIDKey struct{}
+
+// Response writer remembering status code and body size
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+	wrote  bool // Headers were sent, an error response can't be written anymore
+}
+
+func (r *accessRecorder) WriteHeader(status int) {
+	if !r.wrote {
+		r.status, r.wrote = status, true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *accessRecorder) Write(b []byte) (int, error) {
+	r.wrote = true
+	n, err := r.ResponseWriter.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// Expose wrapped writer to http.ResponseController, e.g. for flushing
+func (r *accessRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Log every request from now on, or stop logging them
+func (s *Server) SetAccessLog(enabled bool) {
+	s.accessLog.Store(enabled)
+}
+
+// ID of a request, empty outside LogHandler
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// Request ID sent by a client, empty if it is missing or not made of letters, digits, '-', '_' and '.'
+func clientRequestID(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if len(id) > maxRequestIDLength {
+		return ""
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return ""
+		}
+	}
+	return id
+}
+
+// Middleware giving every request an ID, returned in X-Request-ID, turning panics into 500 responses
+// and logging method, path, status, duration and response size of each request unless ACCESS_LOG is false
+func (s *Server) LogHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := clientRequestID(r)
+		if id == "" {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		start := time.Now()
+		rec := &accessRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler { // Aborted on purpose, let the server close the connection
+					panic(p)
+				}
+				panics.Add(1)
+				log.Printf("Panic serving request %s %s %s - %v\n%s", id, r.Method, r.URL.Path, p, debug.Stack())
+				if !rec.wrote {
+					h.WriteError(rec, http.StatusInternalServerError, h.CodeInternal, "Internal server error, request "+id, "")
+				}
+				rec.status = http.StatusInternalServerError
+			}
+			if s.accessLog.Load() {
+				log.Printf("request id=%s method=%s path=%s status=%d duration=%s bytes=%d remote=%s",
+					id, r.Method, r.URL.EscapedPath(), rec.status, time.Since(start).Round(time.Microsecond), rec.size, r.RemoteAddr)
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
@@ -0,0 +1,271 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	h "gokv/helper"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Access an ACL rule grants to keys under its prefix
+const (
+	aclRead  = 1 << iota // Read keys, list them and watch them
+	aclWrite             // Set, change and delete keys
+)
+
+// Requests and RESP commands rejected by an ACL
+var aclDenied = expvar.NewInt("acl_denied")
+
+// Write routes that don't name keys, other writes naming none are denied while ACLs restrict a principal
+var keylessRoutes = map[string]bool{"/publish": true, "/id/next": true, "/ws": true}
+
+// Access of a principal to keys under a prefix
+type aclRule struct {
+	prefix string
+	access int
+}
+
+// Key prefixes each principal may read or write, by API key name or token subject
+// "*" applies to principals without rules of their own
+// Principals without rules, while there is no "*", and admins aren't restricted
+type ACLs map[string][]aclRule
+
+// Parse rules such as "app1=rw:app1:+r:shared:,*=r:public:"
+// Each rule is r, w or rw, then ':' and the key prefix it covers, an empty prefix covers every key
+func ParseACLs(spec string) (ACLs, error) {
+	acls := make(ACLs)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, rules, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid ACL %q", entry)
+		}
+		for _, rule := range strings.Split(rules, "+") {
+			perm, prefix, ok := strings.Cut(strings.TrimSpace(rule), ":")
+			access := 0
+			switch perm {
+			case "r":
+				access = aclRead
+			case "w":
+				access = aclWrite
+			case "rw":
+				access = aclRead | aclWrite
+			}
+			if !ok || access == 0 {
+				return nil, fmt.Errorf("invalid ACL rule %q of %s", rule, name)
+			}
+			acls[name] = append(acls[name], aclRule{prefix: prefix, access: access})
+		}
+	}
+	return acls, nil
+}
+
+// Check if any rule applies to a principal
+func (a ACLs) restricts(p principal) bool {
+	if p.role == RoleAdmin {
+		return false
+	}
+	_, named := a[p.name]
+	_, all := a["*"]
+	return named || all
+}
+
+// Check if a principal may access every key and every key under each prefix
+func (a ACLs) allows(p principal, access int, keys []string, prefixes []string) bool {
+	if p.role == RoleAdmin {
+		return true
+	}
+	rules, ok := a[p.name]
+	if !ok {
+		if rules, ok = a["*"]; !ok {
+			return true
+		}
+	}
+	covered := func(target string) bool {
+		for _, rule := range rules {
+			if rule.access&access == access && strings.HasPrefix(target, rule.prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, target := range slices.Concat(keys, prefixes) {
+		if !covered(target) {
+			return false
+		}
+	}
+	return true
+}
+
+// Restrict principals to key prefixes from now on, replacing the previous rules
+func (s *Server) SetACLs(acls ACLs) {
+	s.acls.Store(&acls)
+}
+
+// Check a principal's access against the ACLs, true if there are none
+func (s *Server) aclAllows(p principal, access int, keys []string, prefixes []string) bool {
+	acls := s.acls.Load()
+	if acls == nil || len(*acls) == 0 || acls.allows(p, access, keys, prefixes) {
+		return true
+	}
+	aclDenied.Add(1)
+	return false
+}
+
+// Keys a request reads or writes, and prefixes it lists or watches
+// Returns false if its body can't be read, the handler would reject it anyway
+// The body is put back for the handler to read
+func (s *Server) aclTargets(r *http.Request) (keys []string, prefixes []string, ok bool) {
+	path := unversioned(r.URL.Path)
+	query := r.URL.Query()
+	switch path {
+	case "/keys", "/scan", "/count", "/export", "/sample", "/randomkey", "/watch":
+		if path == "/watch" && query.Get("key") != "" {
+			return []string{s.key(query.Get("key"))}, nil, true
+		}
+		// Listed keys match both, so the longer one bounds them
+		prefix := s.prefix(query.Get("prefix"))
+		if match := literalPrefix(s.prefix(query.Get("match"))); len(match) > len(prefix) {
+			prefix = match
+		}
+		return nil, []string{prefix}, true
+	case "/mset", "/mget", "/txn", "/set":
+		if r.Method != "POST" || (path == "/set" && query.Has("key")) {
+			break
+		}
+		b, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(b), r.Body))
+		if err != nil {
+			return nil, nil, false
+		}
+		names, err := bodyKeys(path, bytes.TrimSpace(b))
+		if err != nil {
+			return nil, nil, false
+		}
+		for _, name := range names {
+			keys = append(keys, s.key(name))
+		}
+		return keys, nil, true
+	}
+	names := slices.Concat(query["key"], query["to"])
+	if rest, found := strings.CutPrefix(path, "/delete/"); found {
+		names = append(names, rest)
+	}
+	for _, name := range names {
+		if name != "" { // Missing keys are rejected by the handler
+			keys = append(keys, s.key(name))
+		}
+	}
+	return keys, nil, true
+}
+
+// Keys named in the JSON body of /set, /mset, /mget or /txn
+func bodyKeys(path string, b []byte) ([]string, error) {
+	var keys []string
+	switch {
+	case path == "/set":
+		var body struct {
+			Key *string `json:"key"`
+		}
+		err := json.Unmarshal(b, &body)
+		if body.Key != nil {
+			keys = append(keys, *body.Key)
+		}
+		return keys, err
+	case path == "/mget":
+		return keys, json.Unmarshal(b, &keys)
+	case path == "/mset" && len(b) > 0 && b[0] == '[':
+		var list []struct {
+			Key string `json:"key"`
+		}
+		err := json.Unmarshal(b, &list)
+		for _, p := range list {
+			keys = append(keys, p.Key)
+		}
+		return keys, err
+	case path == "/mset":
+		var pairs map[string]string
+		err := json.Unmarshal(b, &pairs)
+		for k := range pairs {
+			keys = append(keys, k)
+		}
+		return keys, err
+	}
+	var txn struct {
+		Compare []txnCompare   `json:"compare"`
+		Success []txnRequestOp `json:"success"`
+		Failure []txnRequestOp `json:"failure"`
+	}
+	err := json.Unmarshal(b, &txn)
+	for _, c := range txn.Compare {
+		keys = append(keys, c.Key)
+	}
+	for _, op := range append(txn.Success, txn.Failure...) {
+		keys = append(keys, op.Key)
+	}
+	return keys, err
+}
+
+// Check the ACLs for one request on a WebSocket, true if the connection wasn't authenticated
+func (s *Server) wsAllows(r *http.Request, req wsRequest) bool {
+	p, ok := r.Context().Value(principalKey{}).(principal)
+	if !ok {
+		return true
+	}
+	access, keys, prefixes := aclWrite, []string{s.key(req.Key)}, []string(nil)
+	switch req.Op {
+	case "get":
+		access = aclRead
+	case "watch":
+		access = aclRead
+		if req.Key == "" {
+			keys, prefixes = nil, []string{s.prefix(req.Prefix)}
+		}
+	}
+	return s.aclAllows(p, access, keys, prefixes)
+}
+
+// Part of a glob pattern before its first wildcard
+func literalPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// Check the ACLs of a request's principal, responds with 403 if they deny it
+func (s *Server) aclCheck(w http.ResponseWriter, r *http.Request, p principal, need string) bool {
+	acls := s.acls.Load()
+	if acls == nil || len(*acls) == 0 || p.role == RoleAdmin {
+		return true
+	}
+	access := aclWrite
+	if need == RoleRead {
+		access = aclRead
+	}
+	keys, prefixes, ok := s.aclTargets(r)
+	if !ok {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidBody, "Invalid request body", "")
+		return false
+	}
+	if access == aclWrite && len(keys) == 0 && len(prefixes) == 0 && !keylessRoutes[unversioned(r.URL.Path)] && acls.restricts(p) {
+		// A write naming no key the ACLs could check might still write any key
+		aclDenied.Add(1)
+		h.WriteError(w, http.StatusForbidden, h.CodeUnauthorized, "Access denied by ACL, no key named", "")
+		return false
+	}
+	if !s.aclAllows(p, access, keys, prefixes) {
+		h.WriteError(w, http.StatusForbidden, h.CodeUnauthorized, "Access denied by ACL", "")
+		return false
+	}
+	return true
+}
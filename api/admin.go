@@ -0,0 +1,551 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	h "gokv/helper"
+	"gokv/network"
+	"gokv/storage"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of tombstones written to WAL per batch
+const deleteBatchSize = 500
+
+// How long finished jobs can still be looked up
+const jobRetention = time.Hour
+
+// Background admin job, deleting or migrating all keys under a prefix
+type job struct {
+	id      string
+	kind    string // delete-prefix or migrate-prefix
+	prefix  string
+	total   int
+	deleted int
+	state   string    // running, done, cancelled, failed
+	ended   time.Time // When the job stopped running
+
+	// Migrations only
+	to       string
+	mode     string // copy or move
+	conflict string // skip or overwrite
+	migrated int
+	skipped  int
+
+	cancel context.CancelFunc
+	mutex  sync.RWMutex
+}
+
+// Registry of background admin jobs
+type jobs struct {
+	jobs  map[string]*job
+	next  int
+	mutex sync.Mutex
+}
+
+// Get a copy of job progress safe to encode
+func (j *job) snapshot() map[string]any {
+	j.mutex.RLock()
+	defer j.mutex.RUnlock()
+	snap := map[string]any{
+		"id":      j.id,
+		"kind":    j.kind,
+		"prefix":  j.prefix,
+		"total":   j.total,
+		"deleted": j.deleted,
+		"state":   j.state,
+	}
+	if j.kind == "migrate-prefix" {
+		snap["to"], snap["mode"], snap["conflict"] = j.to, j.mode, j.conflict
+		snap["migrated"], snap["skipped"] = j.migrated, j.skipped
+	}
+	return snap
+}
+
+// Register a running job and give it an id, returns the context cancelling it
+// Jobs that finished over jobRetention ago are pruned
+func (s *Server) startJob(j *job) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.jobs.mutex.Lock()
+	defer s.jobs.mutex.Unlock()
+	if s.jobs.jobs == nil {
+		s.jobs.jobs = make(map[string]*job)
+	}
+	for id, old := range s.jobs.jobs {
+		if old.expired(time.Now()) {
+			delete(s.jobs.jobs, id)
+		}
+	}
+	s.jobs.next++
+	j.id, j.state, j.cancel = fmt.Sprintf("%d", s.jobs.next), "running", cancel
+	s.jobs.jobs[j.id] = j
+	return ctx
+}
+
+// Set the final state of a job
+func (j *job) finish(state string) {
+	j.mutex.Lock()
+	j.state, j.ended = state, time.Now()
+	j.mutex.Unlock()
+}
+
+// Check if a job finished longer than jobRetention ago
+func (j *job) expired(now time.Time) bool {
+	j.mutex.RLock()
+	defer j.mutex.RUnlock()
+	return j.state != "running" && now.Sub(j.ended) > jobRetention
+}
+
+// Delete all keys under a prefix as a background job
+// POST /admin/delete-prefix?prefix=<prefix>[&dry_run=true]
+func (s *Server) DeletePrefixRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+
+	prefix := s.prefix(r.URL.Query().Get("prefix"))
+	if prefix == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing prefix parameter", "")
+		return
+	}
+
+	keys := s.mp.Keys(r.Context(), prefix)
+	if aborted(w, r) || !s.unfrozen(w, keys...) {
+		return
+	}
+
+	// Report what would be deleted without mutating state
+	if h.DryRun(r) {
+		writeDryRun(w, map[string]any{
+			"prefix": prefix,
+			"keys":   len(keys),
+			"bytes":  s.footprint(keys),
+		})
+		return
+	}
+
+	if !s.writable(w) {
+		return
+	}
+
+	j := &job{kind: "delete-prefix", prefix: prefix, total: len(keys)}
+	ctx := s.startJob(j)
+
+	go s.deletePrefix(ctx, j, keys)
+
+	h.WriteJSON(w, http.StatusAccepted, j.snapshot())
+}
+
+// Answer a dry run with a report of what the request would have changed
+func writeDryRun(w http.ResponseWriter, report map[string]any) {
+	report["dry_run"] = true
+	h.WriteJSON(w, http.StatusOK, report)
+}
+
+// Bytes of keys and their values, as reported by dry runs
+func (s *Server) footprint(keys []string) int {
+	bytes := 0
+	for _, k := range keys {
+		bytes += len(k) + len(s.mp.GetValue(k))
+	}
+	return bytes
+}
+
+// Write batched tombstones to WAL and remove keys from map
+func (s *Server) deletePrefix(ctx context.Context, j *job, keys []string) {
+	for start := 0; start < len(keys); start += deleteBatchSize {
+		select {
+		case <-ctx.Done():
+			j.finish("cancelled")
+			return
+		default:
+		}
+
+		end := min(start+deleteBatchSize, len(keys))
+		batch := keys[start:end]
+		ops := make([]storage.TxnOp, len(batch))
+		for i, k := range batch {
+			ops[i] = storage.TxnOp{Op: "DELETE", Key: k}
+		}
+		// Logged under the map lock so a concurrent flushall can't lose a batch
+		err := s.mp.Transact(func(func(string) (string, bool), func(string) time.Time, func(string) storage.KeyMeta) ([]storage.TxnOp, error) {
+			if err := s.log.UpdateLogBatch("DELETE", batch, nil); err != nil {
+				return nil, err
+			}
+			return ops, nil
+		})
+		if err != nil {
+			log.Println("Error writing to log - ", err)
+			walErrors.Add(1)
+			j.finish("failed")
+			return
+		}
+
+		j.mutex.Lock()
+		j.deleted += len(batch)
+		j.mutex.Unlock()
+	}
+	j.finish("done")
+}
+
+// Get progress of a background job
+// GET /admin/jobs?id=<id>
+func (s *Server) JobStatusRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+
+	j := s.findJob(r.URL.Query().Get("id"))
+	if j == nil {
+		h.WriteError(w, http.StatusNotFound, h.CodeNotFound, "Job not found", "")
+		return
+	}
+	h.WriteJSON(w, http.StatusOK, j.snapshot())
+}
+
+// Cancel a running background job
+// POST /admin/jobs/cancel?id=<id>
+func (s *Server) CancelJobRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+
+	j := s.findJob(r.URL.Query().Get("id"))
+	if j == nil {
+		h.WriteError(w, http.StatusNotFound, h.CodeNotFound, "Job not found", "")
+		return
+	}
+	j.cancel()
+	h.WriteResponse(w, http.StatusOK, "Job cancelled")
+}
+
+// Look up a job by id, returns nil if it doesn't exist or was pruned
+func (s *Server) findJob(id string) *job {
+	s.jobs.mutex.Lock()
+	defer s.jobs.mutex.Unlock()
+	if j := s.jobs.jobs[id]; j != nil && !j.expired(time.Now()) {
+		return j
+	}
+	return nil
+}
+
+// Report expected vs actual share of keys per node under capacity-weighted placement
+// Actual shares are computed by placing this node's keyspace on the current members
+// GET /admin/balance
+func (s *Server) BalanceRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+
+	// Collect capacity weights of every member, including this node under the address peers know it by,
+	// so every node places keys alike
+	weights := map[string]float64{network.Address(): network.Weight(s.labels)}
+	if s.nodes != nil {
+		for node, labels := range s.nodes.Topology() {
+			weights[node] = network.Weight(labels)
+		}
+	}
+	total := 0.0
+	for _, weight := range weights {
+		total += weight
+	}
+
+	// Place every key and count keys per node
+	keys := s.mp.Keys(r.Context(), "")
+	if aborted(w, r) {
+		return
+	}
+	counts := make(map[string]int, len(weights))
+	for _, k := range keys {
+		counts[network.Owner(k, weights)]++
+	}
+
+	report := make(map[string]any, len(weights))
+	for node, weight := range weights {
+		actual := 0.0
+		if len(keys) > 0 {
+			actual = float64(counts[node]) / float64(len(keys))
+		}
+		report[node] = map[string]any{
+			"weight":   weight,
+			"expected": weight / total,
+			"actual":   actual,
+			"keys":     counts[node],
+		}
+	}
+	h.WriteJSON(w, http.StatusOK, map[string]any{"keys": len(keys), "nodes": report})
+}
+
+// Read a value directly from the database, bypassing the in-memory map
+// GET /admin/db/get?key=<key>
+func (s *Server) DBGetRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+
+	key := s.key(r.URL.Query().Get("key"))
+	if key == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key parameter", "")
+		return
+	} else if s.db == nil {
+		h.WriteError(w, http.StatusServiceUnavailable, h.CodeUnavailable, "Database not available", "")
+		return
+	}
+
+	value, ok, err := s.db.Get(key)
+	if err != nil {
+		log.Println("Could not read from database - ", err)
+		h.WriteError(w, http.StatusInternalServerError, h.CodeInternal, "Internal Server Error", "")
+		return
+	}
+	h.WriteJSON(w, http.StatusOK, map[string]any{
+		"key":       key,
+		"db":        map[string]any{"found": ok, "value": value},
+		"in_memory": map[string]any{"found": s.mp.Exists(key), "value": s.mp.GetValue(key)},
+	})
+}
+
+// Read key-value pairs under a prefix directly from the database
+// GET /admin/db/scan?prefix=<prefix>&limit=<n>
+func (s *Server) DBScanRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	if s.db == nil {
+		h.WriteError(w, http.StatusServiceUnavailable, h.CodeUnavailable, "Database not available", "")
+		return
+	}
+
+	limit, ok := s.parseLimit(w, r)
+	if !ok {
+		return
+	}
+	pairs, err := s.db.Scan(r.Context(), r.URL.Query().Get("prefix"), limit)
+	if aborted(w, r) {
+		return
+	}
+	if err != nil {
+		log.Println("Could not read from database - ", err)
+		h.WriteError(w, http.StatusInternalServerError, h.CodeInternal, "Internal Server Error", "")
+		return
+	}
+	h.WriteJSON(w, http.StatusOK, map[string]any{"pairs": pairs})
+}
+
+// Show WAL entries written but not yet committed to the database
+// GET /admin/pending
+func (s *Server) PendingRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+
+	count, err := storage.PendingEntries(s.log)
+	if err != nil {
+		log.Println("Could not read WAL log - ", err)
+		h.WriteError(w, http.StatusInternalServerError, h.CodeInternal, "Internal Server Error", "")
+		return
+	}
+	oldest, err := storage.OldestPendingLSN(s.log)
+	if err != nil {
+		log.Println("Could not read WAL log - ", err)
+		h.WriteError(w, http.StatusInternalServerError, h.CodeInternal, "Internal Server Error", "")
+		return
+	}
+
+	// Writes aren't replicated to other nodes yet, so there are no peer acks to wait on
+	h.WriteJSON(w, http.StatusOK, map[string]any{
+		"next_lsn":   s.log.GetLSN(),
+		"checkpoint": s.log.GetCheckpoint(),
+		"database": map[string]int{
+			"pending":    count,
+			"oldest_lsn": oldest,
+		},
+		"peers": map[string]any{},
+	})
+}
+
+// Report the parameters a new node needs to join the cluster
+// The cluster secret is only included for ADMIN_TOKEN, an admin API key or a token with the admin role
+// GET /admin/bootstrap-token
+func (s *Server) BootstrapRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	b, err := network.BootstrapConfig()
+	if err != nil {
+		log.Println("Could not read cluster file - ", err)
+		h.WriteError(w, http.StatusInternalServerError, h.CodeInternal, "Internal Server Error", "")
+		return
+	}
+	if !s.adminCredential(r) {
+		b.ClusterToken = ""
+	}
+	h.WriteJSON(w, http.StatusOK, b)
+}
+
+// Pick up to n keys under prefix uniformly at random, along with the number of keys under it
+// Reservoir sampling over the map's keys keeps every key equally likely without copying them all
+func (s *Server) sampleKeys(ctx context.Context, prefix string, n int) ([]string, int) {
+	sample := make([]string, 0, n)
+	seen := 0
+	s.mp.RangeKeys(ctx, prefix, func(key string) bool {
+		if seen < n {
+			sample = append(sample, key)
+		} else if j := rand.IntN(seen + 1); j < n {
+			sample[j] = key
+		}
+		seen++
+		return true
+	})
+	return sample, seen
+}
+
+// Return a uniform random sample of keys, optionally with value sizes and version counts
+// Keys are drawn from the in-memory map, the database isn't scanned
+// GET /admin/sample?n=<n>&prefix=<prefix>[&sizes=true][&versions=true]
+func (s *Server) SampleRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	n := defaultKeysLimit
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Invalid sample size", "")
+			return
+		}
+		n = min(n, s.maxPage())
+	}
+	sizes := r.URL.Query().Get("sizes") == "true"
+	versions := r.URL.Query().Get("versions") == "true" && s.db != nil
+
+	sample, total := s.sampleKeys(r.Context(), s.prefix(r.URL.Query().Get("prefix")), n)
+	if aborted(w, r) {
+		return
+	}
+
+	entries := make([]map[string]any, 0, len(sample))
+	for _, k := range sample {
+		entry := map[string]any{"key": k}
+		if sizes {
+			entry["size"] = len(s.mp.GetValue(k))
+		}
+		if versions {
+			list, err := s.db.Versions(k)
+			if err != nil {
+				log.Println("Could not read versions - ", err)
+				h.WriteError(w, http.StatusInternalServerError, h.CodeInternal, "Internal Server Error", "")
+				return
+			}
+			entry["versions"] = len(list)
+		}
+		entries = append(entries, entry)
+	}
+	h.WriteJSON(w, http.StatusOK, map[string]any{"total": total, "sample": entries})
+}
+
+// List recent node lifecycle events, oldest first
+// GET /admin/events[?type=<type>]
+func (s *Server) LifecycleEventsRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	typ := r.URL.Query().Get("type")
+	events := []h.LifecycleEvent{}
+	for _, event := range h.LifecycleEvents() {
+		if typ == "" || event.Type == typ {
+			events = append(events, event)
+		}
+	}
+	h.WriteJSON(w, http.StatusOK, map[string]any{"events": events})
+}
+
+// Require destructive admin endpoints to send this token as a bearer token
+func (s *Server) SetAdminToken(token string) {
+	s.admin = token
+}
+
+// Check the credential of a destructive admin request, responds with an error if invalid
+// ADMIN_TOKEN, an admin API key or a JWT with the admin role is accepted
+func (s *Server) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if s.adminCredential(r) {
+		return true
+	}
+	if s.admin == "" && !s.authEnabled() {
+		h.WriteError(w, http.StatusForbidden, h.CodeUnauthorized, "Set ADMIN_TOKEN or ADMIN_API_KEYS to enable this endpoint", "")
+		return false
+	}
+	h.WriteError(w, http.StatusUnauthorized, h.CodeUnauthorized, "Invalid admin credential", "")
+	return false
+}
+
+// Check if a request carries a configured admin credential: ADMIN_TOKEN, an admin API key or an admin token
+// Unlike authorized, requests let through because authentication is off don't count
+func (s *Server) adminCredential(r *http.Request) bool {
+	if p, ok := r.Context().Value(principalKey{}).(principal); ok && p.role == RoleAdmin {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && s.admin != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.admin)) == 1
+}
+
+// Delete every key on this node: wipes the in-memory map, cold tier and database,
+// and truncates the WAL. Meant for test environments and re-provisioning
+// POST /admin/flushall[?dry_run=true] with Authorization: Bearer <ADMIN_TOKEN> or an admin X-API-Key
+func (s *Server) FlushAllRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	if !s.authorized(w, r) {
+		return
+	}
+	if s.db == nil {
+		h.WriteError(w, http.StatusServiceUnavailable, h.CodeUnavailable, "Database not attached", "")
+		return
+	}
+
+	// Report what would be deleted without mutating state
+	if h.DryRun(r) {
+		keys := s.mp.Keys(r.Context(), "")
+		if aborted(w, r) {
+			return
+		}
+		writeDryRun(w, map[string]any{
+			"keys":           len(keys),
+			"bytes":          s.footprint(keys),
+			"database_bytes": s.db.Size(),
+			"wal_entries":    s.log.GetLSN() - 1,
+		})
+		return
+	}
+
+	// Writes are logged and applied under the map lock, so none is lost between the wipe and the clear
+	keys, err := s.mp.Clear(func() error { return s.db.Wipe(s.log) })
+	if err != nil {
+		log.Println("Could not wipe database - ", err)
+		h.WriteError(w, http.StatusInternalServerError, h.CodeInternal, "Internal Server Error", "")
+		return
+	}
+	log.Println("Flushed all keys - ", len(keys))
+	h.Lifecycle(h.EventFlushAll, strconv.Itoa(len(keys)))
+	h.WriteJSON(w, http.StatusOK, map[string]any{"message": "All keys deleted", "count": len(keys)})
+}
@@ -0,0 +1,89 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gokv/api"
+	h "gokv/helper"
+	"gokv/storage"
+	"gokv/storage/storagetest"
+)
+
+// Admin API keys may flush the node, data keys may not
+func TestFlushAllAPIKeys(t *testing.T) {
+	const dataKey, adminKey = "data-key-0123456789", "admin-key-0123456789"
+	srv := newServer()
+	srv.SetDatabase(storagetest.NewDatabase())
+	keys, err := api.ParseAPIKeys(dataKey, adminKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.SetAPIKeys(keys)
+	mux := http.NewServeMux()
+	api.Register(mux, srv.Routes())
+	handler := srv.AuthHandler(mux)
+	flush := func(key string) int {
+		req := httptest.NewRequest("POST", "/admin/flushall", nil)
+		req.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := flush(dataKey); code != http.StatusForbidden {
+		t.Fatalf("data key got %d, want 403", code)
+	}
+	if code := flush(adminKey); code != http.StatusOK {
+		t.Fatalf("admin key got %d, want 200", code)
+	}
+}
+
+// Dry runs of destructive admin endpoints report without writing, deleting or stopping anything
+func TestDryRunLeavesState(t *testing.T) {
+	layout := h.Layout{DataDir: t.TempDir(), WALDir: t.TempDir(), AutoCreate: true}
+	if err := h.InitFiles(layout); err != nil {
+		t.Fatal(err)
+	}
+	h.SetLayout(layout)
+	t.Cleanup(func() { h.SetLayout(h.LayoutFromEnv()) })
+
+	const token = "admin-token-0123456789"
+	mp, log := storage.InitMap(), storagetest.NewLog()
+	db, startup := storagetest.NewDatabase(), api.NewStartup(nil)
+	startup.Enter(api.PhaseServing)
+	srv := api.New(mp, log)
+	srv.SetDatabase(db)
+	srv.SetStartup(startup)
+	srv.SetAdminToken(token)
+	mux := http.NewServeMux()
+	api.Register(mux, srv.Routes())
+	for _, k := range []string{"a:1", "a:2", "a:3"} {
+		mp.SetValue(k, "v")
+	}
+	lsn := log.GetLSN()
+
+	for _, path := range []string{
+		"/admin/delete-prefix?prefix=a:&dry_run=true",
+		"/admin/migrate-prefix?from=a:&to=b:&mode=move&dry_run=true",
+		"/admin/flushall?dry_run=true",
+		"/admin/shutdown?dry_run=true",
+	} {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		var body map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusOK || body["dry_run"] != true {
+			t.Fatalf("%s answered %d: %s", path, w.Code, w.Body)
+		}
+		if n := mp.Len(); n != 3 || mp.Exists("b:1") || log.GetLSN() != lsn {
+			t.Fatalf("%s left %d keys and the log at LSN %d, want 3 keys under a: and LSN %d", path, n, log.GetLSN(), lsn)
+		}
+	}
+	if startup.Phase() != api.PhaseServing || db.LastSnapshot() != nil {
+		t.Fatalf("dry run left the node %s and took a snapshot: %v", startup.Phase(), db.LastSnapshot() != nil)
+	}
+}
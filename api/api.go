@@ -1,21 +1,158 @@
 package api
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"expvar"
 	h "gokv/helper"
+	"gokv/network"
 	"gokv/storage"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Core counters, exposed at /debug/vars
+var (
+	getRequests    = expvar.NewInt("get_requests")
+	setRequests    = expvar.NewInt("set_requests")
+	deleteRequests = expvar.NewInt("delete_requests")
+	walErrors      = expvar.NewInt("wal_errors")
+	readOnlyMode   = expvar.NewInt("read_only")
+)
+
+// Largest request body accepted by JSON endpoints
+const maxBodySize = 1 << 20
+
+// Longest key and value accepted in bytes, unless MAX_KEY_BYTES and MAX_VALUE_BYTES say otherwise
+const (
+	DefaultMaxKeyBytes   = 50
+	DefaultMaxValueBytes = 100
 )
 
 type Server struct {
-	mp  storage.InMemoryMap
-	log storage.Log
+	mp       storage.InMemoryMap
+	log      storage.Log
+	db       storage.Database
+	replay   *storage.Replay
+	jobs     jobs
+	freezes  freezes
+	ids      idAllocator
+	nodes    network.Network
+	labels   map[string]string
+	events   events
+	channels channels
+
+	readOnly  atomic.Bool // Reject writes, e.g. while disk space is low
+	quota     softQuota   // Limits that add warnings to write responses
+	schemas   schemas     // JSON schemas of namespaces
+	scans     scanLimits  // Page size and streaming limits of key listings
+	admin     string      // Token required by destructive admin endpoints, empty disables them
+	startup   *Startup    // Startup barrier, reported by /readyz and /topology
+	keyPolicy KeyPolicy   // Normalization of keys per namespace
+
+	readPolicy ReadPolicy    // How reads missing the map are answered per prefix
+	negatives  negativeCache // Keys recently found missing from the database
+
+	nsQuotas       namespaceQuotas              // Hard limits of keys and bytes per namespace
+	shutdown       shutdownConfig               // How the node stops in a coordinated shutdown
+	reload         Reloader                     // Re-reads the configuration, nil if reloading isn't supported
+	apiKeys        atomic.Pointer[APIKeys]      // Keys required by the API, nil or empty disables authentication
+	jwt            atomic.Pointer[JWTValidator] // Checks bearer tokens, nil if they aren't accepted
+	acls           atomic.Pointer[ACLs]         // Key prefixes principals are restricted to
+	throttle       throttle                     // Request rates of clients
+	accessLog      atomic.Bool                  // Log every request
+	cors           atomic.Pointer[CORS]         // Origins allowed to call the API from a browser, nil if none are
+	compressMin    atomic.Int64                 // Smallest response compressed, 0 if compression is off
+	maxKeyBytes    atomic.Int64                 // Longest key accepted, 0 for DefaultMaxKeyBytes
+	maxValueBytes  atomic.Int64                 // Longest value accepted, 0 for DefaultMaxValueBytes
+	requestTimeout atomic.Int64                 // Deadline of requests in nanoseconds, 0 if they have none
 }
 
 func New(m storage.InMemoryMap, l storage.Log) *Server {
-	return &Server{mp: m, log: l}
+	s := &Server{mp: m, log: l}
+	s.events.track = s.nsQuotas.track // Namespace usage follows published changes
+	m.Watch(s.events.publish)         // Attached after WAL replay, so only new writes are published
+	return s
+}
+
+// Publish number of stored keys and last write timestamp at /debug/vars
+func (s *Server) PublishStats() {
+	expvar.Publish("keys", expvar.Func(func() any { return s.mp.Len() }))
+	expvar.Publish("hlc", expvar.Func(func() any { return s.log.Clock().Last() }))
+}
+
+// Attach database so old versions of keys can be read
+func (s *Server) SetDatabase(db storage.Database) {
+	s.db = db
+}
+
+// Attach startup WAL replay so its progress is reported by /readyz
+func (s *Server) SetReplay(r *storage.Replay) {
+	s.replay = r
+}
+
+// Attach startup barrier so its phase is reported by /readyz and /topology
+func (s *Server) SetStartup(st *Startup) {
+	s.startup = st
+}
+
+// Attach cluster membership and this node's labels so they are reported by /topology
+func (s *Server) SetNetwork(n network.Network, labels map[string]string) {
+	s.nodes = n
+	s.labels = labels
+}
+
+// Return labels of this node to other nodes
+func (s *Server) InternalLabelsRequest(w http.ResponseWriter, r *http.Request) {
+	h.WriteJSON(w, http.StatusOK, s.labels)
+}
+
+// Report labels of this node and every connected node
+func (s *Server) TopologyRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	resp := map[string]any{"self": s.labels}
+	if s.startup != nil {
+		resp["phase"] = s.startup.Phase()
+	}
+	if s.nodes != nil {
+		resp["nodes"] = s.nodes.Topology()
+	}
+	h.WriteJSON(w, http.StatusOK, resp)
+}
+
+// Switch read-only mode on or off
+func (s *Server) SetReadOnly(on bool) {
+	if s.readOnly.Swap(on) == on {
+		return
+	}
+	if on {
+		readOnlyMode.Set(1)
+		log.Println("Entering read-only mode")
+		h.Lifecycle(h.EventReadOnly, "")
+	} else {
+		readOnlyMode.Set(0)
+		log.Println("Leaving read-only mode")
+		h.Lifecycle(h.EventWritable, "")
+	}
+}
+
+// Check if node accepts writes, responds with an error if it doesn't
+func (s *Server) writable(w http.ResponseWriter) bool {
+	if s.readOnly.Load() {
+		h.WriteError(w, http.StatusServiceUnavailable, h.CodeReadOnly, "Node is in read-only mode", "")
+		return false
+	}
+	s.warnQuota(w)
+	return true
 }
 
 // Check health of node
@@ -23,72 +160,298 @@ func HealthCheck(w http.ResponseWriter, r *http.Request) {
 	h.WriteResponse(w, 200, "OK")
 }
 
+// Report health details of node, including write stalls
+// A stalled node still serves requests, so this answers 200 either way
+func (s *Server) HealthzRequest(w http.ResponseWriter, r *http.Request) {
+	stall := storage.WriteStall()
+	status := "ok"
+	if stall.Stalled {
+		status = "stalled"
+	}
+	h.WriteJSON(w, http.StatusOK, map[string]any{"status": status, "write_stall": stall})
+}
+
+// Check if node is ready to serve requests
+// Reports WAL replay progress as details
+func (s *Server) ReadyCheck(w http.ResponseWriter, r *http.Request) {
+	resp := map[string]any{"ready": true}
+	if s.replay != nil {
+		status := s.replay.Status()
+		resp["ready"] = status.Done
+		resp["replay"] = status
+	}
+	if s.startup != nil {
+		status := s.startup.Status()
+		resp["ready"] = resp["ready"] == true && status.Phase == PhaseServing
+		resp["startup"] = status
+	}
+	if resp["ready"] == false {
+		h.WriteJSON(w, http.StatusServiceUnavailable, resp)
+		return
+	}
+	h.WriteJSON(w, http.StatusOK, resp)
+}
+
 // Fetch value from key
+// HEAD only reports whether the key exists
 func (s *Server) GetRequest(w http.ResponseWriter, r *http.Request) {
 	// Validate HTTP method
-	if r.Method != "GET" {
-		h.WriteResponse(w, http.StatusMethodNotAllowed, "Invalid HTTP Method")
+	if r.Method == "HEAD" {
+		s.ExistsRequest(w, r)
+		return
+	} else if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
 		return
 	}
 
+	getRequests.Add(1)
+
 	// Extract Query Parameter
-	key := r.URL.Query().Get("key")
+	key := s.key(r.URL.Query().Get("key"))
 	if key == "" {
-		h.WriteResponse(w, 404, "Key not found")
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key parameter", "")
+		return
+	}
+
+	// Read an old version of the key from database
+	if v := r.URL.Query().Get("version"); v != "" {
+		s.getVersion(w, key, v)
 		return
 	}
 
-	// Read value from storage
-	value := s.mp.GetValue(key)
+	// Read value from storage, with its hash as ETag
+	value := s.read(key)
+	if value != "" {
+		w.Header().Set("ETag", etag(value))
+	}
 
 	// Return value
-	if value != "" {
+	// Raw mode streams stored bytes directly, skipping the JSON envelope
+	// Base64 keeps values that aren't valid UTF-8 intact inside JSON
+	if value != "" && r.Header.Get("Accept") == "application/octet-stream" {
+		h.WriteRaw(w, http.StatusOK, value)
+	} else if value != "" && r.URL.Query().Get("encoding") == "base64" {
+		h.WriteResponse(w, http.StatusOK, base64.StdEncoding.EncodeToString([]byte(value)))
+	} else if value != "" {
 		h.WriteResponse(w, http.StatusOK, value)
 	} else {
-		h.WriteResponse(w, http.StatusNotFound, "Value Not found")
+		h.WriteError(w, http.StatusNotFound, h.CodeKeyNotFound, "Key not found", key)
+	}
+}
+
+// Respond with a stored version of key
+func (s *Server) getVersion(w http.ResponseWriter, key string, v string) {
+	version, err := strconv.Atoi(v)
+	if err != nil || s.db == nil {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Invalid version", key)
+		return
+	}
+	value, ok, err := s.db.GetVersion(key, version)
+	if err != nil {
+		log.Println("Could not read version from database - ", err)
+		h.WriteError(w, http.StatusInternalServerError, h.CodeInternal, "Internal Server Error", "")
+		return
+	} else if !ok {
+		h.WriteError(w, http.StatusNotFound, h.CodeNotFound, "Version not found", key)
+		return
+	}
+	h.WriteResponse(w, http.StatusOK, value)
+}
+
+// List stored versions of a key, oldest first
+// Only keys in namespaces with versioning enabled keep versions
+func (s *Server) VersionsRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+
+	key := s.key(r.URL.Query().Get("key"))
+	if key == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key parameter", "")
+		return
+	} else if s.db == nil {
+		h.WriteError(w, http.StatusServiceUnavailable, h.CodeUnavailable, "Database not available", "")
+		return
+	}
+
+	versions, err := s.db.Versions(key)
+	if err != nil {
+		log.Println("Could not read versions from database - ", err)
+		h.WriteError(w, http.StatusInternalServerError, h.CodeInternal, "Internal Server Error", "")
+		return
+	}
+	h.WriteJSON(w, http.StatusOK, map[string]any{"key": key, "versions": versions})
+}
+
+// Check if key exists without transferring its value
+func (s *Server) ExistsRequest(w http.ResponseWriter, r *http.Request) {
+	// Validate HTTP method
+	if r.Method != "GET" && r.Method != "HEAD" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+
+	key := s.key(r.URL.Query().Get("key"))
+	if key == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key parameter", "")
+		return
+	}
+
+	if s.mp.Exists(key) || s.readMiss(key) != "" {
+		h.WriteJSON(w, http.StatusOK, map[string]bool{"exists": true})
+	} else {
+		h.WriteJSON(w, http.StatusNotFound, map[string]bool{"exists": false})
 	}
 }
 
 // Save key-value pair
+// Accepts GET with query parameters, or POST with a JSON body {"key": ..., "value": ...}
+// nx only sets the key if it doesn't exist, xx only if it already exists
 func (s *Server) SetRequest(w http.ResponseWriter, r *http.Request) {
 	// Validate HTTP method
-	if r.Method != "GET" {
-		h.WriteResponse(w, http.StatusMethodNotAllowed, "Invalid HTTP Method")
+	if r.Method != "GET" && r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
 		return
 	}
 
-	// Extract Query Parameters
-	KeyQuery := r.URL.Query()["key"]
-	ValueQuery := r.URL.Query()["value"]
-	if len(KeyQuery) == 0 {
-		h.WriteResponse(w, http.StatusNotFound, "Key not found")
+	if !s.writable(w) {
 		return
-	} else if len(ValueQuery) == 0 {
-		h.WriteResponse(w, http.StatusNotFound, "Value not found")
+	}
+	setRequests.Add(1)
+
+	// Extract Key, Value and flags
+	var key, value, ttlValue, expireAtValue, contentType string
+	var nx, xx bool
+	if r.Method == "POST" && r.URL.Query().Has("key") {
+		// Raw body is the value, stored byte for byte and read no further than the longest value accepted
+		key = s.key(r.URL.Query().Get("key"))
+		_, maxValue := s.pairLimits()
+		raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxValue)))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Value length too long", key)
+			return
+		} else if err != nil {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidBody, "Invalid request body", "")
+			return
+		}
+		value = string(raw)
+		contentType = r.Header.Get("Content-Type")
+		nx, xx = r.URL.Query().Get("nx") == "true", r.URL.Query().Get("xx") == "true"
+		ttlValue = r.URL.Query().Get("ttl")
+		expireAtValue = r.URL.Query().Get("expire_at")
+	} else if r.Method == "POST" {
+		var body struct {
+			Key         *string `json:"key"`
+			Value       *string `json:"value"`
+			ValueBase64 *string `json:"value_base64"` // For values that aren't valid UTF-8
+			ContentType string  `json:"content_type"`
+			NX          bool    `json:"nx"`
+			XX          bool    `json:"xx"`
+			TTL         string  `json:"ttl"`
+			ExpireAt    string  `json:"expire_at"`
+		}
+		// Room for the longest value accepted, even base64 encoded
+		_, maxValue := s.pairLimits()
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, max(maxBodySize, int64(maxValue)*2))).Decode(&body)
+		if err != nil {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidBody, "Invalid request body", "")
+			return
+		}
+		if body.Key == nil {
+			h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key", "")
+			return
+		} else if body.Value == nil && body.ValueBase64 == nil {
+			h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing value", "")
+			return
+		}
+		key = s.key(*body.Key)
+		if body.ValueBase64 != nil {
+			decoded, err := base64.StdEncoding.DecodeString(*body.ValueBase64)
+			if err != nil {
+				h.WriteError(w, http.StatusBadRequest, h.CodeInvalidBody, "Invalid value_base64", key)
+				return
+			}
+			value = string(decoded)
+		} else {
+			value = *body.Value
+		}
+		nx, xx, ttlValue, expireAtValue = body.NX, body.XX, body.TTL, body.ExpireAt
+		contentType = body.ContentType
+	} else {
+		// Extract Query Parameters
+		KeyQuery := r.URL.Query()["key"]
+		ValueQuery := r.URL.Query()["value"]
+		if len(KeyQuery) == 0 {
+			h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key parameter", "")
+			return
+		} else if len(ValueQuery) == 0 {
+			h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing value parameter", "")
+			return
+		}
+		key, value = s.key(KeyQuery[0]), ValueQuery[0]
+		nx, xx = r.URL.Query().Get("nx") == "true", r.URL.Query().Get("xx") == "true"
+		ttlValue = r.URL.Query().Get("ttl")
+		expireAtValue = r.URL.Query().Get("expire_at")
+		contentType = r.URL.Query().Get("content_type")
+	}
+	if nx && xx {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "nx and xx can't be combined", key)
+		return
+	}
+	if ttlValue != "" && expireAtValue != "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "ttl and expire_at can't be combined", key)
 		return
 	}
+	var expireAt time.Time
+	if ttlValue != "" {
+		d, err := parseTTL(ttlValue)
+		if err != nil {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Invalid ttl", key)
+			return
+		}
+		expireAt = time.Now().Add(d)
+	} else if expireAtValue != "" {
+		at, err := parseExpireAt(expireAtValue)
+		if err != nil {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Invalid expiry time", key)
+			return
+		}
+		expireAt = at
+	}
 
-	// Extract Key and Value
-	key := KeyQuery[0]
-	value := ValueQuery[0]
-	if len(key) > 50 {
-		h.WriteResponse(w, http.StatusBadRequest, "Key length too long")
+	if msg := s.validatePair(key, value); msg != "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, msg, key)
 		return
-	} else if len(value) > 100 {
-		h.WriteResponse(w, http.StatusBadRequest, "Value length too long")
+	}
+
+	// JSON values must match the schema of their namespace
+	if isJSON(contentType) && !s.matchesSchema(w, key, value) {
 		return
 	}
 
-	// Save key-value to storage
-	_, err := s.log.UpdateLog("SET", key, value)
+	if !s.unfrozen(w, key) {
+		return
+	}
 
+	// Check existence or version and save atomically, with the expiry in the same WAL record
+	// Like any SET, an existing expiry is cleared unless ttl or expire_at is given
+	match := r.Header.Get("If-Match")
+	err := s.modifyExpiry(key, func(old string, at time.Time, exists bool) (string, time.Time, error) {
+		if match != "" && !ifMatch(match, old, exists) {
+			return "", at, errPrecondition
+		} else if nx && exists {
+			return "", at, &requestError{http.StatusConflict, h.CodeConflict, "Key already exists"}
+		} else if xx && !exists {
+			return "", at, &requestError{http.StatusConflict, h.CodeConflict, "Key does not exist"}
+		}
+		return value, expireAt, nil
+	})
 	if err != nil {
-		log.Println("Error writing to log - ", err)
-		h.WriteResponse(w, http.StatusInternalServerError, "Internal Server Error")
+		writeModifyError(w, key, err)
 		return
 	}
-
-	s.mp.SetValue(key, value)
 	h.WriteResponse(w, http.StatusOK, "Key saved")
 
 	// // Propagate change to other nodes
@@ -99,41 +462,117 @@ func (s *Server) SetRequest(w http.ResponseWriter, r *http.Request) {
 	// }
 }
 
+// Accept keys and values up to these many bytes from now on, 0 restores a default
+func (s *Server) SetPairLimits(maxKey int, maxValue int) {
+	s.maxKeyBytes.Store(int64(max(maxKey, 0)))
+	s.maxValueBytes.Store(int64(max(maxValue, 0)))
+}
+
+// Longest key and value accepted in bytes
+func (s *Server) pairLimits() (int, int) {
+	maxKey, maxValue := int(s.maxKeyBytes.Load()), int(s.maxValueBytes.Load())
+	if maxKey == 0 {
+		maxKey = DefaultMaxKeyBytes
+	}
+	if maxValue == 0 {
+		maxValue = DefaultMaxValueBytes
+	}
+	return maxKey, maxValue
+}
+
+// Check key and value lengths, returns an error message if invalid
+func (s *Server) validatePair(key string, value string) string {
+	maxKey, maxValue := s.pairLimits()
+	if strings.HasPrefix(key, "\x00") {
+		return "Key uses a reserved prefix"
+	} else if len(key) > maxKey {
+		return "Key length too long"
+	} else if len(value) > maxValue {
+		return "Value length too long"
+	}
+	return ""
+}
+
 // Delete key-value pair
+// Accepts GET or DELETE, with key in query (/delete?key=<key>) or path (/delete/<key>)
 func (s *Server) DeleteRequest(w http.ResponseWriter, r *http.Request) {
 	// Validate HTTP method
-	if r.Method != "GET" {
-		h.WriteResponse(w, http.StatusMethodNotAllowed, "Invalid HTTP Method")
+	if r.Method != "GET" && r.Method != "DELETE" {
+		w.Header().Set("Allow", "GET, DELETE")
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
 		return
 	}
 
-	// Extract Query Paramter
-	KeyQuery := r.URL.Query()["key"]
-	if len(KeyQuery) == 0 {
-		h.WriteResponse(w, http.StatusNotFound, "Key not found")
+	if !s.writable(w) {
 		return
 	}
+	deleteRequests.Add(1)
 
-	// Extract key
-	key := KeyQuery[0]
+	// Extract key from path, else from query parameter
+	key := strings.TrimPrefix(r.URL.Path, "/delete/")
+	if key == r.URL.Path {
+		key = ""
+	}
+	if key == "" {
+		KeyQuery := r.URL.Query()["key"]
+		if len(KeyQuery) == 0 {
+			h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key parameter", "")
+			return
+		}
+		key = KeyQuery[0]
+	}
+	key = s.key(key)
 
-	// Delete key-value from storage
-	_, err := s.log.UpdateLog("DELETE", key, "")
+	if !s.unfrozen(w, key) {
+		return
+	}
 
-	if err != nil {
-		log.Println("Error writing to log - ", err)
-		h.WriteResponse(w, http.StatusInternalServerError, "Internal Server Error")
+	// Only delete if the current value or version matches, e.g. to release a lock held by the caller
+	query := r.URL.Query()
+	match := r.Header.Get("If-Match")
+	if query.Has("expected") || query.Has("expected_hash") || match != "" {
+		err := s.mp.Modify(key, func(old string, exists bool) (string, bool, error) {
+			if match != "" && !ifMatch(match, old, exists) {
+				return old, false, errPrecondition
+			} else if !exists {
+				return "", false, &requestError{http.StatusNotFound, h.CodeKeyNotFound, "Key not found"}
+			}
+			if query.Has("expected") && old != query.Get("expected") ||
+				query.Has("expected_hash") && valueHash(old) != query.Get("expected_hash") {
+				return old, false, &requestError{http.StatusConflict, h.CodeConflict, "Value does not match"}
+			}
+			if _, err := s.log.UpdateLog("DELETE", key, ""); err != nil {
+				return old, false, err
+			}
+			return "", true, nil
+		})
+		if err != nil {
+			writeModifyError(w, key, err)
+			return
+		}
+		h.WriteResponse(w, http.StatusOK, "Key deleted")
 		return
 	}
 
-	s.mp.DeleteValue(key)
+	// Delete key-value from storage, logged under the map lock so a concurrent flushall can't lose it
+	err := s.mp.Modify(key, func(old string, exists bool) (string, bool, error) {
+		if _, err := s.log.UpdateLog("DELETE", key, ""); err != nil {
+			return old, false, err
+		}
+		return "", true, nil
+	})
+	if err != nil {
+		writeModifyError(w, key, err)
+		return
+	}
 	h.WriteResponse(w, http.StatusOK, "Key deleted")
 }
 
 // Recieve and mark WAL updates from other nodes
-func InternalUpdateRequest(w http.ResponseWriter, r *http.Request) {
+// The clock is merged with the update's timestamp, so local writes after it are ordered after it
+func (s *Server) InternalUpdateRequest(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		h.WriteResponse(w, http.StatusMethodNotAllowed, "Invalid HTTP Method")
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
 		return
 	}
 
@@ -141,16 +580,22 @@ func InternalUpdateRequest(w http.ResponseWriter, r *http.Request) {
 	b, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Println("Could not read POST body - ", err)
-		h.WriteResponse(w, http.StatusBadRequest, "Invalid request body")
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidBody, "Invalid request body", "")
 		return
 	}
 	var newLog map[string]string
 	err = json.Unmarshal(b, &newLog)
 	if err != nil {
 		log.Println("Error unmarshaling POST body - ", err)
-		h.WriteResponse(w, http.StatusBadRequest, "Invalid request body")
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidBody, "Invalid request body", "")
+		return
+	}
+	ts, ok := storage.EntryTimestamp(newLog["update"])
+	if !ok {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidBody, "Invalid WAL update", "")
 		return
 	}
+	s.log.Clock().Update(ts)
 
 	// Open log file
 	// USE AN EXPORTED FUNCTION HERE
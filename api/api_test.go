@@ -0,0 +1,62 @@
+package api_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Keys and values past the default limits are refused until the limits are raised
+func TestPairLimits(t *testing.T) {
+	srv := newServer()
+	key, value := strings.Repeat("k", 60), strings.Repeat("v", 500)
+	set := func() int {
+		w := httptest.NewRecorder()
+		srv.SetRequest(w, httptest.NewRequest("GET", "/set?key="+key+"&value="+value, nil))
+		return w.Code
+	}
+
+	if code := set(); code != http.StatusBadRequest {
+		t.Fatalf("got %d with default limits, want 400", code)
+	}
+	srv.SetPairLimits(64, 512)
+	if code := set(); code != http.StatusOK {
+		t.Fatalf("got %d with raised limits, want 200", code)
+	}
+	srv.SetPairLimits(64, 100)
+	if code := set(); code != http.StatusBadRequest {
+		t.Fatalf("got %d with a value limit of 100, want 400", code)
+	}
+}
+
+// A binary raw body past the default value limit is stored and read back byte for byte
+func TestBinaryRoundTrip(t *testing.T) {
+	srv := newServer()
+	value := make([]byte, 1000)
+	for i := range value {
+		value[i] = byte(i * 7)
+	}
+	copy(value, "\x00\xff,\n\r")
+
+	w := httptest.NewRecorder()
+	srv.SetRequest(w, httptest.NewRequest("POST", "/set?key=bin", bytes.NewReader(value)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got %d with the default value limit, want 400", w.Code)
+	}
+	srv.SetPairLimits(50, len(value))
+	w = httptest.NewRecorder()
+	srv.SetRequest(w, httptest.NewRequest("POST", "/set?key=bin", bytes.NewReader(value)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("set answered %d: %s", w.Code, w.Body)
+	}
+
+	req := httptest.NewRequest("GET", "/get?key=bin", nil)
+	req.Header.Set("Accept", "application/octet-stream")
+	w = httptest.NewRecorder()
+	srv.GetRequest(w, req)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), value) {
+		t.Fatalf("got %d with %d bytes, want the %d bytes set", w.Code, w.Body.Len(), len(value))
+	}
+}
@@ -0,0 +1,495 @@
+package api
+
+import (
+	"errors"
+	h "gokv/helper"
+	"gokv/storage"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Error returned from inside an atomic modification that should reach the client as-is
+type requestError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// Error of a request about another key than the one being modified, e.g. one key of a batch
+type keyError struct {
+	key string
+	err *requestError
+}
+
+func (e *keyError) Error() string {
+	return e.err.message
+}
+
+func (e *keyError) Unwrap() error {
+	return e.err
+}
+
+// Respond to a failed atomic modification of key, or of the key a keyError names
+func writeModifyError(w http.ResponseWriter, key string, err error) {
+	var keyErr *keyError
+	if errors.As(err, &keyErr) {
+		key = keyErr.key
+	}
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		h.WriteError(w, reqErr.status, reqErr.code, reqErr.message, key)
+		return
+	}
+	log.Println("Error writing to log - ", err)
+	walErrors.Add(1)
+	h.WriteError(w, http.StatusInternalServerError, h.CodeInternal, "Internal Server Error", "")
+}
+
+// Atomically set a key to fn(old value), keeping its expiry, for updates like APPEND
+// The value and kept expiry are logged as one WAL record while fn still holds the map lock
+func (s *Server) modify(key string, fn func(old string, exists bool) (string, error)) error {
+	return s.modifyExpiry(key, func(old string, at time.Time, exists bool) (string, time.Time, error) {
+		value, err := fn(old, exists)
+		return value, at, err
+	})
+}
+
+// Atomically replace a key with fn(old value), clearing its expiry like a plain SET
+func (s *Server) replace(key string, fn func(old string, exists bool) (string, error)) error {
+	return s.modifyExpiry(key, func(old string, at time.Time, exists bool) (string, time.Time, error) {
+		value, err := fn(old, exists)
+		return value, time.Time{}, err
+	})
+}
+
+// Atomically replace a key with fn(old value, metadata), like replace
+// Metadata is zero for a missing key, so its version is 0
+func (s *Server) replaceMeta(key string, fn func(old string, meta storage.KeyMeta, exists bool) (string, error)) error {
+	s.measureQuotas(key)
+	return s.mp.Transact(func(get func(key string) (string, bool), _ func(key string) time.Time, meta func(key string) storage.KeyMeta) ([]storage.TxnOp, error) {
+		old, exists := get(key)
+		value, err := fn(old, meta(key), exists)
+		if err != nil {
+			return nil, err
+		}
+		if msg := s.validatePair(key, value); msg != "" {
+			return nil, &requestError{http.StatusBadRequest, h.CodeInvalidParameter, msg}
+		}
+		if err := s.checkQuota(map[string]int{key: len(value)}); err != nil {
+			return nil, err
+		}
+		if err := s.logSet(key, value, time.Time{}); err != nil {
+			return nil, err
+		}
+		return []storage.TxnOp{{Op: "SET", Key: key, Value: value}}, nil
+	})
+}
+
+// Atomically set a key and its expiry to fn(old value, expiry), zero meaning none
+// Both are logged as one WAL record while fn still holds the map lock, once the new value is within its namespace quota
+func (s *Server) modifyExpiry(key string, fn func(old string, at time.Time, exists bool) (string, time.Time, error)) error {
+	s.measureQuotas(key)
+	return s.mp.ModifyExpiry(key, func(old string, at time.Time, exists bool) (string, time.Time, bool, error) {
+		value, at, err := fn(old, at, exists)
+		if err != nil {
+			return "", at, false, err
+		}
+		if msg := s.validatePair(key, value); msg != "" {
+			return "", at, false, &requestError{http.StatusBadRequest, h.CodeInvalidParameter, msg}
+		}
+		if err := s.checkQuota(map[string]int{key: len(value)}); err != nil {
+			return "", at, false, err
+		}
+		if err := s.logSet(key, value, at); err != nil {
+			return "", at, false, err
+		}
+		return value, at, false, nil
+	})
+}
+
+// Log a SET of key, as a TXN record carrying its expiry if it has one
+func (s *Server) logSet(key string, value string, at time.Time) error {
+	if at.IsZero() {
+		_, err := s.log.UpdateLog("SET", key, value)
+		return err
+	}
+	return s.log.UpdateLogTxn([]storage.TxnOp{{Op: "SET", Key: key, Value: value, Expire: storage.EncodeExpiry(at)}})
+}
+
+// Increment integer value of a key, missing keys start at 0
+// GET /incr?key=<key>&by=<n>
+func (s *Server) IncrRequest(w http.ResponseWriter, r *http.Request) {
+	s.addRequest(w, r, 1)
+}
+
+// Decrement integer value of a key, missing keys start at 0
+// GET /decr?key=<key>&by=<n>
+func (s *Server) DecrRequest(w http.ResponseWriter, r *http.Request) {
+	s.addRequest(w, r, -1)
+}
+
+// Add to an integer counter, creating it with a TTL if it doesn't exist
+// The TTL is only set when the counter is created, so later increments in the
+// same window don't extend it. Used for fixed-window rate limiting
+// GET /incrby?key=<key>&by=<n>&ttl=<seconds or duration>
+func (s *Server) IncrByRequest(w http.ResponseWriter, r *http.Request) {
+	key, by, ok := s.addParams(w, r, 1)
+	if !ok {
+		return
+	}
+	var ttl time.Duration
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		d, err := parseTTL(v)
+		if err != nil {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Invalid ttl", key)
+			return
+		}
+		ttl = d
+	}
+
+	result, created, err := s.add(key, by, ttl)
+	if err != nil {
+		writeModifyError(w, key, err)
+		return
+	}
+
+	resp := map[string]any{"value": result, "created": created, "ttl": -1}
+	if at, ok := s.mp.Expiry(key); ok {
+		resp["ttl"] = max(int64(time.Until(at).Round(time.Second)/time.Second), 0)
+	}
+	h.WriteJSON(w, http.StatusOK, resp)
+}
+
+// Add sign * by to integer value of a key
+func (s *Server) addRequest(w http.ResponseWriter, r *http.Request, sign int64) {
+	key, by, ok := s.addParams(w, r, sign)
+	if !ok {
+		return
+	}
+	result, _, err := s.add(key, by, 0)
+	if err != nil {
+		writeModifyError(w, key, err)
+		return
+	}
+	h.WriteResponse(w, http.StatusOK, strconv.FormatInt(result, 10))
+}
+
+// Validate a counter request, returns the key and sign * by
+// Responds with an error and returns false if invalid
+func (s *Server) addParams(w http.ResponseWriter, r *http.Request, sign int64) (string, int64, bool) {
+	// Validate HTTP method
+	if r.Method != "GET" && r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return "", 0, false
+	}
+	if !s.writable(w) {
+		return "", 0, false
+	}
+	setRequests.Add(1)
+
+	key := s.key(r.URL.Query().Get("key"))
+	if key == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key parameter", "")
+		return "", 0, false
+	}
+	if !s.unfrozen(w, key) {
+		return "", 0, false
+	}
+	by := int64(1)
+	if v := r.URL.Query().Get("by"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n == math.MinInt64 {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Invalid increment", key)
+			return "", 0, false
+		}
+		by = n
+	}
+	return key, by * sign, true
+}
+
+// Atomically add by to integer value of a key, missing or expired keys start at 0
+// A key it creates gets ttl in the same WAL record, existing keys keep their expiry
+// Returns the new value and whether the key was created
+func (s *Server) add(key string, by int64, ttl time.Duration) (int64, bool, error) {
+	var result int64
+	var created bool
+	err := s.modifyExpiry(key, func(old string, at time.Time, exists bool) (string, time.Time, error) {
+		current := int64(0)
+		if exists {
+			n, err := strconv.ParseInt(old, 10, 64)
+			if err != nil {
+				return "", at, &requestError{http.StatusConflict, h.CodeConflict, "Value is not an integer"}
+			}
+			current = n
+		} else if ttl > 0 {
+			at = time.Now().Add(ttl)
+		}
+		if (by > 0 && current > math.MaxInt64-by) || (by < 0 && current < math.MinInt64-by) {
+			return "", at, &requestError{http.StatusConflict, h.CodeConflict, "Increment would overflow"}
+		}
+		result, created = current+by, !exists
+		return strconv.FormatInt(result, 10), at, nil
+	})
+	return result, created, err
+}
+
+// Set a key only if its current value matches old, and its version matches version if given
+// Without old or version, the key is only set if it doesn't exist yet
+// GET /cas?key=<key>&old=<expected value>&version=<expected version>&value=<new value>
+func (s *Server) CASRequest(w http.ResponseWriter, r *http.Request) {
+	// Validate HTTP method
+	if r.Method != "GET" && r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	if !s.writable(w) {
+		return
+	}
+	setRequests.Add(1)
+
+	query := r.URL.Query()
+	key := s.key(query.Get("key"))
+	if key == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key parameter", "")
+		return
+	} else if !query.Has("value") {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing value parameter", "")
+		return
+	}
+	value := query.Get("value")
+	if !s.unfrozen(w, key) {
+		return
+	}
+	expected, hasExpected := query.Get("old"), query.Has("old")
+	var version int64
+	if query.Has("version") {
+		var err error
+		if version, err = strconv.ParseInt(query.Get("version"), 10, 64); err != nil || version < 0 {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Invalid version", key)
+			return
+		}
+	}
+
+	// A version catches a value changed and changed back since it was read
+	err := s.replaceMeta(key, func(old string, meta storage.KeyMeta, exists bool) (string, error) {
+		if query.Has("version") && meta.Version != version {
+			return "", &requestError{http.StatusConflict, h.CodeConflict, "Version has changed"}
+		}
+		if (hasExpected || !query.Has("version")) && (exists != hasExpected || old != expected) {
+			return "", &requestError{http.StatusConflict, h.CodeConflict, "Value has changed"}
+		}
+		return value, nil
+	})
+	if err != nil {
+		writeModifyError(w, key, err)
+		return
+	}
+	h.WriteResponse(w, http.StatusOK, "Key saved")
+}
+
+// Append to the value of a key, creating it if missing
+// Responds with the length of the new value
+// GET /append?key=<key>&value=<suffix>
+func (s *Server) AppendRequest(w http.ResponseWriter, r *http.Request) {
+	// Validate HTTP method
+	if r.Method != "GET" && r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	if !s.writable(w) {
+		return
+	}
+	setRequests.Add(1)
+
+	query := r.URL.Query()
+	key := s.key(query.Get("key"))
+	if key == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key parameter", "")
+		return
+	} else if !query.Has("value") {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing value parameter", "")
+		return
+	}
+	suffix := query.Get("value")
+	if !s.unfrozen(w, key) {
+		return
+	}
+
+	var length int
+	err := s.modify(key, func(old string, exists bool) (string, error) {
+		length = len(old) + len(suffix)
+		return old + suffix, nil
+	})
+	if err != nil {
+		writeModifyError(w, key, err)
+		return
+	}
+	h.WriteJSON(w, http.StatusOK, map[string]int{"length": length})
+}
+
+// Set a key and return its old value, null if the key didn't exist
+// GET /getset?key=<key>&value=<value>
+func (s *Server) GetSetRequest(w http.ResponseWriter, r *http.Request) {
+	// Validate HTTP method
+	if r.Method != "GET" && r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	if !s.writable(w) {
+		return
+	}
+	setRequests.Add(1)
+
+	query := r.URL.Query()
+	key := s.key(query.Get("key"))
+	if key == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key parameter", "")
+		return
+	} else if !query.Has("value") {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing value parameter", "")
+		return
+	}
+	value := query.Get("value")
+	if !s.unfrozen(w, key) {
+		return
+	}
+
+	var previous string
+	var existed bool
+	err := s.replace(key, func(old string, exists bool) (string, error) {
+		previous, existed = old, exists
+		return value, nil
+	})
+	if err != nil {
+		writeModifyError(w, key, err)
+		return
+	}
+	if !existed { // the key was still set, there is just no old value
+		h.WriteJSON(w, http.StatusOK, map[string]any{"message": nil})
+		return
+	}
+	h.WriteResponse(w, http.StatusOK, previous)
+}
+
+// Delete a key and return its value
+// GET /getdel?key=<key>
+func (s *Server) GetDelRequest(w http.ResponseWriter, r *http.Request) {
+	// Validate HTTP method
+	if r.Method != "GET" && r.Method != "DELETE" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	if !s.writable(w) {
+		return
+	}
+	deleteRequests.Add(1)
+
+	key := s.key(r.URL.Query().Get("key"))
+	if key == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key parameter", "")
+		return
+	}
+	if !s.unfrozen(w, key) {
+		return
+	}
+
+	var previous string
+	var existed bool
+	err := s.mp.Modify(key, func(old string, exists bool) (string, bool, error) {
+		previous, existed = old, exists
+		if !exists {
+			return "", true, nil
+		}
+		if _, err := s.log.UpdateLog("DELETE", key, ""); err != nil {
+			return "", false, err
+		}
+		return "", true, nil
+	})
+	if err != nil {
+		writeModifyError(w, key, err)
+		return
+	}
+	if !existed {
+		h.WriteError(w, http.StatusNotFound, h.CodeKeyNotFound, "Key not found", key)
+		return
+	}
+	h.WriteResponse(w, http.StatusOK, previous)
+}
+
+// Move the value of a key to another key in a single WAL record
+// nx=true fails if the destination already exists. Any expiry moves with the value
+// GET /rename?key=<key>&to=<new key>[&nx=true]
+func (s *Server) RenameRequest(w http.ResponseWriter, r *http.Request) {
+	// Validate HTTP method
+	if r.Method != "GET" && r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	if !s.writable(w) {
+		return
+	}
+
+	query := r.URL.Query()
+	key, to := s.key(query.Get("key")), s.key(query.Get("to"))
+	if key == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key parameter", "")
+		return
+	} else if to == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing to parameter", "")
+		return
+	} else if key == to {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "key and to must differ", key)
+		return
+	}
+	if msg := s.validatePair(to, ""); msg != "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, msg, to)
+		return
+	}
+	if !s.unfrozen(w, key, to) {
+		return
+	}
+	s.measureQuotas(to)
+	nx := query.Get("nx") == "true"
+
+	errKey := key // Key reported if the rename fails
+	err := s.mp.Transact(func(get func(key string) (string, bool), expiry func(key string) time.Time, _ func(key string) storage.KeyMeta) ([]storage.TxnOp, error) {
+		old, exists := get(key)
+		if !exists {
+			return nil, &requestError{http.StatusNotFound, h.CodeKeyNotFound, "Key not found"}
+		}
+		if _, taken := get(to); nx && taken {
+			errKey = to
+			return nil, &requestError{http.StatusConflict, h.CodeConflict, "Destination key already exists"}
+		}
+		if msg, _, err := s.checkSchema(to, old); err != nil {
+			return nil, err
+		} else if msg != "" {
+			errKey = to
+			return nil, &requestError{http.StatusBadRequest, h.CodeSchemaViolation, msg}
+		}
+		if err := s.checkQuota(map[string]int{to: len(old)}); err != nil {
+			return nil, err
+		}
+		set := storage.TxnOp{Op: "SET", Key: to, Value: old}
+		if at := expiry(key); !at.IsZero() {
+			set.Expire = storage.EncodeExpiry(at)
+		}
+		ops := []storage.TxnOp{{Op: "DELETE", Key: key}, set}
+		if err := s.log.UpdateLogTxn(ops); err != nil {
+			return nil, err
+		}
+		return ops, nil
+	})
+	if err != nil {
+		writeModifyError(w, errKey, err)
+		return
+	}
+	h.WriteResponse(w, http.StatusOK, "Key renamed")
+}
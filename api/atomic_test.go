@@ -0,0 +1,94 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gokv/api"
+	h "gokv/helper"
+	"gokv/storage/storagetest"
+)
+
+// GETSET of a missing key saves the value and reports no old value
+func TestGetSetMissingKey(t *testing.T) {
+	mp := storagetest.NewMap()
+	srv := api.New(mp, storagetest.NewLog())
+
+	getset := func(value string) (int, *string) {
+		w := httptest.NewRecorder()
+		srv.GetSetRequest(w, httptest.NewRequest("GET", "/getset?key=k&value="+value, nil))
+		var body struct {
+			Message *string `json:"message"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, body.Message
+	}
+
+	if code, old := getset("1"); code != http.StatusOK || old != nil {
+		t.Fatalf("got %d with old value %v, want 200 with none", code, old)
+	}
+	if v := mp.GetValue("k"); v != "1" {
+		t.Fatalf("saved %q, want %q", v, "1")
+	}
+	if code, old := getset("2"); code != http.StatusOK || old == nil || *old != "1" {
+		t.Fatalf("got %d with old value %v, want 200 with %q", code, old, "1")
+	}
+}
+
+// CAS with a version refuses a value changed and changed back since it was read
+func TestCASVersion(t *testing.T) {
+	srv := newServer()
+	call := func(handler http.HandlerFunc, query string) int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/?"+query, nil))
+		return w.Code
+	}
+
+	if code := call(srv.CASRequest, "key=k&version=0&value=a"); code != http.StatusOK {
+		t.Fatalf("swap of a missing key at version 0 got %d, want 200", code)
+	}
+	call(srv.SetRequest, "key=k&value=b")
+	call(srv.SetRequest, "key=k&value=a")
+	if code := call(srv.CASRequest, "key=k&old=a&version=1&value=c"); code != http.StatusConflict {
+		t.Fatalf("swap at a stale version got %d, want 409", code)
+	}
+	if code := call(srv.CASRequest, "key=k&old=a&version=3&value=c"); code != http.StatusOK {
+		t.Fatalf("swap at the current version got %d, want 200", code)
+	}
+	if code := call(srv.CASRequest, "key=k&version=4&value=d"); code != http.StatusOK {
+		t.Fatalf("swap by version alone got %d, want 200", code)
+	}
+	if code := call(srv.CASRequest, "key=k&version=x&value=d"); code != http.StatusBadRequest {
+		t.Fatalf("swap with an invalid version got %d, want 400", code)
+	}
+}
+
+// Renaming into a namespace with a schema checks the value against it
+func TestRenameSchema(t *testing.T) {
+	h.SetLayout(h.Layout{DataDir: t.TempDir(), WALDir: t.TempDir()})
+	t.Cleanup(func() { h.SetLayout(h.LayoutFromEnv()) })
+	srv := newServer()
+	w := httptest.NewRecorder()
+	srv.SchemaRequest(w, httptest.NewRequest("POST", "/admin/schemas?namespace=users", strings.NewReader(`{"type":"object"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("schema answered %d: %s", w.Code, w.Body)
+	}
+	srv.SetRequest(httptest.NewRecorder(), httptest.NewRequest("GET", "/set?key=draft&value=text", nil))
+	srv.SetRequest(httptest.NewRecorder(), httptest.NewRequest("GET", "/set?key=valid&value={}", nil))
+
+	w = httptest.NewRecorder()
+	srv.RenameRequest(w, httptest.NewRequest("GET", "/rename?key=draft&to=users:1", nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "schema_violation") {
+		t.Fatalf("rename of a value not matching the schema answered %d: %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	srv.RenameRequest(w, httptest.NewRequest("GET", "/rename?key=valid&to=users:1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("rename of a matching value answered %d: %s", w.Code, w.Body)
+	}
+}
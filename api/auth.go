@@ -0,0 +1,235 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	h "gokv/helper"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Roles of API keys and tokens, each allowed everything the ones before it are
+const (
+	RoleRead  = "read"  // Read keys and stream changes
+	RoleWrite = "write" // Also change keys and publish messages
+	RoleAdmin = "admin" // Also call admin endpoints and /debug/vars
+)
+
+// Order of roles, unknown roles rank below every known one
+var roleRank = map[string]int{RoleRead: 1, RoleWrite: 2, RoleAdmin: 3}
+
+// Role of a token claim, also accepting "read-only" and "read-write"
+func canonicalRole(role string) string {
+	switch role {
+	case "read-only":
+		return RoleRead
+	case "read-write":
+		return RoleWrite
+	}
+	return role
+}
+
+// Routes a read role may call, other routes outside /admin/ need the write role
+var readRoutes = map[string]bool{
+	"/get": true, "/exists": true, "/keys": true, "/count": true, "/scan": true, "/randomkey": true,
+	"/sample": true, "/export": true, "/history": true, "/versions": true, "/meta": true, "/ttl": true,
+	"/watch": true, "/subscribe": true, "/mget": true, "/stats": true, "/topology": true,
+}
+
+// Header carrying the API key of a request
+const apiKeyHeader = "X-API-Key"
+
+// Shortest API key accepted, so keys can't be guessed
+const minAPIKeyLength = 16
+
+// Requests rejected for a missing, invalid or under-scoped API key
+var authRejected = expvar.NewInt("auth_rejected")
+
+// Routes answered without credentials: probes and the API description
+var openRoutes = map[string]bool{"/ping": true, "/healthz": true, "/readyz": true, "/openapi.json": true}
+
+// Role a route needs, empty if it is open or checked by the Verifier
+func requiredRole(path string) string {
+	switch {
+	case openRoutes[path] || strings.HasPrefix(path, "/internal/"):
+		return ""
+	case strings.HasPrefix(path, "/admin/") || strings.HasPrefix(path, "/debug/"):
+		return RoleAdmin
+	case readRoutes[path]:
+		return RoleRead
+	}
+	return RoleWrite
+}
+
+// Who a request was authenticated as
+type principal struct {
+	id   string // Identifies the key or token, requests are rate limited by it
+	name string // Name of the API key or subject of the token, ACLs are looked up by it
+	role string
+}
+
+// Context key of the principal of a request
+type principalKey struct{}
+
+// API keys allowed on data endpoints, and admin keys allowed everywhere, each with a name
+// Only SHA-256 digests of the keys are kept
+type APIKeys struct {
+	data  map[[32]byte]string
+	admin map[[32]byte]string
+}
+
+// Parse comma separated data and admin keys, e.g. from API_KEYS and ADMIN_API_KEYS
+// A key may be named as "name:key", unnamed keys share the empty name
+func ParseAPIKeys(data string, admin string) (APIKeys, error) {
+	keys := APIKeys{data: make(map[[32]byte]string), admin: make(map[[32]byte]string)}
+	for _, list := range []struct {
+		spec   string
+		digest map[[32]byte]string
+	}{{data, keys.data}, {admin, keys.admin}} {
+		for _, key := range strings.Split(list.spec, ",") {
+			name, key, named := strings.Cut(strings.TrimSpace(key), ":")
+			if !named {
+				name, key = "", name
+			}
+			if key == "" {
+				continue
+			}
+			if len(key) < minAPIKeyLength {
+				return keys, fmt.Errorf("API key shorter than %d characters", minAPIKeyLength)
+			}
+			list.digest[sha256.Sum256([]byte(key))] = name
+		}
+	}
+	return keys, nil
+}
+
+// Check if any key is configured, otherwise requests aren't authenticated
+func (k APIKeys) Enabled() bool {
+	return len(k.data) > 0 || len(k.admin) > 0
+}
+
+// Principal of an API key, with an empty role if the key is unknown
+// Data keys never have the admin role, admin routes need an admin key or token
+func (k APIKeys) principal(key string) principal {
+	digest := sha256.Sum256([]byte(key))
+	id := "key:" + hex.EncodeToString(digest[:8])
+	if name, ok := k.admin[digest]; ok {
+		return principal{id: id, name: name, role: RoleAdmin}
+	}
+	if name, ok := k.data[digest]; ok {
+		return principal{id: id, name: name, role: RoleWrite}
+	}
+	return principal{}
+}
+
+// Require API keys from now on, replacing the previous ones
+func (s *Server) SetAPIKeys(keys APIKeys) {
+	s.apiKeys.Store(&keys)
+}
+
+// Accept bearer tokens checked by v from now on, nil stops accepting them
+func (s *Server) SetJWT(v *JWTValidator) {
+	s.jwt.Store(v)
+}
+
+// Check if requests must carry an API key or token
+func (s *Server) authEnabled() bool {
+	keys := s.apiKeys.Load()
+	return (keys != nil && keys.Enabled()) || s.jwt.Load() != nil
+}
+
+// Find who sent a request from its X-API-Key or Authorization: Bearer header
+// ADMIN_TOKEN is accepted as a bearer token with the admin role
+func (s *Server) authenticate(r *http.Request) (principal, error) {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		if keys := s.apiKeys.Load(); keys != nil {
+			if p := keys.principal(key); p.role != "" {
+				return p, nil
+			}
+		}
+		return principal{}, errors.New("invalid API key")
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return principal{}, errors.New("missing API key or bearer token")
+	}
+	if s.admin != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.admin)) == 1 {
+		return principal{id: "admin_token", role: RoleAdmin}, nil
+	}
+	v := s.jwt.Load()
+	if v == nil {
+		return principal{}, errors.New("invalid bearer token")
+	}
+	role, subject, err := v.Validate(token, time.Now())
+	if err != nil {
+		return principal{}, fmt.Errorf("invalid bearer token - %w", err)
+	}
+	return principal{id: tokenID(token, subject), name: subject, role: role}, nil
+}
+
+// Identity of a token, its subject if it has one
+func tokenID(token string, subject string) string {
+	if subject != "" {
+		return "sub:" + subject
+	}
+	digest := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(digest[:8])
+}
+
+// Middleware requiring an API key or bearer token once either is configured,
+// checking that its role may call the route and the ACLs allow the keys it names
+func (s *Server) AuthHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		need := requiredRole(unversioned(r.URL.Path))
+		if need == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !s.authEnabled() {
+			if s.throttleCheck(w, "principal", principalID(principal{}, clientIP(r.RemoteAddr))) {
+				next.ServeHTTP(w, r)
+			}
+			return
+		}
+		p, err := s.authenticate(r)
+		if err != nil {
+			authRejected.Add(1)
+			h.WriteError(w, http.StatusUnauthorized, h.CodeUnauthorized, "Unauthorized - "+err.Error(), "")
+			return
+		}
+		if roleRank[p.role] < roleRank[need] {
+			authRejected.Add(1)
+			h.WriteError(w, http.StatusForbidden, h.CodeUnauthorized, "Role "+p.role+" can't call this endpoint, it needs "+need, "")
+			return
+		}
+		if !s.aclCheck(w, r, p, need) || !s.throttleCheck(w, "principal", p.id) {
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// Principal of the key or token a RESP client sent with AUTH, admin if none are configured
+// Its role is empty if the credential is invalid
+func (s *Server) respPrincipal(credential string) principal {
+	if !s.authEnabled() {
+		return principal{role: RoleAdmin}
+	}
+	if keys := s.apiKeys.Load(); keys != nil {
+		if p := keys.principal(credential); p.role != "" {
+			return p
+		}
+	}
+	if v := s.jwt.Load(); v != nil {
+		if role, subject, err := v.Validate(credential, time.Now()); err == nil {
+			return principal{id: tokenID(credential, subject), name: subject, role: role}
+		}
+	}
+	return principal{}
+}
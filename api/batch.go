@@ -0,0 +1,149 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	h "gokv/helper"
+	"gokv/storage"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Save multiple key-value pairs with a single WAL append
+// POST body is either {"k1": "v1", ...} or [{"key": "k1", "value": "v1"}, ...]
+func (s *Server) MSetRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+
+	if !s.writable(w) {
+		return
+	}
+
+	// Read request body
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidBody, "Invalid request body", "")
+		return
+	}
+
+	// Decode either form into pairs
+	pairs := make(map[string]string)
+	if b = bytes.TrimSpace(b); len(b) > 0 && b[0] == '[' {
+		var list []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		}
+		if err := json.Unmarshal(b, &list); err != nil {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidBody, "Invalid request body", "")
+			return
+		}
+		for _, p := range list {
+			pairs[p.Key] = p.Value
+		}
+	} else if err := json.Unmarshal(b, &pairs); err != nil {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidBody, "Invalid request body", "")
+		return
+	}
+	// Keys that only differ before normalization would leave the value kept to map order
+	normalized := make(map[string]string, len(pairs))
+	for k, v := range pairs {
+		key := s.key(k)
+		if _, dup := normalized[key]; dup {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidBody, "Keys are the same once normalized", key)
+			return
+		}
+		normalized[key] = v
+	}
+	pairs = normalized
+	if len(pairs) == 0 {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidBody, "No key-value pairs given", "")
+		return
+	}
+
+	// Validate every pair before writing anything
+	keys := make([]string, 0, len(pairs))
+	values := make([]string, 0, len(pairs))
+	for k, v := range pairs {
+		if k == "" {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidBody, "Empty key", "")
+			return
+		}
+		if msg := s.validatePair(k, v); msg != "" {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidBody, msg, k)
+			return
+		}
+		keys = append(keys, k)
+		values = append(values, v)
+	}
+	sizes := make(map[string]int, len(pairs))
+	for k, v := range pairs {
+		sizes[k] = len(v)
+	}
+	if !s.unfrozen(w, keys...) {
+		return
+	}
+	s.measureQuotas(keys...)
+	setRequests.Add(int64(len(pairs)))
+
+	// Save all pairs to storage, checked against quotas and logged under the map lock
+	// so neither a concurrent write nor a flushall can slip in between
+	ops := make([]storage.TxnOp, len(keys))
+	for i, k := range keys {
+		ops[i] = storage.TxnOp{Op: "SET", Key: k, Value: values[i]}
+	}
+	err = s.mp.Transact(func(func(string) (string, bool), func(string) time.Time, func(string) storage.KeyMeta) ([]storage.TxnOp, error) {
+		if err := s.checkQuota(sizes); err != nil {
+			return nil, err
+		}
+		if err := s.log.UpdateLogBatch("SET", keys, values); err != nil {
+			return nil, err
+		}
+		return ops, nil
+	})
+	if err != nil {
+		writeModifyError(w, "", err)
+		return
+	}
+	h.WriteJSON(w, http.StatusOK, map[string]any{"message": "Keys saved", "count": len(pairs)})
+}
+
+// Fetch multiple values at once
+// GET /mget?key=k1&key=k2, or POST with body ["k1", "k2"]
+func (s *Server) MGetRequest(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+	if r.Method == "GET" {
+		keys = r.URL.Query()["key"]
+	} else if r.Method == "POST" {
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&keys)
+		if err != nil {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidBody, "Invalid request body", "")
+			return
+		}
+	} else {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	if len(keys) == 0 {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key parameter", "")
+		return
+	}
+	for i := range keys {
+		keys[i] = s.key(keys[i])
+	}
+	getRequests.Add(int64(len(keys)))
+
+	// Split keys into found values and missing keys
+	values := make(map[string]string)
+	missing := []string{}
+	for _, k := range keys {
+		if v := s.read(k); v != "" {
+			values[k] = v
+		} else {
+			missing = append(missing, k)
+		}
+	}
+	h.WriteJSON(w, http.StatusOK, map[string]any{"values": values, "missing": missing})
+}
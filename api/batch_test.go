@@ -0,0 +1,42 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gokv/api"
+)
+
+// Keys of a batch that are the same once normalized are refused instead of one winning at random
+func TestMSetNormalizedCollision(t *testing.T) {
+	srv := newServer()
+	policy, err := api.ParseKeyPolicy("user=lower")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.SetKeyPolicy(policy)
+	mset := func(body string) int {
+		w := httptest.NewRecorder()
+		srv.MSetRequest(w, httptest.NewRequest("POST", "/mset", strings.NewReader(body)))
+		return w.Code
+	}
+
+	for _, body := range []string{
+		`{"User:A": "1", "user:a": "2"}`,
+		`[{"key": "user:a", "value": "1"}, {"key": "USER:A", "value": "2"}]`,
+	} {
+		if code := mset(body); code != http.StatusBadRequest {
+			t.Fatalf("%s got %d, want 400", body, code)
+		}
+	}
+	w := httptest.NewRecorder()
+	srv.GetRequest(w, httptest.NewRequest("GET", "/get?key=user:a", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("refused batch wrote user:a, got %d: %s", w.Code, w.Body)
+	}
+	if code := mset(`{"User:A": "1", "user:b": "2"}`); code != http.StatusOK {
+		t.Fatalf("batch without collisions got %d, want 200", code)
+	}
+}
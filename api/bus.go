@@ -0,0 +1,59 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	h "gokv/helper"
+	"log"
+	"net/http"
+	"slices"
+)
+
+// Topics that can be streamed from the internal event bus
+var busTopics = []string{h.TopicKeyMutated, h.TopicEntryCommitted, h.TopicPeerState, h.TopicLifecycle}
+
+// Report internal event bus subscribers and counters, or stream one topic as Server-Sent Events
+// Meant for debugging how subsystems talk to each other
+// GET /admin/bus[?topic=<topic>]
+func (s *Server) BusRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		h.WriteJSON(w, http.StatusOK, h.BusStats())
+		return
+	} else if !slices.Contains(busTopics, topic) {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Unknown topic", "")
+		return
+	}
+
+	ch, stop := h.Subscribe(topic, "admin_stream "+r.RemoteAddr)
+	defer stop()
+
+	rc := http.NewResponseController(w)
+	openEnded(rc)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Println("Could not stream events - ", err)
+		return
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-ch:
+			data, _ := json.Marshal(ev)
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"expvar"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Default of COMPRESS_MIN_BYTES, smaller responses aren't worth compressing
+const DefaultCompressMinBytes = 1024
+
+// Responses compressed by encoding, and their sizes before and after
+var compression = expvar.NewMap("compression")
+
+// Encoders reused across responses, they hold large buffers
+var (
+	gzipPool = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+	zstdPool = sync.Pool{New: func() any {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		return enc
+	}}
+)
+
+// Compress responses of at least minBytes from now on, or stop compressing them
+func (s *Server) SetCompression(enabled bool, minBytes int) {
+	if !enabled {
+		minBytes = 0
+	} else if minBytes < 1 {
+		minBytes = 1
+	}
+	s.compressMin.Store(int64(minBytes))
+}
+
+// Preferred encoding a client accepts, "zstd", "gzip" or empty
+// zstd wins over gzip when both have the same quality
+func negotiateEncoding(accept string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if (name == "zstd" || name == "gzip") && (q > bestQ || q == bestQ && name == "zstd") && q > 0 {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// Response writer holding back the first bytes until it knows if the response is large enough to compress
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	min      int
+	status   int
+	buf      bytes.Buffer
+	decided  bool
+	enc      io.WriteCloser // Encoder once the response is compressed
+	size     int64          // Bytes before compression
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.status == 0 && status >= 200 {
+		c.status = status
+	}
+	if status < 200 {
+		c.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	c.size += int64(len(b))
+	if !c.decided {
+		c.buf.Write(b)
+		if c.buf.Len() < c.min {
+			return len(b), nil
+		}
+		if err := c.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if c.enc != nil {
+		return c.enc.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// Send the headers, compressing the rest of the response if asked to and nothing rules it out,
+// then write what was held back
+func (c *compressWriter) decide(compress bool) error {
+	c.decided = true
+	header := c.ResponseWriter.Header()
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if compress && header.Get("Content-Encoding") == "" && c.status != http.StatusNoContent && c.status != http.StatusNotModified {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", c.encoding)
+		if c.encoding == "zstd" {
+			enc := zstdPool.Get().(*zstd.Encoder)
+			enc.Reset(c.ResponseWriter)
+			c.enc = enc
+		} else {
+			enc := gzipPool.Get().(*gzip.Writer)
+			enc.Reset(c.ResponseWriter)
+			c.enc = enc
+		}
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+	if c.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if c.enc != nil {
+		_, err = c.enc.Write(c.buf.Bytes())
+	} else {
+		_, err = c.ResponseWriter.Write(c.buf.Bytes())
+	}
+	c.buf = bytes.Buffer{}
+	return err
+}
+
+// Send what is held back, a response flushed before reaching the threshold is sent uncompressed
+func (c *compressWriter) FlushError() error {
+	if !c.decided {
+		if err := c.decide(false); err != nil {
+			return err
+		}
+	}
+	if enc, ok := c.enc.(interface{ Flush() error }); ok {
+		if err := enc.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+func (c *compressWriter) Flush() {
+	c.FlushError()
+}
+
+// Expose wrapped writer to http.ResponseController, e.g. for deadlines
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// Finish the response, returning the encoder to its pool
+func (c *compressWriter) close() {
+	if !c.decided {
+		if c.status == 0 { // The handler wrote nothing, e.g. it hijacked the connection
+			return
+		}
+		c.decide(false)
+	}
+	if c.enc == nil {
+		return
+	}
+	c.enc.Close()
+	if enc, ok := c.enc.(*zstd.Encoder); ok {
+		enc.Reset(nil)
+		zstdPool.Put(enc)
+	} else {
+		gz := c.enc.(*gzip.Writer)
+		gz.Reset(nil)
+		gzipPool.Put(gz)
+	}
+	compression.Add(c.encoding, 1)
+	compression.Add("bytes_in", c.size)
+}
+
+// Writer counting bytes sent on the wire, behind the encoder
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// Middleware compressing responses of at least COMPRESS_MIN_BYTES with zstd or gzip, as Accept-Encoding allows
+// HEAD requests and WebSocket upgrades are left alone
+func (s *Server) CompressHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		minBytes := int(s.compressMin.Load())
+		if minBytes == 0 || r.Method == "HEAD" || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		wire := &countingWriter{ResponseWriter: w}
+		cw := &compressWriter{ResponseWriter: wire, encoding: encoding, min: minBytes}
+		defer func() {
+			cw.close()
+			if cw.enc != nil {
+				compression.Add("bytes_out", wire.n)
+			}
+		}()
+		next.ServeHTTP(cw, r)
+	})
+}
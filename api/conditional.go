@@ -0,0 +1,32 @@
+package api
+
+import (
+	h "gokv/helper"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Failed If-Match precondition
+var errPrecondition = &requestError{http.StatusPreconditionFailed, h.CodePrecondition, "Key value does not match If-Match"}
+
+// ETag of a value, its SHA-256 as reported by /history
+// Derived from the content, so it survives restarts and a key deleted and recreated with the same value keeps it
+func etag(value string) string {
+	return strconv.Quote(valueHash(value))
+}
+
+// Check an If-Match header against the current value of a key
+// "*" matches any existing key, otherwise one of the listed ETags must be the value's
+func ifMatch(header string, value string, exists bool) bool {
+	if !exists {
+		return false
+	}
+	current := etag(value)
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == current {
+			return true
+		}
+	}
+	return false
+}
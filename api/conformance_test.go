@@ -0,0 +1,219 @@
+package api_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gokv/api"
+	"gokv/storage"
+	"gokv/storage/conformance"
+	"gokv/storage/storagetest"
+)
+
+// Node with a fresh map and log, not attached to a database or cluster
+func newServer() *api.Server {
+	return api.New(storage.InitMap(), storagetest.NewLog())
+}
+
+func TestHTTPConformance(t *testing.T) {
+	mux := http.NewServeMux()
+	api.Register(mux, newServer().Routes())
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	if err := conformance.TestFrontend(httpClient{ts.URL}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRESPConformance(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go newServer().ServeRESP(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conformance.TestFrontend(&respClient{conn: conn, r: bufio.NewReader(conn)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Client of the HTTP API, implementing every optional conformance interface
+type httpClient struct {
+	url string
+}
+
+// Send a request and decode its JSON body into out, unless out is nil
+// Returns the status, statuses other than 200 come with an error
+func (c httpClient) do(method string, path string, query url.Values, body []byte, out any) (int, error) {
+	req, err := http.NewRequest(method, c.url+path+"?"+query.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("%s %s answered %d: %s", method, path, resp.StatusCode, b)
+	}
+	if out != nil {
+		return resp.StatusCode, json.Unmarshal(b, out)
+	}
+	return resp.StatusCode, nil
+}
+
+func (c httpClient) Set(key string, value string) error {
+	_, err := c.do("GET", "/set", url.Values{"key": {key}, "value": {value}}, nil, nil)
+	return err
+}
+
+func (c httpClient) Get(key string) (string, bool, error) {
+	var body struct {
+		Message string `json:"message"`
+	}
+	status, err := c.do("GET", "/get", url.Values{"key": {key}}, nil, &body)
+	if status == http.StatusNotFound {
+		return "", false, nil
+	}
+	return body.Message, err == nil, err
+}
+
+func (c httpClient) Delete(key string) error {
+	_, err := c.do("GET", "/delete", url.Values{"key": {key}}, nil, nil)
+	return err
+}
+
+func (c httpClient) Incr(key string) (int64, error) {
+	var body struct {
+		Message string `json:"message"`
+	}
+	if _, err := c.do("GET", "/incr", url.Values{"key": {key}}, nil, &body); err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(body.Message, 10, 64)
+}
+
+func (c httpClient) SetMany(pairs map[string]string) error {
+	body, err := json.Marshal(pairs)
+	if err != nil {
+		return err
+	}
+	_, err = c.do("POST", "/mset", nil, body, nil)
+	return err
+}
+
+func (c httpClient) CompareAndSwap(key string, old string, exists bool, value string) (bool, error) {
+	query := url.Values{"key": {key}, "value": {value}}
+	if exists {
+		query.Set("old", old)
+	}
+	status, err := c.do("GET", "/cas", query, nil, nil)
+	if status == http.StatusConflict {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (c httpClient) SetTTL(key string, value string, ttl time.Duration) error {
+	_, err := c.do("GET", "/set", url.Values{"key": {key}, "value": {value}, "ttl": {ttl.String()}}, nil, nil)
+	return err
+}
+
+func (c httpClient) TTL(key string) (time.Duration, bool, error) {
+	var body struct {
+		TTL int64 `json:"ttl"`
+	}
+	if _, err := c.do("GET", "/ttl", url.Values{"key": {key}}, nil, &body); err != nil || body.TTL < 0 {
+		return 0, false, err
+	}
+	return time.Duration(body.TTL) * time.Second, true, nil
+}
+
+// Client of the RESP front-end over one connection, commands are sent one at a time
+type respClient struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	mutex sync.Mutex
+}
+
+// Send a command and read its reply, without the type prefix
+// Error replies are returned as errors, a null bulk string as found false
+func (c *respClient) do(args ...string) (string, bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, sb.String()); err != nil {
+		return "", false, err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", false, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch {
+	case line == "$-1":
+		return "", false, nil
+	case strings.HasPrefix(line, "-"):
+		return "", false, errors.New(line[1:])
+	case strings.HasPrefix(line, "$"):
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", false, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return "", false, err
+		}
+		return string(buf[:n]), true, nil
+	}
+	return line[1:], true, nil
+}
+
+func (c *respClient) Set(key string, value string) error {
+	_, _, err := c.do("SET", key, value)
+	return err
+}
+
+func (c *respClient) Get(key string) (string, bool, error) {
+	return c.do("GET", key)
+}
+
+func (c *respClient) Delete(key string) error {
+	_, _, err := c.do("DEL", key)
+	return err
+}
+
+func (c *respClient) Incr(key string) (int64, error) {
+	reply, _, err := c.do("INCR", key)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(reply, 10, 64)
+}
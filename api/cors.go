@@ -0,0 +1,110 @@
+package api
+
+import (
+	"fmt"
+	h "gokv/helper"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Defaults of CORS_METHODS and CORS_HEADERS
+const (
+	defaultCORSMethods = "GET, POST, PUT, DELETE"
+	defaultCORSHeaders = "Content-Type, Authorization, X-API-Key, X-Request-ID, X-Priority, If-Match"
+)
+
+// Response headers scripts on other origins may read
+const corsExposedHeaders = "X-Request-ID, ETag, Retry-After, X-GoKV-Warning"
+
+// How long browsers may cache a preflight response, in seconds
+const corsMaxAge = "600"
+
+// Origins allowed to call the API from a browser, with the methods and headers they may use
+type CORS struct {
+	origins []string // Exact origins, "*" or origins with a "*." wildcard subdomain
+	methods string
+	headers string
+}
+
+// Parse comma separated origins such as "https://dash.example.com,https://*.example.com" or "*"
+// Empty methods and headers take the defaults, returns nil without origins
+func ParseCORS(origins string, methods string, headers string) (*CORS, error) {
+	c := &CORS{methods: defaultCORSMethods, headers: defaultCORSHeaders}
+	for _, origin := range strings.Split(origins, ",") {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		if origin == "" {
+			continue
+		}
+		if origin != "*" {
+			u, err := url.Parse(strings.Replace(origin, "*.", "", 1))
+			if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+				return nil, fmt.Errorf("invalid origin %q", origin)
+			}
+		}
+		c.origins = append(c.origins, origin)
+	}
+	if len(c.origins) == 0 {
+		return nil, nil
+	}
+	if methods != "" {
+		c.methods = methods
+	}
+	if headers != "" {
+		c.headers = headers
+	}
+	return c, nil
+}
+
+// Check if an Origin header matches an allowed origin
+func (c *CORS) allows(origin string) bool {
+	if slices.Contains(c.origins, "*") || slices.Contains(c.origins, origin) {
+		return true
+	}
+	for _, allowed := range c.origins {
+		scheme, host, ok := strings.Cut(allowed, "://*.")
+		if ok && strings.HasPrefix(origin, scheme+"://") && strings.HasSuffix(origin, "."+host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow browsers on other origins to call the API from now on, nil stops allowing them
+func (s *Server) SetCORS(c *CORS) {
+	s.cors.Store(c)
+}
+
+// Middleware adding CORS headers for allowed origins and answering their preflight requests
+// Preflights are answered before authentication, since browsers send them without credentials
+func (s *Server) CORSHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := s.cors.Load()
+		origin := r.Header.Get("Origin")
+		if c == nil || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+		w.Header().Add("Vary", "Origin")
+		if !c.allows(origin) {
+			if preflight {
+				h.WriteError(w, http.StatusForbidden, h.CodeUnauthorized, "Origin "+origin+" isn't allowed", "")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", c.methods)
+		w.Header().Set("Access-Control-Allow-Headers", c.headers)
+		w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
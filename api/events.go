@@ -0,0 +1,324 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	h "gokv/helper"
+	"gokv/storage"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Events a subscriber can buffer before further events to it are dropped
+const eventBuffer = 256
+
+// Events dropped because a subscriber fell behind
+var eventsDropped = expvar.NewInt("events_dropped")
+
+// Keyspace change published on the notification bus
+type Event struct {
+	Type  string    `json:"type"` // "set", "delete" or "expire"
+	Key   string    `json:"key"`
+	Value string    `json:"value,omitempty"`
+	At    time.Time `json:"at"`
+}
+
+// Notification bus, each subscriber gets events for keys under its prefix
+type events struct {
+	subs  map[chan Event]*subscriber                 // Channel of a subscriber -> what it wants
+	track func(typ string, key string, value string) // Called with every event before it is delivered
+	mutex sync.Mutex                                 // Manage access to shared resources
+}
+
+// Subscriber of the notification bus
+type subscriber struct {
+	prefix  string // Only events for keys starting with it are delivered
+	dropped int    // Events dropped since the subscriber was last told
+}
+
+// Subscribe to events for keys starting with prefix
+func (e *events) subscribe(prefix string) chan Event {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.subs == nil {
+		e.subs = make(map[chan Event]*subscriber)
+	}
+	ch := make(chan Event, eventBuffer)
+	e.subs[ch] = &subscriber{prefix: prefix}
+	return ch
+}
+
+// Events dropped for a subscriber since the last call, so it can tell its client
+func (e *events) dropped(ch chan Event) int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	sub, ok := e.subs[ch]
+	if !ok {
+		return 0
+	}
+	n := sub.dropped
+	sub.dropped = 0
+	return n
+}
+
+// Stop delivering events to a subscriber and close its channel
+func (e *events) unsubscribe(ch chan Event) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	delete(e.subs, ch)
+	close(ch)
+}
+
+// Deliver a change of the map to every matching subscriber without blocking
+// Also published on the internal bus for other subsystems
+// Watches the map, so runs under its lock and events of a key are delivered in the order they were applied
+func (e *events) publish(c storage.Change) {
+	ev := Event{Type: c.Type, Key: c.Key, Value: c.Value, At: time.Now()}
+	if e.track != nil {
+		e.track(c.Type, c.Key, c.Value)
+	}
+	h.Publish(h.BusEvent{Topic: h.TopicKeyMutated, Type: c.Type, Key: c.Key, Value: c.Value, At: ev.At})
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for ch, sub := range e.subs {
+		if !strings.HasPrefix(c.Key, sub.prefix) {
+			continue
+		}
+		select {
+		case ch <- ev:
+		default:
+			sub.dropped++
+			eventsDropped.Add(1)
+		}
+	}
+}
+
+// Attempts to deliver a batch to a webhook before it is dropped
+const webhookAttempts = 5
+
+// Gather up to size matching events, waiting at most delay after the first one
+// With no delay only events already queued are added to the batch
+// Returns false once ch is closed or done is closed
+func collect[E any](ch <-chan E, done <-chan struct{}, match func(E) bool, size int, delay time.Duration) ([]E, bool) {
+	var batch []E
+	var timeout <-chan time.Time
+	for len(batch) < size {
+		if len(batch) > 0 && delay <= 0 {
+			select {
+			case ev, ok := <-ch:
+				if !ok {
+					return batch, false
+				}
+				if match(ev) {
+					batch = append(batch, ev)
+				}
+				continue
+			default:
+				return batch, true
+			}
+		}
+		select {
+		case <-done:
+			return batch, false
+		case <-timeout:
+			return batch, true
+		case ev, ok := <-ch:
+			if !ok {
+				return batch, false
+			}
+			if !match(ev) {
+				continue
+			}
+			if len(batch) == 0 && delay > 0 {
+				timer := time.NewTimer(delay)
+				defer timer.Stop()
+				timeout = timer.C
+			}
+			batch = append(batch, ev)
+		}
+	}
+	return batch, true
+}
+
+// Batches waiting for the webhook, further batches are dropped
+const webhookQueue = 64
+
+// Batch of events posted to a webhook
+type webhookBatch struct {
+	Batch   int64   `json:"batch"`
+	Events  []Event `json:"events"`
+	Dropped int64   `json:"dropped,omitempty"` // Events lost since the previous batch, the consumer should resync
+}
+
+// Name the webhook forwarder subscribes to the internal bus with
+const webhookSubscriber = "event_webhook"
+
+// Post delete and expire events in batches to a webhook until ctx is done
+// A batch is acknowledged by a 2xx response, otherwise it is retried with the
+// same sequence number so the consumer can drop duplicates
+// Batches are queued and sent one at a time by a worker, keeping events in order
+// while a slow webhook holds up neither the bus nor writes
+// Events that never reach the webhook, because the bus or the queue was full or
+// a batch ran out of attempts, are counted in the dropped field of the next batch
+// Does nothing if url is empty
+func (s *Server) ForwardEvents(ctx context.Context, url string, size int, delay time.Duration) error {
+	if url == "" {
+		return nil
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	var lost atomic.Int64 // Events dropped and not yet reported to the webhook
+	queue := make(chan webhookBatch, webhookQueue)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for b := range queue {
+			b.Dropped = lost.Swap(0)
+			if !deliver(client, url, b) {
+				lost.Add(b.Dropped + int64(len(b.Events)))
+			}
+		}
+	}()
+	defer func() {
+		close(queue)
+		<-done
+	}()
+
+	ch, stop := h.Subscribe(h.TopicKeyMutated, webhookSubscriber)
+	defer stop()
+	seen := h.Dropped(webhookSubscriber)
+	notSet := func(ev h.BusEvent) bool { return ev.Type != "set" }
+	for seq := int64(1); ; seq++ {
+		batch, ok := collect(ch, ctx.Done(), notSet, size, delay)
+		if n := h.Dropped(webhookSubscriber); n > seen { // Includes sets, which the webhook wouldn't get anyway
+			lost.Add(n - seen)
+			seen = n
+		}
+		if len(batch) > 0 {
+			events := make([]Event, len(batch))
+			for i, ev := range batch {
+				events[i] = Event{Type: ev.Type, Key: ev.Key, At: ev.At}
+			}
+			select {
+			case queue <- webhookBatch{Batch: seq, Events: events}:
+			default:
+				log.Println("Could not send events - ", "webhook queue full")
+				eventsDropped.Add(int64(len(batch)))
+				lost.Add(int64(len(batch)))
+			}
+		}
+		if !ok {
+			return nil
+		}
+	}
+}
+
+// Post a batch to a webhook, retrying with backoff until it is acknowledged
+// Returns false if every attempt failed
+func deliver(client *http.Client, url string, b webhookBatch) bool {
+	body, _ := json.Marshal(b)
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return true
+			}
+			err = errors.New(resp.Status)
+		}
+		if attempt == webhookAttempts {
+			log.Println("Could not send events - ", err)
+			eventsDropped.Add(int64(len(b.Events)))
+			return false
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Stream changes to a key, or every key under a prefix, as Server-Sent Events
+// GET /watch?key=<key> or /watch?prefix=<prefix>
+// With batch_size, events are sent as arrays of up to that many events,
+// waiting at most max_delay (e.g. "100ms") to fill a batch
+// Events dropped because the client fell behind are announced by a dropped event
+func (s *Server) WatchRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+
+	key := s.key(r.URL.Query().Get("key"))
+	prefix := s.prefix(r.URL.Query().Get("prefix"))
+	if key == "" && prefix == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key or prefix parameter", "")
+		return
+	} else if key != "" {
+		prefix = key
+	}
+	size, delay := 1, time.Duration(0)
+	batched := r.URL.Query().Has("batch_size")
+	if batched {
+		var err error
+		size, err = strconv.Atoi(r.URL.Query().Get("batch_size"))
+		if err != nil || size <= 0 {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Invalid batch size", "")
+			return
+		}
+		if v := r.URL.Query().Get("max_delay"); v != "" {
+			delay, err = time.ParseDuration(v)
+			if err != nil || delay < 0 {
+				h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Invalid max delay", "")
+				return
+			}
+		}
+	}
+
+	ch := s.events.subscribe(prefix)
+	defer s.events.unsubscribe(ch)
+
+	rc := http.NewResponseController(w)
+	openEnded(rc)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Println("Could not stream events - ", err)
+		return
+	}
+
+	match := func(ev Event) bool { return key == "" || ev.Key == key }
+	for {
+		batch, ok := collect(ch, r.Context().Done(), match, size, delay)
+		if !ok {
+			return
+		}
+		if n := s.events.dropped(ch); n > 0 {
+			if _, err := fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", n); err != nil {
+				return
+			}
+		}
+		var err error
+		if batched {
+			data, _ := json.Marshal(batch)
+			_, err = fmt.Fprintf(w, "event: batch\ndata: %s\n\n", data)
+		} else {
+			data, _ := json.Marshal(batch[0])
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", batch[0].Type, data)
+		}
+		if err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
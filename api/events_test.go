@@ -0,0 +1,110 @@
+package api_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gokv/api"
+	h "gokv/helper"
+)
+
+// Events of a key written concurrently arrive in the order the writes were applied
+func TestWatchOrder(t *testing.T) {
+	mux := http.NewServeMux()
+	api.Register(mux, newServer().Routes())
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/watch?key=n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	const writers, increments = 4, 25
+	var wg sync.WaitGroup
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range increments {
+				if resp, err := http.Get(ts.URL + "/incr?key=n"); err == nil {
+					resp.Body.Close()
+				}
+			}
+		}()
+	}
+
+	r := bufio.NewReader(resp.Body)
+	for want := 1; want <= writers*increments; {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, ok := strings.CutPrefix(strings.TrimSpace(line), "data: ")
+		if !ok {
+			continue
+		}
+		var ev api.Event
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Value != strconv.Itoa(want) {
+			t.Fatalf("event %d carries %q", want, ev.Value)
+		}
+		want++
+	}
+	wg.Wait()
+}
+
+// Events of a batch the webhook never acknowledged are reported with the next batch
+func TestWebhookReportsDropped(t *testing.T) {
+	received := make(chan map[string]any, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["batch"] == 1.0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		received <- body
+	}))
+	defer hook.Close()
+
+	srv := newServer()
+	mux := http.NewServeMux()
+	api.Register(mux, srv.Routes())
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.ForwardEvents(ctx, hook.URL, 1, 0)
+	for !h.Listening(h.TopicKeyMutated) {
+		time.Sleep(time.Millisecond)
+	}
+	for _, path := range []string{"/set?key=a&value=1", "/delete?key=a", "/set?key=b&value=1", "/delete?key=b"} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	select {
+	case body := <-received:
+		if body["batch"] != 2.0 || body["dropped"] != 1.0 {
+			t.Fatalf("got batch %v reporting %v dropped, want batch 2 reporting 1", body["batch"], body["dropped"])
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no batch received")
+	}
+}
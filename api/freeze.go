@@ -0,0 +1,158 @@
+package api
+
+import (
+	"context"
+	h "gokv/helper"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default duration of a freeze
+const defaultFreezeTTL = 15 * time.Minute
+
+// Key prefixes whose writes are temporarily rejected
+type freezes struct {
+	until map[string]time.Time // Prefix -> expiry of freeze
+	mutex sync.RWMutex
+}
+
+// Freeze writes to prefix for ttl
+func (f *freezes) add(prefix string, ttl time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.until == nil {
+		f.until = make(map[string]time.Time)
+	}
+	f.until[prefix] = time.Now().Add(ttl)
+}
+
+// Lift freeze on prefix
+func (f *freezes) remove(prefix string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.until, prefix)
+}
+
+// Find an active freeze covering key, returns false if there is none
+func (f *freezes) covering(key string) (string, bool) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	now := time.Now()
+	for prefix, until := range f.until {
+		if now.Before(until) && strings.HasPrefix(key, prefix) {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+// Active freezes with their remaining duration
+func (f *freezes) active() map[string]string {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	now := time.Now()
+	list := make(map[string]string)
+	for prefix, until := range f.until {
+		if now.Before(until) {
+			list[prefix] = until.Sub(now).Round(time.Second).String()
+		}
+	}
+	return list
+}
+
+// Check that no key is frozen, responds with an error if one is
+func (s *Server) unfrozen(w http.ResponseWriter, keys ...string) bool {
+	for _, k := range keys {
+		if prefix, ok := s.freezes.covering(k); ok {
+			h.WriteError(w, http.StatusLocked, h.CodeFrozen, "Writes to prefix are frozen - "+prefix, k)
+			return false
+		}
+	}
+	return true
+}
+
+// Freeze or unfreeze writes to a prefix on this node
+// Returns false after responding with an error if the request is invalid
+func (s *Server) applyFreeze(w http.ResponseWriter, r *http.Request, freeze bool) bool {
+	if r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return false
+	}
+
+	prefix := s.prefix(r.URL.Query().Get("prefix"))
+	if prefix == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing prefix parameter", "")
+		return false
+	}
+	if !freeze {
+		s.freezes.remove(prefix)
+		return true
+	}
+
+	ttl := defaultFreezeTTL
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Invalid ttl", "")
+			return false
+		}
+		ttl = d
+	}
+	s.freezes.add(prefix, ttl)
+	return true
+}
+
+// Temporarily reject writes to a prefix across the cluster, reads are still allowed
+// POST /admin/freeze?prefix=<prefix>&ttl=<duration>
+func (s *Server) FreezeRequest(w http.ResponseWriter, r *http.Request) {
+	if !s.applyFreeze(w, r, true) {
+		return
+	}
+	s.broadcast(w, r, "/internal/freeze?"+r.URL.RawQuery, "Prefix frozen")
+}
+
+// Lift a freeze across the cluster
+// POST /admin/unfreeze?prefix=<prefix>
+func (s *Server) UnfreezeRequest(w http.ResponseWriter, r *http.Request) {
+	if !s.applyFreeze(w, r, false) {
+		return
+	}
+	s.broadcast(w, r, "/internal/unfreeze?"+r.URL.RawQuery, "Prefix unfrozen")
+}
+
+// List active freezes
+// GET /admin/freezes
+func (s *Server) FreezesRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	h.WriteJSON(w, http.StatusOK, s.freezes.active())
+}
+
+// Freeze a prefix on request of another node
+func (s *Server) InternalFreezeRequest(w http.ResponseWriter, r *http.Request) {
+	if s.applyFreeze(w, r, true) {
+		h.WriteResponse(w, http.StatusOK, "OK")
+	}
+}
+
+// Unfreeze a prefix on request of another node
+func (s *Server) InternalUnfreezeRequest(w http.ResponseWriter, r *http.Request) {
+	if s.applyFreeze(w, r, false) {
+		h.WriteResponse(w, http.StatusOK, "OK")
+	}
+}
+
+// Forward an admin change to every other node and report nodes that missed it
+// The change already applies here, so it is forwarded even if the client goes away,
+// and each node is given PEER_TIMEOUT to accept it
+func (s *Server) broadcast(w http.ResponseWriter, r *http.Request, path string, message string) {
+	failed := []string{}
+	if s.nodes != nil {
+		failed = s.nodes.Broadcast(context.WithoutCancel(r.Context()), path, nil)
+	}
+	h.WriteJSON(w, http.StatusOK, map[string]any{"message": message, "failed_nodes": failed})
+}
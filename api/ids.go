@@ -0,0 +1,196 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	h "gokv/helper"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Number of IDs a node reserves at once
+const idBlockSize = 1000
+
+// Per-node allocator of cluster-unique IDs
+// Global blocks of IDs are striped across nodes by their place in the cluster file.
+// Each node persists a high-water mark per sequence, the first block no node is known to have reserved,
+// and reserves the next block of its stripe above the highest mark among itself and its peers,
+// so blocks are never reused when the cluster grows, shrinks or restarts.
+// IDs increase monotonically per node and sequence
+type idAllocator struct {
+	high      map[string]int64 // Sequence -> high-water mark in blocks, persisted
+	highMutex sync.Mutex       // Guards high, never held while talking to peers
+	next      map[string]int64 // Sequence -> next ID to hand out
+	end       map[string]int64 // Sequence -> end of current block (exclusive)
+	mutex     sync.Mutex       // Serializes handing out IDs and reserving blocks
+}
+
+// On-disk form of the high-water marks
+type idMarks struct {
+	High map[string]int64 `json:"high"`
+}
+
+// Load high-water marks so restarts never reuse a block, highMutex must be held
+// Files from before high-water marks held the number of blocks reserved by this node,
+// size turns them into a mark past each of them
+func (a *idAllocator) load(size int) error {
+	if a.high != nil {
+		return nil
+	}
+	b, err := os.ReadFile(h.IDsPath())
+	if os.IsNotExist(err) {
+		a.high = make(map[string]int64)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var marks idMarks
+	if err := json.Unmarshal(b, &marks); err == nil && marks.High != nil {
+		a.high = marks.High
+		return nil
+	}
+	var blocks map[string]int64
+	if err := json.Unmarshal(b, &blocks); err != nil {
+		return err
+	}
+	a.high = make(map[string]int64, len(blocks))
+	for sequence, k := range blocks {
+		a.high[sequence] = k * int64(size)
+	}
+	return nil
+}
+
+// Persist high-water marks, highMutex must be held
+func (a *idAllocator) save() error {
+	b, err := json.Marshal(idMarks{High: a.high})
+	if err != nil {
+		return err
+	}
+	tmp := h.IDsPath() + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.IDsPath())
+}
+
+// High-water mark of a sequence on this node
+func (a *idAllocator) highWater(sequence string, size int) (int64, error) {
+	a.highMutex.Lock()
+	defer a.highMutex.Unlock()
+	if err := a.load(size); err != nil {
+		return 0, err
+	}
+	return a.high[sequence], nil
+}
+
+// Hand out the next ID of a sequence, reserving a new block if needed
+// peers returns the highest high-water mark of the sequence among other nodes
+func (a *idAllocator) take(sequence string, index int, size int, peers func() int64) (int64, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.next == nil {
+		a.next = make(map[string]int64)
+		a.end = make(map[string]int64)
+	}
+
+	if a.next[sequence] >= a.end[sequence] {
+		high, err := a.highWater(sequence, size)
+		if err != nil {
+			return 0, err
+		}
+		high = max(high, peers())
+		// First block of this node's stripe at or above the mark
+		block := high + ((int64(index)-high%int64(size))%int64(size)+int64(size))%int64(size)
+
+		a.highMutex.Lock()
+		previous := a.high[sequence]
+		a.high[sequence] = max(previous, block+1)
+		if err := a.save(); err != nil {
+			a.high[sequence] = previous
+			a.highMutex.Unlock()
+			return 0, err
+		}
+		a.highMutex.Unlock()
+
+		start := block*idBlockSize + 1
+		a.next[sequence] = start
+		a.end[sequence] = start + idBlockSize
+	}
+
+	id := a.next[sequence]
+	a.next[sequence]++
+	return id, nil
+}
+
+// Get the next cluster-unique ID of a sequence
+// GET /id/next?sequence=<name>
+func (s *Server) NextIDRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+
+	sequence := r.URL.Query().Get("sequence")
+	if sequence == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing sequence parameter", "")
+		return
+	}
+
+	index, size := 0, 1
+	if s.nodes != nil {
+		index, size = s.nodes.Position()
+	}
+	id, err := s.ids.take(sequence, index, size, func() int64 { return s.peerHighWater(r.Context(), sequence) })
+	if err != nil {
+		log.Println("Could not reserve ID block - ", err)
+		h.WriteError(w, http.StatusInternalServerError, h.CodeInternal, "Internal Server Error", "")
+		return
+	}
+	h.WriteResponse(w, http.StatusOK, strconv.FormatInt(id, 10))
+}
+
+// Highest high-water mark of a sequence among reachable peers, 0 without any
+func (s *Server) peerHighWater(ctx context.Context, sequence string) int64 {
+	if s.nodes == nil {
+		return 0
+	}
+	var high int64
+	for _, b := range s.nodes.Gather(ctx, "/internal/ids?sequence="+url.QueryEscape(sequence)) {
+		var mark struct {
+			High int64 `json:"high"`
+		}
+		if json.Unmarshal(b, &mark) == nil {
+			high = max(high, mark.High)
+		}
+	}
+	return high
+}
+
+// Report the high-water mark of a sequence to a node reserving a block
+// GET /internal/ids?sequence=<name>
+func (s *Server) InternalIDsRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	sequence := r.URL.Query().Get("sequence")
+	if sequence == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing sequence parameter", "")
+		return
+	}
+	size := 1
+	if s.nodes != nil {
+		_, size = s.nodes.Position()
+	}
+	high, err := s.ids.highWater(sequence, size)
+	if err != nil {
+		log.Println("Could not read ID high-water marks - ", err)
+		h.WriteError(w, http.StatusInternalServerError, h.CodeInternal, "Internal Server Error", "")
+		return
+	}
+	h.WriteJSON(w, http.StatusOK, map[string]int64{"high": high})
+}
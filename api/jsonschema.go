@@ -0,0 +1,201 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"sync"
+	"unicode/utf8"
+)
+
+// Compiled pattern keywords by source, schemas are checked on every write
+var patterns sync.Map
+
+// Check a decoded JSON value against a JSON Schema, returning one message per violation
+// Supports the keywords type, enum, const, properties, required, additionalProperties,
+// items, minItems, maxItems, minLength, maxLength, pattern, minimum and maximum
+func validateJSON(schema map[string]any, value any, path string) []string {
+	var violations []string
+	fail := func(format string, args ...any) {
+		violations = append(violations, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if t, ok := schema["type"]; ok && !matchesType(t, value) {
+		fail("expected %s, got %s", typeList(t), jsonType(value))
+		return violations
+	}
+	if enum, ok := schema["enum"].([]any); ok && !slices.ContainsFunc(enum, func(e any) bool { return jsonEqual(e, value) }) {
+		fail("value is not one of the allowed values")
+	}
+	if c, ok := schema["const"]; ok && !jsonEqual(c, value) {
+		fail("value must equal %v", c)
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		properties, _ := schema["properties"].(map[string]any)
+		if required, ok := schema["required"].([]any); ok {
+			for _, name := range required {
+				if n, ok := name.(string); ok {
+					if _, present := v[n]; !present {
+						fail("missing required property %q", n)
+					}
+				}
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names) // Report violations in a stable order
+		for _, name := range names {
+			if sub, ok := properties[name].(map[string]any); ok {
+				violations = append(violations, validateJSON(sub, v[name], path+"."+name)...)
+			} else if extra, ok := schema["additionalProperties"]; ok {
+				if allowed, ok := extra.(bool); ok && !allowed {
+					fail("property %q is not allowed", name)
+				} else if sub, ok := extra.(map[string]any); ok {
+					violations = append(violations, validateJSON(sub, v[name], path+"."+name)...)
+				}
+			}
+		}
+	case []any:
+		if n, ok := number(schema["minItems"]); ok && float64(len(v)) < n {
+			fail("expected at least %v items, got %d", n, len(v))
+		}
+		if n, ok := number(schema["maxItems"]); ok && float64(len(v)) > n {
+			fail("expected at most %v items, got %d", n, len(v))
+		}
+		if sub, ok := schema["items"].(map[string]any); ok {
+			for i, item := range v {
+				violations = append(violations, validateJSON(sub, item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if n, ok := number(schema["minLength"]); ok && length < n {
+			fail("expected at least %v characters, got %v", n, length)
+		}
+		if n, ok := number(schema["maxLength"]); ok && length > n {
+			fail("expected at most %v characters, got %v", n, length)
+		}
+		if p, ok := schema["pattern"].(string); ok {
+			if re, err := compilePattern(p); err != nil {
+				fail("schema has an invalid pattern %q", p)
+			} else if !re.MatchString(v) {
+				fail("value does not match pattern %q", p)
+			}
+		}
+	case float64:
+		if n, ok := number(schema["minimum"]); ok && v < n {
+			fail("expected at least %v, got %v", n, v)
+		}
+		if n, ok := number(schema["maximum"]); ok && v > n {
+			fail("expected at most %v, got %v", n, v)
+		}
+	}
+	return violations
+}
+
+// Compile a pattern keyword once
+func compilePattern(p string) (*regexp.Regexp, error) {
+	if re, ok := patterns.Load(p); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(p)
+	if err != nil {
+		return nil, err
+	}
+	patterns.Store(p, re)
+	return re, nil
+}
+
+// Check that every pattern keyword of a schema, including nested ones, is a valid regular expression
+func checkPatterns(schema map[string]any, path string) error {
+	if p, ok := schema["pattern"]; ok {
+		source, ok := p.(string)
+		if !ok {
+			return fmt.Errorf("%s: pattern must be a string", path)
+		}
+		if _, err := compilePattern(source); err != nil {
+			return fmt.Errorf("%s: invalid pattern %q - %w", path, source, err)
+		}
+	}
+	properties, _ := schema["properties"].(map[string]any)
+	for name, sub := range properties {
+		if sub, ok := sub.(map[string]any); ok {
+			if err := checkPatterns(sub, path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	if sub, ok := schema["additionalProperties"].(map[string]any); ok {
+		if err := checkPatterns(sub, path+".*"); err != nil {
+			return err
+		}
+	}
+	if sub, ok := schema["items"].(map[string]any); ok {
+		if err := checkPatterns(sub, path+"[]"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check a value against a type keyword, either a name or a list of names
+func matchesType(t any, value any) bool {
+	switch t := t.(type) {
+	case string:
+		return t == jsonType(value) || (t == "number" && jsonType(value) == "integer")
+	case []any:
+		return slices.ContainsFunc(t, func(name any) bool { return matchesType(name, value) })
+	}
+	return true
+}
+
+// Describe a type keyword for error messages
+func typeList(t any) string {
+	if list, ok := t.([]any); ok {
+		b, _ := json.Marshal(list)
+		return "one of " + string(b)
+	}
+	return fmt.Sprint(t)
+}
+
+// JSON Schema type name of a decoded value
+func jsonType(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	}
+	return "unknown"
+}
+
+// Read a numeric keyword
+func number(v any) (float64, bool) {
+	n, ok := v.(float64)
+	return n, ok
+}
+
+// Compare two decoded JSON values
+func jsonEqual(a any, b any) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return string(x) == string(y)
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Clock difference between token issuer and node that is tolerated for exp and nbf
+const jwtLeeway = 30 * time.Second
+
+// Checks bearer tokens signed with HS256 by a shared secret, or RS256 or ES256 by a public key
+type JWTValidator struct {
+	secret    []byte
+	public    crypto.PublicKey // *rsa.PublicKey or *ecdsa.PublicKey
+	issuer    string           // Required "iss", empty accepts any
+	audience  string           // Required in "aud", empty accepts any
+	roleClaim string           // Claim holding the role, a string or a list of strings
+	maxAge    time.Duration    // Oldest "iat" accepted, tokens need an "exp" when zero
+}
+
+// Create a validator from JWT_SECRET and JWT_PUBLIC_KEY style settings
+// Returns nil without a secret or public key, tokens then aren't accepted
+func NewJWTValidator(secret string, publicKeyFile string, issuer string, audience string, roleClaim string, maxAge time.Duration) (*JWTValidator, error) {
+	if secret == "" && publicKeyFile == "" {
+		return nil, nil
+	}
+	if roleClaim == "" {
+		roleClaim = "role"
+	}
+	v := &JWTValidator{secret: []byte(secret), issuer: issuer, audience: audience, roleClaim: roleClaim, maxAge: maxAge}
+	if publicKeyFile != "" {
+		data, err := os.ReadFile(publicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no PEM data in " + publicKeyFile)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+			v.public = key
+		default:
+			return nil, errors.New("public key is neither RSA nor ECDSA")
+		}
+	}
+	return v, nil
+}
+
+// Check signature, expiry, age, issuer and audience of a token
+// Returns its highest role and its subject ("sub" claim)
+func (v *JWTValidator) Validate(token string, now time.Time) (role string, subject string, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", "", errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", "", err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", "", errors.New("malformed signature")
+	}
+	if err := v.verify(header.Alg, parts[0]+"."+parts[1], sig); err != nil {
+		return "", "", err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", "", err
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok && v.maxAge == 0 {
+		return "", "", errors.New("token has no expiry")
+	} else if ok && now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return "", "", errors.New("token expired")
+	}
+	if v.maxAge > 0 {
+		iat, ok := claims["iat"].(float64)
+		if !ok {
+			return "", "", errors.New("token has no issue time")
+		} else if now.After(time.Unix(int64(iat), 0).Add(v.maxAge + jwtLeeway)) {
+			return "", "", errors.New("token too old")
+		}
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return "", "", errors.New("token not valid yet")
+	}
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return "", "", errors.New("wrong issuer")
+	}
+	if v.audience != "" && !slices.Contains(claimStrings(claims["aud"]), v.audience) {
+		return "", "", errors.New("wrong audience")
+	}
+
+	for _, r := range claimStrings(claims[v.roleClaim]) {
+		if r = canonicalRole(r); roleRank[r] > roleRank[role] {
+			role = r
+		}
+	}
+	if role == "" {
+		return "", "", fmt.Errorf("no known role in %q claim", v.roleClaim)
+	}
+	subject, _ = claims["sub"].(string)
+	return role, subject, nil
+}
+
+// Check the signature of a token with the key its algorithm needs
+func (v *JWTValidator) verify(alg string, signed string, sig []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch key := v.public.(type) {
+	case *rsa.PublicKey:
+		if alg == "RS256" {
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) != nil {
+				return errors.New("invalid signature")
+			}
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if alg == "ES256" {
+			if len(sig) != 64 || !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+				return errors.New("invalid signature")
+			}
+			return nil
+		}
+	}
+	if alg == "HS256" && len(v.secret) > 0 {
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// Decode a base64url JSON segment of a token
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// A claim that is a string or a list of strings
+func claimStrings(claim any) []string {
+	switch c := claim.(type) {
+	case string:
+		return []string{c}
+	case []any:
+		var s []string
+		for _, v := range c {
+			if str, ok := v.(string); ok {
+				s = append(s, str)
+			}
+		}
+		return s
+	}
+	return nil
+}
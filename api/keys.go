@@ -0,0 +1,267 @@
+package api
+
+import (
+	h "gokv/helper"
+	"gokv/storage"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Default and largest page size of key listings, MAX_PAGE_SIZE overrides the largest
+const (
+	defaultKeysLimit = 100
+	maxKeysLimit     = 1000
+)
+
+// List stored keys in sorted order with cursor-based pagination
+// With format=ndjson every key after cursor is streamed as {"key"} lines instead
+// GET /keys?match=<glob>&cursor=<last key of previous page>&limit=<n>
+func (s *Server) KeysRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+
+	cursor := r.URL.Query().Get("cursor")
+	limit, ok := s.parseLimit(w, r)
+	if !ok {
+		return
+	}
+	ndjson := wantsNDJSON(r)
+	if ndjson {
+		release, ok := s.streamSlot(w)
+		if !ok {
+			return
+		}
+		defer release()
+	}
+
+	// Filter keys by glob pattern, narrowed by its literal prefix
+	match := s.prefix(r.URL.Query().Get("match"))
+	matches := func(k string) bool { return match == "" || storage.MatchGlob(match, k) }
+	if ndjson {
+		var keys []string
+		s.mp.RangeKeys(r.Context(), storage.GlobPrefix(match), func(k string) bool {
+			if matches(k) {
+				keys = append(keys, k)
+			}
+			return true
+		})
+		if aborted(w, r) {
+			return
+		}
+		write := startNDJSON(w, r)
+		for _, key := range after(keys, cursor) {
+			if !write(map[string]string{"key": key}) {
+				return
+			}
+		}
+		return
+	}
+
+	// Only the page is kept while keys are listed
+	sel := newPageHeap(cursor, limit)
+	s.mp.RangeKeys(r.Context(), storage.GlobPrefix(match), func(k string) bool {
+		if matches(k) {
+			sel.offer(k)
+		}
+		return true
+	})
+	if aborted(w, r) {
+		return
+	}
+	keys, next := sel.page()
+	h.WriteJSON(w, http.StatusOK, map[string]any{"keys": keys, "next_cursor": next})
+}
+
+// Get key-value pairs under a prefix in sorted key order with cursor-based pagination
+// With format=ndjson every pair after cursor is streamed as {"key", "value"} lines instead
+// GET /scan?prefix=<prefix>&match=<glob>&cursor=<last key of previous page>&limit=<n>
+func (s *Server) ScanRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+
+	prefix := s.prefix(r.URL.Query().Get("prefix"))
+	match := s.prefix(r.URL.Query().Get("match"))
+	cursor := r.URL.Query().Get("cursor")
+	limit, ok := s.parseLimit(w, r)
+	if !ok {
+		return
+	}
+	ndjson := wantsNDJSON(r)
+	if ndjson {
+		release, ok := s.streamSlot(w)
+		if !ok {
+			return
+		}
+		defer release()
+	}
+
+	// Narrow scan by the literal prefix of the glob pattern
+	if match != "" && prefix == "" {
+		prefix = storage.GlobPrefix(match)
+	}
+	matches := func(k string) bool { return match == "" || storage.MatchGlob(match, k) }
+	if ndjson {
+		pairs := make(map[string]string)
+		var keys []string
+		s.mp.Range(r.Context(), prefix, func(k string, v string) bool {
+			if matches(k) {
+				pairs[k] = v
+				keys = append(keys, k)
+			}
+			return true
+		})
+		if aborted(w, r) {
+			return
+		}
+		write := startNDJSON(w, r)
+		for _, key := range after(keys, cursor) {
+			if !write(map[string]string{"key": key, "value": pairs[key]}) {
+				return
+			}
+		}
+		return
+	}
+
+	// Only the page and its values are kept while pairs are read
+	sel := newPageHeap(cursor, limit)
+	values := make(map[string]string)
+	s.mp.Range(r.Context(), prefix, func(k string, v string) bool {
+		if !matches(k) {
+			return true
+		}
+		if kept, evicted := sel.offer(k); kept {
+			values[k] = v
+			delete(values, evicted)
+		}
+		return true
+	})
+	if aborted(w, r) {
+		return
+	}
+	keys, next := sel.page()
+
+	items := make([]map[string]string, 0, len(keys))
+	for _, k := range keys {
+		items = append(items, map[string]string{"key": k, "value": values[k]})
+	}
+	h.WriteJSON(w, http.StatusOK, map[string]any{"items": items, "next_cursor": next})
+}
+
+// Count keys under a prefix or matching a glob pattern, without reading values
+// GET /count?prefix=<prefix>&match=<glob>
+func (s *Server) CountRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+
+	prefix := s.prefix(r.URL.Query().Get("prefix"))
+	match := s.prefix(r.URL.Query().Get("match"))
+	if match == "" {
+		h.WriteJSON(w, http.StatusOK, map[string]int{"count": s.mp.Count(prefix)})
+		return
+	}
+
+	// Narrow by the literal prefix of the glob pattern, then match the keys
+	if prefix == "" {
+		prefix = storage.GlobPrefix(match)
+	}
+	n := 0
+	for i, k := range s.mp.Keys(r.Context(), prefix) {
+		if i%abortCheckEvery == 0 && r.Context().Err() != nil {
+			break
+		}
+		if storage.MatchGlob(match, k) {
+			n++
+		}
+	}
+	if aborted(w, r) {
+		return
+	}
+	h.WriteJSON(w, http.StatusOK, map[string]int{"count": n})
+}
+
+// Read page size from limit query parameter
+// Responds with an error and returns false if it is invalid
+func (s *Server) parseLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return defaultKeysLimit, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Invalid limit", "")
+		return 0, false
+	}
+	return min(n, s.maxPage()), true
+}
+
+// Return a key picked uniformly at random
+// GET /randomkey[?prefix=<prefix>]
+func (s *Server) RandomKeyRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	sample, _ := s.sampleKeys(r.Context(), s.prefix(r.URL.Query().Get("prefix")), 1)
+	if aborted(w, r) {
+		return
+	}
+	if len(sample) == 0 {
+		h.WriteError(w, http.StatusNotFound, h.CodeNotFound, "No keys", "")
+		return
+	}
+	h.WriteResponse(w, http.StatusOK, sample[0])
+}
+
+// Return up to n keys picked uniformly at random, in no particular order
+// GET /sample?n=<n>[&prefix=<prefix>]
+func (s *Server) KeySampleRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	n := defaultKeysLimit
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Invalid sample size", "")
+			return
+		}
+		n = min(n, s.maxPage())
+	}
+	sample, total := s.sampleKeys(r.Context(), s.prefix(r.URL.Query().Get("prefix")), n)
+	if aborted(w, r) {
+		return
+	}
+	h.WriteJSON(w, http.StatusOK, map[string]any{"keys": sample, "total": total})
+}
+
+// Mutation history of a key reconstructed from the WAL
+// GET /history?key=<key>
+func (s *Server) HistoryRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+
+	key := s.key(r.URL.Query().Get("key"))
+	if key == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key parameter", "")
+		return
+	}
+
+	history, err := storage.History(key)
+	if err != nil {
+		log.Println("Could not read WAL log - ", err)
+		h.WriteError(w, http.StatusInternalServerError, h.CodeInternal, "Internal Server Error", "")
+		return
+	}
+	h.WriteJSON(w, http.StatusOK, map[string]any{"key": key, "history": history})
+}
@@ -0,0 +1,34 @@
+package api
+
+import (
+	h "gokv/helper"
+	"net/http"
+)
+
+// Get created and updated times and version of a key
+// The hash of the value is also sent as ETag, so clients can tell if a key changed
+// GET /meta?key=<key>
+func (s *Server) MetaRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+
+	key := s.key(r.URL.Query().Get("key"))
+	if key == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key parameter", "")
+		return
+	}
+	meta, ok := s.mp.Meta(key)
+	if !ok {
+		h.WriteError(w, http.StatusNotFound, h.CodeKeyNotFound, "Key not found", key)
+		return
+	}
+
+	resp := map[string]any{"key": key, "created": meta.Created, "updated": meta.Updated, "version": meta.Version}
+	if at, ok := s.mp.Expiry(key); ok {
+		resp["expire_at"] = at.Unix()
+	}
+	w.Header().Set("ETag", etag(s.mp.GetValue(key)))
+	h.WriteJSON(w, http.StatusOK, resp)
+}
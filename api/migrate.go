@@ -0,0 +1,237 @@
+package api
+
+import (
+	"context"
+	"errors"
+	h "gokv/helper"
+	"gokv/storage"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keys migrated per second unless the request sets a rate
+const defaultMigrateRate = 1000
+
+// Copy or move every key under one prefix to another as a background job
+// Keys keep the rest of their name and their expiry, each batch is one WAL transaction
+// POST /admin/migrate-prefix?from=<prefix>&to=<prefix>&mode=copy|move&conflict=skip|overwrite&rate=<keys/s>[&dry_run=true]
+func (s *Server) MigratePrefixRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+
+	query := r.URL.Query()
+	from, to := query.Get("from"), query.Get("to")
+	if from == "" || to == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing from or to parameter", "")
+		return
+	}
+	// Overlapping prefixes would migrate keys onto keys still waiting to be migrated
+	if strings.HasPrefix(from, to) || strings.HasPrefix(to, from) {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "from and to must not overlap", "")
+		return
+	}
+	mode, conflict := query.Get("mode"), query.Get("conflict")
+	if mode == "" {
+		mode = "copy"
+	}
+	if conflict == "" {
+		conflict = "skip"
+	}
+	if mode != "copy" && mode != "move" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "mode must be copy or move", "")
+		return
+	}
+	if conflict != "skip" && conflict != "overwrite" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "conflict must be skip or overwrite", "")
+		return
+	}
+	rate := defaultMigrateRate
+	if v := query.Get("rate"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Invalid rate", "")
+			return
+		}
+		rate = n
+	}
+
+	// Every destination must be a valid key, and values must match the schema of its namespace
+	keys := s.mp.Keys(r.Context(), from)
+	if aborted(w, r) {
+		return
+	}
+	sizes := make(map[string]int, len(keys))
+	conflicts, bytes := 0, 0
+	for _, k := range keys {
+		dst := s.migrateDest(k, from, to)
+		if msg := s.validatePair(dst, ""); msg != "" {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, msg, dst)
+			return
+		}
+		value := s.mp.GetValue(k)
+		if !s.matchesSchema(w, dst, value) {
+			return
+		}
+		sizes[dst] = len(value)
+		bytes += len(dst) + len(value)
+		if s.mp.Exists(dst) {
+			conflicts++
+		}
+	}
+
+	// Report what would be migrated without mutating state
+	if h.DryRun(r) {
+		writeDryRun(w, map[string]any{
+			"from":      from,
+			"to":        to,
+			"keys":      len(keys),
+			"conflicts": conflicts,
+			"bytes":     bytes,
+		})
+		return
+	}
+
+	if !s.writable(w) || !s.migrationUnfrozen(w, keys, from, to, mode) || !s.withinQuota(w, sizes) {
+		return
+	}
+
+	j := &job{kind: "migrate-prefix", prefix: from, to: to, mode: mode, conflict: conflict, total: len(keys)}
+	ctx := s.startJob(j)
+
+	go s.migratePrefix(ctx, j, keys, rate)
+
+	h.WriteJSON(w, http.StatusAccepted, j.snapshot())
+}
+
+// Check that no destination, nor any source of a move, is frozen
+// Responds with 423 and returns false otherwise
+func (s *Server) migrationUnfrozen(w http.ResponseWriter, keys []string, from string, to string, mode string) bool {
+	for _, k := range keys {
+		if !s.unfrozen(w, s.migrateDest(k, from, to)) || (mode == "move" && !s.unfrozen(w, k)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Migrate keys in batches of at most rate keys, spread to keep to rate keys per second
+// The job fails if a prefix is frozen after it started
+func (s *Server) migratePrefix(ctx context.Context, j *job, keys []string, rate int) {
+	size := min(deleteBatchSize, rate)
+	start := time.Now()
+	for i := 0; i < len(keys); i += size {
+		// Wait until the keys migrated so far are within the rate
+		wait := time.Duration(float64(i)/float64(rate)*float64(time.Second)) - time.Since(start)
+		select {
+		case <-ctx.Done():
+			j.finish("cancelled")
+			return
+		case <-time.After(max(wait, 0)):
+		}
+
+		batch := keys[i:min(i+size, len(keys))]
+		for _, k := range batch {
+			if s.frozen(s.migrateDest(k, j.prefix, j.to)) || (j.mode == "move" && s.frozen(k)) {
+				log.Println("Migration stopped, prefix frozen - ", j.id, k)
+				j.finish("failed")
+				return
+			}
+		}
+		migrated, skipped, err := s.migrateBatch(j, batch)
+		var reqErr *requestError
+		if errors.As(err, &reqErr) {
+			log.Println("Migration stopped, "+reqErr.message+" - ", j.id)
+			j.finish("failed")
+			return
+		} else if err != nil {
+			log.Println("Error writing to log - ", err)
+			walErrors.Add(1)
+			j.finish("failed")
+			return
+		}
+
+		j.mutex.Lock()
+		j.migrated += migrated
+		j.skipped += skipped
+		if j.mode == "move" {
+			j.deleted += migrated
+		}
+		j.mutex.Unlock()
+	}
+	j.finish("done")
+}
+
+// Check if writes to key are frozen
+func (s *Server) frozen(key string) bool {
+	_, ok := s.freezes.covering(key)
+	return ok
+}
+
+// Destination of a migrated key, normalized like keys sent by clients
+func (s *Server) migrateDest(key string, from string, to string) string {
+	return s.key(to + strings.TrimPrefix(key, from))
+}
+
+// Migrate one batch of keys in a single WAL transaction, expiries move with the values
+// Keys deleted since the job started are skipped, as are taken destinations unless overwriting
+// and values changed since to no longer match the schema of their destination
+// Fails without writing anything if the batch would take a namespace over its quota
+func (s *Server) migrateBatch(j *job, batch []string) (migrated int, skipped int, err error) {
+	dsts := make([]string, len(batch))
+	for i, k := range batch {
+		dsts[i] = s.migrateDest(k, j.prefix, j.to)
+	}
+	s.measureQuotas(dsts...)
+	err = s.mp.Transact(func(get func(key string) (string, bool), expiry func(key string) time.Time, _ func(key string) storage.KeyMeta) ([]storage.TxnOp, error) {
+		var ops []storage.TxnOp
+		sizes := make(map[string]int)
+		for _, k := range batch {
+			value, exists := get(k)
+			if !exists {
+				skipped++
+				continue
+			}
+			dst := s.migrateDest(k, j.prefix, j.to)
+			if _, taken := get(dst); taken && j.conflict == "skip" {
+				skipped++
+				continue
+			}
+			if msg, _, err := s.checkSchema(dst, value); err != nil {
+				return nil, err
+			} else if msg != "" {
+				log.Println("Migration skipped key, "+msg+" - ", j.id, k)
+				skipped++
+				continue
+			}
+			set := storage.TxnOp{Op: "SET", Key: dst, Value: value}
+			if at := expiry(k); !at.IsZero() {
+				set.Expire = storage.EncodeExpiry(at)
+			}
+			ops = append(ops, set)
+			sizes[dst] = len(value)
+			if j.mode == "move" {
+				ops = append(ops, storage.TxnOp{Op: "DELETE", Key: k})
+			}
+			migrated++
+		}
+		if len(ops) == 0 {
+			return nil, nil
+		}
+		if err := s.checkQuota(sizes); err != nil {
+			return nil, err
+		}
+		if err := s.log.UpdateLogTxn(ops); err != nil {
+			return nil, err
+		}
+		return ops, nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return migrated, skipped, nil
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"fmt"
+	"gokv/storage"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Key normalizations a namespace can opt into
+const (
+	NormalizeTrim  = "trim"  // Remove surrounding whitespace
+	NormalizeNFC   = "nfc"   // Compose Latin letters followed by a combining mark
+	NormalizeLower = "lower" // Fold to lower case
+)
+
+// Normalizations of keys per namespace, "*" applies to keys of every other namespace
+// A key's namespace is the part before the first ':', matched ignoring case and leading whitespace
+type KeyPolicy map[string][]string
+
+// Parse a policy such as "user=lower+trim,*=nfc"
+func ParseKeyPolicy(spec string) (KeyPolicy, error) {
+	p := make(KeyPolicy)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		ns, steps, ok := strings.Cut(pair, "=")
+		ns = strings.ToLower(strings.TrimSpace(ns))
+		if !ok || ns == "" {
+			return nil, fmt.Errorf("invalid key normalization %q", pair)
+		}
+		for _, step := range strings.Split(steps, "+") {
+			step = strings.TrimSpace(step)
+			if step != NormalizeTrim && step != NormalizeNFC && step != NormalizeLower {
+				return nil, fmt.Errorf("unknown key normalization %q", step)
+			}
+			p[ns] = append(p[ns], step)
+		}
+	}
+	return p, nil
+}
+
+// Normalize a key by the policy of its namespace
+// Steps run in the order trim, nfc, lower whatever order they were given in
+func (p KeyPolicy) Normalize(key string) string {
+	return p.normalize(key, strings.TrimSpace)
+}
+
+// Normalize a key prefix or glob pattern like the keys it matches
+// Only leading whitespace is trimmed, trailing whitespace may be followed by more of a key
+func (p KeyPolicy) NormalizePrefix(prefix string) string {
+	return p.normalize(prefix, func(s string) string { return strings.TrimLeft(s, " \t\r\n") })
+}
+
+// Normalize key by the policy of its namespace, trimming it with trim
+func (p KeyPolicy) normalize(key string, trim func(string) string) string {
+	if len(p) == 0 {
+		return key
+	}
+	ns, _ := storage.Namespace(strings.TrimLeft(key, " \t\r\n"))
+	steps, ok := p[strings.ToLower(ns)]
+	if !ok {
+		steps = p["*"]
+	}
+	if slices.Contains(steps, NormalizeTrim) {
+		key = trim(key)
+	}
+	if slices.Contains(steps, NormalizeNFC) {
+		key = composeLatin(key)
+	}
+	if slices.Contains(steps, NormalizeLower) {
+		key = strings.ToLower(key)
+	}
+	return key
+}
+
+// Set how keys are normalized before they are read or written
+func (s *Server) SetKeyPolicy(p KeyPolicy) {
+	s.keyPolicy = p
+}
+
+// Normalize a key received from a client
+func (s *Server) key(key string) string {
+	return s.keyPolicy.Normalize(key)
+}
+
+// Normalize a key prefix or glob pattern received from a client
+func (s *Server) prefix(prefix string) string {
+	return s.keyPolicy.NormalizePrefix(prefix)
+}
+
+// Latin letters and their precomposed form, per combining mark
+// Covers Latin-1 Supplement and Latin Extended-A
+var latinCompositions = map[rune]string{
+	0x0300: "AÀEÈIÌOÒUÙaàeèiìoòuù",                             // grave
+	0x0301: "AÁEÉIÍOÓUÚYÝaáeéiíoóuúyýCĆcćLĹlĺNŃnńRŔrŕSŚsśZŹzź", // acute
+	0x0302: "AÂEÊIÎOÔUÛaâeêiîoôuûCĈcĉGĜgĝHĤhĥJĴjĵSŜsŝWŴwŵYŶyŷ", // circumflex
+	0x0303: "AÃNÑOÕaãnñoõIĨiĩUŨuũ",                             // tilde
+	0x0304: "AĀaāEĒeēIĪiīOŌoōUŪuū",                             // macron
+	0x0306: "AĂaăEĔeĕGĞgğIĬiĭOŎoŏUŬuŭ",                         // breve
+	0x0307: "CĊcċEĖeėGĠgġIİZŻzż",                               // dot above
+	0x0308: "AÄEËIÏOÖUÜaäeëiïoöuüyÿYŸ",                         // diaeresis
+	0x030A: "AÅaåUŮuů",                                         // ring above
+	0x030B: "OŐoőUŰuű",                                         // double acute
+	0x030C: "CČcčDĎdďEĚeěLĽlľNŇnňRŘrřSŠsšTŤtťZŽzž",             // caron
+	0x0327: "CÇcçGĢgģKĶkķLĻlļNŅnņRŖrŗSŞsşTŢtţ",                 // cedilla
+	0x0328: "AĄaąEĘeęIĮiįUŲuų",                                 // ogonek
+}
+
+// Base letter and combining mark -> precomposed letter
+var compositions = make(map[[2]rune]rune)
+
+func init() {
+	for mark, pairs := range latinCompositions {
+		runes := []rune(pairs)
+		for i := 0; i+1 < len(runes); i += 2 {
+			compositions[[2]rune{runes[i], mark}] = runes[i+1]
+		}
+	}
+}
+
+// Replace Latin letters followed by a combining mark with their precomposed form,
+// the NFC form of these letters. Other text is left as is
+func composeLatin(s string) string {
+	if !strings.ContainsFunc(s, func(r rune) bool { return r >= 0x0300 && r <= 0x036F }) {
+		return s
+	}
+	out := make([]rune, 0, utf8.RuneCountInString(s))
+	for _, r := range s {
+		if n := len(out); n > 0 {
+			if c, ok := compositions[[2]rune{out[n-1], r}]; ok {
+				out[n-1] = c
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
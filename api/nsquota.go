@@ -0,0 +1,283 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	h "gokv/helper"
+	"gokv/storage"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long tracked namespace usage is trusted before it is measured again
+// Measuring corrects drift from changes that aren't published, such as replicated writes
+const quotaRefresh = time.Minute
+
+// Hard limits of a namespace, zero disables a limit
+type NamespaceQuota struct {
+	MaxKeys  int   `json:"max_keys,omitempty"`
+	MaxBytes int64 `json:"max_bytes,omitempty"` // Keys and values
+}
+
+// Hard limits per namespace, "*" applies to every other namespace on its own
+// A key's namespace is the part before the first ':', keys without one aren't limited
+type NamespaceQuotas map[string]NamespaceQuota
+
+// Parse quotas such as "user=keys:1000+bytes:10MB,*=keys:100000"
+// Byte limits take a KB, MB or GB suffix
+func ParseNamespaceQuotas(spec string) (NamespaceQuotas, error) {
+	q := make(NamespaceQuotas)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		ns, limits, ok := strings.Cut(pair, "=")
+		ns = strings.TrimSpace(ns)
+		if !ok || ns == "" || strings.Contains(ns, ":") {
+			return nil, fmt.Errorf("invalid namespace quota %q", pair)
+		}
+		var quota NamespaceQuota
+		for _, limit := range strings.Split(limits, "+") {
+			name, v, _ := strings.Cut(strings.TrimSpace(limit), ":")
+			var err error
+			switch name {
+			case "keys":
+				quota.MaxKeys, err = strconv.Atoi(v)
+			case "bytes":
+				quota.MaxBytes, err = parseBytes(v)
+			default:
+				err = fmt.Errorf("unknown limit %q", name)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid namespace quota %q - %w", pair, err)
+			}
+		}
+		q[ns] = quota
+	}
+	return q, nil
+}
+
+// Parse a size such as "512", "64KB" or "10MB"
+func parseBytes(v string) (int64, error) {
+	shift := 0
+	for suffix, s := range map[string]int{"KB": 10, "MB": 20, "GB": 30} {
+		if n, ok := strings.CutSuffix(v, suffix); ok {
+			v, shift = n, s
+			break
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	return n << shift, nil
+}
+
+// Usage of a namespace
+type namespaceUsage struct {
+	Keys     int            `json:"keys"`
+	Bytes    int64          `json:"bytes"`
+	Measured time.Time      `json:"measured"`
+	sizes    map[string]int // Key -> bytes of key and value
+}
+
+// Hard namespace limits and usage, enforced on write
+// Usage of a namespace is measured once, then kept up to date from changes as the map applies them
+type namespaceQuotas struct {
+	limits NamespaceQuotas
+	usage  map[string]*namespaceUsage
+	mutex  sync.Mutex
+}
+
+// Set hard limits on keys and bytes per namespace
+func (s *Server) SetNamespaceQuotas(q NamespaceQuotas) {
+	s.nsQuotas.mutex.Lock()
+	defer s.nsQuotas.mutex.Unlock()
+	s.nsQuotas.limits = q
+	s.nsQuotas.usage = make(map[string]*namespaceUsage)
+}
+
+// Limits of a namespace, false if it has none
+func (q *namespaceQuotas) limit(ns string) (NamespaceQuota, bool) {
+	quota, ok := q.limits[ns]
+	if !ok {
+		quota, ok = q.limits["*"]
+	}
+	return quota, ok
+}
+
+// Count a change against the usage of its namespace, if that is tracked
+// Called by the map as it applies the change, under the map lock
+func (q *namespaceQuotas) track(typ string, key string, value string) {
+	ns, ok := storage.Namespace(key)
+	if !ok {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	u, ok := q.usage[ns]
+	if !ok {
+		return
+	}
+	old, existed := u.sizes[key]
+	if typ == "set" {
+		size := len(key) + len(value)
+		u.sizes[key] = size
+		u.Bytes += int64(size - old)
+		if !existed {
+			u.Keys++
+		}
+	} else if existed {
+		delete(u.sizes, key)
+		u.Bytes -= int64(old)
+		u.Keys--
+	}
+}
+
+// Measure usage of namespaces not measured for quotaRefresh, without holding the quota lock
+// Changes published while a namespace is measured may be missed until it is measured again
+func (s *Server) measureUsage(namespaces []string) {
+	now := time.Now()
+	var stale []string
+	s.nsQuotas.mutex.Lock()
+	for _, ns := range namespaces {
+		if u, ok := s.nsQuotas.usage[ns]; !ok || now.Sub(u.Measured) >= quotaRefresh {
+			stale = append(stale, ns)
+		}
+	}
+	s.nsQuotas.mutex.Unlock()
+
+	for _, ns := range stale {
+		u := &namespaceUsage{Measured: now, sizes: make(map[string]int)}
+		s.mp.Range(context.Background(), ns+":", func(k string, v string) bool {
+			u.sizes[k] = len(k) + len(v)
+			u.Keys++
+			u.Bytes += int64(len(k) + len(v))
+			return true
+		})
+		s.nsQuotas.mutex.Lock()
+		if s.nsQuotas.usage != nil {
+			s.nsQuotas.usage[ns] = u
+		}
+		s.nsQuotas.mutex.Unlock()
+	}
+}
+
+// Measure usage of the namespaces of keys that have a quota, if it is stale
+// Writes call it before taking the map lock, under which checkQuota then compares them with the usage
+func (s *Server) measureQuotas(keys ...string) {
+	s.nsQuotas.mutex.Lock()
+	var namespaces []string
+	for _, key := range keys {
+		ns, ok := storage.Namespace(key)
+		if _, limited := s.nsQuotas.limit(ns); ok && limited && !slices.Contains(namespaces, ns) {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	s.nsQuotas.mutex.Unlock()
+	if len(namespaces) > 0 {
+		s.measureUsage(namespaces)
+	}
+}
+
+// Check that writing values of the given sizes keeps every namespace within its quota
+// Writes check under the map lock: usage is charged by the map as it applies a write, under the
+// same lock, so no other write can land between the check and the write it allows
+// Returns a 403 error naming a key of the namespace that would go over
+func (s *Server) checkQuota(sizes map[string]int) error {
+	s.nsQuotas.mutex.Lock()
+	defer s.nsQuotas.mutex.Unlock()
+
+	// Sum what each namespace gains, overwrites only add their growth
+	type delta struct {
+		keys  int
+		bytes int64
+		key   string // Key reported if the quota is exceeded
+	}
+	deltas := make(map[string]*delta)
+	for key, size := range sizes {
+		ns, _ := storage.Namespace(key)
+		u, ok := s.nsQuotas.usage[ns]
+		if !ok { // No quota, or quotas were replaced since measuring
+			continue
+		}
+		d, ok := deltas[ns]
+		if !ok {
+			d = &delta{key: key}
+			deltas[ns] = d
+		}
+		if old, exists := u.sizes[key]; exists {
+			d.bytes += int64(len(key) + size - old)
+		} else {
+			d.keys++
+			d.bytes += int64(len(key) + size)
+		}
+	}
+
+	for ns, d := range deltas {
+		quota, _ := s.nsQuotas.limit(ns)
+		u := s.nsQuotas.usage[ns]
+		if quota.MaxKeys > 0 && d.keys > 0 && u.Keys+d.keys > quota.MaxKeys {
+			return &keyError{d.key, &requestError{http.StatusForbidden, h.CodeQuotaExceeded, fmt.Sprintf("Namespace %s is over its quota of %d keys", ns, quota.MaxKeys)}}
+		}
+		if quota.MaxBytes > 0 && d.bytes > 0 && u.Bytes+d.bytes > quota.MaxBytes {
+			return &keyError{d.key, &requestError{http.StatusForbidden, h.CodeQuotaExceeded, fmt.Sprintf("Namespace %s is over its quota of %d bytes", ns, quota.MaxBytes)}}
+		}
+	}
+	return nil
+}
+
+// Check up front that writing values of the given sizes keeps every namespace within its quota
+// For work such as migrations that writes in many steps, each of which is checked again
+// Responds with 403 if one would go over
+func (s *Server) withinQuota(w http.ResponseWriter, sizes map[string]int) bool {
+	keys := make([]string, 0, len(sizes))
+	for key := range sizes {
+		keys = append(keys, key)
+	}
+	s.measureQuotas(keys...)
+	if err := s.checkQuota(sizes); err != nil {
+		writeModifyError(w, "", err)
+		return false
+	}
+	return true
+}
+
+// Limits and usage of namespaces with a quota
+// Usage is measured again if it is older than quotaRefresh
+// GET /admin/quotas
+func (s *Server) NamespaceQuotasRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	// Namespaces covered by "*" are listed once they have been written to
+	s.nsQuotas.mutex.Lock()
+	var namespaces []string
+	for ns := range s.nsQuotas.usage {
+		namespaces = append(namespaces, ns)
+	}
+	for ns := range s.nsQuotas.limits {
+		if ns != "*" && !slices.Contains(namespaces, ns) {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	s.nsQuotas.mutex.Unlock()
+	s.measureUsage(namespaces)
+
+	s.nsQuotas.mutex.Lock()
+	defer s.nsQuotas.mutex.Unlock()
+	resp := make(map[string]any)
+	for _, ns := range namespaces {
+		quota, limited := s.nsQuotas.limit(ns)
+		if u, ok := s.nsQuotas.usage[ns]; ok && limited {
+			resp[ns] = map[string]any{"quota": quota, "usage": u}
+		}
+	}
+	h.WriteJSON(w, http.StatusOK, map[string]any{"namespaces": resp})
+}
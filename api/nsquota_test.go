@@ -0,0 +1,45 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"gokv/api"
+)
+
+// Concurrent writes of new keys never take a namespace past its key limit
+func TestNamespaceQuotaConcurrentWrites(t *testing.T) {
+	srv := newServer()
+	quotas, err := api.ParseNamespaceQuotas("user=keys:10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.SetNamespaceQuotas(quotas)
+
+	var wg sync.WaitGroup
+	var saved, refused atomic.Int64
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			srv.SetRequest(w, httptest.NewRequest("GET", "/set?key=user:"+strconv.Itoa(i)+"&value=v", nil))
+			switch w.Code {
+			case http.StatusOK:
+				saved.Add(1)
+			case http.StatusForbidden:
+				refused.Add(1)
+			default:
+				t.Errorf("got %d: %s", w.Code, w.Body)
+			}
+		}()
+	}
+	wg.Wait()
+	if saved.Load() != 10 || refused.Load() != 40 {
+		t.Fatalf("saved %d and refused %d keys, want 10 and 40", saved.Load(), refused.Load())
+	}
+}
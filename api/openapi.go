@@ -0,0 +1,93 @@
+package api
+
+import (
+	h "gokv/helper"
+	"net/http"
+	"strings"
+)
+
+// Response schemas referenced by routes
+var openAPISchemas = map[string]any{
+	"Message": map[string]any{
+		"type":       "object",
+		"properties": map[string]any{"message": map[string]any{"type": "string"}},
+	},
+	"Error": map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"code":    map[string]any{"type": "string"},
+			"message": map[string]any{"type": "string"},
+			"key":     map[string]any{"type": "string"},
+		},
+	},
+	"Object": map[string]any{"type": "object"},
+}
+
+// Build an OpenAPI 3 document from the route table
+// Internal routes are left out, paths are relative to the /v1 server
+func OpenAPI(routes []Route) map[string]any {
+	paths := make(map[string]any)
+	for _, route := range routes {
+		if strings.HasPrefix(route.Path, "/internal/") {
+			continue
+		}
+		operations := make(map[string]any)
+		for _, method := range route.Methods {
+			operations[strings.ToLower(method)] = operation(route)
+		}
+		paths[route.Path] = operations
+	}
+	return map[string]any{
+		"openapi":    "3.0.3",
+		"info":       map[string]any{"title": "gokv", "version": strings.TrimPrefix(apiVersion, "/")},
+		"servers":    []map[string]any{{"url": apiVersion}},
+		"paths":      paths,
+		"components": map[string]any{"schemas": openAPISchemas},
+	}
+}
+
+// Describe one method of a route
+func operation(route Route) map[string]any {
+	params := []map[string]any{}
+	for _, p := range route.Params {
+		name, required := strings.CutSuffix(p, "*")
+		params = append(params, map[string]any{
+			"name":     name,
+			"in":       "query",
+			"required": required,
+			"schema":   map[string]any{"type": "string"},
+		})
+	}
+
+	content := map[string]any{}
+	switch route.Returns {
+	case "message":
+		content["application/json"] = map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/Message"}}
+	case "object":
+		content["application/json"] = map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/Object"}}
+	case "stream":
+		content["text/event-stream"] = map[string]any{"schema": map[string]any{"type": "string"}}
+	case "ndjson":
+		content["application/x-ndjson"] = map[string]any{"schema": map[string]any{"type": "string"}}
+	}
+	errorContent := map[string]any{"application/json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/Error"}}}
+
+	return map[string]any{
+		"summary":    route.Summary,
+		"parameters": params,
+		"responses": map[string]any{
+			"200":     map[string]any{"description": "OK", "content": content},
+			"default": map[string]any{"description": "Error", "content": errorContent},
+		},
+	}
+}
+
+// Serve the OpenAPI description of the API
+// GET /openapi.json
+func (s *Server) OpenAPIRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	h.WriteJSON(w, http.StatusOK, OpenAPI(s.Routes()))
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"container/heap"
+	"slices"
+)
+
+// Selects a page of the smallest keys after a cursor from keys offered in any order
+// Only limit+1 keys are held at once, the extra one tells whether more keys follow
+type pageHeap struct {
+	cursor string
+	limit  int
+	keys   []string // Max-heap of the smallest keys offered so far
+}
+
+// Start selecting a page of up to limit keys after cursor
+func newPageHeap(cursor string, limit int) *pageHeap {
+	return &pageHeap{cursor: cursor, limit: limit}
+}
+
+// heap.Interface, with the largest key on top
+func (p *pageHeap) Len() int           { return len(p.keys) }
+func (p *pageHeap) Less(i, j int) bool { return p.keys[i] > p.keys[j] }
+func (p *pageHeap) Swap(i, j int)      { p.keys[i], p.keys[j] = p.keys[j], p.keys[i] }
+func (p *pageHeap) Push(x any)         { p.keys = append(p.keys, x.(string)) }
+func (p *pageHeap) Pop() any {
+	last := p.keys[len(p.keys)-1]
+	p.keys = p.keys[:len(p.keys)-1]
+	return last
+}
+
+// Offer a key, returns whether it was kept and the key it pushed out, if any
+func (p *pageHeap) offer(key string) (kept bool, evicted string) {
+	if key <= p.cursor {
+		return false, ""
+	}
+	if len(p.keys) <= p.limit {
+		heap.Push(p, key)
+		return true, ""
+	}
+	if key >= p.keys[0] {
+		return false, ""
+	}
+	evicted = p.keys[0]
+	p.keys[0] = key
+	heap.Fix(p, 0)
+	return true, evicted
+}
+
+// Sorted keys of the page, next is empty when there are no more keys
+func (p *pageHeap) page() (keys []string, next string) {
+	keys = slices.Sorted(slices.Values(p.keys))
+	if len(keys) > p.limit {
+		keys = keys[:p.limit]
+		if len(keys) > 0 {
+			next = keys[len(keys)-1]
+		}
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+	return keys, next
+}
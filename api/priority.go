@@ -0,0 +1,117 @@
+package api
+
+import (
+	"expvar"
+	h "gokv/helper"
+	"gokv/storage"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Priority classes of requests
+// Classes share one budget of in-flight requests, lower classes may only take
+// from it while enough is left so they can't starve interactive clients
+const (
+	PriorityInteractive = "interactive" // Default for client requests
+	PriorityBackground  = "background"  // Imports, bulk loads, batch jobs
+	PriorityReplication = "replication" // Node-to-node traffic under /internal/
+)
+
+// Background writes shed during a write stall
+var shedWrites = expvar.NewInt("stall_shed_writes")
+
+// How long an interactive request waits for a free slot before being shed
+const interactiveWait = 100 * time.Millisecond
+
+// Limits in-flight requests across priority classes
+type Priorities struct {
+	slots     chan struct{}  // Shared budget, one slot per in-flight request
+	threshold map[string]int // Class -> in-flight requests above which it is shed
+	mutex     sync.Mutex     // Serializes lower classes checking their threshold and taking a slot
+}
+
+// Create priority classes sharing maxInflight requests
+// Replication is shed once three quarters of the budget is in use, background once half is
+func NewPriorities(maxInflight int) *Priorities {
+	return &Priorities{
+		slots: make(chan struct{}, maxInflight),
+		threshold: map[string]int{
+			PriorityInteractive: maxInflight,
+			PriorityReplication: max(maxInflight*3/4, 1),
+			PriorityBackground:  max(maxInflight/2, 1),
+		},
+	}
+}
+
+// Take a slot for a lower class without waiting, false if its threshold is reached
+func (p *Priorities) acquire(class string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.slots) >= p.threshold[class] {
+		return false
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Find priority class of request from path and X-Priority header
+func priorityOf(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, "/internal/") {
+		return PriorityReplication
+	}
+	if r.Header.Get("X-Priority") == PriorityBackground {
+		return PriorityBackground
+	}
+	return PriorityInteractive
+}
+
+// Middleware shedding requests once their class is over its threshold
+// Lower classes are shed immediately, interactive ones wait briefly for a free slot first
+// Event streams, subscriptions and WebSockets stay open indefinitely and don't take a slot
+func (p *Priorities) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if path := unversioned(r.URL.Path); path == "/watch" || path == "/ws" || path == "/subscribe" || path == "/admin/bus" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		class := priorityOf(r)
+
+		// Bulk writes would only deepen a write stall, let interactive ones through
+		if class == PriorityBackground && r.Method != "GET" && r.Method != "HEAD" && storage.WriteStall().Stalled {
+			shedWrites.Add(1)
+			shed(w)
+			return
+		}
+
+		if class != PriorityInteractive {
+			if !p.acquire(class) {
+				shed(w)
+				return
+			}
+		} else {
+			timer := time.NewTimer(interactiveWait)
+			select {
+			case p.slots <- struct{}{}:
+				timer.Stop()
+			case <-timer.C:
+				shed(w)
+				return
+			}
+		}
+		defer func() { <-p.slots }()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Reject request because node is overloaded
+func shed(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	h.WriteError(w, http.StatusServiceUnavailable, h.CodeOverloaded, "Node overloaded, try again later", "")
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	h "gokv/helper"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Messages a subscriber can buffer before further messages to it are dropped
+const messageBuffer = 256
+
+// Publish/subscribe channels, independent of the keyspace
+// Messages are only delivered to clients connected at the time, nothing is stored
+type channels struct {
+	subs  map[string]map[chan string]bool // Channel name -> subscribers
+	relay bool                            // Forward published messages to other nodes
+	mutex sync.Mutex                      // Manage access to shared resources
+}
+
+// Subscribe to messages on a channel
+func (c *channels) subscribe(name string) chan string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.subs == nil {
+		c.subs = make(map[string]map[chan string]bool)
+	}
+	if c.subs[name] == nil {
+		c.subs[name] = make(map[chan string]bool)
+	}
+	ch := make(chan string, messageBuffer)
+	c.subs[name][ch] = true
+	return ch
+}
+
+// Stop delivering messages to a subscriber and close its channel
+func (c *channels) unsubscribe(name string, ch chan string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.subs[name], ch)
+	if len(c.subs[name]) == 0 {
+		delete(c.subs, name)
+	}
+	close(ch)
+}
+
+// Deliver a message to every subscriber of a channel without blocking
+// Returns the number of subscribers that received it
+func (c *channels) publish(name string, message string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	received := 0
+	for ch := range c.subs[name] {
+		select {
+		case ch <- message:
+			received++
+		default:
+			eventsDropped.Add(1)
+		}
+	}
+	return received
+}
+
+// Relay published messages to other nodes in the cluster
+func (s *Server) SetRelay(relay bool) {
+	s.channels.relay = relay
+}
+
+// Publish a message to a channel, the request body is the message
+// POST /publish?channel=<name>
+func (s *Server) PublishRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	name := r.URL.Query().Get("channel")
+	if name == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing channel parameter", "")
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidBody, "Message too large", "")
+		return
+	}
+
+	received := s.channels.publish(name, string(body))
+	if s.channels.relay && s.nodes != nil {
+		query := url.Values{"channel": {name}}
+		go s.nodes.Broadcast(context.Background(), "/internal/publish?"+query.Encode(), body)
+	}
+	h.WriteJSON(w, http.StatusOK, map[string]int{"receivers": received})
+}
+
+// Deliver a message relayed by another node to local subscribers, the request body is the message
+// POST /internal/publish?channel=<name>
+func (s *Server) InternalPublishRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidBody, "Message too large", "")
+		return
+	}
+	s.channels.publish(r.URL.Query().Get("channel"), string(body))
+	h.WriteResponse(w, http.StatusOK, "OK")
+}
+
+// Stream messages published to a channel as Server-Sent Events
+// GET /subscribe?channel=<name>
+func (s *Server) SubscribeRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	name := r.URL.Query().Get("channel")
+	if name == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing channel parameter", "")
+		return
+	}
+
+	ch := s.channels.subscribe(name)
+	defer s.channels.unsubscribe(name, ch)
+
+	rc := http.NewResponseController(w)
+	openEnded(rc)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Println("Could not stream messages - ", err)
+		return
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg := <-ch:
+			// Encode as a JSON string so newlines can't break the event
+			data, _ := json.Marshal(msg)
+			if _, err := fmt.Fprintf(w, "event: message\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Write responses sent with a soft quota warning
+var quotaWarnings = expvar.NewInt("quota_warnings")
+
+// Soft limits of a node, crossing one adds a warning header to write responses
+// Writes are still accepted, zero disables a limit
+type softQuota struct {
+	maxKeys  int
+	maxBytes int64
+	maxRate  int // Writes per second
+
+	second int64 // Unix second writes are being counted for
+	writes int   // Writes seen in that second
+	mutex  sync.Mutex
+}
+
+// Set soft limits on number of keys, database size in bytes and writes per second
+func (s *Server) SetSoftQuota(maxKeys int, maxBytes int64, maxRate int) {
+	s.quota.mutex.Lock()
+	defer s.quota.mutex.Unlock()
+	s.quota.maxKeys, s.quota.maxBytes, s.quota.maxRate = maxKeys, maxBytes, maxRate
+}
+
+// Count a write and add an X-GoKV-Warning header for every soft limit crossed
+func (s *Server) warnQuota(w http.ResponseWriter) {
+	s.quota.mutex.Lock()
+	now := time.Now().Unix()
+	if s.quota.second != now {
+		s.quota.second, s.quota.writes = now, 0
+	}
+	s.quota.writes++
+	maxKeys, maxBytes, maxRate, writes := s.quota.maxKeys, s.quota.maxBytes, s.quota.maxRate, s.quota.writes
+	s.quota.mutex.Unlock()
+
+	var warnings []string
+	if maxKeys > 0 {
+		if keys := s.mp.Len(); keys > maxKeys {
+			warnings = append(warnings, fmt.Sprintf("keys limit=%d usage=%d", maxKeys, keys))
+		}
+	}
+	if maxBytes > 0 && s.db != nil {
+		if size := s.db.Size(); size > maxBytes {
+			warnings = append(warnings, fmt.Sprintf("bytes limit=%d usage=%d", maxBytes, size))
+		}
+	}
+	if maxRate > 0 && writes > maxRate {
+		warnings = append(warnings, fmt.Sprintf("rate limit=%d/s usage=%d/s", maxRate, writes))
+	}
+
+	for _, warning := range warnings {
+		w.Header().Add("X-GoKV-Warning", warning)
+	}
+	if len(warnings) > 0 {
+		quotaWarnings.Add(1)
+	}
+}
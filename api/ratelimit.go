@@ -0,0 +1,189 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	h "gokv/helper"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rate limit algorithms
+const (
+	limitSliding = "sliding"      // Sliding window, approximated from the current and previous fixed window
+	limitBucket  = "token_bucket" // Bucket of limit tokens refilled evenly over window
+)
+
+// Returned from inside a check that used up the limit, so nothing is written
+var errLimited = errors.New("rate limited")
+
+// Result of a rate limit check
+type limitResult struct {
+	Allowed    bool  `json:"allowed"`
+	Remaining  int64 `json:"remaining"`
+	RetryAfter int64 `json:"retry_after_ms"` // Earliest a check of the same cost could be allowed, 0 if allowed
+}
+
+// State of a sliding window limiter, stored as "sw:<window start ms>:<current count>:<previous count>"
+type slidingState struct {
+	start         int64
+	current, prev int64
+}
+
+// Parse a stored sliding window state
+func parseSliding(v string) (slidingState, bool) {
+	var st slidingState
+	_, err := fmt.Sscanf(v, "sw:%d:%d:%d", &st.start, &st.current, &st.prev)
+	return st, err == nil
+}
+
+func (st slidingState) String() string {
+	return fmt.Sprintf("sw:%d:%d:%d", st.start, st.current, st.prev)
+}
+
+// Count cost against a sliding window of limit per window at now
+// The previous window counts in proportion to how much of it still overlaps the sliding window
+func (st slidingState) take(now int64, window int64, limit int64, cost int64) (slidingState, limitResult) {
+	switch elapsed := now - st.start; {
+	case elapsed >= 2*window:
+		st = slidingState{start: now - now%window}
+	case elapsed >= window:
+		st = slidingState{start: st.start + window, prev: st.current}
+	}
+	overlap := 1 - float64(now-st.start)/float64(window)
+	used := int64(math.Ceil(float64(st.prev)*overlap)) + st.current
+	if used+cost > limit {
+		// Wait for the previous window to slide out far enough, or at least for the next window
+		wait := st.start + window - now
+		if st.prev > 0 && st.current+cost <= limit {
+			free := float64(limit-st.current-cost) / float64(st.prev)
+			wait = int64(math.Ceil((overlap - free) * float64(window)))
+		}
+		return st, limitResult{Remaining: max(limit-used, 0), RetryAfter: max(wait, 1)}
+	}
+	st.current += cost
+	return st, limitResult{Allowed: true, Remaining: limit - used - cost}
+}
+
+// State of a token bucket, stored as "tb:<tokens>:<last refill ms>"
+type bucketState struct {
+	tokens float64
+	last   int64
+}
+
+// Parse a stored token bucket state
+func parseBucket(v string) (bucketState, bool) {
+	rest, ok := strings.CutPrefix(v, "tb:")
+	tokens, last, found := strings.Cut(rest, ":")
+	if !ok || !found {
+		return bucketState{}, false
+	}
+	t, err1 := strconv.ParseFloat(tokens, 64)
+	l, err2 := strconv.ParseInt(last, 10, 64)
+	return bucketState{tokens: t, last: l}, err1 == nil && err2 == nil
+}
+
+func (st bucketState) String() string {
+	return "tb:" + strconv.FormatFloat(st.tokens, 'f', 3, 64) + ":" + strconv.FormatInt(st.last, 10)
+}
+
+// Take cost tokens from a bucket holding up to limit tokens, refilled evenly over window
+func (st bucketState) take(now int64, window int64, limit int64, cost int64) (bucketState, limitResult) {
+	rate := float64(limit) / float64(window) // Tokens per millisecond
+	st.tokens = min(st.tokens+float64(max(now-st.last, 0))*rate, float64(limit))
+	st.last = now
+	if st.tokens < float64(cost) {
+		wait := int64(math.Ceil((float64(cost) - st.tokens) / rate))
+		return st, limitResult{Remaining: int64(st.tokens), RetryAfter: max(wait, 1)}
+	}
+	st.tokens -= float64(cost)
+	return st, limitResult{Allowed: true, Remaining: int64(st.tokens)}
+}
+
+// Check and count a request against a rate limit kept under key
+// State is evaluated and stored atomically, so any number of services can share a limit
+// GET /ratelimit/check?key=<key>&limit=<n>&window=<seconds or duration>[&algo=sliding|token_bucket][&cost=<n>]
+func (s *Server) RateLimitRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	if !s.writable(w) {
+		return
+	}
+
+	query := r.URL.Query()
+	key := s.key(query.Get("key"))
+	if key == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key parameter", "")
+		return
+	}
+	limit, err := strconv.ParseInt(query.Get("limit"), 10, 64)
+	if err != nil || limit <= 0 {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Invalid limit", key)
+		return
+	}
+	d, err := parseTTL(query.Get("window"))
+	if err != nil || d < time.Millisecond {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Invalid window", key)
+		return
+	}
+	window := d.Milliseconds()
+	cost := int64(1)
+	if v := query.Get("cost"); v != "" {
+		if cost, err = strconv.ParseInt(v, 10, 64); err != nil || cost <= 0 || cost > limit {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Invalid cost", key)
+			return
+		}
+	}
+	algo := query.Get("algo")
+	if algo == "" {
+		algo = limitSliding
+	} else if algo != limitSliding && algo != limitBucket {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Invalid algo", key)
+		return
+	}
+	if !s.unfrozen(w, key) {
+		return
+	}
+
+	// Idle state is dropped once it no longer affects a check
+	ttl := d
+	if algo == limitSliding {
+		ttl = 2 * d
+	}
+
+	setRequests.Add(1)
+	var result limitResult
+	err = s.modifyExpiry(key, func(old string, at time.Time, exists bool) (string, time.Time, error) {
+		now := time.Now().UnixMilli()
+		var state fmt.Stringer
+		if algo == limitSliding {
+			st, ok := parseSliding(old)
+			if exists && !ok {
+				return "", at, &requestError{http.StatusConflict, h.CodeConflict, "Value is not a sliding window"}
+			}
+			state, result = st.take(now, window, limit, cost)
+		} else {
+			st, ok := parseBucket(old)
+			if !exists {
+				st = bucketState{tokens: float64(limit), last: now}
+			} else if !ok {
+				return "", at, &requestError{http.StatusConflict, h.CodeConflict, "Value is not a token bucket"}
+			}
+			state, result = st.take(now, window, limit, cost)
+		}
+		if !result.Allowed {
+			return "", at, errLimited
+		}
+		return state.String(), time.UnixMilli(now).Add(ttl), nil
+	})
+	if err != nil && !errors.Is(err, errLimited) {
+		writeModifyError(w, key, err)
+		return
+	}
+	h.WriteJSON(w, http.StatusOK, result)
+}
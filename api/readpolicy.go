@@ -0,0 +1,144 @@
+package api
+
+import (
+	"fmt"
+	"gokv/storage"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How a read that misses the in-memory map is answered
+const (
+	ReadMap      = "map" // Trust the map, a miss is a miss
+	ReadDatabase = "db"  // Look the key up in the database
+)
+
+// Most negative lookups remembered at once, the cache is cleared when full
+const maxNegatives = 100000
+
+// Read behavior of keys under a prefix
+// With TTL set, keys missing from the database too aren't looked up again for that long
+type ReadRule struct {
+	Mode string
+	TTL  time.Duration
+}
+
+// Read behavior per key prefix, the longest matching prefix applies and "*" applies to every other key
+// Keys with no rule are read from the map only
+type ReadPolicy map[string]ReadRule
+
+// Parse a policy such as "session:=db,user:=db:30s,*=map"
+func ParseReadPolicy(spec string) (ReadPolicy, error) {
+	p := make(ReadPolicy)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		prefix, mode, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid read policy %q", pair)
+		}
+		var rule ReadRule
+		mode, ttl, cached := strings.Cut(strings.TrimSpace(mode), ":")
+		rule.Mode = mode
+		if rule.Mode != ReadMap && rule.Mode != ReadDatabase {
+			return nil, fmt.Errorf("unknown read mode %q", mode)
+		}
+		if cached {
+			d, err := time.ParseDuration(ttl)
+			if err != nil || d <= 0 || rule.Mode != ReadDatabase {
+				return nil, fmt.Errorf("invalid negative cache TTL in %q", pair)
+			}
+			rule.TTL = d
+		}
+		p[strings.TrimSpace(prefix)] = rule
+	}
+	return p, nil
+}
+
+// Rule of the longest prefix of key
+func (p ReadPolicy) rule(key string) ReadRule {
+	best, found := "", false
+	for prefix := range p {
+		if prefix != "*" && strings.HasPrefix(key, prefix) && (!found || len(prefix) > len(best)) {
+			best, found = prefix, true
+		}
+	}
+	if found {
+		return p[best]
+	}
+	if rule, ok := p["*"]; ok {
+		return rule
+	}
+	return ReadRule{Mode: ReadMap}
+}
+
+// Keys recently found missing from the database, with when they may be looked up again
+type negativeCache struct {
+	until map[string]time.Time
+	mutex sync.Mutex // Manage access to shared resources
+}
+
+// Check if key is known to be missing at now
+func (c *negativeCache) missing(key string, now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	until, ok := c.until[key]
+	if ok && !now.Before(until) {
+		delete(c.until, key)
+		return false
+	}
+	return ok
+}
+
+// Remember that key is missing until the given time
+func (c *negativeCache) add(key string, until time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.until == nil || len(c.until) >= maxNegatives {
+		c.until = make(map[string]time.Time)
+	}
+	c.until[key] = until
+}
+
+// Set how reads that miss the in-memory map are answered
+func (s *Server) SetReadPolicy(p ReadPolicy) {
+	s.readPolicy = p
+}
+
+// Read a key, falling back to the database on a miss if its prefix asks for it
+func (s *Server) read(key string) string {
+	return storage.ReadThrough(s.mp, key, s.readMiss)
+}
+
+// Look up a key missing from the map in the database, following the read policy
+// Keys the map holds as expired aren't looked up, they are only waiting to be swept,
+// nor are keys deleted by WAL entries the database hasn't caught up with
+func (s *Server) readMiss(key string) string {
+	rule := s.readPolicy.rule(key)
+	if rule.Mode != ReadDatabase || s.db == nil {
+		return ""
+	}
+	if _, ok := s.mp.Expiry(key); ok {
+		return ""
+	}
+	if s.log.Deleted(key) {
+		return ""
+	}
+	now := time.Now()
+	if rule.TTL > 0 && s.negatives.missing(key, now) {
+		return ""
+	}
+	value, ok, err := s.db.Get(key)
+	if err != nil {
+		log.Println("Could not read key from database - ", err)
+		return ""
+	}
+	if !ok && rule.TTL > 0 {
+		s.negatives.add(key, now.Add(rule.TTL))
+	}
+	return value
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"errors"
+	h "gokv/helper"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Re-reads the configuration and applies what it can while the node runs
+// Returns the settings applied and those that only take effect after a restart
+type Reloader func() (applied []string, restart []string, err error)
+
+// Serializes reloads from the API and signals
+var reloading sync.Mutex
+
+// Set how the configuration is reloaded
+func (s *Server) SetReloader(r Reloader) {
+	s.reload = r
+}
+
+// Reload the configuration, logging what changed
+// Used by /admin/reload and on SIGHUP
+func (s *Server) Reload() ([]string, []string, error) {
+	if s.reload == nil {
+		return nil, nil, errReloadUnsupported
+	}
+	reloading.Lock()
+	defer reloading.Unlock()
+	applied, restart, err := s.reload()
+	if err != nil {
+		log.Println("Could not reload configuration - ", err)
+		return nil, nil, err
+	}
+	log.Println("Configuration reloaded - applied:", strings.Join(applied, ","), "restart required:", strings.Join(restart, ","))
+	h.Lifecycle(h.EventReloaded, strings.Join(applied, ","))
+	return applied, restart, nil
+}
+
+var errReloadUnsupported = errors.New("reloading isn't supported")
+
+// Re-read the configuration file and apply settings that can change while running
+// Settings in the environment and flags still win over the file
+// POST /admin/reload with Authorization: Bearer <ADMIN_TOKEN> or an admin X-API-Key
+func (s *Server) ReloadRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	if !s.authorized(w, r) {
+		return
+	}
+
+	applied, restart, err := s.Reload()
+	if err == errReloadUnsupported {
+		h.WriteError(w, http.StatusServiceUnavailable, h.CodeUnavailable, "Reloading isn't supported", "")
+		return
+	} else if err != nil {
+		h.WriteError(w, http.StatusInternalServerError, h.CodeInternal, "Configuration not reloaded - "+err.Error(), "")
+		return
+	}
+	h.WriteJSON(w, http.StatusOK, map[string]any{
+		"message":          "Configuration reloaded",
+		"applied":          nonNil(applied),
+		"restart_required": nonNil(restart),
+	})
+}
+
+// Encode nil slices as empty lists
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
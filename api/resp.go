@@ -0,0 +1,234 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Most arguments accepted in one RESP command
+const maxRESPArgs = 1024
+
+// Serve the Redis protocol (RESP) on a listener, blocks until it is closed
+// GET, SET, DEL, EXISTS and INCR run through the HTTP handlers, so freezes,
+// read-only mode and the WAL apply exactly as they do over HTTP
+// With API keys or tokens configured, clients authenticate with AUTH first
+func (s *Server) ServeRESP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveRESPConn(conn)
+	}
+}
+
+// Answer commands on one connection until the client quits or disconnects
+func (s *Server) serveRESPConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	var p principal // Sent with AUTH, needed once authentication is configured
+	for {
+		args, err := readRESP(r)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			fmt.Fprintf(w, "-ERR %s\r\n", err)
+			w.Flush()
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := strings.EqualFold(args[0], "QUIT")
+		cmd := strings.ToUpper(args[0])
+		need, access := RoleWrite, aclWrite
+		if cmd == "GET" || cmd == "EXISTS" {
+			need, access = RoleRead, aclRead
+		}
+		switch {
+		case cmd == "AUTH":
+			// AUTH <key or token>, or AUTH <user> <key or token> as sent by Redis 6 clients
+			if len(args) < 2 || len(args) > 3 {
+				writeRESPError(w, "wrong number of arguments for 'auth' command")
+			} else if p = s.respPrincipal(args[len(args)-1]); p.role != "" {
+				w.WriteString("+OK\r\n")
+			} else {
+				w.WriteString("-WRONGPASS invalid API key or token\r\n")
+			}
+		case cmd == "PING" || cmd == "QUIT":
+			s.respCommand(w, args)
+		case !s.authEnabled():
+			s.respThrottled(w, conn, p, args)
+		case p.role == "":
+			w.WriteString("-NOAUTH Authentication required.\r\n")
+		case roleRank[p.role] < roleRank[need]:
+			w.WriteString("-NOPERM role " + p.role + " can't run '" + strings.ToLower(cmd) + "'\r\n")
+		case !s.aclAllows(p, access, s.respKeys(args), nil):
+			w.WriteString("-NOPERM access denied by ACL\r\n")
+		default:
+			s.respThrottled(w, conn, p, args)
+		}
+		if err := w.Flush(); err != nil || quit {
+			return
+		}
+	}
+}
+
+// Run one command unless its client is over its request rate
+func (s *Server) respThrottled(w *bufio.Writer, conn net.Conn, p principal, args []string) {
+	if ok, wait := s.throttleCommand(conn.RemoteAddr().String(), p); !ok {
+		writeRESPError(w, fmt.Sprintf("too many requests, try again in %d seconds", wait))
+		return
+	}
+	s.respCommand(w, args)
+}
+
+// Run one command and write its reply
+func (s *Server) respCommand(w *bufio.Writer, args []string) {
+	cmd := strings.ToUpper(args[0])
+	switch {
+	case cmd == "PING":
+		w.WriteString("+PONG\r\n")
+	case cmd == "QUIT":
+		w.WriteString("+OK\r\n")
+	case cmd == "GET" && len(args) == 2:
+		status, msg := respCall(s.GetRequest, "/get", url.Values{"key": {args[1]}})
+		if status == http.StatusNotFound {
+			w.WriteString("$-1\r\n")
+		} else if status != http.StatusOK {
+			writeRESPError(w, msg)
+		} else {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(msg), msg)
+		}
+	case cmd == "SET" && len(args) == 3:
+		status, msg := respCall(s.SetRequest, "/set", url.Values{"key": {args[1]}, "value": {args[2]}})
+		if status != http.StatusOK {
+			writeRESPError(w, msg)
+		} else {
+			w.WriteString("+OK\r\n")
+		}
+	case cmd == "DEL" && len(args) >= 2:
+		deleted := 0
+		for _, key := range s.respKeys(args) {
+			if !s.mp.Exists(key) {
+				continue
+			}
+			status, msg := respCall(s.DeleteRequest, "/delete", url.Values{"key": {key}})
+			if status != http.StatusOK {
+				writeRESPError(w, msg)
+				return
+			}
+			deleted++
+		}
+		fmt.Fprintf(w, ":%d\r\n", deleted)
+	case cmd == "EXISTS" && len(args) >= 2:
+		found := 0
+		for _, key := range s.respKeys(args) {
+			if s.mp.Exists(key) {
+				found++
+			}
+		}
+		fmt.Fprintf(w, ":%d\r\n", found)
+	case cmd == "INCR" && len(args) == 2:
+		status, msg := respCall(s.IncrRequest, "/incr", url.Values{"key": {args[1]}})
+		if status != http.StatusOK {
+			writeRESPError(w, msg)
+		} else {
+			fmt.Fprintf(w, ":%s\r\n", msg)
+		}
+	case cmd == "GET" || cmd == "SET" || cmd == "DEL" || cmd == "EXISTS" || cmd == "INCR":
+		writeRESPError(w, "wrong number of arguments for '"+strings.ToLower(cmd)+"' command")
+	default:
+		writeRESPError(w, "unknown command '"+args[0]+"'")
+	}
+}
+
+// Keys a command reads or writes
+func (s *Server) respKeys(args []string) []string {
+	var keys []string
+	switch strings.ToUpper(args[0]) {
+	case "DEL", "EXISTS":
+		keys = args[1:]
+	case "GET", "SET", "INCR":
+		keys = args[1:min(len(args), 2)]
+	}
+	normalized := make([]string, 0, len(keys))
+	for _, key := range keys {
+		normalized = append(normalized, s.key(key))
+	}
+	return normalized
+}
+
+// Call a handler and unwrap the message it responded with
+func respCall(handler http.HandlerFunc, path string, query url.Values) (int, string) {
+	status, body := call(context.Background(), handler, path+"?"+query.Encode())
+	var resp struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		log.Println("Could not decode response - ", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+	return status, resp.Message
+}
+
+// Write an error reply, newlines would end the reply early
+func writeRESPError(w *bufio.Writer, msg string) {
+	fmt.Fprintf(w, "-ERR %s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(msg))
+}
+
+// Read a command sent as an array of bulk strings, or inline as "GET key"
+func readRESP(r *bufio.Reader) ([]string, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > maxRESPArgs {
+		return nil, errors.New("Protocol error: invalid multibulk length")
+	}
+	args := make([]string, 0, n)
+	for range n {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimPrefix(line, "$"))
+		if !strings.HasPrefix(line, "$") || err != nil || size < 0 || size > maxBodySize {
+			return nil, errors.New("Protocol error: invalid bulk length")
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// Read a line without its trailing CRLF
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && line != "" {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	h "gokv/helper"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Prefix of the current API version, routes are also served without it
+const apiVersion = "/v1"
+
+// Route served by a node, with the metadata /openapi.json is built from
+type Route struct {
+	Path    string
+	Methods []string
+	Handler http.HandlerFunc
+	Summary string
+	Params  []string // Query parameters, required ones end with "*"
+	Returns string   // "message", "object", "stream" or "ndjson"
+}
+
+// Every route of the API
+// Routes under /internal/ are used between nodes and are not versioned
+func (s *Server) Routes() []Route {
+	get, write, del := []string{"GET"}, []string{"GET", "POST"}, []string{"GET", "DELETE"}
+	post, head := []string{"POST"}, []string{"GET", "HEAD"}
+	return []Route{
+		{"/ping", get, HealthCheck, "Check that the node is up", nil, "message"},
+		{"/healthz", get, s.HealthzRequest, "Health details including write stalls", nil, "object"},
+		{"/readyz", get, s.ReadyCheck, "Check that WAL replay finished", nil, "object"},
+		{"/internal/update", post, s.InternalUpdateRequest, "Receive WAL updates from other nodes", nil, "message"},
+		{"/internal/labels", get, s.InternalLabelsRequest, "Labels of this node", nil, "object"},
+		{"/internal/freeze", post, s.InternalFreezeRequest, "Freeze a prefix on request of another node", []string{"prefix*", "ttl"}, "message"},
+		{"/internal/unfreeze", post, s.InternalUnfreezeRequest, "Unfreeze a prefix on request of another node", []string{"prefix*"}, "message"},
+		{"/internal/shutdown", post, s.InternalShutdownRequest, "Prepare, call off or finish a coordinated shutdown", []string{"phase*"}, "message"},
+		{"/internal/ids", get, s.InternalIDsRequest, "High-water mark of an ID sequence", []string{"sequence*"}, "object"},
+		{"/internal/publish", post, s.InternalPublishRequest, "Deliver a relayed pub/sub message, the body is the message", []string{"channel*"}, "message"},
+		{"/openapi.json", get, s.OpenAPIRequest, "This API description", nil, "object"},
+		{"/stats", get, s.StatsRequest, "Key count, memory, WAL, flush lag, disk usage and uptime", nil, "object"},
+		{"/topology", get, s.TopologyRequest, "Labels of this node and every connected node", nil, "object"},
+		{"/get", head, s.GetRequest, "Fetch value of a key", []string{"key*", "version", "encoding"}, "message"},
+		{"/exists", head, s.ExistsRequest, "Check if a key exists", []string{"key*"}, "object"},
+		{"/keys", get, s.KeysRequest, "List keys", []string{"match", "cursor", "limit", "format"}, "object"},
+		{"/count", get, s.CountRequest, "Count keys under a prefix or matching a pattern", []string{"prefix", "match"}, "object"},
+		{"/scan", get, s.ScanRequest, "List key-value pairs", []string{"prefix", "match", "cursor", "limit", "format"}, "object"},
+		{"/randomkey", get, s.RandomKeyRequest, "A random key", []string{"prefix"}, "message"},
+		{"/sample", get, s.KeySampleRequest, "Random sample of keys", []string{"n", "prefix"}, "object"},
+		{"/export", get, s.ExportRequest, "Stream key-value pairs as NDJSON", []string{"prefix"}, "ndjson"},
+		{"/history", get, s.HistoryRequest, "WAL history of a key", []string{"key*"}, "object"},
+		{"/versions", get, s.VersionsRequest, "Old versions of a key", []string{"key*"}, "object"},
+		{"/set", write, s.SetRequest, "Set a key-value pair", []string{"key*", "value", "ttl", "expire_at", "nx", "xx", "content_type"}, "message"},
+		{"/txn", post, s.TxnRequest, "Compare keys, then apply sets and deletes atomically", nil, "object"},
+		{"/mset", post, s.MSetRequest, "Set multiple key-value pairs", nil, "object"},
+		{"/incr", write, s.IncrRequest, "Increment an integer value", []string{"key*", "by"}, "message"},
+		{"/incrby", write, s.IncrByRequest, "Increment a counter, setting a TTL when it is created", []string{"key*", "by", "ttl"}, "object"},
+		{"/ratelimit/check", write, s.RateLimitRequest, "Count a request against a sliding window or token bucket limit", []string{"key*", "limit*", "window*", "algo", "cost"}, "object"},
+		{"/decr", write, s.DecrRequest, "Decrement an integer value", []string{"key*", "by"}, "message"},
+		{"/cas", write, s.CASRequest, "Set a key if its value matches old and its version matches version", []string{"key*", "old", "version", "value*"}, "message"},
+		{"/append", write, s.AppendRequest, "Append to the value of a key", []string{"key*", "value*"}, "object"},
+		{"/rename", write, s.RenameRequest, "Move a value to another key", []string{"key*", "to*", "nx"}, "message"},
+		{"/getset", write, s.GetSetRequest, "Set a key and return its old value", []string{"key*", "value*"}, "message"},
+		{"/getdel", del, s.GetDelRequest, "Delete a key and return its value", []string{"key*"}, "message"},
+		{"/id/next", write, s.NextIDRequest, "Next unique ID of a sequence", []string{"sequence"}, "object"},
+		{"/expire", write, s.ExpireRequest, "Set a TTL on a key", []string{"key*", "ttl*"}, "message"},
+		{"/expireat", write, s.ExpireAtRequest, "Expire a key at a unix time", []string{"key*", "at*"}, "message"},
+		{"/persist", write, s.PersistRequest, "Remove the TTL of a key", []string{"key*"}, "message"},
+		{"/meta", get, s.MetaRequest, "Created and updated times and version of a key", []string{"key*"}, "object"},
+		{"/ttl", get, s.TTLRequest, "Remaining TTL of a key in seconds", []string{"key*"}, "object"},
+		{"/watch", get, s.WatchRequest, "Stream changes as Server-Sent Events", []string{"key", "prefix", "batch_size", "max_delay"}, "stream"},
+		{"/ws", get, s.WebSocketRequest, "WebSocket API for get, set, delete and watch", nil, "stream"},
+		{"/publish", post, s.PublishRequest, "Publish a message to a channel", []string{"channel*"}, "object"},
+		{"/subscribe", get, s.SubscribeRequest, "Stream messages of a channel as Server-Sent Events", []string{"channel*"}, "stream"},
+		{"/mget", write, s.MGetRequest, "Fetch multiple values", []string{"key"}, "object"},
+		{"/delete", del, s.DeleteRequest, "Delete a key", []string{"key*", "expected", "expected_hash"}, "message"},
+		{"/delete/", del, s.DeleteRequest, "Delete the key following /delete/", []string{"expected", "expected_hash"}, "message"},
+		{"/admin/delete-prefix", post, s.DeletePrefixRequest, "Delete all keys under a prefix as a background job", []string{"prefix*", "dry_run"}, "object"},
+		{"/admin/migrate-prefix", post, s.MigratePrefixRequest, "Copy or move all keys under a prefix to another (background job)", []string{"from*", "to*", "mode", "conflict", "rate", "dry_run"}, "object"},
+		{"/admin/jobs", get, s.JobStatusRequest, "Status of background jobs", []string{"id"}, "object"},
+		{"/admin/jobs/cancel", post, s.CancelJobRequest, "Cancel a background job", []string{"id*"}, "message"},
+		{"/admin/balance", get, s.BalanceRequest, "Expected and actual key distribution", nil, "object"},
+		{"/admin/freeze", post, s.FreezeRequest, "Reject writes to a prefix across the cluster", []string{"prefix*", "ttl"}, "object"},
+		{"/admin/unfreeze", post, s.UnfreezeRequest, "Lift a freeze across the cluster", []string{"prefix*"}, "object"},
+		{"/admin/quotas", get, s.NamespaceQuotasRequest, "Quotas and usage of namespaces", nil, "object"},
+		{"/admin/freezes", get, s.FreezesRequest, "Active freezes", nil, "object"},
+		{"/admin/db/get", get, s.DBGetRequest, "Read a key directly from the database", []string{"key*"}, "object"},
+		{"/admin/db/scan", get, s.DBScanRequest, "Read key-value pairs directly from the database", []string{"prefix", "limit"}, "object"},
+		{"/admin/pending", get, s.PendingRequest, "WAL entries not yet committed to the database", nil, "object"},
+		{"/admin/sample", get, s.SampleRequest, "Uniform random sample of keys", []string{"n", "prefix", "sizes", "versions"}, "object"},
+		{"/admin/schemas", []string{"GET", "POST", "DELETE"}, s.SchemaRequest, "Manage JSON schemas of namespaces", []string{"namespace"}, "object"},
+		{"/admin/bus", get, s.BusRequest, "Internal event bus subscribers and counters, or a stream of one topic", []string{"topic"}, "object"},
+		{"/admin/reload", post, s.ReloadRequest, "Re-read the configuration file and apply settings that can change while running, requires ADMIN_TOKEN or an admin API key", nil, "object"},
+		{"/admin/shutdown", post, s.ShutdownRequest, "Flush, snapshot and stop every node, requires ADMIN_TOKEN or an admin API key", []string{"dry_run"}, "object"},
+		{"/admin/flushall", post, s.FlushAllRequest, "Delete every key on this node, requires ADMIN_TOKEN or an admin API key", []string{"dry_run"}, "object"},
+		{"/admin/trace", []string{"GET", "POST", "DELETE"}, s.TraceRequest, "Log every operation on a key for a while", []string{"key", "duration"}, "object"},
+		{"/admin/events", get, s.LifecycleEventsRequest, "Recent node lifecycle events", []string{"type"}, "object"},
+		{"/admin/bootstrap-token", get, s.BootstrapRequest, "Parameters for a new node to join the cluster", nil, "object"},
+	}
+}
+
+// Register routes on mux at their path and under /v1
+// Methods are checked before the handler runs, unknown paths return a JSON 404
+func Register(mux *http.ServeMux, routes []Route) {
+	for _, route := range routes {
+		handler := allowMethods(route.Methods, route.Handler)
+		mux.Handle(route.Path, handler)
+		if !strings.HasPrefix(route.Path, "/internal/") {
+			mux.Handle(apiVersion+route.Path, http.StripPrefix(apiVersion, handler))
+		}
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		h.WriteError(w, http.StatusNotFound, h.CodeNotFound, "Route not found", "")
+	})
+}
+
+// Reject methods a route doesn't accept with 405 and an Allow header
+func allowMethods(methods []string, next http.HandlerFunc) http.Handler {
+	allow := strings.Join(methods, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(methods, r.Method) {
+			w.Header().Set("Allow", allow)
+			h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+			return
+		}
+		next(w, r)
+	})
+}
+
+// Path of a request without the API version prefix
+func unversioned(path string) string {
+	if rest, ok := strings.CutPrefix(path, apiVersion); ok && strings.HasPrefix(rest, "/") {
+		return rest
+	}
+	return path
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"encoding/json"
+	h "gokv/helper"
+	"gokv/storage"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// JSON schemas attached to namespaces, persisted on this node
+// A key's namespace is the part before the first ':'
+type schemas struct {
+	byNamespace map[string]map[string]any // Namespace -> schema
+	mutex       sync.Mutex
+}
+
+// Load schemas from disk on first use
+func (s *schemas) load() error {
+	if s.byNamespace != nil {
+		return nil
+	}
+	s.byNamespace = make(map[string]map[string]any)
+	b, err := os.ReadFile(h.SchemasPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		s.byNamespace = nil
+		return err
+	}
+	return json.Unmarshal(b, &s.byNamespace)
+}
+
+// Persist schemas
+func (s *schemas) save() error {
+	b, err := json.Marshal(s.byNamespace)
+	if err != nil {
+		return err
+	}
+	tmp := h.SchemasPath() + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.SchemasPath())
+}
+
+// Find the schema of key's namespace, returns nil if there is none
+func (s *schemas) forKey(key string) (map[string]any, error) {
+	ns, ok := storage.Namespace(key)
+	if !ok {
+		return nil, nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s.byNamespace[ns], nil
+}
+
+// Check if a content type names JSON
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/json"
+}
+
+// Validate a JSON value against the schema of its namespace
+// Returns false after responding with the violations if it doesn't match
+func (s *Server) matchesSchema(w http.ResponseWriter, key string, value string) bool {
+	msg, violations, err := s.checkSchema(key, value)
+	if err != nil {
+		log.Println("Could not read schemas - ", err)
+		h.WriteError(w, http.StatusInternalServerError, h.CodeInternal, "Internal Server Error", "")
+		return false
+	}
+	if msg == "" {
+		return true
+	}
+	if len(violations) == 0 {
+		h.WriteError(w, http.StatusBadRequest, h.CodeSchemaViolation, msg, key)
+		return false
+	}
+	h.WriteJSON(w, http.StatusBadRequest, map[string]any{
+		"code":       h.CodeSchemaViolation,
+		"message":    msg,
+		"key":        key,
+		"violations": violations,
+	})
+	return false
+}
+
+// Check a value against the schema of its namespace, every value matches without one
+// Returns why it doesn't match, with the violations of a JSON value
+func (s *Server) checkSchema(key string, value string) (string, []string, error) {
+	schema, err := s.schemas.forKey(key)
+	if err != nil || schema == nil {
+		return "", nil, err
+	}
+	var doc any
+	if err := json.Unmarshal([]byte(value), &doc); err != nil {
+		return "Value is not valid JSON", nil, nil
+	}
+	if violations := validateJSON(schema, doc, "$"); len(violations) > 0 {
+		return "Value does not match the schema of its namespace", violations, nil
+	}
+	return "", nil, nil
+}
+
+// Manage the JSON schema of a namespace
+// GET lists schemas, or returns the one of namespace. POST sets it from the body, DELETE removes it
+// /admin/schemas[?namespace=<namespace>]
+func (s *Server) SchemaRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	ns := r.URL.Query().Get("namespace")
+	if ns == "" && r.Method != "GET" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing namespace parameter", "")
+		return
+	}
+	if strings.Contains(ns, ":") {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Namespace can't contain ':'", "")
+		return
+	}
+
+	var schema map[string]any
+	if r.Method == "POST" {
+		b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil || json.Unmarshal(b, &schema) != nil || schema == nil {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidBody, "Schema must be a JSON object", "")
+			return
+		}
+		if err := checkPatterns(schema, "$"); err != nil {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidBody, err.Error(), "")
+			return
+		}
+	}
+
+	s.schemas.mutex.Lock()
+	defer s.schemas.mutex.Unlock()
+	if err := s.schemas.load(); err != nil {
+		log.Println("Could not read schemas - ", err)
+		h.WriteError(w, http.StatusInternalServerError, h.CodeInternal, "Internal Server Error", "")
+		return
+	}
+
+	previous, existed := s.schemas.byNamespace[ns]
+	switch r.Method {
+	case "GET":
+		if ns == "" {
+			h.WriteJSON(w, http.StatusOK, map[string]any{"schemas": s.schemas.byNamespace})
+		} else if existed {
+			h.WriteJSON(w, http.StatusOK, previous)
+		} else {
+			h.WriteError(w, http.StatusNotFound, h.CodeNotFound, "No schema for namespace", "")
+		}
+		return
+	case "POST":
+		s.schemas.byNamespace[ns] = schema
+	case "DELETE":
+		delete(s.schemas.byNamespace, ns)
+	}
+	if err := s.schemas.save(); err != nil {
+		if existed {
+			s.schemas.byNamespace[ns] = previous
+		} else {
+			delete(s.schemas.byNamespace, ns)
+		}
+		log.Println("Could not save schemas - ", err)
+		h.WriteError(w, http.StatusInternalServerError, h.CodeInternal, "Internal Server Error", "")
+		return
+	}
+	h.WriteResponse(w, http.StatusOK, "Schema updated")
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"context"
+	"errors"
+	h "gokv/helper"
+	"gokv/storage"
+	"log"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Default time a stopping node waits for in-flight requests
+const DefaultShutdownDrain = 3 * time.Second
+
+// Time a node prepared by a peer waits to be told to stop before it serves again by itself
+const shutdownPrepareTimeout = 30 * time.Second
+
+// How a node stops in a coordinated shutdown
+type shutdownConfig struct {
+	hook    string        // Shell command stopping the process, the node exits by itself if empty
+	drain   time.Duration // Time to wait for in-flight requests
+	signed  bool          // Internal requests are signed, so peers may stop this node
+	stopped chan struct{} // Closed once the node should stop
+	create  sync.Once
+	close   sync.Once
+	expire  *time.Timer // Calls off a shutdown prepared by a peer that never follows up
+	mutex   sync.Mutex  // Guards expire
+}
+
+// Set how the node stops in a coordinated shutdown
+// Peers may only stop this node when requests between nodes are signed
+func (s *Server) SetShutdown(hook string, drain time.Duration, signed bool) {
+	s.shutdown.hook, s.shutdown.drain, s.shutdown.signed = hook, drain, signed
+}
+
+// Closed once a coordinated shutdown has prepared every node and this one should stop
+func (s *Server) Stopped() <-chan struct{} {
+	s.shutdown.create.Do(func() { s.shutdown.stopped = make(chan struct{}) })
+	return s.shutdown.stopped
+}
+
+// Run the shutdown hook, if one is set, once the node has closed its database
+func (s *Server) RunShutdownHook() {
+	if s.shutdown.hook == "" {
+		return
+	}
+	if out, err := exec.Command("sh", "-c", s.shutdown.hook).CombinedOutput(); err != nil {
+		log.Println("Shutdown hook failed - ", err, string(out))
+	}
+}
+
+// Stop taking requests, drain clients, flush every WAL entry, snapshot the database
+// and record a clean shutdown so the next start skips reading the WAL
+func (s *Server) prepareShutdown() (storage.CleanShutdown, int64, error) {
+	if s.db == nil || s.startup == nil {
+		return storage.CleanShutdown{}, 0, errors.New("database or startup barrier not attached")
+	}
+	s.startup.Enter(PhaseStopping)
+	if !s.startup.Drain(s.shutdown.drain) {
+		log.Println("Requests still running after draining for ", s.shutdown.drain)
+	}
+	if err := s.db.UpdateDatabase(s.log); err != nil {
+		return storage.CleanShutdown{}, 0, err
+	}
+	size, err := s.db.Snapshot(h.SnapshotPath())
+	if err != nil {
+		return storage.CleanShutdown{}, 0, err
+	}
+	marker, err := storage.MarkCleanShutdown(s.log)
+	return marker, size, err
+}
+
+// Call off a shutdown prepared by a peer unless it stops or aborts it within shutdownPrepareTimeout
+// Keeps a node from staying stopped when the coordinator fails in between
+func (s *Server) expirePreparedShutdown() {
+	s.shutdown.mutex.Lock()
+	defer s.shutdown.mutex.Unlock()
+	if s.shutdown.expire != nil {
+		s.shutdown.expire.Stop()
+	}
+	s.shutdown.expire = time.AfterFunc(shutdownPrepareTimeout, func() {
+		log.Println("Shutdown prepared but not confirmed, serving again - ", shutdownPrepareTimeout)
+		s.abortShutdown()
+	})
+}
+
+// Stop waiting for a prepared shutdown to be confirmed
+func (s *Server) confirmShutdown() {
+	s.shutdown.mutex.Lock()
+	defer s.shutdown.mutex.Unlock()
+	if s.shutdown.expire != nil {
+		s.shutdown.expire.Stop()
+		s.shutdown.expire = nil
+	}
+}
+
+// Call off a prepared shutdown and serve again
+func (s *Server) abortShutdown() {
+	if err := storage.ClearCleanShutdown(); err != nil {
+		log.Println("Could not remove clean shutdown marker - ", err)
+	}
+	if s.startup != nil && s.startup.Phase() == PhaseStopping {
+		s.startup.Enter(PhaseServing)
+	}
+}
+
+// Signal the node to shut down gracefully, then run the shutdown hook
+func (s *Server) stop() {
+	s.Stopped()
+	s.shutdown.close.Do(func() { close(s.shutdown.stopped) })
+}
+
+// Shut down every node of the cluster cleanly
+// Every node drains its clients, flushes and snapshots its database and records a clean
+// shutdown before any of them stops. If one fails, the others go back to serving
+// POST /admin/shutdown[?dry_run=true] with Authorization: Bearer <ADMIN_TOKEN> or an admin X-API-Key
+func (s *Server) ShutdownRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	if !s.authorized(w, r) {
+		return
+	}
+	if h.DryRun(r) {
+		s.shutdownDryRun(w, r)
+		return
+	}
+
+	// Prepare peers, then this node
+	// Once peers may be prepared, they are told to abort or stop even if the client went away
+	committed := context.WithoutCancel(r.Context())
+	if s.nodes != nil {
+		if failed := s.nodes.Broadcast(r.Context(), "/internal/shutdown?phase=prepare", nil); len(failed) > 0 {
+			s.nodes.Broadcast(committed, "/internal/shutdown?phase=abort", nil)
+			h.WriteJSON(w, http.StatusBadGateway, map[string]any{
+				"code":         h.CodeUnavailable,
+				"message":      "Nodes could not prepare to shut down, shutdown called off",
+				"failed_nodes": failed,
+			})
+			return
+		}
+	}
+	marker, size, err := s.prepareShutdown()
+	if err != nil {
+		log.Println("Could not prepare shutdown - ", err)
+		if s.nodes != nil {
+			s.nodes.Broadcast(committed, "/internal/shutdown?phase=abort", nil)
+		}
+		s.abortShutdown()
+		h.WriteError(w, http.StatusInternalServerError, h.CodeInternal, "Could not prepare shutdown, shutdown called off", "")
+		return
+	}
+
+	// Every node is flushed, stop them all
+	failed := []string{}
+	if s.nodes != nil {
+		failed = s.nodes.Broadcast(committed, "/internal/shutdown?phase=stop", nil)
+	}
+	h.WriteJSON(w, http.StatusOK, map[string]any{
+		"message":        "Cluster shutting down",
+		"lsn":            marker.LSN,
+		"snapshot_bytes": size,
+		"failed_nodes":   failed,
+	})
+	s.stop()
+}
+
+// Report what a shutdown would flush and stop without contacting peers or draining clients
+// Keys and bytes are those of this node, other nodes hold their own
+func (s *Server) shutdownDryRun(w http.ResponseWriter, r *http.Request) {
+	pending, err := storage.PendingEntries(s.log)
+	if err != nil {
+		log.Println("Could not read WAL log - ", err)
+		h.WriteError(w, http.StatusInternalServerError, h.CodeInternal, "Internal Server Error", "")
+		return
+	}
+	keys := s.mp.Keys(r.Context(), "")
+	if aborted(w, r) {
+		return
+	}
+	nodes := 1
+	if s.nodes != nil {
+		_, nodes = s.nodes.Position()
+	}
+	var size int64
+	if s.db != nil {
+		size = s.db.Size()
+	}
+	writeDryRun(w, map[string]any{
+		"nodes":          nodes,
+		"pending":        pending,
+		"keys":           len(keys),
+		"bytes":          s.footprint(keys),
+		"database_bytes": size,
+	})
+}
+
+// Take part in a coordinated shutdown on request of another node
+// POST /internal/shutdown?phase=prepare|abort|stop
+func (s *Server) InternalShutdownRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	if !s.shutdown.signed {
+		h.WriteError(w, http.StatusForbidden, h.CodeUnauthorized, "Set CLUSTER_SECRET to allow coordinated shutdown", "")
+		return
+	}
+
+	switch r.URL.Query().Get("phase") {
+	case "prepare":
+		if _, _, err := s.prepareShutdown(); err != nil {
+			log.Println("Could not prepare shutdown - ", err)
+			s.abortShutdown()
+			h.WriteError(w, http.StatusInternalServerError, h.CodeInternal, "Could not prepare shutdown", "")
+			return
+		}
+		s.expirePreparedShutdown()
+		h.WriteResponse(w, http.StatusOK, "OK")
+	case "abort":
+		s.confirmShutdown()
+		s.abortShutdown()
+		h.WriteResponse(w, http.StatusOK, "OK")
+	case "stop":
+		s.confirmShutdown()
+		if s.startup == nil || s.startup.Phase() != PhaseStopping {
+			h.WriteError(w, http.StatusConflict, h.CodeConflict, "Shutdown not prepared", "")
+			return
+		}
+		h.WriteResponse(w, http.StatusOK, "OK")
+		s.stop()
+	default:
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Invalid phase", "")
+	}
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	h "gokv/helper"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Burn rate over both windows that triggers an alert
+// At 14.4 a 30 day error budget is gone in about 2 days
+const alertBurnRate = 14.4
+
+// Number of one-minute buckets kept, the long window
+const sloBuckets = 60
+
+// Short window confirming a long window burn is still happening
+const shortWindow = 5
+
+// Latency objective of an endpoint, e.g. 99% of /get under 5ms
+type SLO struct {
+	Path      string
+	Target    float64 // Fraction of requests that must be fast enough
+	Threshold time.Duration
+}
+
+// Requests per minute that met and missed the objective
+type sloBucket struct {
+	minute int64
+	good   int64
+	bad    int64
+}
+
+// Tracks compliance of every SLO in rolling windows
+type SLOTracker struct {
+	slos    map[string]SLO
+	buckets map[string]*[sloBuckets]sloBucket
+	alerted map[string]bool
+	mutex   sync.Mutex
+}
+
+// Parse SLOs such as "/get=99:5ms,/set=99.9:20ms"
+func ParseSLOs(spec string) ([]SLO, error) {
+	var slos []SLO
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		path, rest, ok1 := strings.Cut(item, "=")
+		target, threshold, ok2 := strings.Cut(rest, ":")
+		pct, err1 := strconv.ParseFloat(target, 64)
+		d, err2 := time.ParseDuration(threshold)
+		if !ok1 || !ok2 || err1 != nil || err2 != nil || pct <= 0 || pct >= 100 {
+			return nil, errors.New("Invalid SLO - " + item)
+		}
+		slos = append(slos, SLO{Path: path, Target: pct / 100, Threshold: d})
+	}
+	return slos, nil
+}
+
+// Create a tracker for slos
+func NewSLOTracker(slos []SLO) *SLOTracker {
+	t := &SLOTracker{
+		slos:    make(map[string]SLO),
+		buckets: make(map[string]*[sloBuckets]sloBucket),
+		alerted: make(map[string]bool),
+	}
+	for _, slo := range slos {
+		t.slos[slo.Path] = slo
+		t.buckets[slo.Path] = &[sloBuckets]sloBucket{}
+	}
+	return t
+}
+
+// Middleware timing requests to endpoints with an SLO
+// Server errors count against the objective regardless of latency
+func (t *SLOTracker) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slo, ok := t.slos[unversioned(r.URL.Path)]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		good := time.Since(start) <= slo.Threshold && rec.status < 500
+		t.record(slo.Path, start, good)
+	})
+}
+
+// Count a request in its minute bucket
+func (t *SLOTracker) record(path string, at time.Time, good bool) {
+	minute := at.Unix() / 60
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	b := &t.buckets[path][minute%sloBuckets]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	if good {
+		b.good++
+	} else {
+		b.bad++
+	}
+}
+
+// Burn rate of path over the last window minutes
+// 1 means the error budget is used exactly as fast as the target allows
+func (t *SLOTracker) burnRate(path string, window int64, now time.Time) float64 {
+	var good, bad int64
+	current := now.Unix() / 60
+	for _, b := range t.buckets[path] {
+		if b.minute > current-window && b.minute <= current {
+			good += b.good
+			bad += b.bad
+		}
+	}
+	if good+bad == 0 {
+		return 0
+	}
+	return float64(bad) / float64(good+bad) / (1 - t.slos[path].Target)
+}
+
+// Burn rates of every SLO over the short and long window
+func (t *SLOTracker) Stats() map[string]map[string]float64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	stats := make(map[string]map[string]float64, len(t.slos))
+	for path := range t.slos {
+		stats[path] = map[string]float64{
+			"burn_rate_5m": t.burnRate(path, shortWindow, now),
+			"burn_rate_1h": t.burnRate(path, sloBuckets, now),
+		}
+	}
+	return stats
+}
+
+// Send a webhook alert whenever an SLO starts burning its budget too fast
+// Checks every minute until ctx is done
+func (t *SLOTracker) Watch(ctx context.Context, webhook string) error {
+	for h.Wait(ctx, time.Minute) {
+		for path, rates := range t.Stats() {
+			burning := rates["burn_rate_5m"] > alertBurnRate && rates["burn_rate_1h"] > alertBurnRate
+			t.mutex.Lock()
+			changed := burning != t.alerted[path]
+			t.alerted[path] = burning
+			t.mutex.Unlock()
+			if changed && burning {
+				h.Alert(webhook, fmt.Sprintf("SLO of %s burning error budget at %.1fx", path, rates["burn_rate_1h"]))
+			}
+		}
+	}
+	return nil
+}
+
+// Response writer remembering the status code
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Expose wrapped writer to http.ResponseController, e.g. for flushing
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
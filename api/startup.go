@@ -0,0 +1,136 @@
+package api
+
+import (
+	h "gokv/helper"
+	"gokv/storage"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Startup phases of a node, in order
+const (
+	PhaseRecovering = "recovering"  // Loading the database and replaying the WAL
+	PhaseCatchingUp = "catching_up" // Fetching what was missed while down from peers
+	PhaseServing    = "serving"     // Serving reads and accepting writes
+	PhaseStopping   = "stopping"    // Draining clients before a coordinated shutdown
+)
+
+// Routes answered while a node isn't serving, so probes and peers can follow its startup
+// and a coordinated shutdown can go on
+var probeRoutes = map[string]bool{
+	"/ping": true, "/healthz": true, "/readyz": true, "/topology": true,
+	"/stats": true, "/openapi.json": true, "/internal/labels": true, "/internal/shutdown": true,
+}
+
+// Long-lived routes not waited for when draining
+var streamRoutes = map[string]bool{"/watch": true, "/ws": true, "/subscribe": true}
+
+// Phase the node entered and when
+type PhaseChange struct {
+	Phase string    `json:"phase"`
+	At    time.Time `json:"at"`
+}
+
+// Startup state of the node, reported by /readyz and /topology
+type StartupStatus struct {
+	Phase       string               `json:"phase"`
+	Since       time.Time            `json:"since"`
+	Transitions []PhaseChange        `json:"transitions"`
+	Replay      storage.ReplayStatus `json:"replay"`
+}
+
+// Startup barrier
+// The node listens from the start of recovery, but only answers probes until it is serving
+type Startup struct {
+	replay      *storage.Replay
+	transitions []PhaseChange
+	next        atomic.Pointer[http.Handler] // Handler of every route, attached once built
+	inflight    atomic.Int64                 // Requests being handled, streams excluded
+	mutex       sync.RWMutex                 // Manage access to shared resources
+}
+
+// Create a startup barrier in the recovering phase
+// replay reports WAL replay progress while recovering
+func NewStartup(replay *storage.Replay) *Startup {
+	return &Startup{replay: replay, transitions: []PhaseChange{{Phase: PhaseRecovering, At: time.Now()}}}
+}
+
+// Move to the next startup phase
+func (s *Startup) Enter(phase string) {
+	s.mutex.Lock()
+	s.transitions = append(s.transitions, PhaseChange{Phase: phase, At: time.Now()})
+	s.mutex.Unlock()
+	log.Println("Startup phase - ", phase)
+	h.Lifecycle(h.EventStartupPhase, phase)
+}
+
+// Current startup phase
+func (s *Startup) Phase() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.transitions[len(s.transitions)-1].Phase
+}
+
+// Get a copy of the startup state
+func (s *Startup) Status() StartupStatus {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	last := s.transitions[len(s.transitions)-1]
+	status := StartupStatus{
+		Phase:       last.Phase,
+		Since:       last.At,
+		Transitions: append([]PhaseChange(nil), s.transitions...),
+	}
+	if s.replay != nil {
+		status.Replay = s.replay.Status()
+	}
+	return status
+}
+
+// Attach the handler of every route
+// Until then only /ping and /readyz are answered
+func (s *Startup) Serve(next http.Handler) {
+	s.next.Store(&next)
+}
+
+// Wait until requests other than the caller's own have finished, at most timeout
+// Returns false if some were still running
+func (s *Startup) Drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for s.inflight.Load() > 1 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// Hold back requests until the node is serving
+// Probes pass through once routes are attached, everything else gets 503
+func (s *Startup) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	next := s.next.Load()
+	path := strings.TrimPrefix(r.URL.Path, "/v1")
+	if next != nil && (probeRoutes[path] || s.Phase() == PhaseServing) {
+		if !streamRoutes[path] {
+			s.inflight.Add(1)
+			defer s.inflight.Add(-1)
+		}
+		(*next).ServeHTTP(w, r)
+		return
+	}
+	switch path {
+	case "/ping":
+		HealthCheck(w, r)
+		return
+	case "/readyz":
+		h.WriteJSON(w, http.StatusServiceUnavailable, map[string]any{"ready": false, "startup": s.Status()})
+		return
+	}
+	w.Header().Set("Retry-After", "1")
+	h.WriteError(w, http.StatusServiceUnavailable, h.CodeUnavailable, "Node is "+strings.ReplaceAll(s.Phase(), "_", " "), "")
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	h "gokv/helper"
+	"gokv/storage"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+)
+
+// Start of this process, for uptime
+var started = time.Now()
+
+// Report the internal state of the node
+// GET /stats
+func (s *Server) StatsRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	var walBytes int64
+	if info, err := os.Stat(h.WALPath()); err == nil {
+		walBytes = info.Size()
+	} else if !os.IsNotExist(err) {
+		log.Println("Could not stat WAL log - ", err)
+	}
+
+	// LSNs start at 1, the checkpoint counts committed lines
+	lsn, checkpoint := s.log.GetLSN(), s.log.GetCheckpoint()
+	flush := map[string]any{"pending_entries": max(lsn-1-checkpoint, 0), "last_flush": nil, "seconds_since_flush": nil}
+	if last := storage.LastFlush(); !last.IsZero() {
+		flush["last_flush"] = last.UTC().Format(time.RFC3339)
+		flush["seconds_since_flush"] = time.Since(last).Seconds()
+	}
+
+	var diskBytes any
+	if s.db != nil {
+		diskBytes = s.db.Size()
+	}
+
+	h.WriteJSON(w, http.StatusOK, map[string]any{
+		"keys": s.mp.Len(),
+		"memory": map[string]uint64{
+			"heap_alloc_bytes": mem.HeapAlloc,
+			"sys_bytes":        mem.Sys,
+		},
+		"wal": map[string]any{
+			"lsn":        lsn,
+			"checkpoint": checkpoint,
+			"bytes":      walBytes,
+		},
+		"flush":          flush,
+		"disk_bytes":     diskBytes,
+		"uptime_seconds": int64(time.Since(started).Seconds()),
+		"goroutines":     runtime.NumGoroutine(),
+	})
+}
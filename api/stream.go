@@ -0,0 +1,123 @@
+package api
+
+import (
+	"encoding/json"
+	h "gokv/helper"
+	"mime"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// NDJSON lines written between flushes of a streamed response
+const streamFlushEvery = 500
+
+// Limits on key listings
+type scanLimits struct {
+	maxPage int           // Largest page of a paginated listing
+	slots   chan struct{} // Streamed listings that may run at once
+}
+
+// Set the largest page size and how many listings may stream at once
+// Zero keeps the default page size and leaves streams uncapped
+func (s *Server) SetScanLimits(maxPage int, maxStreams int) {
+	s.scans.maxPage = maxPage
+	if maxStreams > 0 {
+		s.scans.slots = make(chan struct{}, maxStreams)
+	}
+}
+
+// Largest page size of paginated listings
+func (s *Server) maxPage() int {
+	if s.scans.maxPage > 0 {
+		return s.scans.maxPage
+	}
+	return maxKeysLimit
+}
+
+// Check if the client asked for a streamed NDJSON response
+func wantsNDJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "ndjson" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Accept"))
+	return err == nil && mediaType == "application/x-ndjson"
+}
+
+// Sort keys and drop those up to and including cursor
+func after(keys []string, cursor string) []string {
+	sort.Strings(keys)
+	start := sort.SearchStrings(keys, cursor)
+	if start < len(keys) && keys[start] == cursor {
+		start++
+	}
+	return keys[start:]
+}
+
+// Lift the server's read and write timeouts for a response that streams as long as the client wants
+// The read timeout would otherwise also cancel the request context
+func openEnded(rc *http.ResponseController) {
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+}
+
+// Take one of the slots streamed listings share, responding overloaded if none is free
+// Taken before keys are listed, so streams over the limit don't scan at all
+// If it returns true, release must be called once the stream ends
+func (s *Server) streamSlot(w http.ResponseWriter) (release func(), ok bool) {
+	if s.scans.slots == nil {
+		return func() {}, true
+	}
+	select {
+	case s.scans.slots <- struct{}{}:
+		return func() { <-s.scans.slots }, true
+	default:
+		shed(w)
+		return nil, false
+	}
+}
+
+// Start an NDJSON response and return a function writing one JSON object per line, flushing as it goes
+// The function returns false once the client went away or a line could not be written
+func startNDJSON(w http.ResponseWriter, r *http.Request) func(line any) bool {
+	rc := http.NewResponseController(w)
+	openEnded(rc)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	n := 0
+	return func(line any) bool {
+		if r.Context().Err() != nil || enc.Encode(line) != nil {
+			return false
+		}
+		if n++; n%streamFlushEvery == 0 {
+			rc.Flush()
+		}
+		return true
+	}
+}
+
+// Stream every key-value pair under a prefix as NDJSON, in no particular order
+// Lines are {"key", "value"} plus "expire_at" in unix seconds for keys with a TTL
+// Pairs are written as they are read, the listing is never held in memory as a whole
+// GET /export?prefix=<prefix>
+func (s *Server) ExportRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	release, ok := s.streamSlot(w)
+	if !ok {
+		return
+	}
+	defer release()
+
+	write := startNDJSON(w, r)
+	s.mp.Range(r.Context(), s.prefix(r.URL.Query().Get("prefix")), func(k string, v string) bool {
+		item := map[string]any{"key": k, "value": v}
+		if at, ok := s.mp.Expiry(k); ok {
+			item["expire_at"] = at.Unix()
+		}
+		return write(item)
+	})
+}
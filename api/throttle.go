@@ -0,0 +1,162 @@
+package api
+
+import (
+	"expvar"
+	"fmt"
+	h "gokv/helper"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often buckets of clients that went quiet are dropped
+const throttleSweep = time.Minute
+
+// Requests rejected with 429, by "ip" and "principal"
+var throttled = expvar.NewMap("throttled")
+
+// Requests allowed per window, as a token bucket holding Limit tokens refilled evenly over Window
+// A zero Limit disables it
+type RequestRate struct {
+	Limit  int64
+	Window time.Duration
+}
+
+// Parse a rate such as "100/s", "6000/1m" or "10/100ms", empty disables it
+func ParseRequestRate(spec string) (RequestRate, error) {
+	if spec == "" {
+		return RequestRate{}, nil
+	}
+	n, per, ok := strings.Cut(spec, "/")
+	limit, err := strconv.ParseInt(strings.TrimSpace(n), 10, 64)
+	if !ok || err != nil || limit <= 0 {
+		return RequestRate{}, fmt.Errorf("invalid rate %q", spec)
+	}
+	per = strings.TrimSpace(per)
+	if per == "s" || per == "m" || per == "h" {
+		per = "1" + per
+	}
+	window, err := time.ParseDuration(per)
+	if err != nil || window < time.Millisecond {
+		return RequestRate{}, fmt.Errorf("invalid rate %q", spec)
+	}
+	return RequestRate{Limit: limit, Window: window}, nil
+}
+
+// Token buckets of clients by IP and by principal
+type throttle struct {
+	rates   atomic.Pointer[[2]RequestRate] // Per IP and per principal
+	buckets map[string]bucketState
+	swept   time.Time
+	mutex   sync.Mutex // Manage access to shared resources
+}
+
+// Limit requests per client IP and per API key or token subject from now on
+func (s *Server) SetRequestRates(perIP RequestRate, perPrincipal RequestRate) {
+	s.throttle.rates.Store(&[2]RequestRate{perIP, perPrincipal})
+}
+
+// Take a token from the bucket of id
+// Buckets that would have refilled completely are dropped every throttleSweep
+func (t *throttle) take(id string, rate RequestRate, now time.Time) limitResult {
+	ms, window := now.UnixMilli(), rate.Window.Milliseconds()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.buckets == nil {
+		t.buckets = make(map[string]bucketState)
+	}
+	if now.Sub(t.swept) > throttleSweep {
+		for k, st := range t.buckets {
+			if ms-st.last > window {
+				delete(t.buckets, k)
+			}
+		}
+		t.swept = now
+	}
+	st, ok := t.buckets[id]
+	if !ok {
+		st = bucketState{tokens: float64(rate.Limit), last: ms}
+	}
+	st, result := st.take(ms, window, rate.Limit, 1)
+	t.buckets[id] = st
+	return result
+}
+
+// Count a request against a client's rate, returns the seconds to wait if it is used up
+// kind is "ip" or "principal"
+func (s *Server) throttleTake(kind string, id string) (bool, int64) {
+	rates := s.throttle.rates.Load()
+	if rates == nil {
+		return true, 0
+	}
+	rate := rates[0]
+	if kind == "principal" {
+		rate = rates[1]
+	}
+	if rate.Limit == 0 {
+		return true, 0
+	}
+	result := s.throttle.take(kind+":"+id, rate, time.Now())
+	if result.Allowed {
+		return true, 0
+	}
+	throttled.Add(kind, 1)
+	return false, (result.RetryAfter + 999) / 1000
+}
+
+// Count a request against a client's rate, responds with 429 and Retry-After if it is used up
+func (s *Server) throttleCheck(w http.ResponseWriter, kind string, id string) bool {
+	ok, wait := s.throttleTake(kind, id)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.FormatInt(wait, 10))
+		h.WriteError(w, http.StatusTooManyRequests, h.CodeRateLimited, "Too many requests, try again later", "")
+	}
+	return ok
+}
+
+// Count a RESP command or WebSocket message against the rates of its client address and principal
+// Returns the seconds to wait if either is used up
+func (s *Server) throttleCommand(addr string, p principal) (bool, int64) {
+	ip := clientIP(addr)
+	if ok, wait := s.throttleTake("ip", ip); !ok {
+		return false, wait
+	}
+	return s.throttleTake("principal", principalID(p, ip))
+}
+
+// Host part of a client address
+func clientIP(addr string) string {
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return ip
+}
+
+// Rate limiting identity of a principal, unauthenticated clients are limited by address
+func principalID(p principal, ip string) string {
+	if p.id == "" {
+		return "anonymous:" + ip
+	}
+	return p.id
+}
+
+// Middleware limiting requests per client IP, probes and routes between nodes aren't limited
+// Requests per principal are limited once authenticated, by AuthHandler
+func (s *Server) ThrottleHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := unversioned(r.URL.Path)
+		if path == "/ping" || path == "/healthz" || path == "/readyz" || strings.HasPrefix(path, "/internal/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !s.throttleCheck(w, "ip", clientIP(r.RemoteAddr)) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
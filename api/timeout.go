@@ -0,0 +1,53 @@
+package api
+
+import (
+	"context"
+	"expvar"
+	h "gokv/helper"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Keys a long loop goes through between checks of the request context
+const abortCheckEvery = 1024
+
+// Requests ended early, by "timeout" once REQUEST_TIMEOUT passed and "disconnected" when the client went away
+var requestsAborted = expvar.NewMap("requests_aborted")
+
+// Give requests at most d from now on, zero lifts the deadline
+func (s *Server) SetRequestTimeout(d time.Duration) {
+	s.requestTimeout.Store(int64(d))
+}
+
+// Check if a request ended before its handler finished, responds with 504 if its deadline passed
+// Nothing is written to a client that went away
+func aborted(w http.ResponseWriter, r *http.Request) bool {
+	switch r.Context().Err() {
+	case nil:
+		return false
+	case context.DeadlineExceeded:
+		requestsAborted.Add("timeout", 1)
+		h.WriteError(w, http.StatusGatewayTimeout, h.CodeTimeout, "Request took longer than REQUEST_TIMEOUT", "")
+	default:
+		requestsAborted.Add("disconnected", 1)
+	}
+	return true
+}
+
+// Middleware giving requests a deadline of REQUEST_TIMEOUT, handlers stop scanning keys once it passes
+// Streams, exports, admin and internal routes run as long as they need
+func (s *Server) TimeoutHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := time.Duration(s.requestTimeout.Load())
+		path := unversioned(r.URL.Path)
+		if d <= 0 || streamRoutes[path] || path == "/export" || wantsNDJSON(r) ||
+			strings.HasPrefix(path, "/admin/") || strings.HasPrefix(path, "/internal/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	h "gokv/helper"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Default and longest duration of a key trace
+const (
+	defaultTraceDuration = 5 * time.Minute
+	maxTraceDuration     = time.Hour
+)
+
+// Numbers requests touching a traced key, so their start and end can be matched in the log
+var tracedRequests atomic.Int64
+
+// Trace every operation on a key across the API, WAL and database flushes for a while
+// GET lists active traces with their recent events, DELETE stops tracing key
+// POST /admin/trace?key=<key>&duration=<seconds or duration>
+func (s *Server) TraceRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	if r.Method == "GET" {
+		h.WriteJSON(w, http.StatusOK, map[string]any{"traces": h.Traces()})
+		return
+	}
+
+	key := s.key(r.URL.Query().Get("key"))
+	if key == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key parameter", "")
+		return
+	}
+	if r.Method == "DELETE" {
+		if !h.StopTrace(key) {
+			h.WriteError(w, http.StatusNotFound, h.CodeNotFound, "Key isn't traced", key)
+			return
+		}
+		h.WriteResponse(w, http.StatusOK, "Trace stopped")
+		return
+	}
+
+	d := defaultTraceDuration
+	if v := r.URL.Query().Get("duration"); v != "" {
+		var err error
+		if d, err = parseTTL(v); err != nil || d > maxTraceDuration {
+			h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Invalid duration, at most "+maxTraceDuration.String(), key)
+			return
+		}
+	}
+	h.WriteJSON(w, http.StatusOK, h.StartTrace(key, d))
+}
+
+// Middleware logging requests that name a traced key, with their status and duration
+func (s *Server) TraceHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.Tracing() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		keys := s.tracedKeys(r)
+		if len(keys) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id := tracedRequests.Add(1)
+		for _, key := range keys {
+			h.Trace(key, h.TraceAPI, fmt.Sprintf("request %d started - %s %s", id, r.Method, r.URL.RequestURI()))
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		for _, key := range keys {
+			h.Trace(key, h.TraceAPI, fmt.Sprintf("request %d finished - status %d in %s", id, rec.status, time.Since(start)))
+		}
+	})
+}
+
+// Traced keys named by a request, in its query, path or JSON body
+// The body is put back for the handler to read
+func (s *Server) tracedKeys(r *http.Request) []string {
+	query := r.URL.Query()
+	names := slices.Concat(query["key"], query["to"])
+	if v := query.Get("keys"); v != "" {
+		names = append(names, strings.Split(v, ",")...)
+	}
+	if rest, ok := strings.CutPrefix(unversioned(r.URL.Path), "/delete/"); ok {
+		names = append(names, rest)
+	}
+
+	var keys []string
+	for _, name := range names {
+		if key := s.key(name); h.Traced(key) && !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+
+	if r.Body == nil || r.Method != "POST" {
+		return keys
+	}
+	b, _ := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(b), r.Body))
+	for _, key := range h.TracedKeys() {
+		quoted, _ := json.Marshal(key)
+		if bytes.Contains(b, quoted) && !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
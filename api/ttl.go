@@ -0,0 +1,196 @@
+package api
+
+import (
+	"context"
+	"errors"
+	h "gokv/helper"
+	"gokv/storage"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Expiries are swept this often
+const sweepInterval = time.Second
+
+// Leaves a listed key alone whose expiry was refreshed since, without writing it
+var errRefreshed = errors.New("expiry refreshed")
+
+// Parse a TTL given in seconds ("30") or as a duration ("30s", "5m")
+func parseTTL(v string) (time.Duration, error) {
+	if n, err := strconv.Atoi(v); err == nil {
+		v = strconv.Itoa(n) + "s"
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, errors.New("invalid ttl")
+	}
+	return d, nil
+}
+
+// Parse an absolute expiry given as unix seconds
+// Times in the past are allowed, the key is then removed by the next sweep
+func parseExpireAt(v string) (time.Time, error) {
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || sec <= 0 {
+		return time.Time{}, errors.New("invalid expiry time")
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// Log and apply expiry of a key, zero time removes it
+// Returns false if the key doesn't exist
+func (s *Server) expire(key string, at time.Time) (bool, error) {
+	if !s.mp.Exists(key) {
+		return false, nil
+	}
+	if _, err := s.log.UpdateLog("EXPIRE", key, storage.EncodeExpiry(at)); err != nil {
+		return false, err
+	}
+	return s.mp.SetExpiry(key, at), nil
+}
+
+// Set a TTL on an existing key
+// GET /expire?key=<key>&ttl=<seconds or duration>
+func (s *Server) ExpireRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	if !s.writable(w) {
+		return
+	}
+
+	key := s.key(r.URL.Query().Get("key"))
+	if key == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key parameter", "")
+		return
+	}
+	ttl, err := parseTTL(r.URL.Query().Get("ttl"))
+	if err != nil {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Invalid ttl", key)
+		return
+	}
+	if !s.unfrozen(w, key) {
+		return
+	}
+
+	s.writeExpire(w, key, time.Now().Add(ttl), "Expiry set")
+}
+
+// Expire a key at an absolute time
+// GET /expireat?key=<key>&at=<unix seconds>
+func (s *Server) ExpireAtRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	if !s.writable(w) {
+		return
+	}
+
+	key := s.key(r.URL.Query().Get("key"))
+	if key == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key parameter", "")
+		return
+	}
+	at, err := parseExpireAt(r.URL.Query().Get("at"))
+	if err != nil {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "Invalid expiry time", key)
+		return
+	}
+	if !s.unfrozen(w, key) {
+		return
+	}
+
+	s.writeExpire(w, key, at, "Expiry set")
+}
+
+// Remove the TTL of a key
+// GET /persist?key=<key>
+func (s *Server) PersistRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	if !s.writable(w) {
+		return
+	}
+
+	key := s.key(r.URL.Query().Get("key"))
+	if key == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key parameter", "")
+		return
+	}
+	if !s.unfrozen(w, key) {
+		return
+	}
+
+	s.writeExpire(w, key, time.Time{}, "Expiry removed")
+}
+
+// Apply expiry and respond with the outcome
+func (s *Server) writeExpire(w http.ResponseWriter, key string, at time.Time, message string) {
+	ok, err := s.expire(key, at)
+	if err != nil {
+		log.Println("Error writing to log - ", err)
+		walErrors.Add(1)
+		h.WriteError(w, http.StatusInternalServerError, h.CodeInternal, "Internal Server Error", "")
+		return
+	} else if !ok {
+		h.WriteError(w, http.StatusNotFound, h.CodeKeyNotFound, "Key not found", key)
+		return
+	}
+	h.WriteResponse(w, http.StatusOK, message)
+}
+
+// Get remaining TTL of a key in seconds, -1 if it doesn't expire
+// GET /ttl?key=<key>
+func (s *Server) TTLRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+
+	key := s.key(r.URL.Query().Get("key"))
+	if key == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeMissingParameter, "Missing key parameter", "")
+		return
+	} else if !s.mp.Exists(key) {
+		h.WriteError(w, http.StatusNotFound, h.CodeKeyNotFound, "Key not found", key)
+		return
+	}
+
+	at, ok := s.mp.Expiry(key)
+	if !ok {
+		h.WriteJSON(w, http.StatusOK, map[string]int64{"ttl": -1})
+		return
+	}
+	remaining := time.Until(at).Round(time.Second) / time.Second
+	h.WriteJSON(w, http.StatusOK, map[string]int64{"ttl": int64(max(remaining, 0))})
+}
+
+// Delete expired keys, logging a DELETE for each so it survives restart
+// The map reports each removal as an "expire" event
+// Runs every second until ctx is done
+func (s *Server) SweepExpired(ctx context.Context) error {
+	for h.Wait(ctx, sweepInterval) {
+		for _, key := range s.mp.Expired() {
+			err := s.mp.Modify(key, func(old string, exists bool) (string, bool, error) {
+				if exists {
+					return old, false, errRefreshed
+				}
+				if _, err := s.log.UpdateLog("DELETE", key, ""); err != nil {
+					return "", false, err
+				}
+				return "", true, nil
+			})
+			if err != nil && !errors.Is(err, errRefreshed) {
+				log.Println("Error writing to log - ", err)
+				walErrors.Add(1)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	h "gokv/helper"
+	"gokv/storage"
+	"net/http"
+	"time"
+)
+
+// Most comparisons and operations a transaction may hold
+const maxTxnOps = 128
+
+// Condition checked before a transaction picks a branch
+// Target is "value" (equal to value), "hash" (SHA-256 of the value as shown
+// by /history equals value), "exists" (key existence equals exists) or
+// "version" (version as shown by /meta equals version, 0 for a missing key)
+type txnCompare struct {
+	Key     string `json:"key"`
+	Target  string `json:"target"`
+	Value   string `json:"value"`
+	Exists  bool   `json:"exists"`
+	Version int64  `json:"version"`
+}
+
+// Operation of a transaction branch, op is "get", "set" or "delete"
+type txnRequestOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Result of one operation of the branch that ran
+type txnResult struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	Found *bool  `json:"found,omitempty"`
+}
+
+// Check a comparison against the current value and metadata of its key
+func (c txnCompare) holds(value string, meta storage.KeyMeta, exists bool) bool {
+	switch c.Target {
+	case "version":
+		return meta.Version == c.Version
+	case "value":
+		return exists && value == c.Value
+	case "hash":
+		return exists && valueHash(value) == c.Value
+	default: // exists
+		return exists == c.Exists
+	}
+}
+
+// SHA-256 of a value in hex, as reported by /history
+func valueHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// Validate comparisons and both branches of a transaction
+// Returns an error message and offending key if invalid
+func (s *Server) validateTxn(compare []txnCompare, branches ...[]txnRequestOp) (string, string) {
+	count := len(compare)
+	for _, c := range compare {
+		if c.Key == "" {
+			return "Empty key", ""
+		}
+		if c.Target != "value" && c.Target != "hash" && c.Target != "exists" && c.Target != "version" {
+			return "Invalid compare target", c.Key
+		}
+	}
+	for _, ops := range branches {
+		count += len(ops)
+		for _, op := range ops {
+			if op.Key == "" {
+				return "Empty key", ""
+			}
+			switch op.Op {
+			case "get", "delete":
+			case "set":
+				if msg := s.validatePair(op.Key, op.Value); msg != "" {
+					return msg, op.Key
+				}
+			default:
+				return "Invalid operation", op.Key
+			}
+		}
+	}
+	if count > maxTxnOps {
+		return "Too many operations", ""
+	}
+	return "", ""
+}
+
+// Compare keys, then apply the success or failure operations atomically
+// All writes of the branch that runs go to the WAL as a single record
+// POST /txn  {"compare": [...], "success": [...], "failure": [...]}
+func (s *Server) TxnRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+
+	if !s.writable(w) {
+		return
+	}
+
+	var body struct {
+		Compare []txnCompare   `json:"compare"`
+		Success []txnRequestOp `json:"success"`
+		Failure []txnRequestOp `json:"failure"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&body); err != nil {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidBody, "Invalid request body", "")
+		return
+	}
+	for i := range body.Compare {
+		body.Compare[i].Key = s.key(body.Compare[i].Key)
+	}
+	for _, ops := range [][]txnRequestOp{body.Success, body.Failure} {
+		for i := range ops {
+			ops[i].Key = s.key(ops[i].Key)
+		}
+	}
+	if msg, key := s.validateTxn(body.Compare, body.Success, body.Failure); msg != "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidBody, msg, key)
+		return
+	}
+
+	// Either branch may run, so neither may write to a frozen prefix
+	// Quotas are checked against the writes of the branch that runs
+	var writes []string
+	for _, op := range append(body.Success, body.Failure...) {
+		if op.Op != "get" {
+			writes = append(writes, op.Key)
+		}
+	}
+	if !s.unfrozen(w, writes...) {
+		return
+	}
+	s.measureQuotas(writes...)
+
+	var succeeded bool
+	var results []txnResult
+	var ops []storage.TxnOp
+	err := s.mp.Transact(func(get func(key string) (string, bool), _ func(key string) time.Time, meta func(key string) storage.KeyMeta) ([]storage.TxnOp, error) {
+		succeeded = true
+		for _, c := range body.Compare {
+			if value, exists := get(c.Key); !c.holds(value, meta(c.Key), exists) {
+				succeeded = false
+				break
+			}
+		}
+		branch := body.Success
+		if !succeeded {
+			branch = body.Failure
+		}
+
+		// Gets see the writes made earlier in the branch
+		written := make(map[string]*string)
+		for _, op := range branch {
+			switch op.Op {
+			case "get":
+				value, found := get(op.Key)
+				if v, ok := written[op.Key]; ok && v == nil {
+					value, found = "", false
+				} else if ok {
+					value, found = *v, true
+				}
+				results = append(results, txnResult{Op: op.Op, Key: op.Key, Value: value, Found: &found})
+			case "set":
+				value := op.Value
+				written[op.Key] = &value
+				ops = append(ops, storage.TxnOp{Op: "SET", Key: op.Key, Value: op.Value})
+				results = append(results, txnResult{Op: op.Op, Key: op.Key})
+			case "delete":
+				written[op.Key] = nil
+				ops = append(ops, storage.TxnOp{Op: "DELETE", Key: op.Key})
+				results = append(results, txnResult{Op: op.Op, Key: op.Key})
+			}
+		}
+
+		sizes := make(map[string]int)
+		for _, op := range ops {
+			if op.Op == "SET" {
+				sizes[op.Key] = len(op.Value)
+			}
+		}
+		if err := s.checkQuota(sizes); err != nil {
+			return nil, err
+		}
+		if len(ops) > 0 {
+			if err := s.log.UpdateLogTxn(ops); err != nil {
+				return nil, err
+			}
+		}
+		return ops, nil
+	})
+	if err != nil {
+		writeModifyError(w, "", err)
+		return
+	}
+
+	for _, op := range ops {
+		if op.Op == "SET" {
+			setRequests.Add(1)
+		} else {
+			deleteRequests.Add(1)
+		}
+	}
+	if results == nil {
+		results = []txnResult{}
+	}
+	h.WriteJSON(w, http.StatusOK, map[string]any{"succeeded": succeeded, "results": results})
+}
@@ -0,0 +1,304 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	h "gokv/helper"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Appended to the client key to accept a WebSocket handshake (RFC 6455)
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+// Close code sent when a client breaks the protocol (RFC 6455 section 7.4.1)
+const wsProtocolError = 1002
+
+// Frame the client should never have sent, the connection is closed with wsProtocolError
+var errWSProtocol = errors.New("protocol error")
+
+// Request sent by a WebSocket client
+type wsRequest struct {
+	ID     int64  `json:"id"`
+	Op     string `json:"op"` // "get", "set", "delete" or "watch"
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	TTL    string `json:"ttl"`
+	Prefix string `json:"prefix"`
+}
+
+// Reply to a request, or an event from a watch
+type wsReply struct {
+	ID      int64           `json:"id,omitempty"`
+	Status  int             `json:"status,omitempty"`
+	Body    json.RawMessage `json:"body,omitempty"`
+	Event   *Event          `json:"event,omitempty"`
+	Dropped int             `json:"dropped,omitempty"` // Events of the watch dropped before this one
+}
+
+// Open WebSocket connection, frames written by replies and watches are serialized
+type wsConn struct {
+	conn  net.Conn
+	rw    *bufio.ReadWriter
+	mutex sync.Mutex
+}
+
+// Serve get, set, delete and watch over a single WebSocket connection
+// GET /ws, then send {"id":1,"op":"set","key":"k","value":"v"} as text frames
+func (s *Server) WebSocketRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.WriteError(w, http.StatusMethodNotAllowed, h.CodeMethodNotAllowed, "Invalid HTTP Method", "")
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		h.WriteError(w, http.StatusBadRequest, h.CodeInvalidParameter, "WebSocket upgrade required", "")
+		return
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Println("Could not upgrade connection - ", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{}) // Lift the server timeouts, the socket stays open as long as the client wants
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	ws := &wsConn{conn: conn, rw: rw}
+	var watches []chan Event
+	defer func() {
+		for _, ch := range watches {
+			s.events.unsubscribe(ch)
+		}
+	}()
+
+	for {
+		op, payload, err := ws.read()
+		if errors.Is(err, errWSProtocol) {
+			ws.close(wsProtocolError, err.Error())
+			return
+		} else if err != nil {
+			return
+		}
+		switch op {
+		case wsClose:
+			ws.write(wsClose, nil)
+			return
+		case wsPing:
+			ws.write(wsPong, payload)
+			continue
+		case wsText:
+		default:
+			continue
+		}
+
+		var req wsRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			ws.reply(wsReply{Status: http.StatusBadRequest, Body: errorBody(h.CodeInvalidBody, "Invalid JSON")})
+			continue
+		}
+		p, _ := r.Context().Value(principalKey{}).(principal)
+		if ok, wait := s.throttleCommand(r.RemoteAddr, p); !ok {
+			ws.reply(wsReply{ID: req.ID, Status: http.StatusTooManyRequests, Body: errorBody(h.CodeRateLimited, fmt.Sprintf("Too many requests, try again in %d seconds", wait))})
+			continue
+		}
+		if !s.wsAllows(r, req) {
+			ws.reply(wsReply{ID: req.ID, Status: http.StatusForbidden, Body: errorBody(h.CodeUnauthorized, "Access denied by ACL")})
+			continue
+		}
+		if req.Op == "watch" {
+			if ch := s.wsWatch(ws, req); ch != nil {
+				watches = append(watches, ch)
+			}
+			continue
+		}
+		ws.reply(s.wsDispatch(r.Context(), req))
+	}
+}
+
+// Run a request through the matching HTTP handler so behaviour is identical
+// ctx is the context of the WebSocket upgrade request, done once the connection is served
+func (s *Server) wsDispatch(ctx context.Context, req wsRequest) wsReply {
+	query := url.Values{"key": {req.Key}}
+	var handler http.HandlerFunc
+	switch req.Op {
+	case "get":
+		handler = s.GetRequest
+	case "set":
+		query.Set("value", req.Value)
+		if req.TTL != "" {
+			query.Set("ttl", req.TTL)
+		}
+		handler = s.SetRequest
+	case "delete":
+		handler = s.DeleteRequest
+	default:
+		return wsReply{ID: req.ID, Status: http.StatusBadRequest, Body: errorBody(h.CodeInvalidParameter, "Unknown op")}
+	}
+
+	status, body := call(ctx, handler, "/"+req.Op+"?"+query.Encode())
+	return wsReply{ID: req.ID, Status: status, Body: body}
+}
+
+// Forward events for a key or prefix until the connection closes
+func (s *Server) wsWatch(ws *wsConn, req wsRequest) chan Event {
+	key, prefix := s.key(req.Key), s.prefix(req.Prefix)
+	if key != "" {
+		prefix = key
+	} else if prefix == "" {
+		ws.reply(wsReply{ID: req.ID, Status: http.StatusBadRequest, Body: errorBody(h.CodeMissingParameter, "Missing key or prefix")})
+		return nil
+	}
+
+	ch := s.events.subscribe(prefix)
+	ws.reply(wsReply{ID: req.ID, Status: http.StatusOK, Body: message("Watching")})
+	go func() {
+		for ev := range ch {
+			if key != "" && ev.Key != key {
+				continue
+			}
+			if err := ws.reply(wsReply{ID: req.ID, Event: &ev, Dropped: s.events.dropped(ch)}); err != nil {
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// Body in the format written by WriteResponse
+func message(msg string) json.RawMessage {
+	body, _ := json.Marshal(map[string]string{"message": msg})
+	return body
+}
+
+// Body in the format written by WriteError
+func errorBody(code string, msg string) json.RawMessage {
+	body, _ := json.Marshal(map[string]string{"code": code, "message": msg})
+	return body
+}
+
+// Send a reply as a text frame
+func (ws *wsConn) reply(reply wsReply) error {
+	data, _ := json.Marshal(reply)
+	return ws.write(wsText, data)
+}
+
+// Read one frame, unmasking the payload
+// Fragmented messages and payloads over maxBodySize are rejected, unmasked frames are a protocol error
+func (ws *wsConn) read() (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(ws.rw, head[:]); err != nil {
+		return 0, nil, err
+	}
+	if head[0]&0x80 == 0 {
+		return 0, nil, errors.New("fragmented frames are not supported")
+	}
+	op := head[0] & 0x0F
+	if head[1]&0x80 == 0 {
+		return 0, nil, fmt.Errorf("%w: client frames must be masked", errWSProtocol)
+	}
+	size := uint64(head[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if size > maxBodySize {
+		return 0, nil, errors.New("frame too large")
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.rw, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(ws.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
+
+// Send a close frame with a status code and reason
+func (ws *wsConn) close(code uint16, reason string) error {
+	return ws.write(wsClose, append(binary.BigEndian.AppendUint16(nil, code), reason...))
+}
+
+// Write one unmasked frame
+func (ws *wsConn) write(op byte, payload []byte) error {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	head := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		head = append(head, byte(n))
+	case n <= 0xFFFF:
+		head = append(head, 126)
+		head = binary.BigEndian.AppendUint16(head, uint16(n))
+	default:
+		head = append(head, 127)
+		head = binary.BigEndian.AppendUint64(head, uint64(n))
+	}
+	ws.rw.Write(head)
+	ws.rw.Write(payload)
+	return ws.rw.Flush()
+}
+
+// Run a GET request through a handler in-process, returning status and body
+// The handler sees ctx as its request context, so it stops when ctx is done
+func call(ctx context.Context, handler http.HandlerFunc, target string) (int, []byte) {
+	r, _ := http.NewRequestWithContext(ctx, "GET", target, nil)
+	rec := &recorder{header: make(http.Header), status: http.StatusOK}
+	handler(rec, r)
+	return rec.status, bytes.TrimSpace(rec.body.Bytes())
+}
+
+// ResponseWriter capturing a handler's response in memory
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recorder) Header() http.Header         { return rec.header }
+func (rec *recorder) Write(b []byte) (int, error) { return rec.body.Write(b) }
+func (rec *recorder) WriteHeader(status int)      { rec.status = status }
@@ -0,0 +1,146 @@
+package helper
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Topics of the internal event bus
+const (
+	TopicKeyMutated     = "key_mutated"     // A key was set, deleted or expired through the API
+	TopicEntryCommitted = "entry_committed" // A WAL entry was committed to the database
+	TopicPeerState      = "peer_state"      // A peer became reachable or unreachable
+	TopicLifecycle      = "lifecycle"       // A node lifecycle event was recorded
+)
+
+// Events a bus subscriber can buffer before further events to it are dropped
+const busBuffer = 1024
+
+// Something one subsystem tells the others through the bus
+type BusEvent struct {
+	Topic  string    `json:"topic"`
+	Type   string    `json:"type"`             // e.g. "set" for a key, "up" for a peer
+	Key    string    `json:"key,omitempty"`    // Key or peer the event is about
+	Value  string    `json:"value,omitempty"`  // New value of a key, if any
+	LSN    int       `json:"lsn,omitempty"`    // WAL entry, if any
+	Detail string    `json:"detail,omitempty"` // Anything else worth knowing
+	At     time.Time `json:"at"`
+}
+
+// Subscribers of the internal event bus by topic
+// The bus carries notifications only, subsystems still call each other to get work done
+// Publishers never block, events to a subscriber that fell behind are dropped
+var bus struct {
+	subs      map[string]map[chan BusEvent]string // Topic -> subscriber -> name
+	active    sync.Map                            // Topic -> subscriber count, checked before taking the lock
+	published sync.Map                            // Topic -> *atomic.Int64
+	dropped   sync.Map                            // Subscriber name -> *atomic.Int64
+	mutex     sync.Mutex
+}
+
+func init() {
+	expvar.Publish("bus", expvar.Func(func() any { return BusStats() }))
+}
+
+// Subscribe to a topic, name identifies the subscriber in stats
+// Returns the channel events arrive on and a function ending the subscription
+func Subscribe(topic string, name string) (<-chan BusEvent, func()) {
+	ch := make(chan BusEvent, busBuffer)
+	bus.mutex.Lock()
+	if bus.subs == nil {
+		bus.subs = make(map[string]map[chan BusEvent]string)
+	}
+	if bus.subs[topic] == nil {
+		bus.subs[topic] = make(map[chan BusEvent]string)
+	}
+	bus.subs[topic][ch] = name
+	bus.mutex.Unlock()
+	counter(&bus.active, topic).Add(1)
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			bus.mutex.Lock()
+			delete(bus.subs[topic], ch)
+			close(ch)
+			bus.mutex.Unlock()
+			counter(&bus.active, topic).Add(-1)
+		})
+	}
+}
+
+// Call fn with every event of a topic on a goroutine of its own, until the subscription ends
+func Handle(topic string, name string, fn func(BusEvent)) func() {
+	ch, stop := Subscribe(topic, name)
+	go func() {
+		for ev := range ch {
+			fn(ev)
+		}
+	}()
+	return stop
+}
+
+// Check if a topic has subscribers, cheap enough for every write
+func Listening(topic string) bool {
+	return counter(&bus.active, topic).Load() > 0
+}
+
+// Deliver an event to every subscriber of its topic without blocking
+func Publish(ev BusEvent) {
+	if !Listening(ev.Topic) {
+		return
+	}
+	if ev.At.IsZero() {
+		ev.At = time.Now()
+	}
+	counter(&bus.published, ev.Topic).Add(1)
+
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	for ch, name := range bus.subs[ev.Topic] {
+		select {
+		case ch <- ev:
+		default:
+			counter(&bus.dropped, name).Add(1)
+		}
+	}
+}
+
+// Counter stored under key, created on first use
+func counter(m *sync.Map, key string) *atomic.Int64 {
+	if c, ok := m.Load(key); ok {
+		return c.(*atomic.Int64)
+	}
+	c, _ := m.LoadOrStore(key, new(atomic.Int64))
+	return c.(*atomic.Int64)
+}
+
+// Events dropped so far for subscribers named name, across their subscriptions
+func Dropped(name string) int64 {
+	return counter(&bus.dropped, name).Load()
+}
+
+// Subscribers per topic, events published per topic and events dropped per subscriber
+func BusStats() map[string]any {
+	subscribers := make(map[string][]string)
+	bus.mutex.Lock()
+	for topic, subs := range bus.subs {
+		for _, name := range subs {
+			subscribers[topic] = append(subscribers[topic], name)
+		}
+	}
+	bus.mutex.Unlock()
+
+	published, dropped := make(map[string]int64), make(map[string]int64)
+	bus.published.Range(func(k, v any) bool {
+		published[k.(string)] = v.(*atomic.Int64).Load()
+		return true
+	})
+	bus.dropped.Range(func(k, v any) bool {
+		dropped[k.(string)] = v.(*atomic.Int64).Load()
+		return true
+	})
+	return map[string]any{"subscribers": subscribers, "published": published, "dropped": dropped}
+}
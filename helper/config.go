@@ -0,0 +1,258 @@
+package helper
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Variables set from the configuration file, a reload may replace them
+var config struct {
+	keys  map[string]bool
+	mutex sync.Mutex
+}
+
+// Variables the node reads, a configuration file or -set flag naming any other is a mistake
+var settings = map[string]bool{
+	"ACCESS_LOG": true, "ACLS": true, "ADMIN_API_KEYS": true, "ADMIN_TOKEN": true, "ALERT_WEBHOOK": true,
+	"API_KEYS": true, "CLUSTER_FILE": true, "CLUSTER_PEERS": true, "CLUSTER_SECRET": true, "CNAME": true,
+	"COLD_AFTER_DAYS": true, "COMPACT_MAP": true, "COMPRESSION": true, "COMPRESS_MIN_BYTES": true,
+	"CORS_HEADERS": true, "CORS_METHODS": true, "CORS_ORIGINS": true, "DATA_DIR": true, "DISK_READONLY": true,
+	"DRILL_DIR": true, "DRILL_INTERVAL": true, "EVENT_BATCH_DELAY": true, "EVENT_BATCH_SIZE": true,
+	"EVENT_WEBHOOK": true, "FLUSH_INTERVAL": true, "FORCE_REPLAY": true, "IDLE_TIMEOUT": true,
+	"INTERNAL_ALLOW": true, "INTERNAL_MTLS": true, "JWT_AUDIENCE": true, "JWT_ISSUER": true, "JWT_MAX_AGE": true,
+	"JWT_PUBLIC_KEY": true, "JWT_ROLE_CLAIM": true, "JWT_SECRET": true, "KEY_NORMALIZATION": true,
+	"LIFECYCLE_WEBHOOK": true, "LOG_LEVEL": true, "MAX_CONCURRENT_SCANS": true, "MAX_CONNS": true,
+	"MAX_CONNS_PER_CLIENT": true, "MAX_HEADER_BYTES": true, "MAX_INFLIGHT": true, "MAX_KEY_BYTES": true,
+	"MAX_PAGE_SIZE": true, "MAX_REPLAY_ENTRIES": true, "MAX_VALUE_BYTES": true, "MIN_FREE_MB": true,
+	"NAMESPACE_QUOTAS": true, "NODE_LABELS": true, "PEER_TIMEOUT": true, "PING_INTERVAL": true, "PORT": true,
+	"PRODUCTION": true, "PUBSUB_RELAY": true, "RATE_LIMIT_PER_IP": true, "RATE_LIMIT_PER_KEY": true,
+	"READ_HEADER_TIMEOUT": true, "READ_POLICY": true, "READ_TIMEOUT": true, "REQUEST_TIMEOUT": true,
+	"RESP_ADDR": true, "SHUTDOWN_DRAIN": true, "SHUTDOWN_HOOK": true, "SLOS": true, "SOFT_MAX_KEYS": true,
+	"SOFT_MAX_MB": true, "SOFT_MAX_WRITES_PER_SEC": true, "TLS_CA_FILE": true, "TLS_CERT_FILE": true,
+	"TLS_KEY_FILE": true, "TLS_RELOAD_INTERVAL": true, "VERSIONING": true, "VERSION_MAX_AGE": true,
+	"WAL_DIR": true, "WRITE_TIMEOUT": true,
+}
+
+// Load settings from a TOML style configuration file into the environment
+// Each key names an environment variable, e.g. data_dir = "/data" sets DATA_DIR
+// Keys under a [section] are prefixed by it, so [soft_max] keys = 100 sets SOFT_MAX_KEYS
+// Variables already set in the environment win over the file, except those the file set before
+func LoadConfig(path string) error {
+	settings, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+	for name := range config.keys {
+		if _, ok := settings[name]; !ok {
+			os.Unsetenv(name)
+		}
+	}
+	keys := make(map[string]bool, len(settings))
+	for name, v := range settings {
+		if _, set := os.LookupEnv(name); !set || config.keys[name] {
+			os.Setenv(name, v)
+			keys[name] = true
+		}
+	}
+	config.keys = keys
+	return nil
+}
+
+// Read the settings of a configuration file by variable name
+func readConfig(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := make(map[string]string)
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if name, ok := strings.CutPrefix(text, "["); ok {
+			name, ok = strings.CutSuffix(name, "]")
+			if !ok || strings.TrimSpace(name) == "" {
+				return nil, fmt.Errorf("%s:%d: invalid section %q", path, line, text)
+			}
+			section = strings.TrimSpace(name) + "_"
+			continue
+		}
+		key, value, ok := strings.Cut(text, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, line)
+		}
+		v, err := configValue(strings.TrimSpace(splitOutsideQuotes(value, '#')[0]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s - %w", path, line, key, err)
+		}
+		name := strings.ToUpper(section + key)
+		if !settings[name] {
+			return nil, fmt.Errorf("%s:%d: unknown setting %s", path, line, name)
+		}
+		values[name] = v
+	}
+	return values, scanner.Err()
+}
+
+// Read the configuration file again and apply overrides on top
+// Returns the sorted names of variables that changed, and a function restoring them
+func ReloadConfig(path string, overrides ConfigOverrides) ([]string, func(), error) {
+	before := environ()
+	config.mutex.Lock()
+	keys := config.keys
+	config.mutex.Unlock()
+	if path != "" {
+		if err := LoadConfig(path); err != nil {
+			return nil, nil, err
+		}
+	}
+	overrides.Apply()
+
+	after := environ()
+	var changed []string
+	for name, v := range after {
+		if old, ok := before[name]; !ok || old != v {
+			changed = append(changed, name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	slices.Sort(changed)
+
+	restore := func() {
+		config.mutex.Lock()
+		config.keys = keys
+		config.mutex.Unlock()
+		for _, name := range changed {
+			if v, ok := before[name]; ok {
+				os.Setenv(name, v)
+			} else {
+				os.Unsetenv(name)
+			}
+		}
+	}
+	return changed, restore, nil
+}
+
+// Current environment by variable name
+func environ() map[string]string {
+	env := make(map[string]string)
+	for _, pair := range os.Environ() {
+		name, v, _ := strings.Cut(pair, "=")
+		env[name] = v
+	}
+	return env
+}
+
+// Parse a configuration value into its environment form
+// Strings may be quoted, arrays are joined with commas, anything else is used as is
+func configValue(v string) (string, error) {
+	if inner, ok := strings.CutPrefix(v, "["); ok {
+		inner, ok = strings.CutSuffix(inner, "]")
+		if !ok {
+			return "", fmt.Errorf("unterminated array %s", v)
+		}
+		var items []string
+		for _, item := range splitOutsideQuotes(inner, ',') {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	}
+	switch {
+	case strings.HasPrefix(v, `"`):
+		return strconv.Unquote(v)
+	case strings.HasPrefix(v, "'"):
+		s, ok := strings.CutSuffix(v[1:], "'")
+		if !ok {
+			return "", fmt.Errorf("unterminated string %s", v)
+		}
+		return s, nil
+	}
+	return v, nil
+}
+
+// Split s on sep outside of quoted strings
+func splitOutsideQuotes(s string, sep rune) []string {
+	var items []string
+	var quote rune
+	start := 0
+	for i, c := range s {
+		switch {
+		case quote != 0 && c == quote && (quote == '\'' || i == 0 || s[i-1] != '\\'):
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == sep:
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+// Settings given on the command line as -set key=value, they win over the environment
+type ConfigOverrides []string
+
+func (o *ConfigOverrides) String() string {
+	return strings.Join(*o, " ")
+}
+
+func (o *ConfigOverrides) Set(v string) error {
+	key, _, ok := strings.Cut(v, "=")
+	if !ok || strings.TrimSpace(key) == "" {
+		return fmt.Errorf("expected key=value, got %q", v)
+	}
+	if name := strings.ToUpper(strings.TrimSpace(key)); !settings[name] {
+		return fmt.Errorf("unknown setting %s", name)
+	}
+	*o = append(*o, v)
+	return nil
+}
+
+// Set every override in the environment
+func (o ConfigOverrides) Apply() {
+	for _, v := range o {
+		key, value, _ := strings.Cut(v, "=")
+		os.Setenv(strings.ToUpper(strings.TrimSpace(key)), value)
+	}
+}
+
+// Port the node listens on and peers reach it on, from PORT (default 8080)
+func Port() string {
+	if v := os.Getenv("PORT"); v != "" {
+		return v
+	}
+	return "8080"
+}
+
+// Scheme of this node's address, https once TLS_CERT_FILE is set
+func Scheme() string {
+	if os.Getenv("TLS_CERT_FILE") != "" {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,35 @@
+package helper
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Write a configuration file in a temporary directory
+func configFile(t *testing.T, text string) string {
+	path := filepath.Join(t.TempDir(), "gokv.toml")
+	if err := os.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Key and value limits load from top level keys and from a [max] section
+func TestConfigPairLimits(t *testing.T) {
+	for _, name := range []string{"MAX_KEY_BYTES", "MAX_VALUE_BYTES"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+	t.Cleanup(func() { config.keys = nil })
+
+	if err := LoadConfig(configFile(t, "max_key_bytes = 200\n[max]\nvalue_bytes = \"65536\"\n")); err != nil {
+		t.Fatal(err)
+	}
+	if k, v := os.Getenv("MAX_KEY_BYTES"), os.Getenv("MAX_VALUE_BYTES"); k != "200" || v != "65536" {
+		t.Fatalf("got MAX_KEY_BYTES=%q MAX_VALUE_BYTES=%q, want 200 and 65536", k, v)
+	}
+	if err := LoadConfig(configFile(t, "max_value = 1\n")); err == nil {
+		t.Fatal("unknown setting MAX_VALUE accepted")
+	}
+}
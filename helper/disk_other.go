@@ -0,0 +1,10 @@
+//go:build !unix
+
+package helper
+
+import "errors"
+
+// Free disk space is only reported on unix systems
+func FreeSpace(path string) (uint64, error) {
+	return 0, errors.New("free disk space not supported on this platform")
+}
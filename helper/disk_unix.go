@@ -0,0 +1,14 @@
+//go:build unix
+
+package helper
+
+import "syscall"
+
+// Free disk space in bytes available to the node at path
+func FreeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,40 @@
+package helper
+
+import (
+	"context"
+	"sync"
+)
+
+// Goroutines run as a unit, like golang.org/x/sync/errgroup
+// The first error cancels the group's context and is returned by Wait
+type Group struct {
+	wg     sync.WaitGroup
+	cancel context.CancelCauseFunc
+	once   sync.Once
+	err    error
+}
+
+// Start a group whose context is canceled by the first error, or once Wait returns
+func NewGroup(ctx context.Context) (*Group, context.Context) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	return &Group{cancel: cancel}, ctx
+}
+
+// Run fn on a goroutine of its own
+func (g *Group) Go(fn func() error) {
+	g.wg.Go(func() {
+		if err := fn(); err != nil {
+			g.once.Do(func() {
+				g.err = err
+				g.cancel(err)
+			})
+		}
+	})
+}
+
+// Wait for every goroutine to return, and return the first error
+func (g *Group) Wait() error {
+	g.wg.Wait()
+	g.cancel(nil)
+	return g.err
+}
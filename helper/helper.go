@@ -1,10 +1,18 @@
 package helper
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Helper function for returning HTTP response
@@ -18,38 +26,220 @@ func WriteResponse(w http.ResponseWriter, statusCode int, message string) {
 	json.NewEncoder(w).Encode(resp)
 }
 
-// Check if important file/folders exist, if not then create them
-// Future scalability: represent the files/folders in an array, to reduce code
-func ValidateFiles() bool {
-	_, err := os.Stat("wal.log")
-	if os.IsNotExist(err) {
-		log.Println("Log file does not exist, creating one")
-		file, err := os.Create("wal.log")
-		if err != nil {
-			log.Println("Could not create log file - ", err)
-			return false
-		}
-		file.Close()
-	}
-	_, err = os.Stat("checkpoint.txt")
-	if os.IsNotExist(err) {
-		log.Println("Checkpoint file does not exist, creating one")
-		file, err := os.Create("checkpoint.txt")
-		file.WriteString("0")
-		if err != nil {
-			log.Println("Could not create checkpoint file - ", err)
-			return false
+// Error codes returned in the error envelope
+const (
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeMissingParameter = "missing_parameter"
+	CodeInvalidParameter = "invalid_parameter"
+	CodeInvalidBody      = "invalid_body"
+	CodeSchemaViolation  = "schema_violation"
+	CodeKeyNotFound      = "key_not_found"
+	CodeNotFound         = "not_found"
+	CodeConflict         = "conflict"
+	CodePrecondition     = "precondition_failed"
+	CodeFrozen           = "frozen"
+	CodeQuotaExceeded    = "quota_exceeded"
+	CodeReadOnly         = "read_only"
+	CodeOverloaded       = "overloaded"
+	CodeRateLimited      = "rate_limited"
+	CodeTimeout          = "timeout"
+	CodeUnavailable      = "unavailable"
+	CodeUnauthorized     = "unauthorized"
+	CodeInternal         = "internal"
+)
+
+// Helper function for returning an error with a code and the offending key, if any
+func WriteError(w http.ResponseWriter, statusCode int, code string, message string, key string) {
+	w.Header().Set("Content-type", "Application/json") // JSON response
+	w.WriteHeader(statusCode)                          // Add HTTP status code
+
+	resp := map[string]string{"code": code, "message": message}
+	if key != "" {
+		resp["key"] = key
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Helper function for returning a value as-is without JSON encoding
+func WriteRaw(w http.ResponseWriter, statusCode int, value string) {
+	w.Header().Set("Content-type", "application/octet-stream")
+	w.Header().Set("Content-length", strconv.Itoa(len(value)))
+	w.WriteHeader(statusCode)
+	io.WriteString(w, value)
+}
+
+// Helper function for returning an arbitrary JSON body
+func WriteJSON(w http.ResponseWriter, statusCode int, body any) {
+	w.Header().Set("Content-type", "Application/json") // JSON response
+	w.WriteHeader(statusCode)                          // Add HTTP status code
+	json.NewEncoder(w).Encode(body)
+}
+
+// Check if request asks for a dry run (?dry_run=true)
+// Destructive admin endpoints must report what would change without mutating state
+func DryRun(r *http.Request) bool {
+	return r.URL.Query().Get("dry_run") == "true"
+}
+
+// Layout describes where a node keeps its files
+type Layout struct {
+	DataDir     string // Badger database and checkpoint file
+	WALDir      string // WAL log file
+	ClusterFile string // List of nodes, optional
+	AutoCreate  bool   // Create missing files/folders instead of failing
+}
+
+var (
+	layout = Layout{DataDir: ".", WALDir: ".", ClusterFile: "cluster.txt", AutoCreate: true}
+	mutex  sync.RWMutex // Manage access to layout
+)
+
+// Build file layout from environment variables
+// DATA_DIR, WAL_DIR (defaults to DATA_DIR), CLUSTER_FILE, PRODUCTION
+func LayoutFromEnv() Layout {
+	l := Layout{DataDir: ".", ClusterFile: "cluster.txt", AutoCreate: true}
+	if v := os.Getenv("DATA_DIR"); v != "" {
+		l.DataDir = v
+	}
+	l.WALDir = l.DataDir
+	if v := os.Getenv("WAL_DIR"); v != "" {
+		l.WALDir = v
+	}
+	if v := os.Getenv("CLUSTER_FILE"); v != "" {
+		l.ClusterFile = v
+	}
+	// Production nodes must be provisioned, never silently start empty
+	if os.Getenv("PRODUCTION") == "true" {
+		l.AutoCreate = false
+	}
+	return l
+}
+
+// Set the file layout used by the rest of the node
+func SetLayout(l Layout) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	layout = l
+}
+
+// Get the current file layout
+func GetLayout() Layout {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return layout
+}
+
+// Path of WAL log file
+func WALPath() string {
+	return filepath.Join(GetLayout().WALDir, "wal.log")
+}
+
+// Path of checkpoint file
+func CheckpointPath() string {
+	return filepath.Join(GetLayout().DataDir, "checkpoint.txt")
+}
+
+// Path of hybrid logical clock file
+func HLCPath() string {
+	return filepath.Join(GetLayout().DataDir, "hlc.txt")
+}
+
+// Path of ID sequence allocations file
+func IDsPath() string {
+	return filepath.Join(GetLayout().DataDir, "ids.json")
+}
+
+// Path of namespace JSON schemas file
+func SchemasPath() string {
+	return filepath.Join(GetLayout().DataDir, "schemas.json")
+}
+
+// Path of clean shutdown marker file
+func ShutdownMarkerPath() string {
+	return filepath.Join(GetLayout().DataDir, "clean_shutdown.json")
+}
+
+// Path of database backup written on shutdown
+func SnapshotPath() string {
+	return filepath.Join(GetLayout().DataDir, "snapshot.bak")
+}
+
+// Path of badger database folder
+func DBPath() string {
+	return filepath.Join(GetLayout().DataDir, "db")
+}
+
+// Path of cold tier database folder
+func ColdPath() string {
+	return filepath.Join(GetLayout().DataDir, "cold")
+}
+
+// Send an alert to a webhook as a JSON POST, does nothing if url is empty
+func Alert(url string, message string) {
+	if url == "" {
+		return
+	}
+	body, _ := json.Marshal(map[string]string{"message": message})
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Println("Could not send alert - ", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// Parse node labels from NODE_LABELS, e.g. "region=eu,capacity=2"
+func LabelsFromEnv() map[string]string {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(os.Getenv("NODE_LABELS"), ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || k == "" {
+			continue
 		}
-		file.Close()
-	}
-	_, err = os.Stat("./db")
-	if os.IsNotExist(err) {
-		log.Println("Database folder does not exist, creating one")
-		err = os.Mkdir("./db", 0600)
-		if err != nil {
-			log.Println("Could not create db folder - ", err)
-			return false
+		labels[k] = v
+	}
+	return labels
+}
+
+// Check if important files/folders of the layout exist, if not then create them
+// Returns an error describing the first missing or unusable path
+func InitFiles(l Layout) error {
+	dirs := []string{l.DataDir, l.WALDir, filepath.Join(l.DataDir, "db")}
+	for _, dir := range dirs {
+		if err := ensure(dir, l.AutoCreate, func() error { return os.MkdirAll(dir, 0700) }); err != nil {
+			return err
 		}
 	}
-	return true
+
+	walPath := filepath.Join(l.WALDir, "wal.log")
+	err := ensure(walPath, l.AutoCreate, func() error {
+		return os.WriteFile(walPath, nil, 0600)
+	})
+	if err != nil {
+		return err
+	}
+
+	checkpointPath := filepath.Join(l.DataDir, "checkpoint.txt")
+	return ensure(checkpointPath, l.AutoCreate, func() error {
+		return os.WriteFile(checkpointPath, []byte("0"), 0600)
+	})
+}
+
+// Create path with create() if it doesn't exist and auto-create is allowed
+func ensure(path string, autoCreate bool, create func() error) error {
+	_, err := os.Stat(path)
+	if err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("could not access %s: %w", path, err)
+	}
+	if !autoCreate {
+		return fmt.Errorf("%s does not exist and auto-create is disabled", path)
+	}
+	log.Println("Creating missing", path)
+	if err := create(); err != nil {
+		return fmt.Errorf("could not create %s: %w", path, err)
+	}
+	return nil
 }
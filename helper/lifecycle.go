@@ -0,0 +1,125 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Node lifecycle event types
+const (
+	EventStarted        = "node_started"
+	EventReadOnly       = "read_only_entered"
+	EventWritable       = "read_only_exited"
+	EventPeerLost       = "peer_lost"
+	EventFlushFailed    = "flush_failed"
+	EventDrillCompleted = "snapshot_completed"
+	EventDrillFailed    = "snapshot_failed"
+	EventWriteStall     = "write_stall"
+	EventStallCleared   = "write_stall_cleared"
+	EventFlushAll       = "flushall"
+	EventStartupPhase   = "startup_phase"
+	EventShutdown       = "shutdown"
+	EventReloaded       = "config_reloaded"
+	EventServiceFailed  = "service_failed"
+)
+
+// Lifecycle events kept in memory for /admin/events, and queued for the webhook at most
+const lifecycleBuffer = 256
+
+// Something that happened to the node as a whole
+type LifecycleEvent struct {
+	Type   string    `json:"type"`
+	Node   string    `json:"node"`
+	Detail string    `json:"detail,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// Ring buffer of recent lifecycle events
+var lifecycle struct {
+	events []LifecycleEvent
+	next   int // Slot the next event is written to once the buffer is full
+	mutex  sync.Mutex
+}
+
+// Events waiting to be posted to LIFECYCLE_WEBHOOK, in order, by a single worker
+var webhook struct {
+	queue   chan LifecycleEvent
+	pending sync.WaitGroup // Events queued or being posted
+	once    sync.Once
+}
+
+// Record a lifecycle event and queue it for LIFECYCLE_WEBHOOK if set
+// Never waits for the webhook, events are dropped when the queue is full
+func Lifecycle(typ string, detail string) {
+	event := LifecycleEvent{Type: typ, Node: os.Getenv("CNAME"), Detail: detail, At: time.Now()}
+
+	lifecycle.mutex.Lock()
+	if len(lifecycle.events) < lifecycleBuffer {
+		lifecycle.events = append(lifecycle.events, event)
+	} else {
+		lifecycle.events[lifecycle.next] = event
+		lifecycle.next = (lifecycle.next + 1) % lifecycleBuffer
+	}
+	lifecycle.mutex.Unlock()
+	Publish(BusEvent{Topic: TopicLifecycle, Type: typ, Detail: detail, At: event.At})
+
+	if url := os.Getenv("LIFECYCLE_WEBHOOK"); url != "" {
+		webhook.once.Do(func() {
+			webhook.queue = make(chan LifecycleEvent, lifecycleBuffer)
+			go func() {
+				for event := range webhook.queue {
+					postEvent(os.Getenv("LIFECYCLE_WEBHOOK"), event)
+					webhook.pending.Done()
+				}
+			}()
+		})
+		webhook.pending.Add(1)
+		select {
+		case webhook.queue <- event:
+		default:
+			webhook.pending.Done()
+			log.Println("Could not send lifecycle event - ", "webhook queue full, dropped "+typ)
+		}
+	}
+}
+
+// Wait until queued lifecycle events are posted, at most timeout
+// Called before exiting, so the shutdown event still arrives
+func FlushLifecycle(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		webhook.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Println("Could not send lifecycle events - ", "webhook did not answer in "+timeout.String())
+	}
+}
+
+// Recent lifecycle events, oldest first
+func LifecycleEvents() []LifecycleEvent {
+	lifecycle.mutex.Lock()
+	defer lifecycle.mutex.Unlock()
+	events := make([]LifecycleEvent, 0, len(lifecycle.events))
+	events = append(events, lifecycle.events[lifecycle.next:]...)
+	return append(events, lifecycle.events[:lifecycle.next]...)
+}
+
+// Send a lifecycle event to a webhook as a JSON POST
+func postEvent(url string, event LifecycleEvent) {
+	body, _ := json.Marshal(event)
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Println("Could not send lifecycle event - ", err)
+		return
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,252 @@
+package helper
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// What a supervisor does when a service fails
+type RestartPolicy int
+
+const (
+	StopNode RestartPolicy = iota // A failure shuts the node down
+	Restart                       // Restart with backoff, shut the node down after MaxRestarts failures in a row
+	Ignore                        // Log the failure and leave the service stopped
+)
+
+// Restarts back off from a second up to a minute, a service running longer counts as recovered
+const (
+	restartBackoff    = time.Second
+	maxRestartBackoff = time.Minute
+)
+
+// A subsystem of the node run by a Supervisor
+type Service struct {
+	Name        string
+	Needs       []string                        // Services started before this one and stopped after it
+	Run         func(ctx context.Context) error // Blocks until ctx is done or the service fails
+	Stop        func() error                    // Optional, ends Run for services not watching ctx, e.g. servers
+	Policy      RestartPolicy
+	MaxRestarts int // Failures in a row before the node shuts down, 0 means no limit
+}
+
+// A started service and its state
+type running struct {
+	Service
+	cancel   context.CancelFunc
+	done     chan struct{}
+	state    string // running, restarting, failed, finished or stopped
+	restarts int
+	err      error
+}
+
+// Starts services in dependency order, restarts them by policy and stops them in reverse order
+// Services run in a Group, the first failure of a StopNode service ends Failed
+type Supervisor struct {
+	started []*running
+	byName  map[string]*running
+	group   *Group
+	ctx     context.Context // Canceled by the first failure that should shut the node down
+	mutex   sync.Mutex
+}
+
+func NewSupervisor() *Supervisor {
+	group, ctx := NewGroup(context.Background())
+	return &Supervisor{byName: make(map[string]*running), group: group, ctx: ctx}
+}
+
+// Start services, each after the ones it needs
+// Needed services are started by this call or an earlier one
+func (s *Supervisor) Start(services ...Service) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	order, err := s.order(services)
+	if err != nil {
+		return err
+	}
+	for _, svc := range order {
+		ctx, cancel := context.WithCancel(context.Background())
+		r := &running{Service: svc, cancel: cancel, done: make(chan struct{}), state: "running"}
+		s.started = append(s.started, r)
+		s.byName[svc.Name] = r
+		s.group.Go(func() error { return s.run(ctx, r) })
+	}
+	return nil
+}
+
+// Sort services so every one comes after the ones it needs
+func (s *Supervisor) order(services []Service) ([]Service, error) {
+	pending := make(map[string]Service)
+	for _, svc := range services {
+		if _, ok := s.byName[svc.Name]; ok {
+			return nil, fmt.Errorf("service %q already started", svc.Name)
+		}
+		if _, ok := pending[svc.Name]; ok {
+			return nil, fmt.Errorf("service %q added twice", svc.Name)
+		}
+		pending[svc.Name] = svc
+	}
+	var order []Service
+	visiting, visited := make(map[string]bool), make(map[string]bool)
+	var visit func(svc Service) error
+	visit = func(svc Service) error {
+		if visited[svc.Name] {
+			return nil
+		}
+		if visiting[svc.Name] {
+			return fmt.Errorf("service %q needs itself", svc.Name)
+		}
+		visiting[svc.Name] = true
+		for _, name := range svc.Needs {
+			if _, ok := s.byName[name]; ok {
+				continue
+			}
+			need, ok := pending[name]
+			if !ok {
+				return fmt.Errorf("service %q needs unknown service %q", svc.Name, name)
+			}
+			if err := visit(need); err != nil {
+				return err
+			}
+		}
+		visited[svc.Name] = true
+		order = append(order, svc)
+		return nil
+	}
+	for _, svc := range services {
+		if err := visit(svc); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// Run a service until ctx is done, applying its restart policy on failure
+// Returns the failure when it should shut the node down
+func (s *Supervisor) run(ctx context.Context, r *running) error {
+	defer close(r.done)
+	backoff := restartBackoff
+	for {
+		began := time.Now()
+		err := call(ctx, r.Run)
+		if ctx.Err() != nil {
+			s.setState(r, "stopped", nil)
+			return nil
+		}
+		if err == nil {
+			s.setState(r, "finished", nil)
+			return nil
+		}
+		log.Println("Service "+r.Name+" failed - ", err)
+		Lifecycle(EventServiceFailed, r.Name+": "+err.Error())
+
+		if time.Since(began) > maxRestartBackoff {
+			backoff = restartBackoff
+			s.mutex.Lock()
+			r.restarts = 0
+			s.mutex.Unlock()
+		}
+		switch {
+		case r.Policy == Ignore:
+			s.setState(r, "failed", err)
+			return nil
+		case r.Policy == Restart && (r.MaxRestarts == 0 || r.restarts < r.MaxRestarts):
+			s.mutex.Lock()
+			r.restarts++
+			s.mutex.Unlock()
+			s.setState(r, "restarting", err)
+			if !Wait(ctx, backoff) {
+				s.setState(r, "stopped", nil)
+				return nil
+			}
+			backoff = min(backoff*2, maxRestartBackoff)
+			s.setState(r, "running", err)
+		default:
+			s.setState(r, "failed", err)
+			return fmt.Errorf("%s - %w", r.Name, err)
+		}
+	}
+}
+
+// Call a service's Run, turning a panic into an error
+func call(ctx context.Context, run func(context.Context) error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return run(ctx)
+}
+
+func (s *Supervisor) setState(r *running, state string, err error) {
+	s.mutex.Lock()
+	r.state, r.err = state, err
+	s.mutex.Unlock()
+}
+
+// Closed by the first failure that should shut the node down, Err returns it
+func (s *Supervisor) Failed() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// First failure that should shut the node down, nil if there was none
+func (s *Supervisor) Err() error {
+	if err := context.Cause(s.ctx); err != context.Canceled {
+		return err
+	}
+	return nil // Canceled by the group once every service stopped
+}
+
+// Stop services in reverse start order, so each stops before the ones it needs
+// Waits for every service to return
+func (s *Supervisor) Stop() {
+	s.mutex.Lock()
+	started := s.started
+	s.mutex.Unlock()
+	for i := len(started) - 1; i >= 0; i-- {
+		r := started[i]
+		r.cancel()
+		select {
+		case <-r.done:
+			continue
+		default:
+		}
+		if r.Stop != nil {
+			if err := r.Stop(); err != nil {
+				log.Println("Error stopping service "+r.Name+" - ", err)
+			}
+		}
+		<-r.done
+	}
+	s.group.Wait()
+}
+
+// State, restarts and last error of every started service
+func (s *Supervisor) Stats() map[string]any {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := make(map[string]any, len(s.started))
+	for _, r := range s.started {
+		stat := map[string]any{"state": r.state, "restarts": r.restarts}
+		if r.err != nil {
+			stat["error"] = r.err.Error()
+		}
+		stats[r.Name] = stat
+	}
+	return stats
+}
+
+// Wait for d, returns false if ctx is done first
+func Wait(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,155 @@
+package helper
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Layers reporting operations on a traced key
+const (
+	TraceAPI   = "api"   // Requests naming the key
+	TraceWAL   = "wal"   // Entries appended to the WAL
+	TraceFlush = "flush" // Entries committed to the database
+)
+
+// Events kept per trace, older ones are dropped
+const traceBuffer = 512
+
+// Operation on a traced key
+type TraceEvent struct {
+	Layer  string    `json:"layer"`
+	Detail string    `json:"detail"`
+	At     time.Time `json:"at"`
+}
+
+// Verbose logging of every operation on a key until it expires
+type KeyTrace struct {
+	ID      string       `json:"id"` // Prefixes every log line of the trace
+	Key     string       `json:"key"`
+	Until   time.Time    `json:"until"`
+	Events  []TraceEvent `json:"events"`
+	Dropped int          `json:"dropped"` // Events beyond the buffer that are only in the log
+
+	timer *time.Timer
+}
+
+// Active key traces
+var traces struct {
+	byKey  map[string]*KeyTrace
+	active atomic.Int32 // Number of active traces, checked before taking the lock
+	mutex  sync.Mutex
+}
+
+// Trace every operation on key for d, restarting any trace already running on it
+func StartTrace(key string, d time.Duration) KeyTrace {
+	traces.mutex.Lock()
+	defer traces.mutex.Unlock()
+	if traces.byKey == nil {
+		traces.byKey = make(map[string]*KeyTrace)
+	}
+	if old, ok := traces.byKey[key]; ok {
+		old.timer.Stop()
+		traces.active.Add(-1)
+	}
+
+	id := make([]byte, 4)
+	rand.Read(id)
+	t := &KeyTrace{ID: hex.EncodeToString(id), Key: key, Until: time.Now().Add(d)}
+	t.timer = time.AfterFunc(d, func() { stopTrace(t) })
+	traces.byKey[key] = t
+	traces.active.Add(1)
+	log.Printf("Trace %s started - key=%q for %s", t.ID, key, d)
+	return t.copy()
+}
+
+// Stop tracing key, returns false if it wasn't traced
+func StopTrace(key string) bool {
+	traces.mutex.Lock()
+	t, ok := traces.byKey[key]
+	traces.mutex.Unlock()
+	if ok {
+		t.timer.Stop()
+		stopTrace(t)
+	}
+	return ok
+}
+
+// Remove a trace unless it was restarted since
+func stopTrace(t *KeyTrace) {
+	traces.mutex.Lock()
+	defer traces.mutex.Unlock()
+	if traces.byKey[t.Key] != t {
+		return
+	}
+	delete(traces.byKey, t.Key)
+	traces.active.Add(-1)
+	log.Printf("Trace %s ended - key=%q, %d events", t.ID, t.Key, len(t.Events)+t.Dropped)
+}
+
+// Get copies of active traces
+func Traces() []KeyTrace {
+	traces.mutex.Lock()
+	defer traces.mutex.Unlock()
+	result := make([]KeyTrace, 0, len(traces.byKey))
+	for _, t := range traces.byKey {
+		result = append(result, t.copy())
+	}
+	return result
+}
+
+// Keys of active traces
+func TracedKeys() []string {
+	traces.mutex.Lock()
+	defer traces.mutex.Unlock()
+	keys := make([]string, 0, len(traces.byKey))
+	for key := range traces.byKey {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Check if any key is traced, cheap enough for every request
+func Tracing() bool {
+	return traces.active.Load() > 0
+}
+
+// Check if key is traced
+func Traced(key string) bool {
+	if !Tracing() {
+		return false
+	}
+	traces.mutex.Lock()
+	defer traces.mutex.Unlock()
+	_, ok := traces.byKey[key]
+	return ok
+}
+
+// Log and record an operation on key if it is traced
+func Trace(key string, layer string, detail string) {
+	if !Tracing() {
+		return
+	}
+	traces.mutex.Lock()
+	defer traces.mutex.Unlock()
+	t, ok := traces.byKey[key]
+	if !ok {
+		return
+	}
+	log.Printf("Trace %s [%s] key=%q - %s", t.ID, layer, key, detail)
+	if len(t.Events) == traceBuffer {
+		t.Events = t.Events[1:]
+		t.Dropped++
+	}
+	t.Events = append(t.Events, TraceEvent{Layer: layer, Detail: detail, At: time.Now()})
+}
+
+func (t *KeyTrace) copy() KeyTrace {
+	c := *t
+	c.Events = append([]TraceEvent{}, t.Events...)
+	c.timer = nil
+	return c
+}
@@ -1,9 +1,20 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"gokv/api"
@@ -13,11 +24,132 @@ import (
 )
 
 func main() {
+	printBootstrap := flag.Bool("print-bootstrap-config", false, "print the parameters a new node needs to join the cluster as JSON and exit")
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "configuration file, settings in the environment win over it")
+	var overrides helper.ConfigOverrides
+	flag.Var(&overrides, "set", "override a setting, e.g. -set flush_interval=1s (repeatable)")
+	flag.Parse()
+
+	// Settings come from flags, then the environment, then the configuration file
+	if *configPath != "" {
+		if err := helper.LoadConfig(*configPath); err != nil {
+			log.Println("Could not read configuration file - ", err)
+			os.Exit(1)
+		}
+	}
+	overrides.Apply()
+	tune, err := readTunables()
+	if err != nil {
+		log.Println("Invalid configuration - ", err)
+		os.Exit(1)
+	}
+	storage.SetLogLevel(tune.logLevel)
+	flushInterval.Store(int64(tune.flush))
+	pingInterval.Store(int64(tune.ping))
+
 	// Check if all required files exist
-	if !helper.ValidateFiles() {
-		log.Println("Necessary files don't exist, Exiting")
+	layout := helper.LayoutFromEnv()
+	if *printBootstrap {
+		helper.SetLayout(layout)
+		b, err := network.BootstrapConfig()
+		if err != nil {
+			log.Println("Could not read cluster file - ", err)
+			os.Exit(1)
+		}
+		json.NewEncoder(os.Stdout).Encode(b)
+		return
+	}
+	if err := helper.InitFiles(layout); err != nil {
+		log.Println("Necessary files don't exist, Exiting - ", err)
+		return
+	}
+	helper.SetLayout(layout)
+
+	// Listen from the start of recovery, only probes are answered until the node is serving
+	PORT := ":" + helper.Port()
+	replay := &storage.Replay{}
+	startup := api.NewStartup(replay)
+	listener, err := net.Listen("tcp", PORT)
+	if err != nil {
+		log.Println("Could not listen on port - ", err)
 		return
 	}
+	clients := network.LimitListener(listener, tune.maxConns, tune.maxTotal)
+	expvar.Publish("connections", expvar.Func(func() any { return clients.Stats() }))
+	server, err := newHTTPServer(startup)
+	if err != nil {
+		log.Println("Invalid server settings - ", err)
+		return
+	}
+	shutdownDrain, err := time.ParseDuration(os.Getenv("SHUTDOWN_DRAIN"))
+	if err != nil || shutdownDrain <= 0 {
+		shutdownDrain = api.DefaultShutdownDrain
+	}
+
+	// Serve HTTPS with TLS_CERT_FILE and TLS_KEY_FILE, reloaded once they change
+	// With INTERNAL_MTLS nodes authenticate each other with certificates signed by TLS_CA_FILE
+	mutualTLS := os.Getenv("INTERNAL_MTLS") == "true"
+	if mutualTLS && (os.Getenv("TLS_CERT_FILE") == "" || os.Getenv("TLS_CA_FILE") == "") {
+		log.Println("INTERNAL_MTLS needs TLS_CERT_FILE, TLS_KEY_FILE and TLS_CA_FILE")
+		return
+	}
+	var certs *network.Certificates
+	if certFile := os.Getenv("TLS_CERT_FILE"); certFile != "" {
+		certs, err = network.LoadCertificates(certFile, os.Getenv("TLS_KEY_FILE"))
+		if err != nil {
+			log.Println("Could not load TLS certificate - ", err)
+			return
+		}
+		server.TLSConfig = certs.Config()
+		if mutualTLS {
+			if err := network.RequestClientCerts(server.TLSConfig, os.Getenv("TLS_CA_FILE")); err != nil {
+				log.Println("Could not load TLS_CA_FILE - ", err)
+				return
+			}
+		}
+		expvar.Publish("tls", expvar.Func(func() any { return certs.Stats() }))
+	}
+
+	// Subsystems run as services, a failure of one shuts the node down cleanly
+	services := helper.NewSupervisor()
+	expvar.Publish("services", expvar.Func(func() any { return services.Stats() }))
+	services.Start(helper.Service{
+		Name: "http",
+		Run: func(ctx context.Context) error {
+			serve := server.Serve
+			if certs != nil {
+				serve = func(l net.Listener) error { return server.ServeTLS(l, "", "") }
+			}
+			if err := serve(clients); err != http.ErrServerClosed {
+				return err
+			}
+			return nil
+		},
+		// Stop accepting connections and let running requests finish
+		Stop: func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownDrain)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Println("Requests still running after draining, closing connections - ", err)
+				return server.Close()
+			}
+			return nil
+		},
+	})
+	if certs != nil {
+		reload := 10 * time.Second
+		if d, err := time.ParseDuration(os.Getenv("TLS_RELOAD_INTERVAL")); err == nil && d > 0 {
+			reload = d
+		}
+		services.Start(helper.Service{
+			Name:   "cert-watch",
+			Policy: helper.Restart,
+			Run: func(ctx context.Context) error {
+				return certs.Watch(ctx, reload)
+			},
+		})
+	}
+	log.Printf("Server running on %s://localhost%s\n", helper.Scheme(), PORT)
 
 	// Start database connection
 	db, err := storage.InitDatabase()
@@ -27,9 +159,31 @@ func main() {
 	}
 	defer db.Close()
 
+	// Keep old versions of keys in configured namespaces
+	maxAge, _ := time.ParseDuration(os.Getenv("VERSION_MAX_AGE"))
+	policy, err := storage.ParseVersionPolicy(os.Getenv("VERSIONING"), maxAge)
+	if err != nil {
+		log.Println("Invalid VERSIONING - ", err)
+		return
+	}
+	db.SetVersioning(policy)
+
 	// Create In-memory map and load log file values
 	mp := storage.InitMap()
-	l, err := storage.InitLog()
+	if os.Getenv("COMPACT_MAP") == "true" {
+		mp = storage.InitCompactMap()
+	}
+	// After a clean shutdown everything is in the database, so the WAL isn't read
+	clean, err := storage.TakeCleanShutdown()
+	resumed := err == nil
+	var l storage.Log
+	if resumed {
+		log.Println("Resuming after clean shutdown at LSN ", clean.LSN)
+		l, err = storage.ResumeLog(clean)
+	} else {
+		log.Println("Recovering from WAL - ", err)
+		l, err = storage.InitLog()
+	}
 	if err != nil {
 		log.Println("Could not initialize WAL log - ", err)
 		return
@@ -40,52 +194,352 @@ func main() {
 		return
 	}
 
-	// Update database every 5 seconds
-	go func() {
-		for {
-			time.Sleep(time.Second * 5)
-			err := db.UpdateDatabase(l)
-			if err != nil {
-				log.Println("Error saving to database - ", err)
-				db.Close()
-				os.Exit(1)
-			}
+	// Refuse to replay a suspiciously large WAL backlog unless forced
+	maxReplay := 1000000
+	if v, err := strconv.Atoi(os.Getenv("MAX_REPLAY_ENTRIES")); err == nil {
+		maxReplay = v
+	}
+	pending := 0
+	if !resumed {
+		pending, err = storage.PendingEntries(l)
+		if err != nil {
+			log.Println("Could not read WAL log - ", err)
+			return
 		}
-	}()
+	}
+	if pending > maxReplay && os.Getenv("FORCE_REPLAY") != "true" {
+		log.Printf("WAL backlog of %d entries exceeds MAX_REPLAY_ENTRIES (%d), set FORCE_REPLAY=true to start anyway\n", pending, maxReplay)
+		return
+	}
+
+	// Apply WAL entries not yet committed to database
+	if resumed {
+		replay.Skip()
+	} else if err = replay.Run(mp, l); err != nil {
+		log.Println("Could not replay WAL log - ", err)
+		return
+	}
+
+	// Services started once the node has recovered
+	var background []helper.Service
+
+	// Move keys idle for COLD_AFTER_DAYS to a compressed cold tier
+	var cold *storage.ColdTier
+	if days, err := strconv.ParseFloat(os.Getenv("COLD_AFTER_DAYS"), 64); err == nil && days > 0 {
+		after := time.Duration(days * float64(24*time.Hour))
+		cold, err = storage.OpenColdTier(after)
+		if err != nil {
+			log.Println("Could not open cold tier - ", err)
+			return
+		}
+		defer cold.Close()
+		tiered := storage.NewTieredMap(mp, l, cold)
+		mp = tiered
+		background = append(background, helper.Service{
+			Name:   "cold-tier",
+			Needs:  []string{"flusher"},
+			Policy: helper.Restart,
+			Run: func(ctx context.Context) error {
+				for helper.Wait(ctx, min(after, time.Hour)) {
+					if n, err := tiered.Demote(); err != nil {
+						log.Println("Error moving keys to cold tier - ", err)
+					} else if n > 0 {
+						log.Println("Moved keys to cold tier - ", n)
+					}
+				}
+				return nil
+			},
+		})
+	}
+
+	// Update database every FLUSH_INTERVAL (default 5 seconds)
+	background = append(background, helper.Service{
+		Name: "flusher",
+		Run: func(ctx context.Context) error {
+			for helper.Wait(ctx, storage.FlushInterval(time.Duration(flushInterval.Load()))) {
+				if err := db.UpdateDatabase(l); err != nil {
+					log.Println("Error saving to database - ", err)
+					helper.Lifecycle(helper.EventFlushFailed, err.Error())
+					return err
+				}
+			}
+			return nil
+		},
+	})
+
+	// Periodically check that a backup of the database can be restored
+	if interval, err := time.ParseDuration(os.Getenv("DRILL_INTERVAL")); err == nil && interval > 0 {
+		var drill atomic.Value
+		expvar.Publish("recovery_drill", expvar.Func(func() any { return drill.Load() }))
+		background = append(background, helper.Service{
+			Name:   "drill",
+			Policy: helper.Restart,
+			Run: func(ctx context.Context) error {
+				for helper.Wait(ctx, interval) {
+					result, err := db.Drill(os.Getenv("DRILL_DIR"))
+					if err != nil {
+						result.Error = err.Error()
+					}
+					if !result.OK {
+						log.Println("Recovery drill failed - ", result.Error)
+						helper.Alert(os.Getenv("ALERT_WEBHOOK"), "recovery drill failed")
+						helper.Lifecycle(helper.EventDrillFailed, result.Error)
+					} else {
+						helper.Lifecycle(helper.EventDrillCompleted, fmt.Sprintf("keys=%d", result.Keys))
+					}
+					drill.Store(result)
+				}
+				return nil
+			},
+		})
+	}
 
 	// Connect to other nodes
-	nodes, err := network.Init()
+	nodes, err := network.Init(certs)
 	if err != nil {
 		log.Println("Could not connect to other nodes - ", err)
 		return
 	}
 
 	// Periodically ping nodes to check if connection is alive
-	go func() {
-		for {
-			time.Sleep(time.Minute * 2)
-			if !nodes.Ping() {
-				log.Println("Lost connection to other nodes, Exiting")
-				db.Close()
-				os.Exit(1)
+	background = append(background, helper.Service{
+		Name: "pinger",
+		Run: func(ctx context.Context) error {
+			for helper.Wait(ctx, time.Duration(pingInterval.Load())) {
+				if !nodes.Ping() {
+					helper.Lifecycle(helper.EventPeerLost, "")
+					return errors.New("lost connection to other nodes")
+				}
 			}
-		}
-	}()
-
-	// Define port on which server will run
-	PORT := ":8080"
+			return nil
+		},
+	})
 
 	// Initialize API server
 	srv := api.New(mp, l)
+	srv.PublishStats()
+	srv.SetDatabase(db)
+	srv.SetReplay(replay)
+	srv.SetStartup(startup)
+	srv.SetNetwork(nodes, helper.LabelsFromEnv())
+	srv.SetRelay(os.Getenv("PUBSUB_RELAY") == "true")
+	srv.SetAdminToken(os.Getenv("ADMIN_TOKEN"))
+	srv.SetShutdown(os.Getenv("SHUTDOWN_HOOK"), shutdownDrain, os.Getenv("CLUSTER_SECRET") != "")
+
+	// Normalize keys of configured namespaces
+	keyPolicy, err := api.ParseKeyPolicy(os.Getenv("KEY_NORMALIZATION"))
+	if err != nil {
+		log.Println("Invalid KEY_NORMALIZATION - ", err)
+		return
+	}
+	srv.SetKeyPolicy(keyPolicy)
+
+	// Fall back to the database on map misses under configured prefixes
+	readPolicy, err := api.ParseReadPolicy(os.Getenv("READ_POLICY"))
+	if err != nil {
+		log.Println("Invalid READ_POLICY - ", err)
+		return
+	}
+	srv.SetReadPolicy(readPolicy)
+
+	// Reject unsigned or replayed requests from other nodes, or from addresses not on INTERNAL_ALLOW
+	verifier := network.NewVerifier(os.Getenv("CLUSTER_SECRET"), mutualTLS)
+
+	// Warn clients in write responses once soft limits are crossed,
+	// and reject writes that would take a namespace over its quota
+	tune.apply(srv, clients, verifier)
+
+	// Re-read the configuration on SIGHUP or /admin/reload
+	srv.SetReloader(reloader(*configPath, overrides, srv, clients, verifier, nodes))
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	background = append(background, helper.Service{
+		Name:   "reloader",
+		Policy: helper.Restart,
+		Run: func(ctx context.Context) error {
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-hangups:
+					srv.Reload()
+				}
+			}
+		},
+	})
+
+	// Cap page sizes and concurrent streamed listings
+	maxPage, _ := strconv.Atoi(os.Getenv("MAX_PAGE_SIZE"))
+	maxStreams := 4
+	if v, err := strconv.Atoi(os.Getenv("MAX_CONCURRENT_SCANS")); err == nil && v > 0 {
+		maxStreams = v
+	}
+	srv.SetScanLimits(maxPage, maxStreams)
+
+	// Remove expired keys in the background
+	background = append(background, helper.Service{Name: "sweeper", Needs: []string{"flusher"}, Policy: helper.Restart, Run: srv.SweepExpired})
+
+	// Send delete and expire events to a webhook in batches
+	batchSize := 100
+	if v, err := strconv.Atoi(os.Getenv("EVENT_BATCH_SIZE")); err == nil && v > 0 {
+		batchSize = v
+	}
+	batchDelay, _ := time.ParseDuration(os.Getenv("EVENT_BATCH_DELAY"))
+	webhook := os.Getenv("EVENT_WEBHOOK")
+	background = append(background, helper.Service{
+		Name:   "event-forwarder",
+		Policy: helper.Restart,
+		Run: func(ctx context.Context) error {
+			return srv.ForwardEvents(ctx, webhook, batchSize, batchDelay)
+		},
+	})
+
+	// Enter read-only mode while the WAL or database disk is low on space
+	minFree := uint64(100)
+	if v, err := strconv.ParseUint(os.Getenv("MIN_FREE_MB"), 10, 64); err == nil {
+		minFree = v
+	}
+	minFree <<= 20
+	background = append(background, helper.Service{
+		Name:   "disk-monitor",
+		Policy: helper.Restart,
+		Run: func(ctx context.Context) error {
+			low := false
+			for helper.Wait(ctx, time.Second*30) {
+				pressure := false
+				for _, dir := range []string{layout.WALDir, layout.DataDir} {
+					free, err := helper.FreeSpace(dir)
+					if err == nil && free < minFree {
+						pressure = true
+					}
+				}
+				if pressure != low {
+					low = pressure
+					if low {
+						log.Println("Disk space below MIN_FREE_MB")
+						helper.Alert(os.Getenv("ALERT_WEBHOOK"), "disk space low")
+					} else {
+						log.Println("Disk space recovered")
+						helper.Alert(os.Getenv("ALERT_WEBHOOK"), "disk space recovered")
+					}
+					if os.Getenv("DISK_READONLY") != "false" {
+						srv.SetReadOnly(low)
+					}
+				}
+			}
+			return nil
+		},
+	})
+
+	// Define Routes, also served under /v1
+	api.Register(http.DefaultServeMux, srv.Routes())
+	// expvar registers /debug/vars on the default mux
 
-	// Define Routes
-	http.HandleFunc("/ping", api.HealthCheck)
-	http.HandleFunc("/internal/update", api.InternalUpdateRequest)
-	http.HandleFunc("/get", srv.GetRequest)
-	http.HandleFunc("/set", srv.SetRequest)
-	http.HandleFunc("/delete", srv.DeleteRequest)
+	maxInflight := 256
+	if v, err := strconv.Atoi(os.Getenv("MAX_INFLIGHT")); err == nil && v > 0 {
+		maxInflight = v
+	}
+	priorities := api.NewPriorities(maxInflight)
 
-	// Start Server
-	log.Printf("Server running on http://localhost%s\n", PORT)
-	log.Panic(http.ListenAndServe(PORT, nil))
+	// Track latency SLOs and alert on fast error budget burn
+	slos, err := api.ParseSLOs(os.Getenv("SLOS"))
+	if err != nil {
+		log.Println("Invalid SLOS - ", err)
+		return
+	}
+	tracker := api.NewSLOTracker(slos)
+	expvar.Publish("slo", expvar.Func(func() any { return tracker.Stats() }))
+	alerts := os.Getenv("ALERT_WEBHOOK")
+	background = append(background, helper.Service{
+		Name:   "slo-watch",
+		Policy: helper.Restart,
+		Run: func(ctx context.Context) error {
+			return tracker.Watch(ctx, alerts)
+		},
+	})
+
+	if err := services.Start(background...); err != nil {
+		log.Println("Could not start services - ", err)
+		return
+	}
+
+	// Attach routes, probes are answered from here on
+	startup.Serve(srv.LogHandler(srv.CORSHandler(srv.CompressHandler(srv.ThrottleHandler(srv.TimeoutHandler(srv.AuthHandler(priorities.Handler(tracker.Handler(verifier.Handler(srv.TraceHandler(http.DefaultServeMux)))))))))))
+
+	// Refresh peers before serving
+	// Writes aren't replicated to other nodes yet, so there are no missed entries to fetch
+	startup.Enter(api.PhaseCatchingUp)
+	if !nodes.Ping() {
+		log.Println("No other nodes reachable, serving without them")
+	}
+	startup.Enter(api.PhaseServing)
+	helper.Lifecycle(helper.EventStarted, PORT)
+
+	// Optionally speak the Redis protocol on a second port
+	var respListener net.Listener
+	if addr := os.Getenv("RESP_ADDR"); addr != "" {
+		respListener, err = net.Listen("tcp", addr)
+		if err != nil {
+			log.Println("Could not listen on RESP address - ", err)
+			return
+		}
+		log.Printf("RESP listener running on %s\n", addr)
+		services.Start(helper.Service{
+			Name:   "resp",
+			Policy: helper.Ignore,
+			Run: func(ctx context.Context) error {
+				err := srv.ServeRESP(respListener)
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			},
+			Stop: respListener.Close,
+		})
+	}
+
+	// Stop on SIGINT or SIGTERM, or once a coordinated shutdown has prepared every node
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	coordinated, failed := false, false
+	select {
+	case sig := <-signals:
+		log.Println("Received signal, shutting down - ", sig)
+	case <-srv.Stopped():
+		coordinated = true
+	case <-services.Failed():
+		log.Println("Service failed, shutting down - ", services.Err())
+		failed = true
+	}
+	if startup.Phase() != api.PhaseStopping {
+		startup.Enter(api.PhaseStopping)
+	}
+
+	// Stop services in reverse start order, the HTTP server drains running requests last
+	services.Stop()
+
+	// Commit WAL entries after the checkpoint, so the next start doesn't have to replay them
+	if err := db.UpdateDatabase(l); err != nil {
+		log.Println("Error saving to database - ", err)
+	} else if _, err := storage.MarkCleanShutdown(l); err != nil {
+		log.Println("Could not record clean shutdown - ", err)
+	}
+	helper.Lifecycle(helper.EventShutdown, "")
+	helper.FlushLifecycle(10 * time.Second)
+
+	if cold != nil {
+		if err := cold.Close(); err != nil {
+			log.Println("Could not close cold tier - ", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		log.Println("Could not close database - ", err)
+	}
+	if coordinated {
+		srv.RunShutdownHook()
+	}
+	log.Println("Shut down")
+	if failed {
+		os.Exit(1)
+	}
 }
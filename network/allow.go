@@ -0,0 +1,111 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often addresses of the cluster nodes are resolved again, at most
+const peerResolveInterval = 30 * time.Second
+
+// Client addresses allowed to call routes under /internal/
+type Allowlist struct {
+	prefixes []netip.Prefix
+	peers    bool         // Also allow addresses of the cluster nodes
+	resolved []netip.Addr // Addresses of the cluster nodes when last resolved
+	at       time.Time    // When the cluster nodes were last resolved
+	mutex    sync.Mutex   // Manage access to shared resources
+}
+
+// Parse comma separated CIDRs and IPs, "peers" stands for the nodes of the cluster
+// Returns nil for an empty list, internal routes then aren't restricted by address
+func ParseAllowlist(spec string) (*Allowlist, error) {
+	a := &Allowlist{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+			continue
+		case entry == "peers":
+			a.peers = true
+		case strings.Contains(entry, "/"):
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", entry)
+			}
+			a.prefixes = append(a.prefixes, prefix.Masked())
+		default:
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			a.prefixes = append(a.prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+		}
+	}
+	if len(a.prefixes) == 0 && !a.peers {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// Check if a client address is allowed
+// An unknown address makes the cluster nodes be resolved again, if they weren't just now
+func (a *Allowlist) Allows(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range a.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	if !a.peers {
+		return false
+	}
+	a.mutex.Lock()
+	if slices.Contains(a.resolved, addr) {
+		a.mutex.Unlock()
+		return true
+	}
+	if !a.at.IsZero() && time.Since(a.at) < peerResolveInterval {
+		a.mutex.Unlock()
+		return false
+	}
+	a.at = time.Now() // Claim the lookup, other callers use the old addresses meanwhile
+	a.mutex.Unlock()
+
+	// Lookups may take seconds, so they run without the lock
+	resolved := resolvePeers()
+	a.mutex.Lock()
+	a.resolved, a.at = resolved, time.Now()
+	a.mutex.Unlock()
+	return slices.Contains(resolved, addr)
+}
+
+// Addresses of the cluster nodes, nodes that can't be resolved are left out
+func resolvePeers() []netip.Addr {
+	cluster, _ := clusterNodes()
+	var addrs []netip.Addr
+	for _, node := range cluster {
+		u, err := url.Parse(strings.TrimSpace(node))
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(u.Hostname()); err == nil {
+			addrs = append(addrs, addr.Unmap())
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		found, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+		cancel()
+		for _, addr := range found {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,34 @@
+package network
+
+import (
+	"hash/fnv"
+	"os"
+	"strconv"
+)
+
+// Parameters a new node needs to join the cluster, for provisioning tools
+type Bootstrap struct {
+	Address         string   `json:"address"`                 // Address of this node, from CNAME or the hostname
+	Nodes           []string `json:"nodes"`                   // CLUSTER_PEERS or contents of the cluster file
+	ClusterToken    string   `json:"cluster_token,omitempty"` // Value of CLUSTER_SECRET, left out if requests aren't signed
+	TopologyVersion string   `json:"topology_version"`        // Changes whenever the list of nodes changes
+}
+
+// Read join parameters from the cluster nodes and environment
+func BootstrapConfig() (Bootstrap, error) {
+	b := Bootstrap{Address: Address(), Nodes: []string{}, ClusterToken: os.Getenv("CLUSTER_SECRET")}
+
+	cluster, err := clusterNodes()
+	if err != nil {
+		return b, err
+	}
+	b.Nodes = append(b.Nodes, cluster...)
+
+	// Order matters, it decides each node's position in the cluster
+	hash := fnv.New64a()
+	for _, node := range b.Nodes {
+		hash.Write([]byte(node + "\n"))
+	}
+	b.TopologyVersion = strconv.FormatUint(hash.Sum64(), 16)
+	return b, nil
+}
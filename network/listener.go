@@ -0,0 +1,105 @@
+package network
+
+import (
+	"log"
+	"net"
+	"sync"
+)
+
+// Listener tracking open connections per client IP
+// Connections beyond the per-client or total limit are closed right after accept
+type ClientListener struct {
+	net.Listener
+	limit int            // Max open connections per client, 0 for no limit
+	total int            // Max open connections of all clients, 0 for no limit
+	count int            // Open connections of all clients
+	open  map[string]int // Client IP -> open connections
+	mutex sync.Mutex     // Manage access to shared resource
+}
+
+// Wrap a listener to enforce per-client and total connection limits
+func LimitListener(l net.Listener, limit int, total int) *ClientListener {
+	return &ClientListener{Listener: l, limit: limit, total: total, open: make(map[string]int)}
+}
+
+// Change the connection limits, open connections are kept
+func (l *ClientListener) SetLimits(limit int, total int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.limit, l.total = limit, total
+}
+
+// Accept next connection within its client's limit
+func (l *ClientListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := clientIP(conn.RemoteAddr())
+		l.mutex.Lock()
+		if l.limit > 0 && l.open[ip] >= l.limit {
+			l.mutex.Unlock()
+			log.Println("Connection limit reached for client", ip)
+			conn.Close()
+			continue
+		}
+		if l.total > 0 && l.count >= l.total {
+			l.mutex.Unlock()
+			log.Println("Connection limit reached, refused", ip)
+			conn.Close()
+			continue
+		}
+		l.open[ip]++
+		l.count++
+		l.mutex.Unlock()
+
+		return &clientConn{Conn: conn, ip: ip, listener: l}, nil
+	}
+}
+
+// Number of open connections per client IP
+func (l *ClientListener) Stats() map[string]int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	stats := make(map[string]int, len(l.open))
+	for ip, n := range l.open {
+		stats[ip] = n
+	}
+	return stats
+}
+
+// Forget a closed connection
+func (l *ClientListener) release(ip string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.open[ip]--
+	l.count--
+	if l.open[ip] <= 0 {
+		delete(l.open, ip)
+	}
+}
+
+// Connection that releases its slot once closed
+type clientConn struct {
+	net.Conn
+	ip       string
+	listener *ClientListener
+	once     sync.Once
+}
+
+func (c *clientConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.listener.release(c.ip) })
+	return err
+}
+
+// IP part of a remote address
+func clientIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
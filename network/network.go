@@ -2,53 +2,75 @@ package network
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	h "gokv/helper"
+	"hash/fnv"
+	"io"
+	"math"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 // Network is a cluster of multiple nodes
 type Network interface {
-	Ping() bool // Occasionally ping other nodes to check connection
+	Ping() bool                                                       // Occasionally ping other nodes to check connection
+	Topology() map[string]map[string]string                           // Labels of each connected node
+	Broadcast(ctx context.Context, path string, body []byte) []string // Send a POST to every connected node at once
+	Gather(ctx context.Context, path string) [][]byte                 // Send a GET to every connected node at once
+	Position() (index int, size int)                                  // Place of this node in the cluster file
+	Reload() error                                                    // Read the list of cluster nodes again
 }
 
 type nodes struct {
-	client *http.Client // HTTP Client to ping other nodes
-	nodes  []string     // list of connected nodes
-	mutex  sync.RWMutex // Manage access to shared resource
+	client *http.Client                 // HTTP Client to ping other nodes
+	secret []byte                       // Shared secret signing internal requests
+	nodes  []string                     // list of connected nodes
+	labels map[string]map[string]string // labels reported by each node
+	index  int                          // line of this node in cluster file
+	size   int                          // number of nodes in cluster file
+	mutex  sync.RWMutex                 // Manage access to shared resource
 }
 
+// Timeout of requests to other nodes, unless PEER_TIMEOUT is set
+const defaultPeerTimeout = 5 * time.Second
+
 // Create a network and connect to other nodes
-// It finds the IP of other nodes from cluster.txt
-func Init() (Network, error) {
+// It finds the IP of other nodes from CLUSTER_PEERS or the cluster file (cluster.txt by default)
+// With certs, requests to other nodes present this node's certificate
+func Init(certs *Certificates) (Network, error) {
+	timeout, err := time.ParseDuration(os.Getenv("PEER_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		timeout = defaultPeerTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+	peers, err := peerTLS(os.Getenv("TLS_CA_FILE"), certs)
+	if err != nil {
+		return nil, err
+	}
+	if peers != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = peers
+		client.Transport = transport
+	}
 	n := &nodes{
-		client: &http.Client{Timeout: 5 * time.Second},
+		client: client,
+		secret: []byte(os.Getenv("CLUSTER_SECRET")),
 		nodes:  []string{},
+		labels: make(map[string]map[string]string),
+		size:   1,
 		mutex:  sync.RWMutex{},
 	}
 
-	// Find container name (node shouldnt connect to itself)
-	cname := os.Getenv("CNAME")
-	if cname != "" {
-		cname = "http://" + cname + ":8080"
-	}
-
-	// Read from cluster.txt and update nodes[]
-	file, err := os.Open("cluster.txt")
-	if err != nil {
+	if err := n.Reload(); err != nil {
 		return nil, err
 	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		node := scanner.Text()
-		if node == cname { // so that node doesnt connect to itself
-			continue
-		}
-		n.nodes = append(n.nodes, node)
-	}
 
 	// Ping nodes to check connection
 	// Remove inactive clients from nodes[] list
@@ -59,6 +81,51 @@ func Init() (Network, error) {
 	return n, nil
 }
 
+// Read the cluster nodes again and update nodes[]
+// Without any the node runs standalone, labels of removed nodes are dropped
+func (n *nodes) Reload() error {
+	// Find own address (node shouldnt connect to itself)
+	cname := Address()
+
+	cluster, err := clusterNodes()
+	if err != nil {
+		return err
+	}
+
+	others, index, found := []string{}, 0, false
+	for line, node := range cluster {
+		if node == cname { // so that node doesnt connect to itself
+			index = line
+			found = true
+			continue
+		}
+		others = append(others, node)
+	}
+	if !found { // node isn't listed, place it after every listed node
+		index = len(others)
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for _, node := range others {
+		if !slices.Contains(n.nodes, node) {
+			h.Publish(h.BusEvent{Topic: h.TopicPeerState, Type: "added", Key: node})
+		}
+	}
+	for _, node := range n.nodes {
+		if !slices.Contains(others, node) {
+			h.Publish(h.BusEvent{Topic: h.TopicPeerState, Type: "removed", Key: node})
+		}
+	}
+	n.nodes, n.index, n.size = others, index, len(others)+1
+	for node := range n.labels {
+		if !slices.Contains(others, node) {
+			delete(n.labels, node)
+		}
+	}
+	return nil
+}
+
 // Ping other nodes to check if connection is alive
 // Updates nodes[] if a connection breaks
 // Return false if all connections fail, else return true
@@ -69,8 +136,14 @@ func (n *nodes) Ping() bool {
 	copy(temp, n.nodes)
 	n.mutex.RUnlock()
 
+	// Standalone node has no connections to lose
+	if len(temp) == 0 {
+		return true
+	}
+
 	// Ping each node and save in newNodes[]
 	var newNodes []string
+	newLabels := make(map[string]map[string]string)
 	for _, v := range temp {
 		resp, err := n.client.Get(v + "/ping")
 		if err != nil || resp == nil {
@@ -79,9 +152,15 @@ func (n *nodes) Ping() bool {
 
 		if resp.StatusCode == http.StatusOK {
 			newNodes = append(newNodes, v)
+			newLabels[v] = n.fetchLabels(v)
 		}
 		resp.Body.Close()
 	}
+	for _, v := range temp {
+		if !slices.Contains(newNodes, v) {
+			h.Publish(h.BusEvent{Topic: h.TopicPeerState, Type: "down", Key: v})
+		}
+	}
 
 	// If all pings failed, return false
 	if len(newNodes) == 0 {
@@ -91,10 +170,36 @@ func (n *nodes) Ping() bool {
 	// Update nodes[]
 	n.mutex.Lock()
 	n.nodes = newNodes
+	n.labels = newLabels
 	n.mutex.Unlock()
 	return true
 }
 
+// Fetch labels of a node, returns empty labels if node doesn't report any
+func (n *nodes) fetchLabels(node string) map[string]string {
+	labels := make(map[string]string)
+	resp, err := n.internal(context.Background(), "GET", node+"/internal/labels", nil)
+	if err != nil {
+		return labels
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		json.NewDecoder(resp.Body).Decode(&labels)
+	}
+	return labels
+}
+
+// Get labels of each connected node
+func (n *nodes) Topology() map[string]map[string]string {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	topology := make(map[string]map[string]string, len(n.nodes))
+	for _, v := range n.nodes {
+		topology[v] = n.labels[v]
+	}
+	return topology
+}
+
 // // Propagate change to other nodes
 // func PropagateChange(newLog string) error {
 // 	bodyFormat := fmt.Sprintf(`{"update": "%s"}`, newLog)
@@ -110,3 +215,157 @@ func (n *nodes) Ping() bool {
 // 	}
 // 	return nil
 // }
+
+// Send a POST request with body, which may be nil, to path on every connected node at once
+// Each node has PEER_TIMEOUT to answer, so a stalled node doesn't hold up the others
+// Returns the nodes that did not accept it, including those not answering before ctx was done
+func (n *nodes) Broadcast(ctx context.Context, path string, body []byte) []string {
+	n.mutex.RLock()
+	temp := slices.Clone(n.nodes)
+	n.mutex.RUnlock()
+
+	failed := []string{}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, v := range temp {
+		wg.Go(func() {
+			resp, err := n.internal(ctx, "POST", v+path, body)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if err != nil || resp.StatusCode != http.StatusOK {
+				mutex.Lock()
+				failed = append(failed, v)
+				mutex.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	slices.Sort(failed)
+	return failed
+}
+
+// Send a GET request to path on every connected node at once
+// Returns the bodies of the nodes that answered 200, nodes failing or not answering before ctx is done are left out
+func (n *nodes) Gather(ctx context.Context, path string) [][]byte {
+	n.mutex.RLock()
+	temp := slices.Clone(n.nodes)
+	n.mutex.RUnlock()
+
+	bodies := [][]byte{}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, v := range temp {
+		wg.Go(func() {
+			resp, err := n.internal(ctx, "GET", v+path, nil)
+			if err != nil {
+				return
+			}
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			if err != nil || resp.StatusCode != http.StatusOK {
+				return
+			}
+			mutex.Lock()
+			bodies = append(bodies, b)
+			mutex.Unlock()
+		})
+	}
+	wg.Wait()
+	return bodies
+}
+
+// Send a signed request to another node, body may be nil
+func (n *nodes) internal(ctx context.Context, method string, url string, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	Sign(req, n.secret, body)
+	return n.client.Do(req)
+}
+
+// Get place of this node in the cluster file and number of nodes in it
+// Every node gets a distinct index, usable to partition work without coordination
+func (n *nodes) Position() (int, int) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.index, n.size
+}
+
+// Address of this node as other nodes list it, from CNAME or else the hostname
+// Empty if neither is known
+func Address() string {
+	name := os.Getenv("CNAME")
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	if name == "" {
+		return ""
+	}
+	return h.Scheme() + "://" + name + ":" + h.Port()
+}
+
+// Pick the node owning a key using weighted rendezvous hashing
+// Nodes with a higher capacity weight own a proportionally larger share of keys
+func Owner(key string, weights map[string]float64) string {
+	owner := ""
+	best := math.Inf(-1)
+	for node, weight := range weights {
+		if weight <= 0 {
+			continue
+		}
+		hash := fnv.New64a()
+		hash.Write([]byte(node))
+		hash.Write([]byte(key))
+		// Map hash to (0, 1) and score it, higher score wins
+		u := (float64(hash.Sum64()>>11) + 0.5) / (1 << 53)
+		score := -weight / math.Log(u)
+		if score > best || (score == best && node < owner) {
+			best = score
+			owner = node
+		}
+	}
+	return owner
+}
+
+// Capacity weight of a node from its "capacity" label, defaults to 1
+func Weight(labels map[string]string) float64 {
+	w, err := strconv.ParseFloat(labels["capacity"], 64)
+	if err != nil || w <= 0 {
+		return 1
+	}
+	return w
+}
+
+// Nodes of the cluster in order, from CLUSTER_PEERS or else the cluster file
+// Returns none if neither is set
+func clusterNodes() ([]string, error) {
+	if v := os.Getenv("CLUSTER_PEERS"); v != "" {
+		var cluster []string
+		for _, node := range strings.Split(v, ",") {
+			if node = strings.TrimSpace(node); node != "" {
+				cluster = append(cluster, node)
+			}
+		}
+		return cluster, nil
+	}
+	file, err := os.Open(h.GetLayout().ClusterFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var cluster []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		cluster = append(cluster, scanner.Text())
+	}
+	return cluster, scanner.Err()
+}
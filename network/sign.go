@@ -0,0 +1,149 @@
+package network
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	h "gokv/helper"
+	"io"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Headers carrying the signature of internal requests
+const (
+	timestampHeader = "X-Gokv-Timestamp"
+	nonceHeader     = "X-Gokv-Nonce"
+	signatureHeader = "X-Gokv-Signature"
+)
+
+// Signed requests older than this, or this far in the future, are rejected
+// Nonces are remembered for twice as long so a replay is caught either way
+const signatureWindow = 30 * time.Second
+
+// Largest body of an internal request, bodies are read whole to check their hash
+const maxSignedBody = 1 << 20
+
+// Internal requests rejected for a bad, stale or replayed signature
+var rejectedInternal = expvar.NewInt("rejected_internal")
+
+// Sign a request to another node with a timestamp and a one-time nonce
+// The signature covers method, path and query and a hash of body, which may be nil
+func Sign(r *http.Request, secret []byte, body []byte) {
+	if len(secret) == 0 {
+		return
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	ts := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	r.Header.Set(timestampHeader, ts)
+	r.Header.Set(nonceHeader, hex.EncodeToString(nonce))
+	r.Header.Set(signatureHeader, signature(r, secret, ts, hex.EncodeToString(nonce), body))
+}
+
+// HMAC-SHA256 of the signed parts of a request
+func signature(r *http.Request, secret []byte, ts string, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(r.Method + "\n" + r.URL.RequestURI() + "\n" + ts + "\n" + nonce + "\n" + hex.EncodeToString(sum[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Nonce remembered until it can be forgotten
+type seenNonce struct {
+	nonce string
+	until time.Time
+}
+
+// Checks signatures and client certificates of requests under /internal/ and remembers used nonces
+type Verifier struct {
+	secret      []byte
+	requireCert bool                      // Internal requests need a verified client certificate
+	allow       atomic.Pointer[Allowlist] // Client addresses allowed, nil allows any
+	seen        map[string]bool           // Nonces used within the window
+	expiring    []seenNonce               // Seen nonces in the order they can be forgotten
+	mutex       sync.Mutex                // Manage access to shared resources
+}
+
+// Create a verifier for the shared cluster secret
+// With an empty secret internal requests are not signed, with requireCert
+// they must come over TLS with a client certificate signed by the cluster CA
+func NewVerifier(secret string, requireCert bool) *Verifier {
+	return &Verifier{secret: []byte(secret), requireCert: requireCert, seen: make(map[string]bool)}
+}
+
+// Only accept internal requests from addresses on the allowlist, nil allows any
+func (v *Verifier) SetAllowlist(a *Allowlist) {
+	v.allow.Store(a)
+}
+
+// Middleware rejecting internal requests from addresses not on the allowlist,
+// without a client certificate if one is required, or that aren't signed, are stale or were seen before
+func (v *Verifier) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/internal/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if allow := v.allow.Load(); allow != nil {
+			client, err := netip.ParseAddrPort(r.RemoteAddr)
+			if err != nil || !allow.Allows(client.Addr()) {
+				rejectedInternal.Add(1)
+				h.WriteError(w, http.StatusForbidden, h.CodeUnauthorized, "Address not allowed", "")
+				return
+			}
+		}
+		if v.requireCert && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			rejectedInternal.Add(1)
+			h.WriteError(w, http.StatusUnauthorized, h.CodeUnauthorized, "Client certificate required", "")
+			return
+		}
+		if len(v.secret) > 0 {
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSignedBody))
+			if err != nil || !v.verify(r, body, time.Now()) {
+				rejectedInternal.Add(1)
+				h.WriteError(w, http.StatusUnauthorized, h.CodeUnauthorized, "Invalid signature", "")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Check signature and freshness of a request and its body, recording its nonce
+func (v *Verifier) verify(r *http.Request, body []byte, now time.Time) bool {
+	ts := r.Header.Get(timestampHeader)
+	nonce := r.Header.Get(nonceHeader)
+	ms, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || nonce == "" {
+		return false
+	}
+	if age := now.Sub(time.UnixMilli(ms)); age > signatureWindow || age < -signatureWindow {
+		return false
+	}
+	if !hmac.Equal([]byte(r.Header.Get(signatureHeader)), []byte(signature(r, v.secret, ts, nonce, body))) {
+		return false
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.seen[nonce] {
+		return false
+	}
+	for len(v.expiring) > 0 && now.After(v.expiring[0].until) {
+		delete(v.seen, v.expiring[0].nonce)
+		v.expiring = v.expiring[1:]
+	}
+	v.seen[nonce] = true
+	v.expiring = append(v.expiring, seenNonce{nonce: nonce, until: now.Add(2 * signatureWindow)})
+	return true
+}
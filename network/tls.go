@@ -0,0 +1,151 @@
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	h "gokv/helper"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Certificate served to clients, reloaded once its certificate or key file changes
+// so a renewed certificate is picked up without a restart
+type Certificates struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+	modified          time.Time // Latest change of either file when last loaded
+	loaded            time.Time
+	mutex             sync.Mutex // Manage access to shared resource
+}
+
+// Load a PEM certificate chain and its private key
+func LoadCertificates(certFile string, keyFile string) (*Certificates, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both a certificate and a key file are needed")
+	}
+	c := &Certificates{certFile: certFile, keyFile: keyFile}
+	if _, err := c.Refresh(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// TLS settings serving the current certificate
+func (c *Certificates) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return c.cert.Load(), nil
+		},
+	}
+}
+
+// Load the files again if either changed since they were last loaded
+// On failure, e.g. while a renewed certificate is half written, the current one is kept
+func (c *Certificates) Refresh() (bool, error) {
+	modified, err := latestChange(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.cert.Load() != nil && modified.Equal(c.modified) {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	c.cert.Store(&cert)
+	c.modified, c.loaded = modified, time.Now()
+	return true, nil
+}
+
+// Check the files for changes every interval until ctx is done
+func (c *Certificates) Watch(ctx context.Context, interval time.Duration) error {
+	for h.Wait(ctx, interval) {
+		if reloaded, err := c.Refresh(); err != nil {
+			log.Println("Could not reload TLS certificate - ", err)
+		} else if reloaded {
+			log.Println("Reloaded TLS certificate - ", c.certFile)
+		}
+	}
+	return nil
+}
+
+// Subject, expiry and load time of the current certificate
+func (c *Certificates) Stats() map[string]any {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := map[string]any{"cert_file": c.certFile, "loaded_at": c.loaded}
+	if cert := c.cert.Load(); cert != nil && cert.Leaf != nil {
+		stats["subject"] = cert.Leaf.Subject.String()
+		stats["not_after"] = cert.Leaf.NotAfter
+	}
+	return stats
+}
+
+// Latest modification time of the files
+func latestChange(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Ask clients for a certificate signed by a CA in caFile, for internal routes
+// Clients without one are still served, the Verifier rejects them on internal routes
+func RequestClientCerts(config *tls.Config, caFile string) error {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return errors.New("no certificates in " + caFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
+
+// TLS settings for requests to other nodes, trusting the CAs in caFile besides the
+// system ones and presenting this node's certificate. Returns nil without either
+func peerTLS(caFile string, certs *Certificates) (*tls.Config, error) {
+	if caFile == "" && certs == nil {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + caFile)
+		}
+		config.RootCAs = pool
+	}
+	if certs != nil {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certs.cert.Load(), nil
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"gokv/api"
+	"gokv/helper"
+	"gokv/network"
+	"gokv/storage"
+)
+
+// Settings a reload applies, any other change needs a restart
+var reloadable = map[string]bool{
+	"FLUSH_INTERVAL": true, "PING_INTERVAL": true, "LOG_LEVEL": true,
+	"CLUSTER_FILE": true, "CLUSTER_PEERS": true, "MAX_CONNS_PER_CLIENT": true, "MAX_CONNS": true,
+	"SOFT_MAX_KEYS": true, "SOFT_MAX_MB": true, "SOFT_MAX_WRITES_PER_SEC": true,
+	"NAMESPACE_QUOTAS": true, "API_KEYS": true, "ADMIN_API_KEYS": true,
+	"JWT_SECRET": true, "JWT_PUBLIC_KEY": true, "JWT_ISSUER": true, "JWT_AUDIENCE": true, "JWT_ROLE_CLAIM": true, "JWT_MAX_AGE": true, "ACLS": true, "INTERNAL_ALLOW": true,
+	"RATE_LIMIT_PER_IP": true, "RATE_LIMIT_PER_KEY": true, "ACCESS_LOG": true,
+	"CORS_ORIGINS": true, "CORS_METHODS": true, "CORS_HEADERS": true,
+	"COMPRESSION": true, "COMPRESS_MIN_BYTES": true, "REQUEST_TIMEOUT": true,
+	"MAX_KEY_BYTES": true, "MAX_VALUE_BYTES": true,
+}
+
+// Intervals of the flush and ping loops, changed on reload
+var flushInterval, pingInterval atomic.Int64
+
+// Settings that can change while the node runs
+type tunables struct {
+	flush, ping        time.Duration
+	logLevel           storage.LogLevel
+	maxConns, maxTotal int
+	softKeys, softRate int
+	softBytes          int64
+	nsQuotas           api.NamespaceQuotas
+	apiKeys            api.APIKeys
+	jwt                *api.JWTValidator
+	acls               api.ACLs
+	internalAllow      *network.Allowlist
+	perIP, perKey      api.RequestRate
+	accessLog          bool
+	cors               *api.CORS
+	compress           bool
+	compressMin        int
+	requestTimeout     time.Duration
+	maxKey, maxValue   int
+}
+
+// Read tunables from the environment, failing on invalid values before anything is applied
+func readTunables() (tunables, error) {
+	t := tunables{flush: time.Second * 5, ping: time.Minute * 2}
+	if d, err := time.ParseDuration(os.Getenv("FLUSH_INTERVAL")); err == nil && d > 0 {
+		t.flush = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("PING_INTERVAL")); err == nil && d > 0 {
+		t.ping = d
+	}
+	var err error
+	if t.logLevel, err = storage.ParseLogLevel(os.Getenv("LOG_LEVEL")); err != nil {
+		return t, fmt.Errorf("invalid LOG_LEVEL - %w", err)
+	}
+	t.maxConns, _ = strconv.Atoi(os.Getenv("MAX_CONNS_PER_CLIENT"))
+	t.maxTotal, _ = strconv.Atoi(os.Getenv("MAX_CONNS"))
+	t.softKeys, _ = strconv.Atoi(os.Getenv("SOFT_MAX_KEYS"))
+	softMB, _ := strconv.ParseInt(os.Getenv("SOFT_MAX_MB"), 10, 64)
+	t.softBytes = softMB << 20
+	t.softRate, _ = strconv.Atoi(os.Getenv("SOFT_MAX_WRITES_PER_SEC"))
+	if t.nsQuotas, err = api.ParseNamespaceQuotas(os.Getenv("NAMESPACE_QUOTAS")); err != nil {
+		return t, fmt.Errorf("invalid NAMESPACE_QUOTAS - %w", err)
+	}
+	if t.apiKeys, err = api.ParseAPIKeys(os.Getenv("API_KEYS"), os.Getenv("ADMIN_API_KEYS")); err != nil {
+		return t, fmt.Errorf("invalid API_KEYS or ADMIN_API_KEYS - %w", err)
+	}
+	var jwtMaxAge time.Duration
+	if v := os.Getenv("JWT_MAX_AGE"); v != "" {
+		if jwtMaxAge, err = time.ParseDuration(v); err != nil || jwtMaxAge <= 0 {
+			return t, fmt.Errorf("invalid JWT_MAX_AGE %q", v)
+		}
+	}
+	t.jwt, err = api.NewJWTValidator(os.Getenv("JWT_SECRET"), os.Getenv("JWT_PUBLIC_KEY"),
+		os.Getenv("JWT_ISSUER"), os.Getenv("JWT_AUDIENCE"), os.Getenv("JWT_ROLE_CLAIM"), jwtMaxAge)
+	if err != nil {
+		return t, fmt.Errorf("invalid JWT_PUBLIC_KEY - %w", err)
+	}
+	if t.acls, err = api.ParseACLs(os.Getenv("ACLS")); err != nil {
+		return t, fmt.Errorf("invalid ACLS - %w", err)
+	}
+	if t.internalAllow, err = network.ParseAllowlist(os.Getenv("INTERNAL_ALLOW")); err != nil {
+		return t, fmt.Errorf("invalid INTERNAL_ALLOW - %w", err)
+	}
+	if t.perIP, err = api.ParseRequestRate(os.Getenv("RATE_LIMIT_PER_IP")); err != nil {
+		return t, fmt.Errorf("invalid RATE_LIMIT_PER_IP - %w", err)
+	}
+	if t.perKey, err = api.ParseRequestRate(os.Getenv("RATE_LIMIT_PER_KEY")); err != nil {
+		return t, fmt.Errorf("invalid RATE_LIMIT_PER_KEY - %w", err)
+	}
+	t.accessLog = os.Getenv("ACCESS_LOG") != "false"
+	if t.cors, err = api.ParseCORS(os.Getenv("CORS_ORIGINS"), os.Getenv("CORS_METHODS"), os.Getenv("CORS_HEADERS")); err != nil {
+		return t, fmt.Errorf("invalid CORS_ORIGINS - %w", err)
+	}
+	t.compress, t.compressMin = os.Getenv("COMPRESSION") != "false", api.DefaultCompressMinBytes
+	if v := os.Getenv("COMPRESS_MIN_BYTES"); v != "" {
+		if t.compressMin, err = strconv.Atoi(v); err != nil || t.compressMin < 1 {
+			return t, fmt.Errorf("invalid COMPRESS_MIN_BYTES %q", v)
+		}
+	}
+	if v := os.Getenv("REQUEST_TIMEOUT"); v != "" {
+		if t.requestTimeout, err = time.ParseDuration(v); err != nil || t.requestTimeout < 0 {
+			return t, fmt.Errorf("invalid REQUEST_TIMEOUT %q", v)
+		}
+	}
+	t.maxKey, t.maxValue = api.DefaultMaxKeyBytes, api.DefaultMaxValueBytes
+	if v := os.Getenv("MAX_KEY_BYTES"); v != "" {
+		if t.maxKey, err = strconv.Atoi(v); err != nil || t.maxKey < 1 {
+			return t, fmt.Errorf("invalid MAX_KEY_BYTES %q", v)
+		}
+	}
+	if v := os.Getenv("MAX_VALUE_BYTES"); v != "" {
+		if t.maxValue, err = strconv.Atoi(v); err != nil || t.maxValue < 1 {
+			return t, fmt.Errorf("invalid MAX_VALUE_BYTES %q", v)
+		}
+	}
+	return t, nil
+}
+
+// Apply tunables to the running node
+func (t tunables) apply(srv *api.Server, clients *network.ClientListener, verifier *network.Verifier) {
+	flushInterval.Store(int64(t.flush))
+	pingInterval.Store(int64(t.ping))
+	storage.SetLogLevel(t.logLevel)
+	clients.SetLimits(t.maxConns, t.maxTotal)
+	srv.SetSoftQuota(t.softKeys, t.softBytes, t.softRate)
+	srv.SetNamespaceQuotas(t.nsQuotas)
+	srv.SetAPIKeys(t.apiKeys)
+	srv.SetJWT(t.jwt)
+	srv.SetACLs(t.acls)
+	verifier.SetAllowlist(t.internalAllow)
+	srv.SetRequestRates(t.perIP, t.perKey)
+	srv.SetAccessLog(t.accessLog)
+	srv.SetCORS(t.cors)
+	srv.SetCompression(t.compress, t.compressMin)
+	srv.SetRequestTimeout(t.requestTimeout)
+	srv.SetPairLimits(t.maxKey, t.maxValue)
+}
+
+// Reload the configuration file and overrides, then apply the tunables and cluster nodes
+// On invalid settings the previous environment is restored and nothing changes
+func reloader(configPath string, overrides helper.ConfigOverrides, srv *api.Server, clients *network.ClientListener, verifier *network.Verifier, nodes network.Network) api.Reloader {
+	return func() ([]string, []string, error) {
+		changed, restore, err := helper.ReloadConfig(configPath, overrides)
+		if err != nil {
+			return nil, nil, err
+		}
+		t, err := readTunables()
+		if err != nil {
+			restore()
+			return nil, nil, err
+		}
+
+		old := helper.GetLayout()
+		layout := old
+		layout.ClusterFile = helper.LayoutFromEnv().ClusterFile
+		helper.SetLayout(layout)
+		if err := nodes.Reload(); err != nil {
+			restore()
+			helper.SetLayout(old)
+			return nil, nil, fmt.Errorf("could not read cluster nodes - %w", err)
+		}
+		t.apply(srv, clients, verifier)
+
+		applied, restart := []string{}, []string{}
+		for _, name := range changed {
+			if reloadable[name] {
+				applied = append(applied, name)
+			} else {
+				restart = append(restart, name)
+			}
+		}
+		return applied, restart, nil
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Build the HTTP server with timeouts and a header size limit, so slow or idle
+// clients can't hold connections forever
+// READ_HEADER_TIMEOUT, READ_TIMEOUT, WRITE_TIMEOUT, IDLE_TIMEOUT and MAX_HEADER_BYTES,
+// a timeout of 0 disables it. Streaming responses lift the read and write timeouts
+func newHTTPServer(handler http.Handler) (*http.Server, error) {
+	server := &http.Server{Handler: handler, MaxHeaderBytes: 64 << 10}
+	timeouts := []struct {
+		name  string
+		value *time.Duration
+		def   time.Duration
+	}{
+		{"READ_HEADER_TIMEOUT", &server.ReadHeaderTimeout, 10 * time.Second},
+		{"READ_TIMEOUT", &server.ReadTimeout, 30 * time.Second},
+		{"WRITE_TIMEOUT", &server.WriteTimeout, time.Minute},
+		{"IDLE_TIMEOUT", &server.IdleTimeout, 2 * time.Minute},
+	}
+	for _, t := range timeouts {
+		*t.value = t.def
+		if v := os.Getenv(t.name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid %s %q", t.name, v)
+			}
+			*t.value = d
+		}
+	}
+	if v := os.Getenv("MAX_HEADER_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid MAX_HEADER_BYTES %q", v)
+		}
+		server.MaxHeaderBytes = n
+	}
+	return server, nil
+}
@@ -0,0 +1,21 @@
+package storage
+
+// Change of a key made through an in-memory map
+type Change struct {
+	Type  string // "set", "delete", or "expire" when an expired key is removed
+	Key   string
+	Value string // New value of a set key
+}
+
+// Called by an in-memory map with every change it makes, under the map lock,
+// so changes to a key arrive in the order they were applied
+// Must not block or call back into the map
+type Watcher func(c Change)
+
+// Type of change removing a key, depending on whether it had expired
+func removal(expired bool) string {
+	if expired {
+		return "expire"
+	}
+	return "delete"
+}
@@ -0,0 +1,568 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	h "gokv/helper"
+	debug "log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/options"
+)
+
+// Keys moved to and fetched back from the cold tier
+var (
+	coldDemotions  = expvar.NewInt("cold_demotions")
+	coldPromotions = expvar.NewInt("cold_promotions")
+)
+
+// Compressed database holding keys that haven't been accessed for a while
+type ColdTier struct {
+	db      *badger.DB
+	after   time.Duration    // Idle time after which keys are moved here
+	count   atomic.Int64     // Keys stored here
+	touched map[string]int64 // Key -> unix second of last access, only for keys in the hot tier
+	since   int64            // Keys never accessed count as accessed at start
+	mutex   sync.Mutex       // Manage access to shared resources
+}
+
+// Open the cold tier database, keys idle for longer than after are moved there
+func OpenColdTier(after time.Duration) (*ColdTier, error) {
+	db, err := badger.Open(badger.DefaultOptions(h.ColdPath()).WithCompression(options.ZSTD).WithLogger(nil))
+	if err != nil {
+		return nil, err
+	}
+	c := &ColdTier{db: db, after: after, touched: make(map[string]int64), since: time.Now().Unix()}
+	n := 0
+	err = c.rangeKeys(context.Background(), "", func(string) bool {
+		n++
+		return true
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	c.count.Store(int64(n))
+	return c, nil
+}
+
+// Close cold tier database before quitting
+func (c *ColdTier) Close() error {
+	return c.db.Close()
+}
+
+// Record an access to key
+func (c *ColdTier) touch(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.touched[key] = time.Now().Unix()
+}
+
+// Remove every key from the cold tier
+func (c *ColdTier) drop() error {
+	c.mutex.Lock()
+	c.touched = make(map[string]int64)
+	c.mutex.Unlock()
+	if err := c.db.DropAll(); err != nil {
+		return err
+	}
+	c.count.Store(0)
+	return nil
+}
+
+// Stop tracking accesses to keys that were removed
+func (c *ColdTier) forget(keys ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, key := range keys {
+		delete(c.touched, key)
+	}
+}
+
+// Check if key wasn't accessed since cutoff
+func (c *ColdTier) idle(key string, cutoff int64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	last, ok := c.touched[key]
+	if !ok {
+		last = c.since
+	}
+	return last < cutoff
+}
+
+// Read a key from the cold tier
+func (c *ColdTier) get(key string) (string, bool) {
+	var value string
+	err := c.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		val, err := item.ValueCopy(nil)
+		value = string(val)
+		return err
+	})
+	if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+		debug.Println("Could not read from cold tier - ", err)
+	}
+	return value, err == nil
+}
+
+// Write a key to the cold tier
+func (c *ColdTier) put(key string, value string) error {
+	added := false
+	err := c.db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(key))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			added = true
+		} else if err != nil {
+			return err
+		}
+		return txn.Set([]byte(key), []byte(value))
+	})
+	if err == nil && added {
+		c.count.Add(1)
+	}
+	return err
+}
+
+// Remove keys from the cold tier
+func (c *ColdTier) remove(keys ...string) {
+	removed := 0
+	err := c.db.Update(func(txn *badger.Txn) error {
+		removed = 0
+		for _, key := range keys {
+			if _, err := txn.Get([]byte(key)); errors.Is(err, badger.ErrKeyNotFound) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if err := txn.Delete([]byte(key)); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		debug.Println("Could not delete from cold tier - ", err)
+		return
+	}
+	c.count.Add(-int64(removed))
+}
+
+// Call fn with each key-value pair under prefix in the cold tier, until it returns false
+// Pairs are read from an iterator, keys skip returns true for are left out
+func (c *ColdTier) rangePairs(ctx context.Context, prefix string, skip func(key string) bool, fn func(key string, value string) bool) error {
+	return c.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		p := []byte(prefix)
+		n := 0
+		for it.Seek(p); it.ValidForPrefix(p); it.Next() {
+			if n++; n%rangeChunk == 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+			}
+			key := string(it.Item().Key())
+			if skip(key) {
+				continue
+			}
+			val, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if !fn(key, string(val)) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// Keys under prefix in the cold tier, values aren't read
+func (c *ColdTier) keys(prefix string) []string {
+	var keys []string
+	err := c.rangeKeys(context.Background(), prefix, func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		debug.Println("Could not list cold tier keys - ", err)
+	}
+	return keys
+}
+
+// Call fn with each key under prefix in the cold tier, until it returns false, values aren't read
+func (c *ColdTier) rangeKeys(ctx context.Context, prefix string, fn func(key string) bool) error {
+	return c.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		p := []byte(prefix)
+		n := 0
+		for it.Seek(p); it.ValidForPrefix(p); it.Next() {
+			if n++; n%rangeChunk == 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+			}
+			if !fn(string(it.Item().Key())) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// In-memory map backed by a cold tier
+// Keys missing from the map are looked up in the cold tier and moved back on access
+type TieredMap struct {
+	InMemoryMap
+	log    Log
+	cold   *ColdTier
+	watch  Watcher // Told about changes of cold keys, nil if nothing watches the map
+	moving string  // Key being moved between tiers, its change isn't reported. Guarded by the map lock
+}
+
+// Wrap an in-memory map with a cold tier
+func NewTieredMap(mp InMemoryMap, log Log, cold *ColdTier) *TieredMap {
+	return &TieredMap{InMemoryMap: mp, log: log, cold: cold}
+}
+
+// Report every later change of either tier to fn
+// Moving a key between tiers doesn't change it, so isn't reported
+func (t *TieredMap) Watch(fn Watcher) {
+	t.watch = fn
+	t.InMemoryMap.Watch(func(c Change) {
+		if c.Key == t.moving {
+			t.moving = ""
+			return
+		}
+		fn(c)
+	})
+}
+
+// Report a change of a cold key to the watcher, callers hold the map lock
+func (t *TieredMap) changed(typ string, key string) {
+	if t.watch != nil {
+		t.watch(Change{Type: typ, Key: key})
+	}
+}
+
+// Move key back from the cold tier if it isn't in the map
+// The value is written to the WAL first, so it survives a restart
+// Only keys found in either tier count as accessed
+func (t *TieredMap) promote(key string) {
+	if t.InMemoryMap.Exists(key) {
+		t.cold.touch(key)
+		return
+	}
+	value, ok := t.cold.get(key)
+	if !ok {
+		return
+	}
+	err := t.InMemoryMap.Modify(key, func(old string, exists bool) (string, bool, error) {
+		if exists { // written meanwhile, the newer value wins
+			t.moving = key
+			return old, false, nil
+		}
+		if _, err := t.log.UpdateLog("SET", key, value); err != nil {
+			return "", false, err
+		}
+		t.moving = key
+		return value, false, nil
+	})
+	if err != nil {
+		debug.Println("Could not move key from cold tier - ", err)
+		return
+	}
+	t.cold.touch(key)
+	t.cold.remove(key)
+	coldPromotions.Add(1)
+}
+
+// Get value from in-memory map, fetching it from the cold tier if needed
+func (t *TieredMap) GetValue(key string) string {
+	t.promote(key)
+	return t.InMemoryMap.GetValue(key)
+}
+
+// Check if key exists in in-memory map or the cold tier
+func (t *TieredMap) Exists(key string) bool {
+	t.promote(key)
+	return t.InMemoryMap.Exists(key)
+}
+
+// Get metadata of a key, fetching it from the cold tier if needed
+// Metadata starts over when a key is fetched back
+func (t *TieredMap) Meta(key string) (KeyMeta, bool) {
+	t.promote(key)
+	return t.InMemoryMap.Meta(key)
+}
+
+// Set value in in-memory map, replacing any cold copy
+func (t *TieredMap) SetValue(key string, value string) {
+	t.cold.touch(key)
+	t.InMemoryMap.SetValue(key, value)
+	t.cold.remove(key)
+}
+
+// Set multiple values in in-memory map, replacing any cold copies
+func (t *TieredMap) SetValues(pairs map[string]string) {
+	keys := make([]string, 0, len(pairs))
+	for key := range pairs {
+		t.cold.touch(key)
+		keys = append(keys, key)
+	}
+	t.InMemoryMap.SetValues(pairs)
+	t.cold.remove(keys...)
+}
+
+// Delete key from in-memory map and the cold tier
+func (t *TieredMap) DeleteValue(key string) {
+	t.InMemoryMap.DeleteValue(key)
+	t.cold.remove(key)
+	t.cold.forget(key)
+}
+
+// Remove every key from in-memory map and the cold tier, running wipe first under the map lock
+// Returns the keys removed from both tiers. A key moving between tiers may be reported deleted twice
+func (t *TieredMap) Clear(wipe func() error) ([]string, error) {
+	var cold []string
+	keys, err := t.InMemoryMap.Clear(func() error {
+		if err := wipe(); err != nil {
+			return err
+		}
+		cold = t.cold.keys("")
+		if err := t.cold.drop(); err != nil {
+			return err
+		}
+		for _, key := range cold {
+			t.changed("delete", key)
+		}
+		return nil
+	})
+	hot := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		hot[key] = true
+	}
+	for _, key := range cold {
+		if !hot[key] { // moved back meanwhile
+			keys = append(keys, key)
+		}
+	}
+	return keys, err
+}
+
+// Modify a key atomically, fetching it from the cold tier first
+func (t *TieredMap) Modify(key string, fn func(old string, exists bool) (string, bool, error)) error {
+	t.promote(key)
+	removed := false
+	err := t.InMemoryMap.Modify(key, func(old string, exists bool) (string, bool, error) {
+		value, remove, err := fn(old, exists)
+		removed = remove && err == nil
+		return value, remove, err
+	})
+	t.forgetIf(key, removed)
+	return err
+}
+
+// Modify a key atomically with its metadata, fetching it from the cold tier first
+func (t *TieredMap) ModifyMeta(key string, fn func(old string, meta KeyMeta, exists bool) (string, bool, error)) error {
+	t.promote(key)
+	removed := false
+	err := t.InMemoryMap.ModifyMeta(key, func(old string, meta KeyMeta, exists bool) (string, bool, error) {
+		value, remove, err := fn(old, meta, exists)
+		removed = remove && err == nil
+		return value, remove, err
+	})
+	t.forgetIf(key, removed)
+	return err
+}
+
+// Modify a key atomically with its expiry, fetching it from the cold tier first
+func (t *TieredMap) ModifyExpiry(key string, fn func(old string, at time.Time, exists bool) (string, time.Time, bool, error)) error {
+	t.promote(key)
+	removed := false
+	err := t.InMemoryMap.ModifyExpiry(key, func(old string, at time.Time, exists bool) (string, time.Time, bool, error) {
+		value, expireAt, remove, err := fn(old, at, exists)
+		removed = remove && err == nil
+		return value, expireAt, remove, err
+	})
+	t.forgetIf(key, removed)
+	return err
+}
+
+// Stop tracking accesses to key if a modification removed it
+func (t *TieredMap) forgetIf(key string, removed bool) {
+	if removed {
+		t.cold.forget(key)
+	}
+}
+
+// Apply operations on several keys atomically, cold keys are read in place
+// Keys set by the transaction count as accessed, all keys it writes are removed from the cold tier
+func (t *TieredMap) Transact(fn func(get func(key string) (string, bool), expiry func(key string) time.Time, meta func(key string) KeyMeta) ([]TxnOp, error)) error {
+	var written, set, deleted []string
+	err := t.InMemoryMap.Transact(func(get func(key string) (string, bool), expiry func(key string) time.Time, meta func(key string) KeyMeta) ([]TxnOp, error) {
+		ops, err := fn(func(key string) (string, bool) {
+			value, ok := get(key)
+			if ok {
+				t.cold.touch(key)
+			} else { // stays cold, so its access isn't tracked
+				value, ok = t.cold.get(key)
+			}
+			return value, ok
+		}, expiry, func(key string) KeyMeta { // Cold keys never have a TTL, and are at version 1 once promoted
+			if m := meta(key); m.Version > 0 {
+				return m
+			}
+			if _, ok := t.cold.get(key); ok {
+				return KeyMeta{Version: 1}
+			}
+			return KeyMeta{}
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, op := range ops {
+			written = append(written, op.Key)
+			if op.Op != "DELETE" {
+				set = append(set, op.Key)
+				continue
+			}
+			deleted = append(deleted, op.Key)
+			if _, hot := get(op.Key); !hot { // the map only reports keys it holds
+				if _, ok := t.cold.get(op.Key); ok {
+					t.changed("delete", op.Key)
+				}
+			}
+		}
+		return ops, nil
+	})
+	if err == nil && len(written) > 0 {
+		for _, key := range set {
+			t.cold.touch(key)
+		}
+		t.cold.remove(written...)
+		t.cold.forget(deleted...)
+	}
+	return err
+}
+
+// Number of keys in both tiers
+// Like InMemoryMap.Len it may include expired keys, and a key moving between tiers may briefly count twice
+func (t *TieredMap) Len() int {
+	return t.InMemoryMap.Len() + int(t.cold.count.Load())
+}
+
+// Set expiry of a key, fetching it from the cold tier first
+func (t *TieredMap) SetExpiry(key string, at time.Time) bool {
+	t.promote(key)
+	return t.InMemoryMap.SetExpiry(key, at)
+}
+
+// Get keys whose key starts with prefix, including cold keys
+// Stops early once ctx is done, cold keys are listed only if it isn't
+func (t *TieredMap) Keys(ctx context.Context, prefix string) []string {
+	keys := t.InMemoryMap.Keys(ctx, prefix)
+	if ctx.Err() != nil {
+		return keys
+	}
+	for _, key := range t.cold.keys(prefix) {
+		if !t.InMemoryMap.Exists(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Call fn with each key starting with prefix, including cold keys, until it returns false
+// Hot keys come first, under the map lock like InMemoryMap.RangeKeys, then cold keys without it
+func (t *TieredMap) RangeKeys(ctx context.Context, prefix string, fn func(key string) bool) error {
+	more := true
+	err := t.InMemoryMap.RangeKeys(ctx, prefix, func(key string) bool {
+		more = fn(key)
+		return more
+	})
+	if err != nil || !more {
+		return err
+	}
+	return t.cold.rangeKeys(ctx, prefix, func(key string) bool {
+		return t.InMemoryMap.Exists(key) || fn(key)
+	})
+}
+
+// Count keys whose key starts with prefix, including cold keys
+func (t *TieredMap) Count(prefix string) int {
+	n := t.InMemoryMap.Count(prefix)
+	for _, key := range t.cold.keys(prefix) {
+		if !t.InMemoryMap.Exists(key) {
+			n++
+		}
+	}
+	return n
+}
+
+// Call fn with each key-value pair whose key starts with prefix, including cold keys, until it returns false
+// Hot keys come first, cold keys are then streamed from the cold tier and stay there
+func (t *TieredMap) Range(ctx context.Context, prefix string, fn func(key string, value string) bool) error {
+	more := true
+	err := t.InMemoryMap.Range(ctx, prefix, func(key string, value string) bool {
+		more = fn(key, value)
+		return more
+	})
+	if err != nil || !more {
+		return err
+	}
+	return t.cold.rangePairs(ctx, prefix, t.InMemoryMap.Exists, fn)
+}
+
+// Move keys idle for longer than the cold tier's threshold out of the map
+// Keys with an expiry are left alone, they go away on their own
+// Returns the number of keys moved
+func (t *TieredMap) Demote() (int, error) {
+	cutoff := time.Now().Add(-t.cold.after).Unix()
+	moved := 0
+	for _, key := range t.InMemoryMap.Keys(context.Background(), "") {
+		if strings.HasPrefix(key, "\x00") || !t.cold.idle(key, cutoff) {
+			continue
+		}
+		if _, ok := t.InMemoryMap.Expiry(key); ok {
+			continue
+		}
+		demoted := false
+		err := t.InMemoryMap.Modify(key, func(old string, exists bool) (string, bool, error) {
+			if !exists {
+				return "", true, nil
+			}
+			if err := t.cold.put(key, old); err != nil {
+				return old, false, err
+			}
+			// Removes the key from the hot database once committed
+			if _, err := t.log.UpdateLog("DEMOTE", key, ""); err != nil {
+				return old, false, err
+			}
+			demoted = true
+			t.moving = key
+			return "", true, nil
+		})
+		if err != nil {
+			return moved, err
+		}
+		if demoted {
+			t.cold.forget(key)
+			moved++
+		}
+	}
+	coldDemotions.Add(int64(moved))
+	return moved, nil
+}
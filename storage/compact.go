@@ -0,0 +1,503 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+// Alternative in-memory map for workloads with millions of small keys
+// Keys and values are packed into one byte arena and every other structure is free of pointers,
+// so the garbage collector has a handful of objects to scan instead of two strings per key.
+// Metadata lives in the entry of a key and expiries are keyed by the same entry index.
+// See the benchmarks in compact_test.go
+type compactStore struct {
+	arena   []byte            // Keys and values, back to back
+	garbage int               // Arena bytes no longer referenced by an entry
+	entries []compactEntry    // Keys by index, removed ones are reused through free
+	free    []uint32          // Indexes of removed entries
+	index   map[uint64]uint32 // Hash of key -> index+1 of the first entry with that hash
+	expiry  map[uint32]int64  // Entry index -> expiry, as nanoseconds since base
+	seed    maphash.Seed      // Seed for hashing keys
+	base    time.Time         // Times are stored as offsets from base, keeping its monotonic clock reading
+	watch   Watcher           // Told about every change, nil if nothing watches the map
+	mutex   sync.RWMutex      // Manage access to shared resources
+}
+
+// A key, its value and metadata in a compact map
+type compactEntry struct {
+	keyOff, valueOff int    // Offsets of key and value in the arena
+	keyLen, valueLen uint32 // Lengths of key and value in the arena
+	next             uint32 // Index+1 of the next entry with the same hash, 0 for none
+	live             bool   // False once removed
+	created, updated int64  // Nanoseconds since base
+	version          int64  // Writes of the key, starting at 1
+}
+
+// Arena is rewritten once garbage passes this many bytes and half its size
+const compactGarbage = 1 << 20
+
+// Initialize compact in-memory map
+func InitCompactMap() InMemoryMap {
+	m := &compactStore{seed: maphash.MakeSeed(), base: time.Now(), mutex: sync.RWMutex{}}
+	m.reset()
+	return m
+}
+
+// Drop every key, callers hold the lock
+func (m *compactStore) reset() {
+	m.arena, m.garbage, m.entries, m.free = nil, 0, nil, nil
+	m.index, m.expiry = make(map[uint64]uint32), make(map[uint32]int64)
+}
+
+// Time as an offset from base
+func (m *compactStore) since(t time.Time) int64 {
+	return int64(t.Sub(m.base))
+}
+
+// Offset from base as a time
+func (m *compactStore) at(ns int64) time.Time {
+	return m.base.Add(time.Duration(ns))
+}
+
+// Key of entry i, aliasing the arena
+func (m *compactStore) key(i uint32) []byte {
+	e := &m.entries[i]
+	return m.arena[e.keyOff : e.keyOff+int(e.keyLen)]
+}
+
+// Value of entry i, copied out of the arena
+func (m *compactStore) value(i uint32) string {
+	e := &m.entries[i]
+	return string(m.arena[e.valueOff : e.valueOff+int(e.valueLen)])
+}
+
+// Find the entry of key, expired or not, callers hold the lock
+func (m *compactStore) find(key string) (uint32, bool) {
+	for n := m.index[maphash.String(m.seed, key)]; n != 0; n = m.entries[n-1].next {
+		if string(m.key(n-1)) == key {
+			return n - 1, true
+		}
+	}
+	return 0, false
+}
+
+// Check if entry i has expired at now
+func (m *compactStore) expired(i uint32, now int64) bool {
+	at, ok := m.expiry[i]
+	return ok && now >= at
+}
+
+// Find the entry of key if it exists and hasn't expired at now, callers hold the lock
+func (m *compactStore) lookup(key string, now int64) (uint32, bool) {
+	i, ok := m.find(key)
+	return i, ok && !m.expired(i, now)
+}
+
+// Set key to value at now, keeping its expiry, and return its entry index
+// A key that didn't exist or had expired starts over at version 1, like metadata.written
+func (m *compactStore) put(key string, value string, now int64) uint32 {
+	i, ok := m.find(key)
+	if !ok {
+		return m.insert(key, value, now)
+	}
+	e := &m.entries[i]
+	if m.expired(i, now) {
+		e.created, e.version = now, 0
+	}
+	if len(value) <= int(e.valueLen) { // overwrite in place
+		copy(m.arena[e.valueOff:], value)
+		m.garbage += int(e.valueLen) - len(value)
+	} else {
+		m.garbage += int(e.valueLen)
+		e.valueOff = len(m.arena)
+		m.arena = append(m.arena, value...)
+	}
+	e.valueLen = uint32(len(value))
+	e.updated = now
+	e.version++
+	m.compact()
+	return i
+}
+
+// Add a new entry for key, callers checked it doesn't have one
+func (m *compactStore) insert(key string, value string, now int64) uint32 {
+	e := compactEntry{keyOff: len(m.arena), keyLen: uint32(len(key)), valueLen: uint32(len(value)), live: true, created: now, updated: now, version: 1}
+	m.arena = append(m.arena, key...)
+	e.valueOff = len(m.arena)
+	m.arena = append(m.arena, value...)
+
+	var i uint32
+	if n := len(m.free); n > 0 {
+		i, m.free = m.free[n-1], m.free[:n-1]
+		m.entries[i] = e
+	} else {
+		i = uint32(len(m.entries))
+		m.entries = append(m.entries, e)
+	}
+	h := maphash.String(m.seed, key)
+	m.entries[i].next = m.index[h]
+	m.index[h] = i + 1
+	return i
+}
+
+// Remove key with its expiry and metadata, reporting it if it was there, callers hold the lock
+func (m *compactStore) remove(key string, now int64) {
+	h := maphash.String(m.seed, key)
+	prev := uint32(0)
+	for n := m.index[h]; n != 0; prev, n = n, m.entries[n-1].next {
+		i := n - 1
+		if string(m.key(i)) != key {
+			continue
+		}
+		e := &m.entries[i]
+		if prev == 0 && e.next == 0 {
+			delete(m.index, h)
+		} else if prev == 0 {
+			m.index[h] = e.next
+		} else {
+			m.entries[prev-1].next = e.next
+		}
+		expired := m.expired(i, now)
+		m.garbage += int(e.keyLen) + int(e.valueLen)
+		*e = compactEntry{}
+		delete(m.expiry, i)
+		m.free = append(m.free, i)
+		m.compact()
+		m.changed(removal(expired), key, "")
+		return
+	}
+}
+
+// Set or clear the expiry of entry i
+func (m *compactStore) setExpiry(i uint32, at time.Time) {
+	if at.IsZero() {
+		delete(m.expiry, i)
+	} else {
+		m.expiry[i] = m.since(at)
+	}
+}
+
+// Expiry of entry i, zero without one
+func (m *compactStore) expiryOf(i uint32) time.Time {
+	if at, ok := m.expiry[i]; ok {
+		return m.at(at)
+	}
+	return time.Time{}
+}
+
+// Metadata of entry i
+func (m *compactStore) metaOf(i uint32) KeyMeta {
+	e := &m.entries[i]
+	return KeyMeta{Created: m.at(e.created), Updated: m.at(e.updated), Version: e.version}
+}
+
+// Rewrite the arena with only live keys and values once enough of it is garbage
+func (m *compactStore) compact() {
+	if m.garbage < compactGarbage || m.garbage < len(m.arena)/2 {
+		return
+	}
+	arena := make([]byte, 0, len(m.arena)-m.garbage)
+	for i := range m.entries {
+		e := &m.entries[i]
+		if !e.live {
+			continue
+		}
+		off := len(arena)
+		arena = append(arena, m.arena[e.keyOff:e.keyOff+int(e.keyLen)]...)
+		arena = append(arena, m.arena[e.valueOff:e.valueOff+int(e.valueLen)]...)
+		e.keyOff, e.valueOff = off, off+int(e.keyLen)
+	}
+	m.arena, m.garbage = arena, 0
+}
+
+// Get value from compact map
+func (m *compactStore) GetValue(key string) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if i, ok := m.lookup(key, m.since(time.Now())); ok {
+		return m.value(i)
+	}
+	return ""
+}
+
+// Check if key exists in compact map without copying the value
+func (m *compactStore) Exists(key string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	_, ok := m.lookup(key, m.since(time.Now()))
+	return ok
+}
+
+// Report every later change to fn
+func (m *compactStore) Watch(fn Watcher) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.watch = fn
+}
+
+// Report a change to the watcher, callers hold the lock
+func (m *compactStore) changed(typ string, key string, value string) {
+	if m.watch != nil {
+		m.watch(Change{Type: typ, Key: key, Value: value})
+	}
+}
+
+// Set value in compact map, clearing any expiry
+func (m *compactStore) SetValue(key string, value string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.expiry, m.put(key, value, m.since(time.Now())))
+	m.changed("set", key, value)
+}
+
+// Set multiple values in compact map in a single pass
+func (m *compactStore) SetValues(pairs map[string]string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := m.since(time.Now())
+	for k, v := range pairs {
+		delete(m.expiry, m.put(k, v, now))
+		m.changed("set", k, v)
+	}
+}
+
+// Delete value from compact map
+func (m *compactStore) DeleteValue(key string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.remove(key, m.since(time.Now()))
+}
+
+// Remove every key from compact map, running wipe first under the map lock
+// Like memStore.Clear, nothing is removed if wipe fails
+func (m *compactStore) Clear(wipe func() error) ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := wipe(); err != nil {
+		return nil, err
+	}
+	now := m.since(time.Now())
+	keys := make([]string, 0, len(m.entries)-len(m.free))
+	for i := range m.entries {
+		if m.entries[i].live && !m.expired(uint32(i), now) {
+			keys = append(keys, string(m.key(uint32(i))))
+		}
+	}
+	m.reset()
+	for _, k := range keys {
+		m.changed("delete", k, "")
+	}
+	return keys, nil
+}
+
+// Atomically read-modify-write a key in compact map
+// fn runs under the map lock and returns the new value, or remove to delete the key
+// If fn returns an error the map is left unchanged. Expiry of a kept key is unchanged
+func (m *compactStore) Modify(key string, fn func(old string, exists bool) (string, bool, error)) error {
+	return m.ModifyMeta(key, func(old string, _ KeyMeta, exists bool) (string, bool, error) {
+		return fn(old, exists)
+	})
+}
+
+// Atomically read-modify-write a key in compact map, like Modify
+// fn also gets the metadata of the key before the write
+func (m *compactStore) ModifyMeta(key string, fn func(old string, meta KeyMeta, exists bool) (string, bool, error)) error {
+	return m.update(key, func(old string, meta KeyMeta, at time.Time, exists bool) (string, time.Time, bool, error) {
+		value, remove, err := fn(old, meta, exists)
+		return value, at, remove, err
+	})
+}
+
+// Atomically read-modify-write a key and its expiry in compact map, like Modify
+// fn gets the expiry of the key, zero without one, and returns the expiry to keep
+func (m *compactStore) ModifyExpiry(key string, fn func(old string, at time.Time, exists bool) (string, time.Time, bool, error)) error {
+	return m.update(key, func(old string, _ KeyMeta, at time.Time, exists bool) (string, time.Time, bool, error) {
+		return fn(old, at, exists)
+	})
+}
+
+// Read-modify-write a key with its metadata and expiry under the map lock
+func (m *compactStore) update(key string, fn func(old string, meta KeyMeta, at time.Time, exists bool) (string, time.Time, bool, error)) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := m.since(time.Now())
+	var old string
+	var meta KeyMeta
+	var at time.Time
+	i, exists := m.lookup(key, now)
+	if exists {
+		old, meta, at = m.value(i), m.metaOf(i), m.expiryOf(i)
+	}
+	value, at, remove, err := fn(old, meta, at, exists)
+	if err != nil {
+		return err
+	}
+	if remove {
+		m.remove(key, now)
+		return nil
+	}
+	m.setExpiry(m.put(key, value, now), at)
+	m.changed("set", key, value)
+	return nil
+}
+
+// Atomically apply operations on several keys in compact map
+// fn runs under the map lock with a view of current values, expiries and metadata, zero for none, and returns the
+// operations to apply, which also replace expiries. On error the map is left unchanged
+func (m *compactStore) Transact(fn func(get func(key string) (string, bool), expiry func(key string) time.Time, meta func(key string) KeyMeta) ([]TxnOp, error)) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := m.since(time.Now())
+	ops, err := fn(func(key string) (string, bool) {
+		if i, ok := m.lookup(key, now); ok {
+			return m.value(i), true
+		}
+		return "", false
+	}, func(key string) time.Time {
+		if i, ok := m.lookup(key, now); ok {
+			return m.expiryOf(i)
+		}
+		return time.Time{}
+	}, func(key string) KeyMeta {
+		if i, ok := m.lookup(key, now); ok {
+			return m.metaOf(i)
+		}
+		return KeyMeta{}
+	})
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if op.Op == "DELETE" {
+			m.remove(op.Key, now)
+			continue
+		}
+		at, err := DecodeExpiry(op.Expire)
+		if err != nil {
+			at = time.Time{}
+		}
+		m.setExpiry(m.put(op.Key, op.Value, now), at)
+		m.changed("set", op.Key, op.Value)
+	}
+	return nil
+}
+
+// Set expiry of a key, zero time removes it
+// Returns false if the key doesn't exist
+func (m *compactStore) SetExpiry(key string, at time.Time) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	i, ok := m.lookup(key, m.since(time.Now()))
+	if !ok {
+		return false
+	}
+	m.setExpiry(i, at)
+	return true
+}
+
+// Get expiry of a key, false if it has none
+func (m *compactStore) Expiry(key string) (time.Time, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	i, ok := m.find(key)
+	if !ok {
+		return time.Time{}, false
+	}
+	at, ok := m.expiry[i]
+	return m.at(at), ok
+}
+
+// Get metadata of a key, false if it doesn't exist
+func (m *compactStore) Meta(key string) (KeyMeta, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	i, ok := m.lookup(key, m.since(time.Now()))
+	if !ok {
+		return KeyMeta{}, false
+	}
+	return m.metaOf(i), true
+}
+
+// Keys whose expiry has passed
+func (m *compactStore) Expired() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	now := m.since(time.Now())
+	var keys []string
+	for i, at := range m.expiry {
+		if now >= at {
+			keys = append(keys, string(m.key(i)))
+		}
+	}
+	return keys
+}
+
+// Number of keys in compact map
+// May include expired keys the sweeper hasn't removed yet
+func (m *compactStore) Len() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return len(m.entries) - len(m.free)
+}
+
+// List keys in compact map starting with prefix, stopping early once ctx is done
+func (m *compactStore) Keys(ctx context.Context, prefix string) []string {
+	var keys []string
+	m.RangeKeys(ctx, prefix, func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// Call fn with each key in compact map starting with prefix, until it returns false
+// Like memStore.RangeKeys, fn runs under the map lock and must not use the map
+// Each key is copied out of the arena
+func (m *compactStore) RangeKeys(ctx context.Context, prefix string, fn func(key string) bool) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	now := m.since(time.Now())
+	p := []byte(prefix)
+	for i := range m.entries {
+		if (i+1)%rangeChunk == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !m.entries[i].live || m.expired(uint32(i), now) {
+			continue
+		}
+		if key := m.key(uint32(i)); bytes.HasPrefix(key, p) && !fn(string(key)) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Count keys in compact map starting with prefix
+// Only keys are walked, nothing is copied
+func (m *compactStore) Count(prefix string) int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	now := m.since(time.Now())
+	p := []byte(prefix)
+	n := 0
+	for i := range m.entries {
+		if m.entries[i].live && bytes.HasPrefix(m.key(uint32(i)), p) && !m.expired(uint32(i), now) {
+			n++
+		}
+	}
+	return n
+}
+
+// Call fn with each key-value pair in compact map whose key starts with prefix, until it returns false
+// Like memStore.Range, fn runs without the map lock
+func (m *compactStore) Range(ctx context.Context, prefix string, fn func(key string, value string) bool) error {
+	return rangeKeys(ctx, m.Keys(ctx, prefix), m.mutex.RLocker(), func(key string, now time.Time) (string, bool) {
+		if i, ok := m.lookup(key, m.since(now)); ok {
+			return m.value(i), true
+		}
+		return "", false
+	}, fn)
+}
@@ -0,0 +1,106 @@
+package storage_test
+
+import (
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"gokv/storage"
+)
+
+// Small keys each benchmark fills a map with
+const benchKeys = 100_000
+
+var benchMaps = []struct {
+	name   string
+	newMap func() storage.InMemoryMap
+}{
+	{"map", storage.InitMap},
+	{"compact", storage.InitCompactMap},
+}
+
+// Fill a map with benchKeys small keys
+func fill(mp storage.InMemoryMap) {
+	for i := range benchKeys {
+		mp.SetValue("user:"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+}
+
+func BenchmarkSetValue(b *testing.B) {
+	for _, bm := range benchMaps {
+		b.Run(bm.name, func(b *testing.B) {
+			mp := bm.newMap()
+			b.ReportAllocs()
+			for i := 0; b.Loop(); i++ {
+				mp.SetValue("user:"+strconv.Itoa(i%benchKeys), "v")
+			}
+		})
+	}
+}
+
+func BenchmarkGetValue(b *testing.B) {
+	for _, bm := range benchMaps {
+		b.Run(bm.name, func(b *testing.B) {
+			mp := bm.newMap()
+			fill(mp)
+			b.ReportAllocs()
+			for i := 0; b.Loop(); i++ {
+				mp.GetValue("user:" + strconv.Itoa(i%benchKeys))
+			}
+		})
+	}
+}
+
+// Heap held per key and the duration of a full collection with the map live
+func BenchmarkHeap(b *testing.B) {
+	for _, bm := range benchMaps {
+		b.Run(bm.name, func(b *testing.B) {
+			var heap uint64
+			var pause time.Duration
+			for b.Loop() {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				mp := bm.newMap()
+				fill(mp)
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				heap += after.HeapAlloc - before.HeapAlloc
+				start := time.Now()
+				runtime.GC()
+				pause += time.Since(start)
+				runtime.KeepAlive(mp)
+			}
+			b.ReportMetric(float64(heap)/float64(b.N)/benchKeys, "heap-B/key")
+			b.ReportMetric(float64(pause.Microseconds())/float64(b.N), "gc-µs")
+		})
+	}
+}
+
+// Values survive the arena being rewritten after many overwrites and deletes
+func TestCompactArena(t *testing.T) {
+	mp := storage.InitCompactMap()
+	fill(mp)
+	for i := range benchKeys {
+		key := "user:" + strconv.Itoa(i)
+		if i%2 == 0 {
+			mp.DeleteValue(key)
+		} else {
+			mp.SetValue(key, key+":"+strconv.Itoa(i)) // longer than the old value
+		}
+	}
+	if n := mp.Len(); n != benchKeys/2 {
+		t.Fatalf("Len() = %d, want %d", n, benchKeys/2)
+	}
+	for i := range benchKeys {
+		key := "user:" + strconv.Itoa(i)
+		want := ""
+		if i%2 == 1 {
+			want = key + ":" + strconv.Itoa(i)
+		}
+		if got := mp.GetValue(key); got != want {
+			t.Fatalf("GetValue(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
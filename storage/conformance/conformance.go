@@ -0,0 +1,358 @@
+// Package conformance checks that storage backends and protocol front-ends keep
+// the semantics the API relies on. TestMap covers InMemoryMap implementations:
+// write ordering, atomic batches, atomic read-modify-write, key expiry, key
+// metadata and the changes reported to a watcher. TestLog covers Log implementations: LSNs numbered from 1, entries
+// timestamped in write order, refused entries and tombstones. TestFrontend
+// covers a protocol front-end through a Client: write ordering, deletes and
+// atomic increments, plus batches, compare-and-swap and TTLs for clients that
+// implement Batcher, Swapper or Expirer.
+//
+// Like testing/fstest, checks return an error instead of taking a *testing.T,
+// so a backend's test only needs:
+//
+//	if err := conformance.TestMap(storage.InitMap); err != nil {
+//		t.Fatal(err)
+//	}
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"gokv/storage"
+)
+
+// Run every check against fresh maps created by newMap
+func TestMap(newMap func() storage.InMemoryMap) error {
+	checks := []struct {
+		name  string
+		check func(storage.InMemoryMap) error
+	}{
+		{"last write wins", lastWriteWins},
+		{"delete", deleteRemoves},
+		{"batch atomicity", batchAtomic},
+		{"modify atomicity", modifyAtomic},
+		{"modify error leaves value", modifyErrorUnchanged},
+		{"transaction atomicity", transactAtomic},
+		{"prefix listing", prefixListing},
+		{"key metadata", metaTracksWrites},
+		{"expiry", expiryHides},
+		{"modify with expiry", modifyExpiry},
+		{"clear", clearAll},
+		{"watch", watchReports},
+	}
+	var errs []error
+	for _, c := range checks {
+		if err := c.check(newMap()); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Sequential writes to a key must leave the last value
+func lastWriteWins(mp storage.InMemoryMap) error {
+	for i := range 100 {
+		mp.SetValue("k", strconv.Itoa(i))
+	}
+	if v := mp.GetValue("k"); v != "99" {
+		return fmt.Errorf("got %q, want %q", v, "99")
+	}
+	return nil
+}
+
+// Deleted keys must no longer exist
+func deleteRemoves(mp storage.InMemoryMap) error {
+	mp.SetValue("k", "v")
+	mp.DeleteValue("k")
+	if mp.Exists("k") || mp.GetValue("k") != "" || mp.Len() != 0 {
+		return errors.New("key still present after delete")
+	}
+	return nil
+}
+
+// Every write must bump a key's version, deleting it must reset its metadata
+func metaTracksWrites(mp storage.InMemoryMap) error {
+	if _, ok := mp.Meta("k"); ok {
+		return errors.New("metadata of a missing key")
+	}
+	mp.SetValue("k", "1")
+	first, _ := mp.Meta("k")
+	mp.SetValues(map[string]string{"k": "2"})
+	mp.Modify("k", func(old string, exists bool) (string, bool, error) { return "3", false, nil })
+	var viewed storage.KeyMeta
+	mp.Transact(func(get func(string) (string, bool), _ func(string) time.Time, meta func(string) storage.KeyMeta) ([]storage.TxnOp, error) {
+		viewed = meta("k")
+		return []storage.TxnOp{{Op: "SET", Key: "k", Value: "4"}}, nil
+	})
+	if viewed.Version != 3 {
+		return fmt.Errorf("transaction saw version %d, want 3", viewed.Version)
+	}
+	meta, ok := mp.Meta("k")
+	if !ok || meta.Version != 4 {
+		return fmt.Errorf("got version %d after 4 writes", meta.Version)
+	}
+	if !meta.Created.Equal(first.Created) || meta.Updated.Before(meta.Created) {
+		return errors.New("created time changed on update")
+	}
+	var seen storage.KeyMeta
+	mp.ModifyMeta("k", func(old string, meta storage.KeyMeta, exists bool) (string, bool, error) {
+		seen = meta
+		return old, false, nil
+	})
+	if seen.Version != 4 {
+		return fmt.Errorf("modify saw version %d, want 4", seen.Version)
+	}
+	mp.DeleteValue("k")
+	mp.SetValue("k", "5")
+	if meta, _ := mp.Meta("k"); meta.Version != 1 {
+		return fmt.Errorf("got version %d after recreating key", meta.Version)
+	}
+	return nil
+}
+
+// Readers must see either none or all of a batch
+func batchAtomic(mp storage.InMemoryMap) error {
+	batch := make(map[string]string)
+	for i := range 50 {
+		batch["b:"+strconv.Itoa(i)] = "v"
+	}
+
+	var wg sync.WaitGroup
+	var partial bool
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 1000 {
+			if n := len(mp.Keys(context.Background(), "b:")); n != 0 && n != len(batch) {
+				partial = true
+				return
+			}
+		}
+	}()
+	mp.SetValues(batch)
+	wg.Wait()
+
+	if partial {
+		return errors.New("reader observed a partially applied batch")
+	}
+	if n := mp.Len(); n != len(batch) {
+		return fmt.Errorf("got %d keys, want %d", n, len(batch))
+	}
+	return nil
+}
+
+// Concurrent read-modify-writes of a key must not lose updates
+func modifyAtomic(mp storage.InMemoryMap) error {
+	const writers, increments = 8, 100
+	var wg sync.WaitGroup
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range increments {
+				mp.Modify("counter", func(old string, exists bool) (string, bool, error) {
+					n, _ := strconv.Atoi(old)
+					return strconv.Itoa(n + 1), false, nil
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := strconv.Itoa(writers * increments)
+	if v := mp.GetValue("counter"); v != want {
+		return fmt.Errorf("got %q, want %q", v, want)
+	}
+	return nil
+}
+
+// A failed modification must leave the key unchanged
+func modifyErrorUnchanged(mp storage.InMemoryMap) error {
+	mp.SetValue("k", "v")
+	err := mp.Modify("k", func(old string, exists bool) (string, bool, error) {
+		return "changed", false, errors.New("conflict")
+	})
+	if err == nil {
+		return errors.New("error from modify function was dropped")
+	}
+	if v := mp.GetValue("k"); v != "v" {
+		return fmt.Errorf("got %q, want %q", v, "v")
+	}
+	return nil
+}
+
+// Transactions moving units between two keys must never expose a changed total
+func transactAtomic(mp storage.InMemoryMap) error {
+	mp.SetValues(map[string]string{"a": "100", "b": "0"})
+	total := func(get func(string) (string, bool)) int {
+		a, _ := get("a")
+		b, _ := get("b")
+		x, _ := strconv.Atoi(a)
+		y, _ := strconv.Atoi(b)
+		return x + y
+	}
+
+	var wg sync.WaitGroup
+	var broken bool
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 1000 {
+			mp.Transact(func(get func(string) (string, bool), _ func(string) time.Time, _ func(string) storage.KeyMeta) ([]storage.TxnOp, error) {
+				if total(get) != 100 {
+					broken = true
+				}
+				return nil, nil
+			})
+		}
+	}()
+	for range 100 {
+		mp.Transact(func(get func(string) (string, bool), _ func(string) time.Time, _ func(string) storage.KeyMeta) ([]storage.TxnOp, error) {
+			a, _ := get("a")
+			b, _ := get("b")
+			x, _ := strconv.Atoi(a)
+			y, _ := strconv.Atoi(b)
+			return []storage.TxnOp{
+				{Op: "SET", Key: "a", Value: strconv.Itoa(x - 1)},
+				{Op: "SET", Key: "b", Value: strconv.Itoa(y + 1)},
+			}, nil
+		})
+	}
+	wg.Wait()
+
+	if broken {
+		return errors.New("reader observed a partially applied transaction")
+	}
+	if a, b := mp.GetValue("a"), mp.GetValue("b"); a != "0" || b != "100" {
+		return fmt.Errorf("got a=%q b=%q, want a=%q b=%q", a, b, "0", "100")
+	}
+	return nil
+}
+
+// Keys, Count, RangeKeys and Range must return exactly the keys under a prefix
+func prefixListing(mp storage.InMemoryMap) error {
+	mp.SetValues(map[string]string{"a:1": "1", "a:2": "2", "b:1": "3"})
+	if n := len(mp.Keys(context.Background(), "a:")); n != 2 {
+		return fmt.Errorf("Keys returned %d keys, want 2", n)
+	}
+	if n := mp.Count("a:"); n != 2 {
+		return fmt.Errorf("Count returned %d, want 2", n)
+	}
+	n := 0
+	mp.RangeKeys(context.Background(), "a:", func(string) bool {
+		n++
+		return true
+	})
+	if n != 2 {
+		return fmt.Errorf("RangeKeys saw %d keys, want 2", n)
+	}
+	pairs := make(map[string]string)
+	err := mp.Range(context.Background(), "a:", func(key string, value string) bool {
+		pairs[key] = value
+		return true
+	})
+	if err != nil || len(pairs) != 2 || pairs["a:1"] != "1" || pairs["a:2"] != "2" {
+		return fmt.Errorf("Range returned %v, %v", pairs, err)
+	}
+	return nil
+}
+
+// Expired keys must be hidden until swept, and a new SET clears expiry
+func expiryHides(mp storage.InMemoryMap) error {
+	if mp.SetExpiry("missing", time.Now()) {
+		return errors.New("expiry set on missing key")
+	}
+	mp.SetValue("k", "v")
+	mp.SetExpiry("k", time.Now().Add(-time.Second))
+	if mp.Exists("k") || mp.GetValue("k") != "" || len(mp.Keys(context.Background(), "")) != 0 {
+		return errors.New("expired key still visible")
+	}
+	if keys := mp.Expired(); len(keys) != 1 || keys[0] != "k" {
+		return fmt.Errorf("Expired returned %v", keys)
+	}
+	mp.SetValue("k", "v2")
+	if _, ok := mp.Expiry("k"); ok || mp.GetValue("k") != "v2" {
+		return errors.New("SET did not clear expiry")
+	}
+	return nil
+}
+
+// ModifyExpiry must see and replace the expiry with the value, in one step
+func modifyExpiry(mp storage.InMemoryMap) error {
+	at := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	mp.ModifyExpiry("k", func(old string, current time.Time, exists bool) (string, time.Time, bool, error) {
+		return "1", at, false, nil
+	})
+	if got, ok := mp.Expiry("k"); !ok || !got.Equal(at) || mp.GetValue("k") != "1" {
+		return errors.New("new key did not get its expiry")
+	}
+	var seen time.Time
+	mp.ModifyExpiry("k", func(old string, current time.Time, exists bool) (string, time.Time, bool, error) {
+		seen = current
+		return "2", current, false, nil
+	})
+	if got, ok := mp.Expiry("k"); !seen.Equal(at) || !ok || !got.Equal(at) {
+		return fmt.Errorf("saw expiry %v, kept %v, want %v", seen, got, at)
+	}
+	mp.ModifyExpiry("k", func(old string, current time.Time, exists bool) (string, time.Time, bool, error) {
+		return "3", time.Time{}, false, nil
+	})
+	if _, ok := mp.Expiry("k"); ok || mp.GetValue("k") != "3" {
+		return errors.New("zero expiry did not clear it")
+	}
+	return nil
+}
+
+// Clear must keep every key if wipe fails and remove them all otherwise
+func clearAll(mp storage.InMemoryMap) error {
+	mp.SetValues(map[string]string{"a": "1", "b": "2"})
+	if _, err := mp.Clear(func() error { return errors.New("wipe failed") }); err == nil || mp.Len() != 2 {
+		return errors.New("failed wipe removed keys")
+	}
+	keys, err := mp.Clear(func() error { return nil })
+	if err != nil || len(keys) != 2 || mp.Len() != 0 || mp.Exists("a") {
+		return fmt.Errorf("Clear returned %v, %v and left %d keys", keys, err, mp.Len())
+	}
+	return nil
+}
+
+// Every applied change must be reported once and in order, failed and empty ones not at all
+func watchReports(mp storage.InMemoryMap) error {
+	mp.SetValue("before", "v")
+	var got []storage.Change
+	mp.Watch(func(c storage.Change) { got = append(got, c) })
+
+	mp.SetValue("k", "1")
+	mp.Modify("k", func(old string, exists bool) (string, bool, error) { return "2", false, nil })
+	mp.Modify("k", func(old string, exists bool) (string, bool, error) { return "3", false, errors.New("conflict") })
+	mp.Modify("k", func(old string, exists bool) (string, bool, error) { return "", true, nil })
+	mp.Modify("k", func(old string, exists bool) (string, bool, error) { return "", true, nil })
+	mp.SetValue("t", "v")
+	mp.SetExpiry("t", time.Now().Add(-time.Second))
+	mp.Modify("t", func(old string, exists bool) (string, bool, error) { return "", true, nil })
+	mp.Transact(func(func(string) (string, bool), func(string) time.Time, func(string) storage.KeyMeta) ([]storage.TxnOp, error) {
+		return []storage.TxnOp{{Op: "SET", Key: "a", Value: "1"}, {Op: "DELETE", Key: "before"}}, nil
+	})
+	mp.Clear(func() error { return nil })
+
+	want := []storage.Change{
+		{Type: "set", Key: "k", Value: "1"},
+		{Type: "set", Key: "k", Value: "2"},
+		{Type: "delete", Key: "k"},
+		{Type: "set", Key: "t", Value: "v"},
+		{Type: "expire", Key: "t"},
+		{Type: "set", Key: "a", Value: "1"},
+		{Type: "delete", Key: "before"},
+		{Type: "delete", Key: "a"},
+	}
+	if !slices.Equal(got, want) {
+		return fmt.Errorf("reported %v, want %v", got, want)
+	}
+	return nil
+}
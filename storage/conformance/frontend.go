@@ -0,0 +1,191 @@
+package conformance
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Protocol front-end of a node under test, e.g. HTTP or RESP
+// Each method sends one request and returns the error the node answered with
+type Client interface {
+	Set(key string, value string) error
+	Get(key string) (value string, found bool, err error)
+	Delete(key string) error
+	Incr(key string) (int64, error)
+}
+
+// Front-end that can set several keys in one request
+type Batcher interface {
+	SetMany(pairs map[string]string) error
+}
+
+// Front-end with compare-and-swap, an empty old value with exists false means the key must be missing
+type Swapper interface {
+	CompareAndSwap(key string, old string, exists bool, value string) (swapped bool, err error)
+}
+
+// Front-end that can set a key with a TTL and read it back, found is false for keys without one
+type Expirer interface {
+	SetTTL(key string, value string, ttl time.Duration) error
+	TTL(key string) (ttl time.Duration, found bool, err error)
+}
+
+// Run every check against a front-end, each on its own keys
+// Checks of Batcher, Swapper and Expirer only run if the client implements them
+func TestFrontend(c Client) error {
+	checks := []struct {
+		name  string
+		check func(Client) error
+	}{
+		{"last write wins", frontendLastWrite},
+		{"delete", frontendDelete},
+		{"atomic increments", frontendIncr},
+		{"batch", frontendBatch},
+		{"compare-and-swap", frontendCAS},
+		{"ttl", frontendTTL},
+	}
+	var errs []error
+	for _, ch := range checks {
+		if err := ch.check(c); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", ch.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Sequential writes to a key must leave the last value
+func frontendLastWrite(c Client) error {
+	for i := range 20 {
+		if err := c.Set("conformance:last", strconv.Itoa(i)); err != nil {
+			return err
+		}
+	}
+	if v, ok, err := c.Get("conformance:last"); err != nil || !ok || v != "19" {
+		return fmt.Errorf("got %q, %v, %v, want %q", v, ok, err, "19")
+	}
+	return nil
+}
+
+// Deleted and never written keys must not be found
+func frontendDelete(c Client) error {
+	if _, ok, err := c.Get("conformance:never"); err != nil || ok {
+		return fmt.Errorf("missing key found, %v", err)
+	}
+	if err := c.Set("conformance:delete", "v"); err != nil {
+		return err
+	}
+	if err := c.Delete("conformance:delete"); err != nil {
+		return err
+	}
+	if _, ok, err := c.Get("conformance:delete"); err != nil || ok {
+		return fmt.Errorf("deleted key found, %v", err)
+	}
+	return nil
+}
+
+// Concurrent increments must not lose updates, and non-integer values must be refused
+func frontendIncr(c Client) error {
+	const writers, increments = 4, 25
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var errs []error
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range increments {
+				if _, err := c.Incr("conformance:counter"); err != nil {
+					mutex.Lock()
+					errs = append(errs, err)
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	want := strconv.Itoa(writers * increments)
+	if v, _, err := c.Get("conformance:counter"); err != nil || v != want {
+		return fmt.Errorf("got %q, %v, want %q", v, err, want)
+	}
+	if err := c.Set("conformance:text", "abc"); err != nil {
+		return err
+	}
+	if _, err := c.Incr("conformance:text"); err == nil {
+		return errors.New("incremented a non-integer value")
+	}
+	return nil
+}
+
+// Every pair of a batch must be written
+func frontendBatch(c Client) error {
+	b, ok := c.(Batcher)
+	if !ok {
+		return nil
+	}
+	pairs := make(map[string]string)
+	for i := range 10 {
+		pairs["conformance:batch:"+strconv.Itoa(i)] = strconv.Itoa(i)
+	}
+	if err := b.SetMany(pairs); err != nil {
+		return err
+	}
+	for k, want := range pairs {
+		if v, ok, err := c.Get(k); err != nil || !ok || v != want {
+			return fmt.Errorf("%s is %q, %v, %v, want %q", k, v, ok, err, want)
+		}
+	}
+	return nil
+}
+
+// A swap must only happen while the key holds the expected value
+func frontendCAS(c Client) error {
+	s, ok := c.(Swapper)
+	if !ok {
+		return nil
+	}
+	key := "conformance:cas"
+	if swapped, err := s.CompareAndSwap(key, "", false, "1"); err != nil || !swapped {
+		return fmt.Errorf("swap of a missing key refused, %v", err)
+	}
+	if swapped, err := s.CompareAndSwap(key, "", false, "2"); err != nil || swapped {
+		return fmt.Errorf("swap expecting a missing key went through, %v", err)
+	}
+	if swapped, err := s.CompareAndSwap(key, "0", true, "2"); err != nil || swapped {
+		return fmt.Errorf("swap with a stale value went through, %v", err)
+	}
+	if swapped, err := s.CompareAndSwap(key, "1", true, "2"); err != nil || !swapped {
+		return fmt.Errorf("swap with the current value refused, %v", err)
+	}
+	if v, _, err := c.Get(key); err != nil || v != "2" {
+		return fmt.Errorf("got %q, %v, want %q", v, err, "2")
+	}
+	return nil
+}
+
+// A TTL must be reported until the key is set again without one
+func frontendTTL(c Client) error {
+	e, ok := c.(Expirer)
+	if !ok {
+		return nil
+	}
+	key := "conformance:ttl"
+	if err := e.SetTTL(key, "v", time.Hour); err != nil {
+		return err
+	}
+	if ttl, ok, err := e.TTL(key); err != nil || !ok || ttl <= 0 || ttl > time.Hour {
+		return fmt.Errorf("got TTL %v, %v, %v, want up to 1h", ttl, ok, err)
+	}
+	if err := c.Set(key, "v2"); err != nil {
+		return err
+	}
+	if _, ok, err := e.TTL(key); err != nil || ok {
+		return fmt.Errorf("SET kept the TTL, %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package conformance
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"gokv/storage"
+)
+
+// Run every check against fresh logs created by newLog
+func TestLog(newLog func() storage.Log) error {
+	checks := []struct {
+		name  string
+		check func(storage.Log) error
+	}{
+		{"numbering", lsnNumbering},
+		{"entry order", entryOrder},
+		{"concurrent appends", concurrentAppends},
+		{"invalid entries", invalidEntries},
+		{"tombstones", tombstones},
+		{"reset", resetNumbering},
+	}
+	var errs []error
+	for _, c := range checks {
+		if err := c.check(newLog()); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LSNs must start at 1 and grow by one per entry, a batch takes one per key and a transaction one in all
+func lsnNumbering(log storage.Log) error {
+	if lsn := log.GetLSN(); lsn != 1 {
+		return fmt.Errorf("empty log at LSN %d, want 1", lsn)
+	}
+	line, err := log.UpdateLog("SET", "k", "v")
+	if err != nil {
+		return err
+	}
+	ts, _ := storage.EntryTimestamp(line)
+	if want := storage.FormatEntry(1, ts, "SET", "k", "v"); line != want {
+		return fmt.Errorf("first entry written as %q, want %q", line, want)
+	}
+	if err := log.UpdateLogBatch("SET", []string{"a", "b", "c"}, []string{"1", "2", "3"}); err != nil {
+		return err
+	}
+	if lsn := log.GetLSN(); lsn != 5 {
+		return fmt.Errorf("LSN %d after a batch of 3, want 5", lsn)
+	}
+	if err := log.UpdateLogTxn([]storage.TxnOp{{Op: "SET", Key: "a", Value: "4"}, {Op: "DELETE", Key: "b"}}); err != nil {
+		return err
+	}
+	if lsn := log.GetLSN(); lsn != 6 {
+		return fmt.Errorf("LSN %d after a transaction, want 6", lsn)
+	}
+	return nil
+}
+
+// Entries must be timestamped in the order they were written
+func entryOrder(log storage.Log) error {
+	var last uint64
+	for i := range 100 {
+		line, err := log.UpdateLog("SET", "k", strconv.Itoa(i))
+		if err != nil {
+			return err
+		}
+		ts, ok := storage.EntryTimestamp(line)
+		if !ok || ts <= last {
+			return fmt.Errorf("entry %d stamped %d after %d", i, ts, last)
+		}
+		last = ts
+	}
+	if clock := log.Clock().Last(); clock != last {
+		return fmt.Errorf("clock at %d, last entry stamped %d", clock, last)
+	}
+	return nil
+}
+
+// Concurrent appends must each get their own LSN
+func concurrentAppends(log storage.Log) error {
+	const writers, appends = 8, 50
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var errs []error
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range appends {
+				if _, err := log.UpdateLog("SET", strconv.Itoa(w), strconv.Itoa(i)); err != nil {
+					mutex.Lock()
+					errs = append(errs, err)
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	if lsn := log.GetLSN(); lsn != 1+writers*appends {
+		return fmt.Errorf("LSN %d after %d appends, want %d", lsn, writers*appends, 1+writers*appends)
+	}
+	return nil
+}
+
+// Invalid entries must be refused without taking an LSN
+func invalidEntries(log storage.Log) error {
+	if _, err := log.UpdateLog("PUT", "k", "v"); err == nil {
+		return errors.New("unknown operation accepted")
+	}
+	if err := log.UpdateLogBatch("SET", []string{"a", "b"}, []string{"1"}); err == nil {
+		return errors.New("batch with missing values accepted")
+	}
+	if err := log.UpdateLogTxn([]storage.TxnOp{{Op: "DELETE", Key: "k", Expire: "1"}}); err == nil {
+		return errors.New("DELETE with an expiry accepted")
+	}
+	if lsn := log.GetLSN(); lsn != 1 {
+		return fmt.Errorf("LSN %d after refused entries, want 1", lsn)
+	}
+	return nil
+}
+
+// Deleted must follow the last write of a key, in single entries and transactions
+func tombstones(log storage.Log) error {
+	log.UpdateLog("SET", "k", "v")
+	if log.Deleted("k") {
+		return errors.New("set key reported deleted")
+	}
+	log.UpdateLog("DELETE", "k", "")
+	if !log.Deleted("k") {
+		return errors.New("deleted key not reported")
+	}
+	log.UpdateLogTxn([]storage.TxnOp{{Op: "SET", Key: "k", Value: "v2"}})
+	if log.Deleted("k") {
+		return errors.New("key set again by a transaction still reported deleted")
+	}
+	log.UpdateLogBatch("DELETE", []string{"k"}, nil)
+	if !log.Deleted("k") {
+		return errors.New("key deleted in a batch not reported")
+	}
+	return nil
+}
+
+// Reset must drop every entry and number them from 1 again
+func resetNumbering(log storage.Log) error {
+	log.UpdateLog("SET", "k", "v")
+	log.UpdateLog("DELETE", "k", "")
+	if err := log.Reset(); err != nil {
+		return err
+	}
+	if lsn := log.GetLSN(); lsn != 1 || log.GetCheckpoint() != 0 {
+		return fmt.Errorf("reset log at LSN %d and checkpoint %d, want 1 and 0", lsn, log.GetCheckpoint())
+	}
+	if log.Deleted("k") {
+		return errors.New("tombstone survived reset")
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package storage_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	h "gokv/helper"
+	"gokv/storage"
+	"gokv/storage/conformance"
+	"gokv/storage/storagetest"
+)
+
+// Open a tiered map over a fresh cold tier in a temporary directory
+// Keys are demoted on the first Demote, however recently they were used
+func tieredMap(t *testing.T) *storage.TieredMap {
+	h.SetLayout(h.Layout{DataDir: t.TempDir(), WALDir: t.TempDir()})
+	t.Cleanup(func() { h.SetLayout(h.LayoutFromEnv()) })
+	cold, err := storage.OpenColdTier(-time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cold.Close() })
+	return storage.NewTieredMap(storage.InitMap(), storagetest.NewLog(), cold)
+}
+
+func TestConformance(t *testing.T) {
+	backends := map[string]func() storage.InMemoryMap{
+		"map":     storage.InitMap,
+		"compact": storage.InitCompactMap,
+		"tiered":  func() storage.InMemoryMap { return tieredMap(t) },
+		"fake":    func() storage.InMemoryMap { return storagetest.NewMap() },
+	}
+	for name, newMap := range backends {
+		t.Run(name, func(t *testing.T) {
+			if err := conformance.TestMap(newMap); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// Open a WAL over fresh files in a temporary directory
+func walLog(t *testing.T) storage.Log {
+	layout := h.Layout{DataDir: t.TempDir(), WALDir: t.TempDir(), AutoCreate: true}
+	if err := h.InitFiles(layout); err != nil {
+		t.Fatal(err)
+	}
+	h.SetLayout(layout)
+	t.Cleanup(func() { h.SetLayout(h.LayoutFromEnv()) })
+	log, err := storage.InitLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return log
+}
+
+func TestLogConformance(t *testing.T) {
+	backends := map[string]func() storage.Log{
+		"wal":  func() storage.Log { return walLog(t) },
+		"fake": func() storage.Log { return storagetest.NewLog() },
+	}
+	for name, newLog := range backends {
+		t.Run(name, func(t *testing.T) {
+			if err := conformance.TestLog(newLog); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// Values a WAL line can't hold as is must replay byte for byte
+func TestWALBinaryReplay(t *testing.T) {
+	log := walLog(t)
+	value := string([]byte{0x00, 0xff, ',', '\n', '\r', ' ', 'v'})
+	if _, err := log.UpdateLog("SET", "bin", value); err != nil {
+		t.Fatal(err)
+	}
+	mp := storage.InitMap()
+	if err := new(storage.Replay).Run(mp, log); err != nil {
+		t.Fatal(err)
+	}
+	if got := mp.GetValue("bin"); got != value {
+		t.Fatalf("replayed %q, want %q", got, value)
+	}
+}
+
+// Keys moved to the cold tier must stay readable, listable and writable
+func TestTieredColdKeys(t *testing.T) {
+	mp := tieredMap(t)
+	mp.SetValues(map[string]string{"a:1": "1", "a:2": "2", "b:1": "3"})
+	if n, err := mp.Demote(); err != nil || n != 3 {
+		t.Fatalf("Demote moved %d keys, %v", n, err)
+	}
+	if n := mp.Len(); n != 3 {
+		t.Errorf("Len returned %d after demoting every key, want 3", n)
+	}
+
+	if n := mp.Count("a:"); n != 2 {
+		t.Errorf("Count returned %d, want 2", n)
+	}
+	pairs := make(map[string]string)
+	mp.Range(context.Background(), "a:", func(key string, value string) bool {
+		pairs[key] = value
+		return true
+	})
+	if len(pairs) != 2 || pairs["a:1"] != "1" || pairs["a:2"] != "2" {
+		t.Errorf("Range returned %v", pairs)
+	}
+
+	var version int64
+	mp.Transact(func(get func(string) (string, bool), _ func(string) time.Time, meta func(string) storage.KeyMeta) ([]storage.TxnOp, error) {
+		version = meta("a:1").Version
+		return []storage.TxnOp{{Op: "DELETE", Key: "a:2"}}, nil
+	})
+	if version != 1 {
+		t.Errorf("transaction saw version %d of a cold key, want 1", version)
+	}
+	if mp.Exists("a:2") {
+		t.Error("cold key still present after delete")
+	}
+	if v := mp.GetValue("b:1"); v != "3" {
+		t.Errorf("got %q, want %q", v, "3")
+	}
+	if meta, ok := mp.Meta("a:1"); !ok || meta.Version != 1 {
+		t.Errorf("promoted key has version %d", meta.Version)
+	}
+	if n := mp.Len(); n != 2 {
+		t.Errorf("Len returned %d, want 2", n)
+	}
+}
+
+// Moving keys between tiers changes nothing a watcher should hear about
+func TestTieredWatch(t *testing.T) {
+	mp := tieredMap(t)
+	mp.SetValues(map[string]string{"a": "1", "b": "2", "c": "3"})
+	var got []storage.Change
+	mp.Watch(func(c storage.Change) { got = append(got, c) })
+	if n, err := mp.Demote(); err != nil || n != 3 {
+		t.Fatalf("Demote moved %d keys, %v", n, err)
+	}
+	mp.GetValue("a")
+	mp.Modify("b", func(old string, exists bool) (string, bool, error) { return old + "0", false, nil })
+	mp.Transact(func(func(string) (string, bool), func(string) time.Time, func(string) storage.KeyMeta) ([]storage.TxnOp, error) {
+		return []storage.TxnOp{{Op: "DELETE", Key: "c"}}, nil
+	})
+
+	want := []storage.Change{{Type: "set", Key: "b", Value: "20"}, {Type: "delete", Key: "c"}}
+	if !slices.Equal(got, want) {
+		t.Fatalf("reported %v, want %v", got, want)
+	}
+}
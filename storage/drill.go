@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Outcome of a recovery drill
+type DrillResult struct {
+	OK       bool          `json:"ok"`
+	Keys     int           `json:"keys"`
+	Restored int           `json:"restored_keys"`
+	Checksum uint64        `json:"checksum"`
+	Elapsed  time.Duration `json:"elapsed_ns"`
+	Error    string        `json:"error,omitempty"`
+	At       time.Time     `json:"at"`
+}
+
+// Back up the database, restore the backup into a spare directory and check
+// that the restored copy has the same keys and values
+// Commits to the database are paused only while the backup is written to a file
+// in the spare directory and the database is checksummed, so both sides match
+func (d *badgerDB) Drill(dir string) (DrillResult, error) {
+	start := time.Now()
+	result := DrillResult{At: start}
+
+	spare, err := os.MkdirTemp(dir, "gokv-drill-")
+	if err != nil {
+		return result, err
+	}
+	defer os.RemoveAll(spare)
+	backup, err := os.Create(filepath.Join(spare, "backup"))
+	if err != nil {
+		return result, err
+	}
+	defer backup.Close()
+
+	if err := d.drillBackup(backup, &result); err != nil {
+		return result, err
+	}
+
+	// Restore into the spare directory
+	if _, err := backup.Seek(0, io.SeekStart); err != nil {
+		return result, err
+	}
+	restored, err := badger.Open(badger.DefaultOptions(filepath.Join(spare, "db")).WithLogger(nil))
+	if err != nil {
+		return result, err
+	}
+	defer restored.Close()
+	if err := restored.Load(backup, 256); err != nil {
+		return result, err
+	}
+
+	// Compare key counts and checksums of both databases
+	var restoredSum uint64
+	result.Restored, restoredSum, err = checksum(restored)
+	if err != nil {
+		return result, err
+	}
+	result.OK = result.Keys == result.Restored && result.Checksum == restoredSum
+	result.Elapsed = time.Since(start)
+	return result, nil
+}
+
+// Write a backup of the database to w and record its key count and checksum in result
+// Holds the flush lock so no commit lands between the two
+func (d *badgerDB) drillBackup(w io.Writer, result *DrillResult) error {
+	d.flush.Lock()
+	defer d.flush.Unlock()
+	if d.closed {
+		return errClosed
+	}
+	buffered := bufio.NewWriter(w)
+	if _, err := d.db.Backup(buffered, 0); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	var err error
+	result.Keys, result.Checksum, err = checksum(d.db)
+	return err
+}
+
+// Count keys and compute an order-independent checksum of every key-value pair
+func checksum(db *badger.DB) (int, uint64, error) {
+	count := 0
+	var sum uint64
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			hash := fnv.New64a()
+			hash.Write(item.Key())
+			hash.Write([]byte{0})
+			err := item.Value(func(val []byte) error {
+				_, err := io.Copy(hash, bytes.NewReader(val))
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			sum ^= hash.Sum64()
+			count++
+		}
+		return nil
+	})
+	return count, sum, err
+}
@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Parsed WAL line
+type entry struct {
+	lsn   int
+	ts    uint64 // HLC timestamp of the write, 0 for entries written before writes were timestamped
+	op    string // SET, DELETE, EXPIRE or DEMOTE
+	key   string
+	value string
+}
+
+// Format the first field of a WAL line, the LSN and the HLC timestamp of the write as "<lsn>@<ts>"
+func formatLSN(lsn int, ts uint64) string {
+	return strconv.Itoa(lsn) + "@" + strconv.FormatUint(ts, 10)
+}
+
+// Parse the first field of a WAL line, entries written before writes were timestamped have no "@<ts>"
+func parseLSN(field string) (lsn int, ts uint64, err error) {
+	n, stamp, found := strings.Cut(field, "@")
+	if lsn, err = strconv.Atoi(n); err != nil || !found {
+		return lsn, 0, err
+	}
+	ts, err = strconv.ParseUint(stamp, 10, 64)
+	return lsn, ts, err
+}
+
+// Check if text would break the line format, or isn't valid UTF-8
+func unsafeField(text string) bool {
+	return strings.ContainsAny(text, ",\r\n") || !utf8.ValidString(text)
+}
+
+// Op and key fields of an entry
+// Keys that would break the line format are written base64 encoded, marked by a K after the op
+func keyFields(op string, key string) (string, string) {
+	if unsafeField(key) {
+		return op + "K", base64.StdEncoding.EncodeToString([]byte(key))
+	}
+	return op, key
+}
+
+// Format a SET entry
+// Values that would break the line format are written base64 encoded as SETB
+func formatSet(lsn int, ts uint64, key string, value string) string {
+	op := "SET"
+	if unsafeField(value) {
+		op, value = "SETB", base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	op, key = keyFields(op, key)
+	return fmt.Sprintf("%s,%s,%s,%s", formatLSN(lsn, ts), op, key, value)
+}
+
+// Format a SET, EXPIRE, DELETE or DEMOTE entry as a WAL line, ts is the HLC timestamp of the write
+func FormatEntry(lsn int, ts uint64, op string, key string, value string) string {
+	if op == "SET" {
+		return formatSet(lsn, ts, key, value)
+	}
+	op, field := keyFields(op, key)
+	if op == "EXPIRE" || op == "EXPIREK" {
+		return fmt.Sprintf("%s,%s,%s,%s", formatLSN(lsn, ts), op, field, value)
+	}
+	return fmt.Sprintf("%s,%s,%s", formatLSN(lsn, ts), op, field)
+}
+
+// Parse a WAL line, SETB entries are decoded and returned as SET
+// Returns false if the line is malformed
+func parseEntry(line string) (entry, bool) {
+	fields := strings.SplitN(line, ",", 4)
+	if len(fields) < 3 {
+		return entry{}, false
+	}
+	lsn, ts, err := parseLSN(fields[0])
+	if err != nil {
+		return entry{}, false
+	}
+	e := entry{lsn: lsn, ts: ts, op: fields[1], key: fields[2]}
+	if len(fields) == 4 {
+		e.value = fields[3]
+	}
+	if op, encoded := strings.CutSuffix(e.op, "K"); encoded {
+		key, err := base64.StdEncoding.DecodeString(e.key)
+		if err != nil {
+			return entry{}, false
+		}
+		e.op, e.key = op, string(key)
+	}
+
+	switch e.op {
+	case "SETB":
+		value, err := base64.StdEncoding.DecodeString(e.value)
+		if err != nil || len(fields) < 4 {
+			return entry{}, false
+		}
+		e.op, e.value = "SET", string(value)
+	case "SET", "EXPIRE":
+		if len(fields) < 4 {
+			return entry{}, false
+		}
+	case "DELETE", "DEMOTE":
+	default:
+		return entry{}, false
+	}
+	return e, true
+}
+
+// Operation of a multi-key transaction
+type TxnOp struct {
+	Op     string `json:"op"` // SET or DELETE
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Expire string `json:"expire,omitempty"` // Expiry a SET gives its key, as EncodeExpiry writes it, empty for none
+}
+
+// Format a TXN entry, its operations are stored base64 encoded JSON and share one LSN
+func formatTxn(lsn int, ts uint64, ops []TxnOp) string {
+	data, _ := json.Marshal(ops)
+	return fmt.Sprintf("%s,TXN,%d,%s", formatLSN(lsn, ts), len(ops), base64.StdEncoding.EncodeToString(data))
+}
+
+// Parse a WAL line into the entries it holds, a TXN entry into one per operation
+// Returns false if the line is malformed
+func parseEntries(line string) ([]entry, bool) {
+	fields := strings.SplitN(line, ",", 4)
+	if len(fields) < 2 || fields[1] != "TXN" {
+		e, ok := parseEntry(line)
+		return []entry{e}, ok
+	}
+	if len(fields) < 4 {
+		return nil, false
+	}
+	lsn, ts, err := parseLSN(fields[0])
+	if err != nil {
+		return nil, false
+	}
+	data, err := base64.StdEncoding.DecodeString(fields[3])
+	if err != nil {
+		return nil, false
+	}
+	var ops []TxnOp
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return nil, false
+	}
+	entries := make([]entry, 0, len(ops))
+	for _, op := range ops {
+		if op.Op != "SET" && op.Op != "DELETE" || op.Op == "DELETE" && op.Expire != "" {
+			return nil, false
+		}
+		entries = append(entries, entry{lsn: lsn, ts: ts, op: op.Op, key: op.Key, value: op.Value})
+		if op.Expire != "" { // Applied right after the SET, like a separate EXPIRE entry
+			entries = append(entries, entry{lsn: lsn, ts: ts, op: "EXPIRE", key: op.Key, value: op.Expire})
+		}
+	}
+	return entries, true
+}
+
+// HLC timestamp of a WAL line, e.g. one received from another node
+// Returns false if the line is malformed, 0 if it was written before writes were timestamped
+func EntryTimestamp(line string) (uint64, bool) {
+	entries, ok := parseEntries(line)
+	if !ok || len(entries) == 0 {
+		return 0, false
+	}
+	return entries[0].ts, true
+}
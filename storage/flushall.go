@@ -0,0 +1,41 @@
+package storage
+
+import (
+	h "gokv/helper"
+	"path/filepath"
+)
+
+// Empty the log file and number entries from the start again
+func (l *wal) Reset() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	// Both must reach the disk, an old checkpoint over an empty log would skip new entries on replay
+	if err := writeSynced(h.WALPath(), nil); err != nil {
+		return err
+	}
+	if err := writeSynced(h.CheckpointPath(), []byte("0")); err != nil {
+		return err
+	}
+	for _, path := range []string{h.WALPath(), h.CheckpointPath()} {
+		if err := syncDir(filepath.Dir(path)); err != nil {
+			return err
+		}
+	}
+	l.lsn, l.checkpoint, l.tombstones = 1, 0, nil // like InitLog on an empty file
+	return nil
+}
+
+// Drop all data, including old versions, and reset the WAL
+// Commits to the database are paused so no WAL entry is applied halfway
+func (d *badgerDB) Wipe(log Log) error {
+	d.flush.Lock()
+	defer d.flush.Unlock()
+	if d.closed {
+		return errClosed
+	}
+	if err := log.Reset(); err != nil {
+		return err
+	}
+	d.published = 0 // LSNs start from 1 again
+	return d.db.DropAll()
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	h "gokv/helper"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Append data to the WAL file and sync it to disk before returning
+// The sync is timed with the write, it's what stalls on a busy disk
+func appendWAL(data string) error {
+	path := h.WALPath()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	created := false
+	if os.IsNotExist(err) {
+		file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		created = true
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	start := time.Now()
+	_, err = file.WriteString(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	stalls.walWrite(time.Since(start))
+	if err != nil {
+		return err
+	}
+	if created {
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// Replace the contents of a file and sync it to disk
+func writeSynced(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Sync a directory, so files created or truncated in it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,92 @@
+package storage
+
+import "strings"
+
+// Check if key matches a glob pattern, similar to Redis KEYS/SCAN MATCH
+// Supports * (any run of characters), ? (any single character),
+// [abc] / [a-z] / [^a] character classes, and \ to escape
+func MatchGlob(pattern string, key string) bool {
+	p, k := []rune(pattern), []rune(key)
+	// Position to resume from after the last *, -1 if none seen yet
+	starP, starK := -1, 0
+	i, j := 0, 0
+	for j < len(k) {
+		if i < len(p) {
+			switch p[i] {
+			case '*':
+				starP, starK = i, j
+				i++
+				continue
+			case '?':
+				i++
+				j++
+				continue
+			case '[':
+				if end, ok := matchClass(p, i, k[j]); ok {
+					i = end
+					j++
+					continue
+				}
+			case '\\':
+				if i+1 < len(p) && p[i+1] == k[j] {
+					i += 2
+					j++
+					continue
+				}
+			default:
+				if p[i] == k[j] {
+					i++
+					j++
+					continue
+				}
+			}
+		}
+		// Mismatch, let the last * swallow one more character
+		if starP < 0 {
+			return false
+		}
+		starK++
+		i, j = starP+1, starK
+	}
+	// Remaining pattern must be only *
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+	return i == len(p)
+}
+
+// Match character c against the class starting at p[start] == '['
+// Returns the index after the closing ] and whether c is in the class
+func matchClass(p []rune, start int, c rune) (int, bool) {
+	i := start + 1
+	negate := i < len(p) && p[i] == '^'
+	if negate {
+		i++
+	}
+	matched := false
+	for ; i < len(p) && p[i] != ']'; i++ {
+		if p[i] == '\\' && i+1 < len(p) {
+			i++
+		}
+		if i+2 < len(p) && p[i+1] == '-' && p[i+2] != ']' {
+			if p[i] <= c && c <= p[i+2] {
+				matched = true
+			}
+			i += 2
+		} else if p[i] == c {
+			matched = true
+		}
+	}
+	if i >= len(p) {
+		return 0, false // unterminated class
+	}
+	return i + 1, matched != negate
+}
+
+// Literal prefix of a glob pattern, usable to narrow a prefix scan
+func GlobPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, "*?[\\"); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// A single mutation of a key found in the WAL
+type HistoryEntry struct {
+	LSN       int        `json:"lsn"`
+	Operation string     `json:"op"`
+	ValueHash string     `json:"value_hash,omitempty"` // sha256 of value, SET only
+	Origin    string     `json:"origin"`
+	At        *time.Time `json:"at,omitempty"` // When the write was logged, none for entries written before writes were timestamped
+}
+
+// Reconstruct the mutation history of a key from the WAL, oldest first
+// WAL entries don't record where a write came from, so every entry is local
+func History(key string) ([]HistoryEntry, error) {
+	lines, err := readLog(0)
+	if err != nil {
+		return nil, err
+	}
+
+	history := []HistoryEntry{}
+	for _, lineString := range lines {
+		entries, _ := parseEntries(lineString)
+		for _, e := range entries {
+			if e.key != key {
+				continue
+			}
+			entry := HistoryEntry{LSN: e.lsn, Operation: e.op, Origin: "local"}
+			if e.ts != 0 {
+				at := wallClock(e.ts)
+				entry.At = &at
+			}
+			if e.op == "SET" {
+				sum := sha256.Sum256([]byte(e.value))
+				entry.ValueHash = hex.EncodeToString(sum[:])
+			}
+			history = append(history, entry)
+		}
+	}
+	return history, nil
+}
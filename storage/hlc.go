@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hybrid logical clock
+// Timestamps combine wall clock milliseconds with a logical counter so they
+// keep increasing even if the wall clock drifts or jumps backwards
+type HLC struct {
+	last  uint64     // Last issued timestamp
+	mutex sync.Mutex // Manage access to shared resources
+}
+
+// Bits of a timestamp used by the logical counter
+const logicalBits = 16
+
+// Pack wall clock milliseconds into the high bits of a timestamp
+func physical(t time.Time) uint64 {
+	return uint64(t.UnixMilli()) << logicalBits
+}
+
+// Wall clock time a timestamp was issued at, to the millisecond
+func wallClock(ts uint64) time.Time {
+	return time.UnixMilli(int64(ts >> logicalBits))
+}
+
+// Issue a new timestamp for a local write
+func (c *HLC) Now() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	pt := physical(time.Now())
+	if pt > c.last {
+		c.last = pt
+	} else {
+		c.last++ // wall clock hasn't moved forward, bump logical counter
+	}
+	return c.last
+}
+
+// Merge a timestamp received from another node
+// Returns a timestamp greater than both the remote and every local timestamp
+func (c *HLC) Update(remote uint64) uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	pt := physical(time.Now())
+	c.last = max(c.last+1, remote+1, pt)
+	return c.last
+}
+
+// Get last issued timestamp
+func (c *HLC) Last() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.last
+}
+
+// Load last timestamp from file, a missing file starts the clock at zero
+func (c *HLC) Load(path string) error {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	last, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	c.last = max(c.last, last)
+	c.mutex.Unlock()
+	return nil
+}
+
+// Save last timestamp to file so the clock never goes backwards across restarts
+func (c *HLC) Save(path string) error {
+	return os.WriteFile(path, []byte(strconv.FormatUint(c.Last(), 10)), 0600)
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// Severity of a database log message
+type LogLevel int32
+
+// Levels of database log messages, from most to least verbose
+var logLevels = map[string]LogLevel{"debug": 0, "info": 1, "warning": 2, "error": 3}
+
+// Logs database messages at or above a level that can change while running
+type dbLogger struct {
+	level atomic.Int32
+}
+
+// Logger of the database, at info level like badger's default
+var databaseLog = func() *dbLogger {
+	l := &dbLogger{}
+	l.level.Store(int32(logLevels["info"]))
+	return l
+}()
+
+// Parse a log level: debug, info, warning or error, empty means info
+func ParseLogLevel(level string) (LogLevel, error) {
+	if level == "" {
+		level = "info"
+	}
+	n, ok := logLevels[level]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q", level)
+	}
+	return n, nil
+}
+
+// Set the least severe database messages that are logged
+func SetLogLevel(level LogLevel) {
+	databaseLog.level.Store(int32(level))
+}
+
+func (l *dbLogger) logf(level string, format string, args ...any) {
+	if int32(logLevels[level]) >= l.level.Load() {
+		log.Printf("badger "+level+": "+format, args...)
+	}
+}
+
+func (l *dbLogger) Errorf(format string, args ...any)   { l.logf("error", format, args...) }
+func (l *dbLogger) Warningf(format string, args ...any) { l.logf("warning", format, args...) }
+func (l *dbLogger) Infof(format string, args ...any)    { l.logf("info", format, args...) }
+func (l *dbLogger) Debugf(format string, args ...any)   { l.logf("debug", format, args...) }
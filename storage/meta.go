@@ -0,0 +1,26 @@
+package storage
+
+import "time"
+
+// Metadata of a key, tracked in memory since the node started
+type KeyMeta struct {
+	Created time.Time `json:"created"` // First write of the key, or when it was loaded from database
+	Updated time.Time `json:"updated"` // Last write of the key
+	Version int64     `json:"version"` // Writes of the key, starting at 1
+}
+
+// Metadata of keys, kept next to the values of a map implementation
+// Not safe for concurrent use, guarded by the lock of the owning map
+type metadata map[string]KeyMeta
+
+// Record a write of key at now
+// A key that didn't exist before the write starts over at version 1
+func (m metadata) written(key string, now time.Time, existed bool) {
+	meta, ok := m[key]
+	if !existed || !ok {
+		meta = KeyMeta{Created: now}
+	}
+	meta.Updated = now
+	meta.Version++
+	m[key] = meta
+}
@@ -0,0 +1,10 @@
+package storage
+
+import "strings"
+
+// Namespace of a key, the part before the first ':'
+// Returns false for keys without one, which belong to no namespace
+func Namespace(key string) (string, bool) {
+	ns, _, ok := strings.Cut(key, ":")
+	return ns, ok
+}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Keys read under one hold of the map lock while ranging, the context is checked between chunks
+const rangeChunk = 1024
+
+// Call fn with the value of each key still in a map, in chunks so fn runs without the map lock
+// get looks a key up while lock is held and reports whether it still exists at now
+func rangeKeys(ctx context.Context, keys []string, lock sync.Locker, get func(key string, now time.Time) (string, bool), fn func(key string, value string) bool) error {
+	values := make([]string, min(rangeChunk, len(keys)))
+	found := make([]bool, len(values))
+	for start := 0; start < len(keys); start += rangeChunk {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chunk := keys[start:min(start+rangeChunk, len(keys))]
+		lock.Lock()
+		now := time.Now()
+		for i, key := range chunk {
+			values[i], found[i] = get(key, now)
+		}
+		lock.Unlock()
+		for i, key := range chunk {
+			if found[i] && !fn(key, values[i]) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// Tiers a read can be served from
+const (
+	TierMap      = "map"  // In-memory map
+	TierCold     = "cold" // Fetched back from the cold tier
+	TierDatabase = "db"   // Looked up in the database after missing the map, as READ_POLICY asks
+	TierMiss     = "miss" // Not found in any tier
+)
+
+// Reads and their total latency per tier
+type readStats struct {
+	count   map[string]int64
+	latency map[string]time.Duration
+	mutex   sync.Mutex
+}
+
+var reads = readStats{count: make(map[string]int64), latency: make(map[string]time.Duration)}
+
+func init() {
+	expvar.Publish("read_tiers", expvar.Func(func() any { return reads.snapshot() }))
+}
+
+// Count a read served by tier
+func (r *readStats) record(tier string, d time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.count[tier]++
+	r.latency[tier] += d
+}
+
+// Reads, share of all reads and average latency per tier
+func (r *readStats) snapshot() map[string]any {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var total int64
+	for _, n := range r.count {
+		total += n
+	}
+	stats := make(map[string]any)
+	for _, tier := range []string{TierMap, TierCold, TierDatabase, TierMiss} {
+		n := r.count[tier]
+		tierStats := map[string]any{"reads": n, "ratio": 0.0, "avg_latency_us": 0.0}
+		if n > 0 {
+			tierStats["ratio"] = float64(n) / float64(total)
+			tierStats["avg_latency_us"] = float64(r.latency[tier].Microseconds()) / float64(n)
+		}
+		stats[tier] = tierStats
+	}
+	return stats
+}
+
+// Read a key, recording which tier served it and how long it took
+// Returns an empty string if the key doesn't exist
+func Read(mp InMemoryMap, key string) string {
+	return ReadThrough(mp, key, nil)
+}
+
+// Read a key like Read, asking fallback for keys missing from every tier of the map
+// Values fallback finds are counted as served by the database
+func ReadThrough(mp InMemoryMap, key string, fallback func(key string) string) string {
+	start := time.Now()
+	var value, tier string
+	if t, ok := mp.(*TieredMap); ok {
+		value, tier = t.read(key)
+	} else if value = mp.GetValue(key); value != "" {
+		tier = TierMap
+	} else {
+		tier = TierMiss
+	}
+	if tier == TierMiss && fallback != nil {
+		if value = fallback(key); value != "" {
+			tier = TierDatabase
+		}
+	}
+	reads.record(tier, time.Since(start))
+	return value
+}
+
+// Read a key, fetching it from the cold tier if it isn't in the map
+func (t *TieredMap) read(key string) (string, string) {
+	if value := t.InMemoryMap.GetValue(key); value != "" {
+		t.cold.touch(key)
+		return value, TierMap
+	}
+	if value := t.GetValue(key); value != "" {
+		return value, TierCold
+	}
+	return "", TierMiss
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	debug "log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Progress of the WAL replay done at startup
+type ReplayStatus struct {
+	Applied int           `json:"applied"`
+	Total   int           `json:"total"`
+	Done    bool          `json:"done"`
+	Skipped bool          `json:"skipped"` // Resumed from a clean shutdown without reading the WAL
+	Elapsed time.Duration `json:"elapsed_ns"`
+}
+
+// Replay keeps track of WAL entries being applied to the in-memory map
+type Replay struct {
+	status ReplayStatus
+	mutex  sync.RWMutex // Manage access to shared resources
+}
+
+// Log progress every reportEvery entries
+const reportEvery = 10000
+
+// Number of WAL entries written after the last checkpoint
+func PendingEntries(log Log) (int, error) {
+	lines, err := readLog(log.GetCheckpoint())
+	if err != nil {
+		return 0, err
+	}
+	return len(lines), nil
+}
+
+// LSN of the oldest WAL entry not yet committed to database, 0 if there is none
+func OldestPendingLSN(log Log) (int, error) {
+	lines, err := readLog(log.GetCheckpoint())
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range lines {
+		field, _, _ := strings.Cut(line, ",")
+		if n, _, err := parseLSN(field); err == nil {
+			return n, nil
+		}
+	}
+	return 0, nil
+}
+
+// Get a copy of the current replay status
+func (r *Replay) Status() ReplayStatus {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.status
+}
+
+// Apply WAL entries after the last checkpoint to the in-memory map
+// These entries have not yet been committed to the database
+func (r *Replay) Run(mp InMemoryMap, log Log) error {
+	lines, err := readLog(log.GetCheckpoint())
+	if err != nil {
+		return err
+	}
+
+	w, _ := log.(*wal) // Pending deletes are remembered so reads don't bring them back from the database
+	start := time.Now()
+	r.mutex.Lock()
+	r.status = ReplayStatus{Total: len(lines)}
+	r.mutex.Unlock()
+
+	for i, lineString := range lines {
+		entries, ok := parseEntries(lineString)
+		if !ok {
+			debug.Println("Found invalid WAL entry - ", lineString)
+		}
+		for _, e := range entries {
+			// Timestamps written after the clock was last saved must not be issued again
+			log.Clock().Update(e.ts)
+			if w != nil {
+				w.mutex.Lock()
+				w.noteWrite(e.lsn, e.op, e.key)
+				w.mutex.Unlock()
+			}
+			if e.op == "SET" {
+				mp.SetValue(e.key, e.value)
+			} else if e.op == "DELETE" || e.op == "DEMOTE" {
+				mp.DeleteValue(e.key)
+			} else if e.op == "EXPIRE" {
+				// Expiries that passed while the node was down are removed by the sweeper
+				if at, err := DecodeExpiry(e.value); err == nil {
+					mp.SetExpiry(e.key, at)
+				}
+			}
+		}
+
+		applied := i + 1
+		r.mutex.Lock()
+		r.status.Applied = applied
+		r.status.Elapsed = time.Since(start)
+		r.mutex.Unlock()
+
+		if applied%reportEvery == 0 {
+			elapsed := time.Since(start)
+			eta := elapsed / time.Duration(applied) * time.Duration(len(lines)-applied)
+			debug.Printf("WAL replay: applied=%d total=%d percent=%.1f eta=%s\n",
+				applied, len(lines), float64(applied)*100/float64(len(lines)), eta.Round(time.Millisecond))
+		}
+	}
+
+	r.mutex.Lock()
+	r.status.Done = true
+	r.status.Elapsed = time.Since(start)
+	r.mutex.Unlock()
+	debug.Printf("WAL replay: applied=%d total=%d percent=100.0 elapsed=%s\n",
+		len(lines), len(lines), time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	h "gokv/helper"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recorded on a clean shutdown, once every WAL entry is committed to the database
+// The next start trusts it instead of reading the WAL
+type CleanShutdown struct {
+	LSN        int       `json:"lsn"`
+	Checkpoint int       `json:"checkpoint"`
+	WALBytes   int64     `json:"wal_bytes"` // Size of the WAL, any later write invalidates the marker
+	At         time.Time `json:"at"`
+}
+
+// Write a full backup of the database to path, replacing any previous one
+// Commits to the database are paused while it is written
+// Returns the size of the backup in bytes
+func (d *badgerDB) Snapshot(path string) (int64, error) {
+	d.flush.Lock()
+	defer d.flush.Unlock()
+	if d.closed {
+		return 0, errClosed
+	}
+
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+	if _, err := d.db.Backup(file, 0); err != nil {
+		file.Close()
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return 0, err
+	}
+	if err := file.Close(); err != nil {
+		return 0, err
+	}
+	return info.Size(), os.Rename(tmp, path)
+}
+
+// Record a clean shutdown
+// Fails if WAL entries are still waiting to be committed to the database
+func MarkCleanShutdown(log Log) (CleanShutdown, error) {
+	info, err := os.Stat(h.WALPath())
+	if err != nil {
+		return CleanShutdown{}, err
+	}
+	c := CleanShutdown{LSN: log.GetLSN(), Checkpoint: log.GetCheckpoint(), WALBytes: info.Size(), At: time.Now()}
+	if pending := c.LSN - 1 - c.Checkpoint; pending > 0 {
+		return CleanShutdown{}, fmt.Errorf("%d WAL entries not yet committed to database", pending)
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return CleanShutdown{}, err
+	}
+	tmp := h.ShutdownMarkerPath() + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return CleanShutdown{}, err
+	}
+	return c, os.Rename(tmp, h.ShutdownMarkerPath())
+}
+
+// Remove the clean shutdown marker, e.g. when a shutdown is called off
+func ClearCleanShutdown() error {
+	err := os.Remove(h.ShutdownMarkerPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Read and remove the clean shutdown marker, so a later crash isn't mistaken for a clean stop
+// Returns an error saying why the marker can't be trusted if there is none,
+// or the WAL or checkpoint changed since it was written
+func TakeCleanShutdown() (CleanShutdown, error) {
+	var c CleanShutdown
+	b, err := os.ReadFile(h.ShutdownMarkerPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return c, errors.New("no clean shutdown marker")
+	} else if err != nil {
+		return c, err
+	}
+	if err := ClearCleanShutdown(); err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("invalid clean shutdown marker - %w", err)
+	}
+	if c.Checkpoint < c.LSN-1 {
+		return c, fmt.Errorf("marker LSN %d is ahead of its checkpoint %d", c.LSN, c.Checkpoint)
+	}
+	info, err := os.Stat(h.WALPath())
+	if err != nil {
+		return c, err
+	} else if info.Size() != c.WALBytes {
+		return c, fmt.Errorf("WAL is %d bytes, marker recorded %d", info.Size(), c.WALBytes)
+	}
+	b, err = os.ReadFile(h.CheckpointPath())
+	if err != nil {
+		return c, err
+	}
+	if n, _ := strconv.Atoi(strings.TrimSpace(string(b))); n != c.Checkpoint {
+		return c, fmt.Errorf("checkpoint is %d, marker recorded %d", n, c.Checkpoint)
+	}
+	return c, nil
+}
+
+// Initialize Log from a clean shutdown marker without reading the WAL
+func ResumeLog(c CleanShutdown) (Log, error) {
+	l := &wal{lsn: c.LSN, checkpoint: c.Checkpoint, mutex: sync.RWMutex{}}
+	if err := l.clock.Load(h.HLCPath()); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Mark the replay done without reading the WAL, as nothing is pending after a clean shutdown
+func (r *Replay) Skip() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.status = ReplayStatus{Done: true, Skipped: true}
+}
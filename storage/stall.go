@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"expvar"
+	h "gokv/helper"
+	debug "log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Latencies over which writes are considered stalled
+const (
+	walStallLatency   = 50 * time.Millisecond // Average WAL write
+	flushStallLatency = 2 * time.Second       // Applying the WAL to the database
+)
+
+// Number of write stalls seen since start
+var writeStalls = expvar.NewInt("write_stalls")
+
+func init() {
+	expvar.Publish("write_stall", expvar.Func(func() any { return WriteStall() }))
+}
+
+// Write stall state of the node
+type StallStatus struct {
+	Stalled      bool      `json:"stalled"`
+	Reasons      []string  `json:"reasons,omitempty"` // wal, flush or compaction
+	Since        time.Time `json:"since,omitzero"`
+	WALLatency   string    `json:"wal_latency"`   // Moving average of WAL writes
+	FlushLatency string    `json:"flush_latency"` // Last database flush
+	L0Tables     int       `json:"l0_tables"`     // Level 0 tables waiting for compaction
+	L0Limit      int       `json:"l0_limit"`      // Level 0 tables at which badger stalls writes
+}
+
+// Latencies and compaction backlog feeding the stall state
+type stallTracker struct {
+	wal      time.Duration
+	flush    time.Duration
+	l0Tables int
+	l0Limit  int
+	since    time.Time
+	last     time.Time // End of the last database flush
+	mutex    sync.Mutex
+}
+
+var stalls stallTracker
+
+// Record the latency of a WAL write
+func (t *stallTracker) walWrite(d time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.wal += (d - t.wal) / 8
+	t.update()
+}
+
+// Record the duration of a database flush and the level 0 backlog after it
+func (t *stallTracker) flushed(d time.Duration, l0Tables int, l0Limit int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.flush, t.l0Tables, t.l0Limit = d, l0Tables, l0Limit
+	t.last = time.Now()
+	t.update()
+}
+
+// Reasons writes are currently stalled
+func (t *stallTracker) reasons() []string {
+	var reasons []string
+	if t.wal > walStallLatency {
+		reasons = append(reasons, "wal")
+	}
+	if t.flush > flushStallLatency {
+		reasons = append(reasons, "flush")
+	}
+	if t.l0Limit > 0 && t.l0Tables >= t.l0Limit {
+		reasons = append(reasons, "compaction")
+	}
+	return reasons
+}
+
+// Log the start and end of a stall
+func (t *stallTracker) update() {
+	reasons := t.reasons()
+	if len(reasons) > 0 && t.since.IsZero() {
+		t.since = time.Now()
+		writeStalls.Add(1)
+		debug.Println("Writes stalled - ", reasons)
+		h.Lifecycle(h.EventWriteStall, strings.Join(reasons, ","))
+	} else if len(reasons) == 0 && !t.since.IsZero() {
+		debug.Println("Write stall cleared after ", time.Since(t.since).Round(time.Millisecond))
+		h.Lifecycle(h.EventStallCleared, "")
+		t.since = time.Time{}
+	}
+}
+
+// Current write stall state
+func WriteStall() StallStatus {
+	stalls.mutex.Lock()
+	defer stalls.mutex.Unlock()
+	reasons := stalls.reasons()
+	return StallStatus{
+		Stalled:      len(reasons) > 0,
+		Reasons:      reasons,
+		Since:        stalls.since,
+		WALLatency:   stalls.wal.String(),
+		FlushLatency: stalls.flush.String(),
+		L0Tables:     stalls.l0Tables,
+		L0Limit:      stalls.l0Limit,
+	}
+}
+
+// End of the last database flush, zero if there was none yet
+func LastFlush() time.Time {
+	stalls.mutex.Lock()
+	defer stalls.mutex.Unlock()
+	return stalls.last
+}
+
+// Time to wait between database flushes
+// While writes stall flushes happen less often, so each commits a larger batch
+func FlushInterval(base time.Duration) time.Duration {
+	if WriteStall().Stalled {
+		return base * 3
+	}
+	return base
+}
+
+// Record a database flush that started at start, with the level 0 backlog after it
+func (d *badgerDB) recordFlush(start time.Time) {
+	l0Tables := 0
+	for _, level := range d.db.Levels() {
+		if level.Level == 0 {
+			l0Tables = level.NumTables
+		}
+	}
+	stalls.flushed(time.Since(start), l0Tables, d.db.Opts().NumLevelZeroTablesStall)
+}
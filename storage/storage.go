@@ -3,6 +3,7 @@ package storage
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -11,6 +12,9 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	h "gokv/helper"
 
 	"github.com/dgraph-io/badger/v4"
 )
@@ -19,12 +23,38 @@ type Database interface {
 	Close() error
 	ScanDatabase(mp InMemoryMap) error
 	UpdateDatabase(log Log) error
+	SetVersioning(p VersionPolicy)
+	Versions(key string) ([]Version, error)
+	GetVersion(key string, version int) (string, bool, error)
+	Get(key string) (string, bool, error)
+	Scan(ctx context.Context, prefix string, limit int) (map[string]string, error)
+	Drill(dir string) (DrillResult, error)
+	Size() int64
+	Wipe(log Log) error
+	Snapshot(path string) (int64, error)
 }
 
 type InMemoryMap interface {
 	GetValue(key string) string
+	Exists(key string) bool
 	SetValue(key string, value string)
+	SetValues(pairs map[string]string)
 	DeleteValue(key string)
+	Clear(wipe func() error) ([]string, error)
+	Modify(key string, fn func(old string, exists bool) (value string, remove bool, err error)) error
+	ModifyMeta(key string, fn func(old string, meta KeyMeta, exists bool) (value string, remove bool, err error)) error
+	ModifyExpiry(key string, fn func(old string, at time.Time, exists bool) (value string, expireAt time.Time, remove bool, err error)) error
+	Transact(fn func(get func(key string) (string, bool), expiry func(key string) time.Time, meta func(key string) KeyMeta) ([]TxnOp, error)) error
+	SetExpiry(key string, at time.Time) bool
+	Expiry(key string) (time.Time, bool)
+	Expired() []string
+	Meta(key string) (KeyMeta, bool)
+	Len() int
+	Keys(ctx context.Context, prefix string) []string
+	RangeKeys(ctx context.Context, prefix string, fn func(key string) bool) error
+	Count(prefix string) int
+	Range(ctx context.Context, prefix string, fn func(key string, value string) bool) error
+	Watch(fn Watcher) // Report every later change to fn, writes made before, such as WAL replay, aren't reported
 }
 
 type Log interface {
@@ -33,27 +63,41 @@ type Log interface {
 	SetLSN(a int)
 	SetCheckpoint(a int)
 	UpdateLog(operation string, key string, value string) (string, error)
+	UpdateLogBatch(operation string, keys []string, values []string) error
+	UpdateLogTxn(ops []TxnOp) error
+	Reset() error
+	Clock() *HLC
+	Deleted(key string) bool // Key was deleted by an entry not yet committed to database
 }
 
 type badgerDB struct {
-	db    *badger.DB   // Database object
-	mutex sync.RWMutex // Manage access to shared resources
+	db         *badger.DB    // Database object
+	versioning VersionPolicy // Namespaces keeping old versions of keys
+	flush      sync.Mutex    // Held while committing WAL entries to database
+	closed     bool          // Set under flush once closed, commits after it fail
+	published  int           // Highest LSN published as committed, flushes may read an entry again
+	mutex      sync.RWMutex  // Manage access to shared resources
 }
 
 type memStore struct {
-	mp    map[string]string // In-memory map for fast access
-	mutex sync.RWMutex      // Manage access to shared resources
+	mp     map[string]string // In-memory map for fast access
+	expiry expiries          // Expiry of keys with a TTL
+	meta   metadata          // Created and updated times and version of keys
+	watch  Watcher           // Told about every change, nil if nothing watches the map
+	mutex  sync.RWMutex      // Manage access to shared resources
 }
 
 type wal struct {
-	lsn        int          // Keep track of log file entries
-	checkpoint int          // Last checkpoint
-	mutex      sync.RWMutex // Manage access to shared resources
+	lsn        int            // Keep track of log file entries
+	checkpoint int            // Last checkpoint
+	clock      HLC            // Timestamps writes, persisted with checkpoint
+	tombstones map[string]int // Key -> LSN of its DELETE, while not committed to database
+	mutex      sync.RWMutex   // Manage access to shared resources
 }
 
 // Start database connection
 func InitDatabase() (Database, error) {
-	db, err := badger.Open(badger.DefaultOptions("./db"))
+	db, err := badger.Open(badger.DefaultOptions(h.DBPath()).WithLogger(databaseLog))
 	if err != nil {
 		return nil, err
 	}
@@ -62,11 +106,20 @@ func InitDatabase() (Database, error) {
 }
 
 // Close Database connection before quitting
+// Waits for a running commit, later commits, backups and wipes fail with errClosed
 func (d *badgerDB) Close() error {
-	err := d.db.Close()
-	return err
+	d.flush.Lock()
+	defer d.flush.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	return d.db.Close()
 }
 
+// Returned by database writes after Close
+var errClosed = errors.New("database closed")
+
 // Load data from database to in-memory map
 func (d *badgerDB) ScanDatabase(mp InMemoryMap) error {
 	// Start a new transaction
@@ -82,6 +135,9 @@ func (d *badgerDB) ScanDatabase(mp InMemoryMap) error {
 	for it.Rewind(); it.Valid(); it.Next() {
 		item := it.Item()
 		key := item.Key()
+		if bytes.HasPrefix(key, []byte(versionPrefix)) { // old versions aren't user keys
+			continue
+		}
 		err := item.Value(func(val []byte) error {
 			mp.SetValue(string(key), string(val))
 			return nil
@@ -89,57 +145,115 @@ func (d *badgerDB) ScanDatabase(mp InMemoryMap) error {
 		if err != nil {
 			return err
 		}
+		// Restore TTL stored with badger's native expiry
+		if expiresAt := item.ExpiresAt(); expiresAt > 0 {
+			mp.SetExpiry(string(key), time.Unix(int64(expiresAt), 0))
+		}
 	}
 	return nil
 }
 
+// Size of database files on disk in bytes
+func (d *badgerDB) Size() int64 {
+	lsm, vlog := d.db.Size()
+	return lsm + vlog
+}
+
+// Read a value directly from database, bypassing the in-memory map
+// Returns false if the key isn't stored
+func (d *badgerDB) Get(key string) (string, bool, error) {
+	var value string
+	err := d.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			value = string(val)
+			return nil
+		})
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// Read up to limit key-value pairs under prefix directly from database
+// Stops with ctx's error once it is done
+func (d *badgerDB) Scan(ctx context.Context, prefix string, limit int) (map[string]string, error) {
+	pairs := make(map[string]string)
+	err := d.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		p := []byte(prefix)
+		for it.Seek(p); it.ValidForPrefix(p) && len(pairs) < limit; it.Next() {
+			item := it.Item()
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if bytes.HasPrefix(item.Key(), []byte(versionPrefix)) { // old versions aren't user keys
+				continue
+			}
+			key := string(item.Key())
+			err := item.Value(func(val []byte) error {
+				pairs[key] = string(val)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return pairs, err
+}
+
 // Reads from WAL log and updates database from last checkpoint
-// Runs every 5 seconds
+// Runs every FLUSH_INTERVAL
 func (d *badgerDB) UpdateDatabase(log Log) error {
-	// Open log file and save lines after checkpoint to array
-	file, err := os.Open("wal.log")
-	if err != nil {
-		return err
+	d.flush.Lock()
+	defer d.flush.Unlock()
+	if d.closed {
+		return errClosed
 	}
+	start := time.Now()
 
-	var lines []string
-	scanner := bufio.NewScanner(file)
-	lineCount := 1
+	// Save lines after checkpoint to array
 	checkpoint := log.GetCheckpoint()
-	for scanner.Scan() {
-		if lineCount < checkpoint { // ignore lines before checkpoint
-			lineCount++
-			continue
-		}
-		lines = append(lines, scanner.Text())
-	}
-	if err := scanner.Err(); err != nil {
-		file.Close()
+	lines, err := readLog(checkpoint)
+	if err != nil {
 		return err
 	}
-	file.Close()
 
 	// If no new changes, return
 	if len(lines) == 0 {
+		d.recordFlush(start)
 		return nil
 	}
 
 	// Iterate over each line and commit to database
+	versioned := make(map[string]bool)
+	var traced, committed []entry
+	listening := h.Listening(h.TopicEntryCommitted)
 	err = d.db.Update(func(txn *badger.Txn) error {
 		for _, lineString := range lines {
-			line := strings.Split(lineString, ",")
-			if len(line) < 3 {
+			entries, ok := parseEntries(lineString)
+			if !ok {
 				debug.Println("Found invalid WAL entry - ", lineString)
 				continue
 			}
-			if line[1] == "SET" {
-				if err := txn.Set([]byte(line[2]), []byte(line[3])); err != nil {
+			for _, e := range entries {
+				if err := d.applyEntry(txn, e, versioned); err != nil {
 					return err
 				}
-
-			} else if line[1] == "DELETE" {
-				if err := txn.Delete([]byte(line[2])); err != nil {
-					return err
+				if h.Traced(e.key) {
+					traced = append(traced, e)
+				}
+				if listening && e.lsn > d.published {
+					committed = append(committed, e)
 				}
 			}
 		}
@@ -149,6 +263,20 @@ func (d *badgerDB) UpdateDatabase(log Log) error {
 	if err != nil {
 		return err
 	}
+	for _, e := range traced {
+		h.Trace(e.key, h.TraceFlush, fmt.Sprintf("%s at LSN %d committed to database", e.op, e.lsn))
+	}
+	for _, e := range committed {
+		h.Publish(h.BusEvent{Topic: h.TopicEntryCommitted, Type: e.op, Key: e.key, LSN: e.lsn})
+		d.published = max(d.published, e.lsn)
+	}
+
+	// Drop versions beyond retention count
+	if err := d.pruneVersions(versioned); err != nil {
+		return err
+	}
+
+	d.recordFlush(start)
 
 	// Update checkpoint
 	checkpoint = checkpoint + len(lines)
@@ -156,36 +284,397 @@ func (d *badgerDB) UpdateDatabase(log Log) error {
 	checkpointString := fmt.Sprintf("%d", checkpoint)
 
 	// Save new checkpoint
-	if err := os.WriteFile("checkpoint.txt", []byte(checkpointString), 0600); err != nil {
+	if err := os.WriteFile(h.CheckpointPath(), []byte(checkpointString), 0600); err != nil {
 		return err
 	}
+	return log.Clock().Save(h.HLCPath())
+}
+
+// Commit a single WAL entry to database, recording keys that got a new version
+func (d *badgerDB) applyEntry(txn *badger.Txn, e entry, versioned map[string]bool) error {
+	if e.op == "SET" {
+		if err := txn.Set([]byte(e.key), []byte(e.value)); err != nil {
+			return err
+		}
+		// Keep this value as a version, identified by its LSN
+		if err := d.saveVersion(txn, e.key, e.lsn, e.value); err != nil {
+			return err
+		}
+		versioned[e.key] = true
+
+	} else if e.op == "DELETE" || e.op == "DEMOTE" { // demoted keys live in the cold tier
+		return txn.Delete([]byte(e.key))
+	} else if e.op == "EXPIRE" {
+		return expireEntry(txn, e.key, e.value)
+	}
 	return nil
 }
 
+// Rewrite a database entry with the expiry of an EXPIRE WAL entry
+// Uses badger's native TTL, so expired keys vanish from the database too
+func expireEntry(txn *badger.Txn, key string, value string) error {
+	at, err := DecodeExpiry(value)
+	if err != nil {
+		debug.Println("Found invalid WAL expiry - ", value)
+		return nil
+	}
+	item, err := txn.Get([]byte(key))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+
+	if at.IsZero() { // expiry removed
+		return txn.Set([]byte(key), val)
+	}
+	ttl := time.Until(at)
+	if ttl <= 0 {
+		return txn.Delete([]byte(key))
+	}
+	return txn.SetEntry(badger.NewEntry([]byte(key), val).WithTTL(ttl))
+}
+
+// Read lines of the log file from the given checkpoint onwards
+func readLog(checkpoint int) ([]string, error) {
+	file, err := os.Open(h.WALPath())
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	lineCount := 1
+	for scanner.Scan() {
+		if lineCount < checkpoint { // ignore lines before checkpoint
+			lineCount++
+			continue
+		}
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
 // Initialize In-memory map
 func InitMap() InMemoryMap {
-	return &memStore{mp: make(map[string]string), mutex: sync.RWMutex{}}
+	return &memStore{mp: make(map[string]string), expiry: make(expiries), meta: make(metadata), mutex: sync.RWMutex{}}
 }
 
 // Get value from in-memory map
 func (m *memStore) GetValue(key string) string {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
+	if m.expiry.expired(key, time.Now()) {
+		return ""
+	}
 	return m.mp[key]
 }
 
-// Set value in in-memory map
+// Check if key exists in in-memory map
+func (m *memStore) Exists(key string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.exists(key, time.Now())
+}
+
+// Check if key exists and hasn't expired at now, callers hold the lock
+func (m *memStore) exists(key string, now time.Time) bool {
+	_, ok := m.mp[key]
+	return ok && !m.expiry.expired(key, now)
+}
+
+// Report every later change to fn
+func (m *memStore) Watch(fn Watcher) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.watch = fn
+}
+
+// Report a change to the watcher, callers hold the lock
+func (m *memStore) changed(typ string, key string, value string) {
+	if m.watch != nil {
+		m.watch(Change{Type: typ, Key: key, Value: value})
+	}
+}
+
+// Set value in in-memory map, clearing any expiry
 func (m *memStore) SetValue(key string, value string) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
+	now := time.Now()
+	m.meta.written(key, now, m.exists(key, now))
 	m.mp[key] = value
+	delete(m.expiry, key)
+	m.changed("set", key, value)
+}
+
+// Set multiple values in in-memory map in a single pass
+func (m *memStore) SetValues(pairs map[string]string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	for k, v := range pairs {
+		m.meta.written(k, now, m.exists(k, now))
+		m.mp[k] = v
+		delete(m.expiry, k)
+		m.changed("set", k, v)
+	}
 }
 
 // Delete value from in-memory map
 func (m *memStore) DeleteValue(key string) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
+	m.remove(key, time.Now())
+}
+
+// Remove key with its expiry and metadata, reporting it if it was there, callers hold the lock
+func (m *memStore) remove(key string, now time.Time) {
+	if _, ok := m.mp[key]; !ok {
+		return
+	}
+	expired := m.expiry.expired(key, now)
 	delete(m.mp, key)
+	delete(m.expiry, key)
+	delete(m.meta, key)
+	m.changed(removal(expired), key, "")
+}
+
+// Remove every key from in-memory map, running wipe first under the map lock
+// so no write lands between the two. Nothing is removed if wipe fails
+// Returns the keys removed, leaving out expired ones
+func (m *memStore) Clear(wipe func() error) ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := wipe(); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	keys := make([]string, 0, len(m.mp))
+	for k := range m.mp {
+		if !m.expiry.expired(k, now) {
+			keys = append(keys, k)
+		}
+	}
+	m.mp, m.expiry, m.meta = make(map[string]string), make(expiries), make(metadata)
+	for _, k := range keys {
+		m.changed("delete", k, "")
+	}
+	return keys, nil
+}
+
+// Atomically read-modify-write a key in in-memory map
+// fn runs under the map lock and returns the new value, or remove to delete the key
+// If fn returns an error the map is left unchanged. Expiry of a kept key is unchanged
+func (m *memStore) Modify(key string, fn func(old string, exists bool) (string, bool, error)) error {
+	return m.ModifyMeta(key, func(old string, _ KeyMeta, exists bool) (string, bool, error) {
+		return fn(old, exists)
+	})
+}
+
+// Atomically read-modify-write a key in in-memory map, like Modify
+// fn also gets the metadata of the key before the write
+func (m *memStore) ModifyMeta(key string, fn func(old string, meta KeyMeta, exists bool) (string, bool, error)) error {
+	return m.update(key, func(old string, meta KeyMeta, at time.Time, exists bool) (string, time.Time, bool, error) {
+		value, remove, err := fn(old, meta, exists)
+		return value, at, remove, err
+	})
+}
+
+// Atomically read-modify-write a key and its expiry in in-memory map, like Modify
+// fn gets the expiry of the key, zero without one, and returns the expiry to keep
+func (m *memStore) ModifyExpiry(key string, fn func(old string, at time.Time, exists bool) (string, time.Time, bool, error)) error {
+	return m.update(key, func(old string, _ KeyMeta, at time.Time, exists bool) (string, time.Time, bool, error) {
+		return fn(old, at, exists)
+	})
+}
+
+// Read-modify-write a key with its metadata and expiry under the map lock
+func (m *memStore) update(key string, fn func(old string, meta KeyMeta, at time.Time, exists bool) (string, time.Time, bool, error)) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	old, exists := m.mp[key]
+	if m.expiry.expired(key, now) {
+		old, exists = "", false
+	}
+	var meta KeyMeta
+	var at time.Time
+	if exists {
+		meta, at = m.meta[key], m.expiry[key]
+	}
+	value, at, remove, err := fn(old, meta, at, exists)
+	if err != nil {
+		return err
+	}
+	if remove {
+		m.remove(key, now)
+		return nil
+	}
+	m.meta.written(key, now, exists)
+	m.mp[key] = value
+	if at.IsZero() {
+		delete(m.expiry, key)
+	} else {
+		m.expiry[key] = at
+	}
+	m.changed("set", key, value)
+	return nil
+}
+
+// Atomically apply operations on several keys
+// fn runs under the map lock with a view of current values, expiries and metadata, zero for none, and returns the
+// operations to apply, which also replace expiries. On error the map is left unchanged
+func (m *memStore) Transact(fn func(get func(key string) (string, bool), expiry func(key string) time.Time, meta func(key string) KeyMeta) ([]TxnOp, error)) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	ops, err := fn(func(key string) (string, bool) {
+		value, ok := m.mp[key]
+		if !ok || m.expiry.expired(key, now) {
+			return "", false
+		}
+		return value, true
+	}, func(key string) time.Time {
+		if m.expiry.expired(key, now) {
+			return time.Time{}
+		}
+		return m.expiry[key]
+	}, func(key string) KeyMeta {
+		if !m.exists(key, now) {
+			return KeyMeta{}
+		}
+		return m.meta[key]
+	})
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if op.Op == "DELETE" {
+			m.remove(op.Key, now)
+			continue
+		}
+		m.meta.written(op.Key, now, m.exists(op.Key, now))
+		m.mp[op.Key] = op.Value
+		delete(m.expiry, op.Key)
+		if at, err := DecodeExpiry(op.Expire); err == nil && !at.IsZero() {
+			m.expiry[op.Key] = at
+		}
+		m.changed("set", op.Key, op.Value)
+	}
+	return nil
+}
+
+// Set expiry of a key, zero time removes it
+// Returns false if the key doesn't exist
+func (m *memStore) SetExpiry(key string, at time.Time) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.mp[key]; !ok || m.expiry.expired(key, time.Now()) {
+		return false
+	}
+	if at.IsZero() {
+		delete(m.expiry, key)
+	} else {
+		m.expiry[key] = at
+	}
+	return true
+}
+
+// Get expiry of a key, false if it has none
+func (m *memStore) Expiry(key string) (time.Time, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	at, ok := m.expiry[key]
+	return at, ok
+}
+
+// Get metadata of a key, false if it doesn't exist
+func (m *memStore) Meta(key string) (KeyMeta, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if !m.exists(key, time.Now()) {
+		return KeyMeta{}, false
+	}
+	return m.meta[key], true
+}
+
+// Keys whose expiry has passed
+func (m *memStore) Expired() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.expiry.due(time.Now())
+}
+
+// Number of keys in in-memory map
+// May include expired keys the sweeper hasn't removed yet
+func (m *memStore) Len() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return len(m.mp)
+}
+
+// List keys in in-memory map starting with prefix
+// Stops early once ctx is done, returning the keys listed so far
+func (m *memStore) Keys(ctx context.Context, prefix string) []string {
+	var keys []string
+	m.RangeKeys(ctx, prefix, func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// Call fn with each key in in-memory map starting with prefix, until it returns false
+// Keys aren't copied: fn runs under the map lock and must not use the map
+// Returns ctx's error if it is done before every key was seen
+func (m *memStore) RangeKeys(ctx context.Context, prefix string, fn func(key string) bool) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	now := time.Now()
+	i := 0
+	for k := range m.mp {
+		if i++; i%rangeChunk == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if strings.HasPrefix(k, prefix) && !m.expiry.expired(k, now) && !fn(k) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Count keys in in-memory map starting with prefix
+// Only keys are walked, nothing is copied
+func (m *memStore) Count(prefix string) int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	now := time.Now()
+	n := 0
+	for k := range m.mp {
+		if strings.HasPrefix(k, prefix) && !m.expiry.expired(k, now) {
+			n++
+		}
+	}
+	return n
+}
+
+// Call fn with each key-value pair in in-memory map whose key starts with prefix, until it returns false
+// Pairs come in no particular order. Keys are listed first and values read in chunks, so fn runs
+// without the map lock: keys deleted meanwhile are skipped and written ones have their latest value
+func (m *memStore) Range(ctx context.Context, prefix string, fn func(key string, value string) bool) error {
+	return rangeKeys(ctx, m.Keys(ctx, prefix), m.mutex.RLocker(), func(key string, now time.Time) (string, bool) {
+		value, ok := m.mp[key]
+		return value, ok && !m.expiry.expired(key, now)
+	}, fn)
 }
 
 // Initialize Log
@@ -194,7 +683,7 @@ func InitLog() (Log, error) {
 	l := &wal{lsn: 0, checkpoint: 0, mutex: sync.RWMutex{}}
 
 	// Open log file
-	file, err := os.Open("wal.log")
+	file, err := os.Open(h.WALPath())
 	if err != nil {
 		return nil, err
 	}
@@ -215,7 +704,7 @@ func InitLog() (Log, error) {
 	}
 
 	// Load last checkpoint
-	checkpointBytes, err := os.ReadFile("checkpoint.txt")
+	checkpointBytes, err := os.ReadFile(h.CheckpointPath())
 	if err != nil {
 		return nil, err
 	}
@@ -229,6 +718,11 @@ func InitLog() (Log, error) {
 		return nil, err
 	}
 
+	// Load hybrid logical clock
+	if err := l.clock.Load(h.HLCPath()); err != nil {
+		return nil, err
+	}
+
 	l.mutex.Lock()
 	l.lsn = count + 1
 	l.checkpoint = checkpointVal
@@ -263,40 +757,110 @@ func (l *wal) SetCheckpoint(a int) {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 	l.checkpoint = a
+	l.pruneTombstones()
+}
+
+// Get hybrid logical clock of Log
+func (l *wal) Clock() *HLC {
+	return &l.clock
 }
 
 // Write to log file
 func (l *wal) UpdateLog(operation string, key string, value string) (string, error) {
-	if operation != "SET" && operation != "DELETE" {
+	if operation != "SET" && operation != "DELETE" && operation != "EXPIRE" && operation != "DEMOTE" {
 		return "", errors.New("Invalid operation to WAL log - " + operation)
 	}
 
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
-	// Format log entry
-	var newLog string
-	if operation == "SET" {
-		newLog = fmt.Sprintf("%d,%s,%s,%s", l.lsn, operation, key, value)
-	} else if operation == "DELETE" {
-		newLog = fmt.Sprintf("%d,%s,%s", l.lsn, operation, key)
-	}
+	// Format log entry, stamped with the clock so replicas can order it
+	newLog := FormatEntry(l.lsn, l.clock.Now(), operation, key, value)
 
-	// Open log file
-	file, err := os.OpenFile("wal.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-	if err != nil {
+	// Write to log file
+	if err := appendWAL(newLog + "\n"); err != nil {
+		debug.Println("Could not write to WAL log - ", err)
 		return "", err
 	}
-	defer file.Close()
+
+	h.Trace(key, h.TraceWAL, fmt.Sprintf("%s appended at LSN %d", operation, l.lsn))
+	l.noteWrite(l.lsn, operation, key)
+
+	// Update log file counter
+	l.lsn++
+	return newLog, nil
+}
+
+// Write multiple entries of the same operation to log file in a single write
+// values is ignored for DELETE
+func (l *wal) UpdateLogBatch(operation string, keys []string, values []string) error {
+	if operation != "SET" && operation != "DELETE" {
+		return errors.New("Invalid operation to WAL log - " + operation)
+	}
+	if operation == "SET" && len(values) != len(keys) {
+		return errors.New("Mismatched keys and values in WAL batch")
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// Format log entries
+	var sb strings.Builder
+	for i, key := range keys {
+		if operation == "SET" {
+			sb.WriteString(formatSet(l.lsn+i, l.clock.Now(), key, values[i]) + "\n")
+		} else {
+			sb.WriteString(FormatEntry(l.lsn+i, l.clock.Now(), operation, key, "") + "\n")
+		}
+	}
 
 	// Write to log file
-	_, err = file.WriteString(newLog + "\n")
-	if err != nil {
+	if err := appendWAL(sb.String()); err != nil {
 		debug.Println("Could not write to WAL log - ", err)
-		return "", err
+		return err
+	}
+
+	for i, key := range keys {
+		l.noteWrite(l.lsn+i, operation, key)
+	}
+	if h.Tracing() {
+		for i, key := range keys {
+			h.Trace(key, h.TraceWAL, fmt.Sprintf("%s appended at LSN %d in a batch of %d", operation, l.lsn+i, len(keys)))
+		}
+	}
+
+	// Update log file counter
+	l.lsn += len(keys)
+	return nil
+}
+
+// Write the operations of a transaction to log file as a single TXN entry
+func (l *wal) UpdateLogTxn(ops []TxnOp) error {
+	for _, op := range ops {
+		if op.Op != "SET" && op.Op != "DELETE" || op.Op == "DELETE" && op.Expire != "" {
+			return errors.New("Invalid operation to WAL log - " + op.Op)
+		}
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// Write to log file
+	if err := appendWAL(formatTxn(l.lsn, l.clock.Now(), ops) + "\n"); err != nil {
+		debug.Println("Could not write to WAL log - ", err)
+		return err
+	}
+
+	for _, op := range ops {
+		l.noteWrite(l.lsn, op.Op, op.Key)
+	}
+	if h.Tracing() {
+		for _, op := range ops {
+			h.Trace(op.Key, h.TraceWAL, fmt.Sprintf("%s appended at LSN %d in a transaction of %d", op.Op, l.lsn, len(ops)))
+		}
 	}
 
 	// Update log file counter
 	l.lsn++
-	return newLog, nil
+	return nil
 }
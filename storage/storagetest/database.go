@@ -0,0 +1,241 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gokv/storage"
+)
+
+// Database keeping committed keys in memory
+// Only commits entries of a *Log, version MaxAge is ignored
+type Database struct {
+	Faults
+	data       map[string]string            // Committed keys
+	expiry     map[string]time.Time         // Expiry of keys with a TTL
+	versions   map[string][]storage.Version // Old versions of keys, oldest first
+	versioning storage.VersionPolicy        // Namespaces keeping old versions of keys
+	snapshot   map[string]string            // Committed keys at the latest snapshot
+	mutex      sync.RWMutex                 // Manage access to shared resources
+}
+
+// Create an empty database
+func NewDatabase() *Database {
+	return &Database{data: make(map[string]string), expiry: make(map[string]time.Time), versions: make(map[string][]storage.Version)}
+}
+
+// Close database
+func (d *Database) Close() error {
+	return d.check("Close")
+}
+
+// Load committed keys to in-memory map
+func (d *Database) ScanDatabase(mp storage.InMemoryMap) error {
+	if err := d.check("ScanDatabase"); err != nil {
+		return err
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	for key, value := range d.data {
+		mp.SetValue(key, value)
+		if at, ok := d.expiry[key]; ok {
+			mp.SetExpiry(key, at)
+		}
+	}
+	return nil
+}
+
+// Commit log entries after the checkpoint and move the checkpoint past them
+func (d *Database) UpdateDatabase(log storage.Log) error {
+	if err := d.check("UpdateDatabase"); err != nil {
+		return err
+	}
+	l, ok := log.(*Log)
+	if !ok {
+		return errors.New("storagetest: UpdateDatabase needs a *storagetest.Log")
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	pending := l.pending()
+	for _, e := range pending {
+		if e.Op != "TXN" {
+			d.apply(e.LSN, e.Op, e.Key, e.Value)
+			continue
+		}
+		for _, op := range e.Ops {
+			d.apply(e.LSN, op.Op, op.Key, op.Value)
+			if op.Expire != "" {
+				d.apply(e.LSN, "EXPIRE", op.Key, op.Expire)
+			}
+		}
+	}
+	l.SetCheckpoint(l.GetCheckpoint() + len(pending))
+	return nil
+}
+
+// Commit a single operation
+func (d *Database) apply(lsn int, op string, key string, value string) {
+	switch op {
+	case "SET":
+		d.data[key] = value
+		delete(d.expiry, key)
+		ns, ok := storage.Namespace(key)
+		if retain := d.versioning.Retain[ns]; ok && retain > 0 {
+			versions := append(d.versions[key], storage.Version{Version: lsn, Value: value})
+			d.versions[key] = versions[max(len(versions)-retain, 0):]
+		}
+	case "DELETE", "DEMOTE":
+		delete(d.data, key)
+		delete(d.expiry, key)
+	case "EXPIRE":
+		at, err := storage.DecodeExpiry(value)
+		if _, exists := d.data[key]; err != nil || !exists {
+			return
+		}
+		if at.IsZero() {
+			delete(d.expiry, key)
+		} else {
+			d.expiry[key] = at
+		}
+	}
+}
+
+// Set the version policy
+func (d *Database) SetVersioning(p storage.VersionPolicy) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.versioning = p
+}
+
+// List stored versions of key, oldest first
+func (d *Database) Versions(key string) ([]storage.Version, error) {
+	if err := d.check("Versions"); err != nil {
+		return nil, err
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return append([]storage.Version{}, d.versions[key]...), nil
+}
+
+// Get a specific version of key, returns false if it isn't stored
+func (d *Database) GetVersion(key string, version int) (string, bool, error) {
+	if err := d.check("GetVersion"); err != nil {
+		return "", false, err
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	for _, v := range d.versions[key] {
+		if v.Version == version {
+			return v.Value, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// Read a committed value, returns false if the key isn't stored or has expired
+func (d *Database) Get(key string) (string, bool, error) {
+	if err := d.check("Get"); err != nil {
+		return "", false, err
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	if d.expired(key) {
+		return "", false, nil
+	}
+	value, ok := d.data[key]
+	return value, ok, nil
+}
+
+// Read up to limit committed key-value pairs under prefix, in key order
+func (d *Database) Scan(ctx context.Context, prefix string, limit int) (map[string]string, error) {
+	if err := d.check("Scan"); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	var keys []string
+	for key := range d.data {
+		if strings.HasPrefix(key, prefix) && !d.expired(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	pairs := make(map[string]string)
+	for _, key := range keys[:min(limit, len(keys))] {
+		pairs[key] = d.data[key]
+	}
+	return pairs, nil
+}
+
+// Check if key has expired
+func (d *Database) expired(key string) bool {
+	at, ok := d.expiry[key]
+	return ok && !at.After(time.Now())
+}
+
+// Report a successful drill restoring every committed key
+func (d *Database) Drill(dir string) (storage.DrillResult, error) {
+	if err := d.check("Drill"); err != nil {
+		return storage.DrillResult{Error: err.Error(), At: time.Now()}, err
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return storage.DrillResult{OK: true, Keys: len(d.data), Restored: len(d.data), At: time.Now()}, nil
+}
+
+// Total bytes of committed keys and values
+func (d *Database) Size() int64 {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	var size int64
+	for key, value := range d.data {
+		size += int64(len(key) + len(value))
+	}
+	return size
+}
+
+// Drop all data, including old versions, and reset the log
+func (d *Database) Wipe(log storage.Log) error {
+	if err := d.check("Wipe"); err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := log.Reset(); err != nil {
+		return err
+	}
+	d.data, d.expiry, d.versions = make(map[string]string), make(map[string]time.Time), make(map[string][]storage.Version)
+	return nil
+}
+
+// Keep a copy of committed keys as the latest snapshot, path is ignored
+// Returns the size of the keys and values copied
+func (d *Database) Snapshot(path string) (int64, error) {
+	if err := d.check("Snapshot"); err != nil {
+		return 0, err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var size int64
+	d.snapshot = make(map[string]string, len(d.data))
+	for key, value := range d.data {
+		d.snapshot[key] = value
+		size += int64(len(key) + len(value))
+	}
+	return size, nil
+}
+
+// Keys of the latest snapshot, nil if none was taken
+func (d *Database) LastSnapshot() map[string]string {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.snapshot
+}
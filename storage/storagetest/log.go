@@ -0,0 +1,172 @@
+package storagetest
+
+import (
+	"errors"
+	"sync"
+
+	"gokv/storage"
+)
+
+// Entry written to a fake log
+type Entry struct {
+	LSN   int    // Numbered from 1, like the WAL
+	TS    uint64 // HLC timestamp of the write
+	Op    string // SET, DELETE, EXPIRE, DEMOTE or TXN
+	Key   string
+	Value string
+	Ops   []storage.TxnOp // Operations of a TXN entry
+}
+
+// Log keeping its entries in memory instead of a WAL file
+type Log struct {
+	Faults
+	entries    []Entry      // Written entries, oldest first
+	checkpoint int          // Entries committed to a database
+	clock      storage.HLC  // Timestamps writes
+	mutex      sync.RWMutex // Manage access to shared resources
+}
+
+// Create an empty log
+func NewLog() *Log {
+	return &Log{}
+}
+
+// Copy of the written entries, oldest first
+func (l *Log) Entries() []Entry {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return append([]Entry(nil), l.entries...)
+}
+
+// Get LSN of the next entry, which like the WAL starts at 1
+func (l *Log) GetLSN() int {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.next()
+}
+
+// Set LSN of the next entry, dropping entries from it on or padding with empty ones up to it
+func (l *Log) SetLSN(a int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for l.next() < a {
+		l.entries = append(l.entries, Entry{LSN: l.next()})
+	}
+	l.entries = l.entries[:max(a-1, 0)]
+}
+
+// LSN of the next entry, callers hold the lock
+func (l *Log) next() int {
+	return len(l.entries) + 1
+}
+
+// Get checkpoint
+func (l *Log) GetCheckpoint() int {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.checkpoint
+}
+
+// Set checkpoint
+func (l *Log) SetCheckpoint(a int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.checkpoint = a
+}
+
+// Get write clock
+func (l *Log) Clock() *storage.HLC {
+	return &l.clock
+}
+
+// Append an entry, returns its WAL line
+func (l *Log) UpdateLog(operation string, key string, value string) (string, error) {
+	if operation != "SET" && operation != "DELETE" && operation != "EXPIRE" && operation != "DEMOTE" {
+		return "", errors.New("Invalid operation to WAL log - " + operation)
+	}
+	if err := l.check("UpdateLog"); err != nil {
+		return "", err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	lsn, ts := l.next(), l.clock.Now()
+	l.entries = append(l.entries, Entry{LSN: lsn, TS: ts, Op: operation, Key: key, Value: value})
+	return storage.FormatEntry(lsn, ts, operation, key, value), nil
+}
+
+// Append entries of the same operation, values is ignored for DELETE
+func (l *Log) UpdateLogBatch(operation string, keys []string, values []string) error {
+	if operation != "SET" && operation != "DELETE" {
+		return errors.New("Invalid operation to WAL log - " + operation)
+	}
+	if operation == "SET" && len(values) != len(keys) {
+		return errors.New("Mismatched keys and values in WAL batch")
+	}
+	if err := l.check("UpdateLogBatch"); err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for i, key := range keys {
+		e := Entry{LSN: l.next(), TS: l.clock.Now(), Op: operation, Key: key}
+		if operation == "SET" {
+			e.Value = values[i]
+		}
+		l.entries = append(l.entries, e)
+	}
+	return nil
+}
+
+// Append the operations of a transaction as a single TXN entry
+func (l *Log) UpdateLogTxn(ops []storage.TxnOp) error {
+	for _, op := range ops {
+		if op.Op != "SET" && op.Op != "DELETE" || op.Op == "DELETE" && op.Expire != "" {
+			return errors.New("Invalid operation to WAL log - " + op.Op)
+		}
+	}
+	if err := l.check("UpdateLogTxn"); err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = append(l.entries, Entry{LSN: l.next(), TS: l.clock.Now(), Op: "TXN", Ops: append([]storage.TxnOp(nil), ops...)})
+	return nil
+}
+
+// Drop every entry and number them from 1 again
+func (l *Log) Reset() error {
+	if err := l.check("Reset"); err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries, l.checkpoint = nil, 0
+	return nil
+}
+
+// Check if the last entry after the checkpoint writing key deletes it
+func (l *Log) Deleted(key string) bool {
+	deleted := false
+	for _, e := range l.pending() {
+		if e.Op == "TXN" {
+			for _, op := range e.Ops {
+				if op.Key == key {
+					deleted = op.Op == "DELETE"
+				}
+			}
+		} else if e.Key == key && (e.Op == "SET" || e.Op == "DELETE") {
+			deleted = e.Op == "DELETE"
+		}
+	}
+	return deleted
+}
+
+// Entries after the checkpoint
+func (l *Log) pending() []Entry {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return append([]Entry(nil), l.entries[min(l.checkpoint, len(l.entries)):]...)
+}
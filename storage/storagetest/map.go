@@ -0,0 +1,50 @@
+package storagetest
+
+import (
+	"time"
+
+	"gokv/storage"
+)
+
+// In-memory map whose Modify, ModifyMeta, ModifyExpiry and Transact can be made to fail
+type Map struct {
+	storage.InMemoryMap
+	Faults
+}
+
+// Create an empty map
+func NewMap() *Map {
+	return &Map{InMemoryMap: storage.InitMap()}
+}
+
+// Atomically update a key, unless an error is injected
+func (m *Map) Modify(key string, fn func(old string, exists bool) (value string, remove bool, err error)) error {
+	if err := m.check("Modify"); err != nil {
+		return err
+	}
+	return m.InMemoryMap.Modify(key, fn)
+}
+
+// Atomically update a key given its metadata, unless an error is injected
+func (m *Map) ModifyMeta(key string, fn func(old string, meta storage.KeyMeta, exists bool) (value string, remove bool, err error)) error {
+	if err := m.check("ModifyMeta"); err != nil {
+		return err
+	}
+	return m.InMemoryMap.ModifyMeta(key, fn)
+}
+
+// Atomically update a key and its expiry, unless an error is injected
+func (m *Map) ModifyExpiry(key string, fn func(old string, at time.Time, exists bool) (value string, expireAt time.Time, remove bool, err error)) error {
+	if err := m.check("ModifyExpiry"); err != nil {
+		return err
+	}
+	return m.InMemoryMap.ModifyExpiry(key, fn)
+}
+
+// Atomically update several keys, unless an error is injected
+func (m *Map) Transact(fn func(get func(key string) (string, bool), expiry func(key string) time.Time, meta func(key string) storage.KeyMeta) ([]storage.TxnOp, error)) error {
+	if err := m.check("Transact"); err != nil {
+		return err
+	}
+	return m.InMemoryMap.Transact(fn)
+}
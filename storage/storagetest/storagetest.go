@@ -0,0 +1,71 @@
+// Package storagetest provides in-memory fakes of the storage interfaces for
+// tests of handlers and of programs embedding gokv. The fakes touch no files,
+// and errors can be injected into any of their methods returning one:
+//
+//	log := storagetest.NewLog()
+//	log.Fail("UpdateLog", errors.New("disk full"))
+//	srv := api.New(storagetest.NewMap(), log)
+//	srv.SetDatabase(storagetest.NewDatabase())
+package storagetest
+
+import (
+	"sync"
+
+	"gokv/storage"
+)
+
+// Every fake must keep implementing its interface
+var (
+	_ storage.InMemoryMap = (*Map)(nil)
+	_ storage.Log         = (*Log)(nil)
+	_ storage.Database    = (*Database)(nil)
+)
+
+// Errors injected into the methods of a fake, by method name
+type Faults struct {
+	errs  map[string]error // Method -> error returned by every call
+	once  map[string]error // Method -> error returned by the next call only
+	mutex sync.Mutex       // Manage access to shared resources
+}
+
+// Make every call of method return err, a nil err clears it
+func (f *Faults) Fail(method string, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.errs == nil {
+		f.errs = make(map[string]error)
+	}
+	if err == nil {
+		delete(f.errs, method)
+		return
+	}
+	f.errs[method] = err
+}
+
+// Make only the next call of method return err
+func (f *Faults) FailOnce(method string, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.once == nil {
+		f.once = make(map[string]error)
+	}
+	f.once[method] = err
+}
+
+// Clear every injected error
+func (f *Faults) Heal() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.errs, f.once = nil, nil
+}
+
+// Error injected into a call of method, nil if there is none
+func (f *Faults) check(method string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err, ok := f.once[method]; ok {
+		delete(f.once, method)
+		return err
+	}
+	return f.errs[method]
+}
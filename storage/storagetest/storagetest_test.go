@@ -0,0 +1,94 @@
+package storagetest_test
+
+import (
+	"errors"
+	"testing"
+
+	"gokv/storage/storagetest"
+)
+
+// Injected errors must be returned, once or until healed
+func TestFaults(t *testing.T) {
+	mp := storagetest.NewMap()
+	errFull := errors.New("disk full")
+	update := func(old string, exists bool) (string, bool, error) { return "v", false, nil }
+
+	mp.FailOnce("Modify", errFull)
+	if err := mp.Modify("k", update); !errors.Is(err, errFull) {
+		t.Fatalf("got %v, want %v", err, errFull)
+	}
+	if err := mp.Modify("k", update); err != nil {
+		t.Fatalf("error injected once returned again: %v", err)
+	}
+
+	mp.Fail("Modify", errFull)
+	for range 2 {
+		if err := mp.Modify("k", update); !errors.Is(err, errFull) {
+			t.Fatalf("got %v, want %v", err, errFull)
+		}
+	}
+	mp.Heal()
+	if err := mp.Modify("k", update); err != nil {
+		t.Fatalf("healed map still fails: %v", err)
+	}
+}
+
+// Entries written to the log must reach the database and back into a map
+func TestLogToDatabase(t *testing.T) {
+	log := storagetest.NewLog()
+	db := storagetest.NewDatabase()
+	log.UpdateLog("SET", "a", "1")
+	log.UpdateLog("SET", "b", "2")
+	log.UpdateLog("DELETE", "a", "")
+	if err := db.UpdateDatabase(log); err != nil {
+		t.Fatal(err)
+	}
+	if log.GetCheckpoint() != 3 {
+		t.Errorf("checkpoint at %d, want 3", log.GetCheckpoint())
+	}
+	if _, ok, _ := db.Get("a"); ok {
+		t.Error("deleted key committed")
+	}
+	if v, ok, _ := db.Get("b"); !ok || v != "2" {
+		t.Errorf("got %q, want %q", v, "2")
+	}
+
+	mp := storagetest.NewMap()
+	if err := db.ScanDatabase(mp); err != nil {
+		t.Fatal(err)
+	}
+	if mp.Len() != 1 || mp.GetValue("b") != "2" {
+		t.Errorf("map loaded %d keys", mp.Len())
+	}
+
+	log.Fail("UpdateLog", errors.New("disk full"))
+	if _, err := log.UpdateLog("SET", "c", "3"); err == nil {
+		t.Error("injected log error dropped")
+	}
+}
+
+// Entries must be numbered like the WAL, from 1 with GetLSN the next one
+func TestLogNumbering(t *testing.T) {
+	log := storagetest.NewLog()
+	if log.GetLSN() != 1 {
+		t.Fatalf("empty log at LSN %d, want 1", log.GetLSN())
+	}
+	log.UpdateLog("SET", "a", "1")
+	log.UpdateLogBatch("DELETE", []string{"a", "b"}, nil)
+	for i, e := range log.Entries() {
+		if e.LSN != i+1 {
+			t.Errorf("entry %d has LSN %d, want %d", i, e.LSN, i+1)
+		}
+	}
+	if log.GetLSN() != 4 {
+		t.Errorf("next LSN %d, want 4", log.GetLSN())
+	}
+	log.SetLSN(2)
+	if n := len(log.Entries()); n != 1 || log.GetLSN() != 2 {
+		t.Errorf("kept %d entries and next LSN %d, want 1 and 2", n, log.GetLSN())
+	}
+	log.Reset()
+	if log.GetLSN() != 1 {
+		t.Errorf("reset log at LSN %d, want 1", log.GetLSN())
+	}
+}
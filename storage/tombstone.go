@@ -0,0 +1,35 @@
+package storage
+
+// Keys whose last WAL entry is a DELETE, by the LSN of the entry
+// Until the checkpoint passes it, the database may still hold the deleted value.
+// Only entries before the checkpoint are surely committed, flushes start reading at it
+
+// Note a write of key at lsn, l.mutex must be held
+func (l *wal) noteWrite(lsn int, op string, key string) {
+	switch op {
+	case "DELETE":
+		if l.tombstones == nil {
+			l.tombstones = make(map[string]int)
+		}
+		l.tombstones[key] = lsn
+	case "SET":
+		delete(l.tombstones, key)
+	}
+}
+
+// Drop tombstones committed to the database, l.mutex must be held
+func (l *wal) pruneTombstones() {
+	for key, lsn := range l.tombstones {
+		if lsn < l.checkpoint {
+			delete(l.tombstones, key)
+		}
+	}
+}
+
+// Check if key was deleted by a WAL entry not yet committed to the database
+func (l *wal) Deleted(key string) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	lsn, ok := l.tombstones[key]
+	return ok && lsn >= l.checkpoint
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"strconv"
+	"time"
+)
+
+// Expiry times of keys, kept next to the values of a map implementation
+// Not safe for concurrent use, guarded by the lock of the owning map
+// Expiries set in this process carry a monotonic clock reading, so wall
+// clock jumps don't expire keys early or late
+type expiries map[string]time.Time
+
+// Check if key has expired at now
+func (e expiries) expired(key string, now time.Time) bool {
+	at, ok := e[key]
+	return ok && !now.Before(at)
+}
+
+// Keys that have expired at now
+func (e expiries) due(now time.Time) []string {
+	var keys []string
+	for k, at := range e {
+		if !now.Before(at) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// Encode expiry as an EXPIRE WAL value, unix milliseconds or 0 for no expiry
+func EncodeExpiry(at time.Time) string {
+	if at.IsZero() {
+		return "0"
+	}
+	return strconv.FormatInt(at.UnixMilli(), 10)
+}
+
+// Decode the value of an EXPIRE WAL entry, zero time means no expiry
+func DecodeExpiry(value string) (time.Time, error) {
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms == 0 {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(ms), nil
+}
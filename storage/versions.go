@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Badger keys starting with this prefix hold old versions, not user keys
+const versionPrefix = "\x00versions/"
+
+// Which namespaces keep old versions of their keys
+// A key's namespace is the part before the first ':'
+type VersionPolicy struct {
+	Retain map[string]int // Namespace -> number of versions to keep
+	MaxAge time.Duration  // Drop versions older than this, 0 keeps them forever
+}
+
+// A stored version of a key, identified by the LSN of its WAL entry
+type Version struct {
+	Version int    `json:"version"`
+	Value   string `json:"value"`
+}
+
+// Parse a version policy such as "user=5,cfg=10"
+func ParseVersionPolicy(spec string, maxAge time.Duration) (VersionPolicy, error) {
+	p := VersionPolicy{Retain: make(map[string]int), MaxAge: maxAge}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		ns, n, ok := strings.Cut(pair, "=")
+		count, err := strconv.Atoi(n)
+		if !ok || err != nil || count <= 0 {
+			return p, errors.New("Invalid version policy - " + pair)
+		}
+		p.Retain[ns] = count
+	}
+	return p, nil
+}
+
+// Number of versions to keep for key, 0 if its namespace isn't versioned
+func (p VersionPolicy) retain(key string) int {
+	ns, ok := Namespace(key)
+	if !ok {
+		return 0
+	}
+	return p.Retain[ns]
+}
+
+// Width of the zero padded version closing a version's badger key
+const versionWidth = 20
+
+// Start of the badger keys of all versions of key
+// The key's length comes first, so no other key's versions share the prefix
+func versionKeyPrefix(key string) []byte {
+	return []byte(fmt.Sprintf("%s%08x/%s/", versionPrefix, len(key), key))
+}
+
+// Badger key of a version, zero padded so versions sort in order
+func versionKey(key string, version int) []byte {
+	return fmt.Appendf(versionKeyPrefix(key), "%0*d", versionWidth, version)
+}
+
+// Version in a badger key under prefix, false if the rest isn't a padded version
+func parseVersionKey(prefix, key []byte) (int, bool) {
+	rest := key[len(prefix):]
+	if len(rest) != versionWidth {
+		return 0, false
+	}
+	version, err := strconv.Atoi(string(rest))
+	return version, err == nil
+}
+
+// Set which namespaces keep old versions of their keys
+func (d *badgerDB) SetVersioning(p VersionPolicy) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.versioning = p
+}
+
+// Get the current version policy
+func (d *badgerDB) versionPolicy() VersionPolicy {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.versioning
+}
+
+// Save a version of key inside a database update
+func (d *badgerDB) saveVersion(txn *badger.Txn, key string, version int, value string) error {
+	p := d.versionPolicy()
+	if p.retain(key) == 0 {
+		return nil
+	}
+	entry := badger.NewEntry(versionKey(key, version), []byte(value))
+	if p.MaxAge > 0 {
+		entry = entry.WithTTL(p.MaxAge) // badger drops versions older than MaxAge
+	}
+	return txn.SetEntry(entry)
+}
+
+// List stored versions of key, oldest first
+func (d *badgerDB) Versions(key string) ([]Version, error) {
+	versions := []Version{}
+	prefix := versionKeyPrefix(key)
+	err := d.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			version, ok := parseVersionKey(prefix, item.Key())
+			if !ok {
+				continue
+			}
+			err := item.Value(func(val []byte) error {
+				versions = append(versions, Version{Version: version, Value: string(val)})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return versions, err
+}
+
+// Get a specific version of key, returns false if it isn't stored
+func (d *badgerDB) GetVersion(key string, version int) (string, bool, error) {
+	var value string
+	err := d.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(versionKey(key, version))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			value = string(val)
+			return nil
+		})
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// Delete the oldest versions of keys beyond their namespace's retention count
+func (d *badgerDB) pruneVersions(keys map[string]bool) error {
+	p := d.versionPolicy()
+	return d.db.Update(func(txn *badger.Txn) error {
+		for key := range keys {
+			retain := p.retain(key)
+			if retain == 0 {
+				continue
+			}
+			var stored [][]byte
+			prefix := versionKeyPrefix(key)
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+			it := txn.NewIterator(opts)
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				if _, ok := parseVersionKey(prefix, it.Item().Key()); ok {
+					stored = append(stored, it.Item().KeyCopy(nil))
+				}
+			}
+			it.Close()
+			for i := 0; i < len(stored)-retain; i++ {
+				if err := txn.Delete(stored[i]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}